@@ -2,10 +2,11 @@ package boot
 
 import (
 	"context"
-	"encoding/json"
 	"flag"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/hotafrika/tcp_proxy_simple/service"
 	"github.com/pkg/errors"
@@ -16,27 +17,35 @@ import (
 var configFile string
 var pprofEnabled bool
 var logLevel int
+var adminAddr string
 
 //nolint:gosec
 func InitAndStart(ctx context.Context) error {
 	flag.StringVar(&configFile, "config", "config.json", "config file path")
 	flag.BoolVar(&pprofEnabled, "pprof", false, "run pprof on 6060 port")
-	flag.IntVar(&logLevel, "loglevel", 3, "log level: 0-4 (debug - fatal), 7 - disabled")
+	flag.IntVar(&logLevel, "loglevel", 3, "log level: -1-4 (trace - fatal), 7 - disabled")
+	flag.StringVar(&adminAddr, "admin", "", "admin API listen address, e.g. 127.0.0.1:9000 (disabled if empty)")
 	flag.Parse()
 
 	level := zerolog.Level(logLevel)
 	logger := log.Level(level)
 
-	b, err := os.ReadFile(configFile)
+	config, err := loadConfig(configFile)
 	if err != nil {
-		return errors.Wrap(err, "ReadFile() config")
+		return errors.Wrap(err, "loadConfig()")
 	}
-	var config Config
-	err = json.Unmarshal(b, &config)
+	proxyConfig, err := config.toProxyConfig()
 	if err != nil {
-		return errors.Wrap(err, "Unmarshal() config")
+		return errors.Wrap(err, "toProxyConfig()")
+	}
+	if config.AccessLog != "" {
+		accessLog, err := openAccessLog(config.AccessLog)
+		if err != nil {
+			return errors.Wrap(err, "openAccessLog()")
+		}
+		defer accessLog.Close()
+		proxyConfig.AccessLog = accessLog
 	}
-	proxyConfig := config.toProxyConfig()
 
 	proxy, err := service.NewProxy(ctx, &logger, proxyConfig)
 	if err != nil {
@@ -51,8 +60,82 @@ func InitAndStart(ctx context.Context) error {
 		}()
 	}
 
-	// here the proxy blocks the main routine until ctx cancelled.
-	proxy.Run()
+	if adminAddr != "" {
+		go func() {
+			if err := http.ListenAndServe(adminAddr, proxy.AdminHandler()); err != nil {
+				logger.Error().Err(err).Msg("admin API failed")
+			}
+		}()
+	}
+
+	go reloadOnSignal(ctx, &logger, proxy)
+	go stopOnSecondSignal(ctx, &logger, proxy)
 
-	return nil
+	// here the proxy blocks the main routine until ctx cancelled or a listener can't be bound.
+	return errors.Wrap(proxy.Run(), "Run()")
+}
+
+// openAccessLog opens the access log file for appending. "-" means stdout.
+func openAccessLog(path string) (*os.File, error) {
+	if path == "-" {
+		return os.Stdout, nil
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+}
+
+func loadConfig(path string) (Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, errors.Wrap(err, "ReadFile() config")
+	}
+	config, err := parseConfig(b)
+	if err != nil {
+		return Config{}, errors.Wrap(err, path)
+	}
+	return config, nil
+}
+
+// stopOnSecondSignal stops the proxy right away on a termination signal received after ctx is done,
+// so a second signal doesn't wait for the shutdown drain.
+func stopOnSecondSignal(ctx context.Context, logger *zerolog.Logger, proxy service.Proxy) {
+	<-ctx.Done()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	defer signal.Stop(sig)
+
+	select {
+	case s := <-sig:
+		logger.Warn().Str("signal", s.String()).Msg("second signal, stopping without drain")
+		proxy.Stop()
+	case <-proxy.Done():
+	}
+}
+
+// reloadOnSignal re-reads the config file and reloads the proxy on every SIGHUP until ctx is done.
+func reloadOnSignal(ctx context.Context, logger *zerolog.Logger, proxy service.Proxy) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		}
+		logger.Info().Str("config", configFile).Msg("reloading config")
+		config, err := loadConfig(configFile)
+		if err != nil {
+			logger.Error().Err(err).Msg("config reload failed")
+			continue
+		}
+		proxyConfig, err := config.toProxyConfig()
+		if err != nil {
+			logger.Error().Err(err).Msg("config reload failed")
+			continue
+		}
+		if err := proxy.Reload(proxyConfig); err != nil {
+			logger.Error().Err(err).Msg("config partially reloaded")
+		}
+	}
 }
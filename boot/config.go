@@ -1,26 +1,397 @@
 package boot
 
-import "github.com/hotafrika/tcp_proxy_simple/service"
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net"
+	"os"
+	"time"
+
+	"github.com/hotafrika/tcp_proxy_simple/service"
+	"github.com/pkg/errors"
+)
 
 type Config struct {
-	Apps []App `json:"Apps"`
+	Apps              []App    `json:"Apps"`
+	BufferSize        int      `json:"BufferSize"`
+	BufferArena       int      `json:"BufferArena"`
+	RateLimit         int64    `json:"RateLimit"`
+	StateFile         string   `json:"StateFile"`
+	StateSaveInterval Duration `json:"StateSaveInterval"`
+	ConnLogSampling   uint32   `json:"ConnLogSampling"`
+	AccessLog         string   `json:"AccessLog"`
+	AccessLogFormat   string   `json:"AccessLogFormat"`
+	DrainTimeout      Duration `json:"DrainTimeout"`
 }
 
 type App struct {
-	Name    string   `json:"Name"`
-	Ports   []int    `json:"Ports"`
-	Targets []string `json:"Targets"`
+	Name                 string    `json:"Name"`
+	Ports                []int     `json:"Ports"`
+	ListenHost           string    `json:"ListenHost"`
+	ListenNetwork        string    `json:"ListenNetwork"`
+	ListenUnix           []string  `json:"ListenUnix"`
+	Targets              []string  `json:"Targets"`
+	Backends             []Backend `json:"Backends"`
+	Strategy             string    `json:"Strategy"`
+	HashReplicas         int       `json:"HashReplicas"`
+	MaxConnAge           Duration  `json:"MaxConnAge"`
+	ConnRateLimit        int64     `json:"ConnRateLimit"`
+	MaxWriteChunk        int       `json:"MaxWriteChunk"`
+	CoalesceSize         int       `json:"CoalesceSize"`
+	CoalesceDelay        Duration  `json:"CoalesceDelay"`
+	AllowEphemeralPort   bool      `json:"AllowEphemeralPort"`
+	Allow                []string  `json:"Allow"`
+	Deny                 []string  `json:"Deny"`
+	MaxConnsPerIP        int       `json:"MaxConnsPerIP"`
+	RejectDelay          Duration  `json:"RejectDelay"`
+	ResetOnClose         bool      `json:"ResetOnClose"`
+	AcceptProxyProtocol  bool      `json:"AcceptProxyProtocol"`
+	AcceptWorkers        int       `json:"AcceptWorkers"`
+	SetupSoftLimit       int       `json:"SetupSoftLimit"`
+	OriginalDst          bool      `json:"OriginalDst"`
+	ReusePort            bool      `json:"ReusePort"`
+	ListenRetries        int       `json:"ListenRetries"`
+	ListenKeepAlive      Duration  `json:"ListenKeepAlive"`
+	KeepAlive            Duration  `json:"KeepAlive"`
+	WriteTimeout         Duration  `json:"WriteTimeout"`
+	ClientReadTimeout    Duration  `json:"ClientReadTimeout"`
+	BackendReadTimeout   Duration  `json:"BackendReadTimeout"`
+	MinThroughput        int64     `json:"MinThroughput"`
+	MinThroughputWindow  Duration  `json:"MinThroughputWindow"`
+	DumpBytes            int       `json:"DumpBytes"`
+	CopyAuditInterval    Duration  `json:"CopyAuditInterval"`
+	PreambleTimeout      Duration  `json:"PreambleTimeout"`
+	PreambleMaxBytes     int       `json:"PreambleMaxBytes"`
+	PreambleConcurrency  int       `json:"PreambleConcurrency"`
+	PreambleQueueTimeout Duration  `json:"PreambleQueueTimeout"`
+	Nagle                bool      `json:"Nagle"`
+	DialRetries          int       `json:"DialRetries"`
+	SetupBudget          Duration  `json:"SetupBudget"`
+	RetryBackoff         Duration  `json:"RetryBackoff"`
+	RetryJitter          Duration  `json:"RetryJitter"`
+	SourceAddr           string    `json:"SourceAddr"`
+	DialKeepAlive        Duration  `json:"DialKeepAlive"`
+	FallbackDelay        Duration  `json:"FallbackDelay"`
+	ConnectTimeout       Duration  `json:"ConnectTimeout"`
+	FirstByteTimeout     Duration  `json:"FirstByteTimeout"`
+	PoolSize             int       `json:"PoolSize"`
+	PoolMaxIdle          Duration  `json:"PoolMaxIdle"`
+	MaxConcurrentDrains  int       `json:"MaxConcurrentDrains"`
+	ChoiceCacheTTL       Duration  `json:"ChoiceCacheTTL"`
+	AffinityTTL          Duration  `json:"AffinityTTL"`
+	HealthcheckKind      string    `json:"HealthcheckKind"`
+	HealthcheckPath      string    `json:"HealthcheckPath"`
+	HealthcheckInterval  Duration  `json:"HealthcheckInterval"`
+	SlowStart            Duration  `json:"SlowStart"`
+	OutlierErrorRate     float64   `json:"OutlierErrorRate"`
+	OutlierMinSessions   int       `json:"OutlierMinSessions"`
+	OutlierEjectTime     Duration  `json:"OutlierEjectTime"`
+	OutlierHalfOpen      bool      `json:"OutlierHalfOpen"`
+	DownReminder         Duration  `json:"DownReminder"`
+	TLS                  *TLS      `json:"TLS"`
+	ResolveRemoveAfter   Duration  `json:"ResolveRemoveAfter"`
+	DiscoverySRV         string    `json:"DiscoverySRV"`
+	DiscoveryDNS         bool      `json:"DiscoveryDNS"`
+	DiscoveryInterval    Duration  `json:"DiscoveryInterval"`
+}
+
+// Backend is a static backend with a weight and a priority tier.
+type Backend struct {
+	Addr     string `json:"Addr"`
+	Weight   int    `json:"Weight"`
+	Priority int    `json:"Priority"`
+	// TLS overrides TLS of the app for this backend.
+	TLS *TLS `json:"TLS"`
+}
+
+// TLS is TLS to backends. CertFile and KeyFile are a PEM client certificate presented to backends which request it.
+// CAFile is a PEM bundle of roots the backend certificates are verified against, empty means system roots.
+// NextProtos are the protocols offered via ALPN in the order of preference.
+type TLS struct {
+	ServerName         string   `json:"ServerName"`
+	CAFile             string   `json:"CAFile"`
+	CertFile           string   `json:"CertFile"`
+	KeyFile            string   `json:"KeyFile"`
+	InsecureSkipVerify bool     `json:"InsecureSkipVerify"`
+	NextProtos         []string `json:"NextProtos"`
+}
+
+func (t *TLS) validate() error {
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return errors.New("CertFile and KeyFile must be set together")
+	}
+	return nil
+}
+
+// load reads the files of the TLS settings into a TLS config. Nil settings mean no TLS.
+func (t *TLS) load() (*tls.Config, error) {
+	if t == nil {
+		return nil, nil
+	}
+	config := &tls.Config{
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+		NextProtos:         t.NextProtos,
+	}
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "ReadFile()")
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates in %s", t.CAFile)
+		}
+	}
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "LoadX509KeyPair()")
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// Duration is a time.Duration which is represented in the config file as a string like "1m30s".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return errors.Wrap(err, "duration must be a string")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return errors.Wrap(err, "ParseDuration()")
+	}
+	*d = Duration(v)
+	return nil
 }
 
-func (c Config) toProxyConfig() service.ProxyConfig {
-	var proxyConfig service.ProxyConfig
+// toProxyConfig converts the config to the service config. Files of TLS settings are read here.
+func (c Config) toProxyConfig() (service.ProxyConfig, error) {
+	proxyConfig := service.ProxyConfig{
+		BufferSize:        c.BufferSize,
+		BufferArena:       c.BufferArena,
+		RateLimit:         c.RateLimit,
+		StateFile:         c.StateFile,
+		ConnLogSampling:   c.ConnLogSampling,
+		DrainTimeout:      time.Duration(c.DrainTimeout),
+		StateSaveInterval: time.Duration(c.StateSaveInterval),
+	}
+	// the format is validated, the access log file is opened by InitAndStart
+	proxyConfig.AccessLogFormatter, _ = service.AccessLogFormat(c.AccessLogFormat)
 	for _, app := range c.Apps {
 		configApp := service.ConfigApp{
-			Name:    app.Name,
-			Ports:   app.Ports,
-			Targets: app.Targets,
+			Name:                 app.Name,
+			Ports:                app.Ports,
+			ListenHost:           app.ListenHost,
+			ListenNetwork:        app.ListenNetwork,
+			ListenUnix:           app.ListenUnix,
+			Targets:              app.Targets,
+			Strategy:             app.Strategy,
+			HashReplicas:         app.HashReplicas,
+			MaxConnAge:           time.Duration(app.MaxConnAge),
+			ConnRateLimit:        app.ConnRateLimit,
+			MaxWriteChunk:        app.MaxWriteChunk,
+			CoalesceSize:         app.CoalesceSize,
+			CoalesceDelay:        time.Duration(app.CoalesceDelay),
+			AllowEphemeralPort:   app.AllowEphemeralPort,
+			Allow:                app.Allow,
+			Deny:                 app.Deny,
+			MaxConnsPerIP:        app.MaxConnsPerIP,
+			RejectDelay:          time.Duration(app.RejectDelay),
+			ResetOnClose:         app.ResetOnClose,
+			AcceptProxyProtocol:  app.AcceptProxyProtocol,
+			AcceptWorkers:        app.AcceptWorkers,
+			SetupSoftLimit:       app.SetupSoftLimit,
+			OriginalDst:          app.OriginalDst,
+			ReusePort:            app.ReusePort,
+			ListenRetries:        app.ListenRetries,
+			ListenKeepAlive:      time.Duration(app.ListenKeepAlive),
+			KeepAlive:            time.Duration(app.KeepAlive),
+			WriteTimeout:         time.Duration(app.WriteTimeout),
+			ClientReadTimeout:    time.Duration(app.ClientReadTimeout),
+			BackendReadTimeout:   time.Duration(app.BackendReadTimeout),
+			MinThroughput:        app.MinThroughput,
+			MinThroughputWindow:  time.Duration(app.MinThroughputWindow),
+			DumpBytes:            app.DumpBytes,
+			CopyAuditInterval:    time.Duration(app.CopyAuditInterval),
+			PreambleTimeout:      time.Duration(app.PreambleTimeout),
+			PreambleMaxBytes:     app.PreambleMaxBytes,
+			PreambleConcurrency:  app.PreambleConcurrency,
+			PreambleQueueTimeout: time.Duration(app.PreambleQueueTimeout),
+			Nagle:                app.Nagle,
+			DialRetries:          app.DialRetries,
+			SetupBudget:          time.Duration(app.SetupBudget),
+			RetryBackoff:         time.Duration(app.RetryBackoff),
+			RetryJitter:          time.Duration(app.RetryJitter),
+			SourceAddr:           app.SourceAddr,
+			DialKeepAlive:        time.Duration(app.DialKeepAlive),
+			FallbackDelay:        time.Duration(app.FallbackDelay),
+			ConnectTimeout:       time.Duration(app.ConnectTimeout),
+			FirstByteTimeout:     time.Duration(app.FirstByteTimeout),
+			PoolSize:             app.PoolSize,
+			PoolMaxIdle:          time.Duration(app.PoolMaxIdle),
+			MaxConcurrentDrains:  app.MaxConcurrentDrains,
+			ChoiceCacheTTL:       time.Duration(app.ChoiceCacheTTL),
+			AffinityTTL:          time.Duration(app.AffinityTTL),
+			HealthcheckKind:      app.HealthcheckKind,
+			HealthcheckPath:      app.HealthcheckPath,
+			HealthcheckInterval:  time.Duration(app.HealthcheckInterval),
+			SlowStart:            time.Duration(app.SlowStart),
+			OutlierErrorRate:     app.OutlierErrorRate,
+			OutlierMinSessions:   app.OutlierMinSessions,
+			OutlierEjectTime:     time.Duration(app.OutlierEjectTime),
+			OutlierHalfOpen:      app.OutlierHalfOpen,
+			DownReminder:         time.Duration(app.DownReminder),
+			ResolveRemoveAfter:   time.Duration(app.ResolveRemoveAfter),
+		}
+		var err error
+		configApp.TLS, err = app.TLS.load()
+		if err != nil {
+			return service.ProxyConfig{}, errors.Wrapf(err, "app %s: TLS", app.Name)
+		}
+		for _, b := range app.Backends {
+			bndTLS, err := b.TLS.load()
+			if err != nil {
+				return service.ProxyConfig{}, errors.Wrapf(err, "app %s: backend %s: TLS", app.Name, b.Addr)
+			}
+			configApp.Backends = append(configApp.Backends, service.ConfigBackend{
+				Addr:     b.Addr,
+				Weight:   b.Weight,
+				Priority: b.Priority,
+				TLS:      bndTLS,
+			})
+		}
+		switch {
+		case app.DiscoverySRV != "":
+			configApp.Discovery = service.NewSRVDiscovery(app.DiscoverySRV, time.Duration(app.DiscoveryInterval))
+		case app.DiscoveryDNS:
+			targets := make([]service.DiscoveredBackend, 0, len(app.Targets)+len(app.Backends))
+			for _, target := range app.Targets {
+				targets = append(targets, service.DiscoveredBackend{Addr: target, Weight: 1})
+			}
+			for _, b := range configApp.Backends {
+				targets = append(targets, service.DiscoveredBackend(b))
+			}
+			configApp.Discovery = service.NewDNSDiscovery(targets, time.Duration(app.DiscoveryInterval))
 		}
 		proxyConfig.Apps = append(proxyConfig.Apps, configApp)
 	}
-	return proxyConfig
+	return proxyConfig, nil
+}
+
+// parseConfig decodes the JSON config and validates it. Syntax and type errors are reported with their line and column.
+func parseConfig(b []byte) (Config, error) {
+	var config Config
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&config); err != nil {
+		return Config{}, withPosition(b, err)
+	}
+	if err := config.validate(); err != nil {
+		return Config{}, errors.Wrap(err, "invalid config")
+	}
+	return config, nil
+}
+
+// withPosition adds the line and column of the error offset to JSON syntax and type errors.
+func withPosition(b []byte, err error) error {
+	var offset int64
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		offset = syntaxErr.Offset
+	case errors.As(err, &typeErr):
+		offset = typeErr.Offset
+	default:
+		return err
+	}
+	if offset > int64(len(b)) {
+		offset = int64(len(b))
+	}
+	line := bytes.Count(b[:offset], []byte("\n")) + 1
+	column := int(offset) - bytes.LastIndexByte(b[:offset], '\n')
+	return errors.Wrapf(err, "line %d, column %d", line, column)
+}
+
+// validate checks required fields of the config.
+func (c Config) validate() error {
+	if len(c.Apps) == 0 {
+		return errors.New("no apps")
+	}
+	if _, err := service.AccessLogFormat(c.AccessLogFormat); err != nil {
+		return err
+	}
+	names := make(map[string]bool, len(c.Apps))
+	for i, app := range c.Apps {
+		if app.Name == "" {
+			return errors.Errorf("app #%d: Name is required", i+1)
+		}
+		if names[app.Name] {
+			return errors.Errorf("app %s: duplicate Name", app.Name)
+		}
+		names[app.Name] = true
+		if err := app.validate(); err != nil {
+			return errors.Wrapf(err, "app %s", app.Name)
+		}
+	}
+	return nil
+}
+
+func (a App) validate() error {
+	if len(a.Ports) == 0 && len(a.ListenUnix) == 0 {
+		return errors.New("Ports or ListenUnix are required")
+	}
+	for _, port := range a.Ports {
+		if port < 0 || port > 65535 {
+			return errors.Errorf("port %d is out of range", port)
+		}
+	}
+	if len(a.Targets) == 0 && len(a.Backends) == 0 && a.DiscoverySRV == "" {
+		return errors.New("one of Targets, Backends or DiscoverySRV is required")
+	}
+	if a.DiscoveryDNS && a.DiscoverySRV != "" {
+		return errors.New("DiscoveryDNS and DiscoverySRV can't be used together")
+	}
+	if a.DiscoveryDNS && len(a.Targets) == 0 && len(a.Backends) == 0 {
+		return errors.New("DiscoveryDNS requires Targets or Backends")
+	}
+	if a.TLS != nil {
+		if err := a.TLS.validate(); err != nil {
+			return errors.Wrap(err, "TLS")
+		}
+	}
+	addrs := make([]string, 0, len(a.Targets)+len(a.Backends))
+	addrs = append(addrs, a.Targets...)
+	for _, b := range a.Backends {
+		if b.Weight < 0 {
+			return errors.Errorf("backend %s: negative Weight", b.Addr)
+		}
+		if b.Weight > service.MaxWeight {
+			return errors.Errorf("backend %s: Weight is above %d", b.Addr, service.MaxWeight)
+		}
+		if b.TLS != nil {
+			if err := b.TLS.validate(); err != nil {
+				return errors.Wrapf(err, "backend %s: TLS", b.Addr)
+			}
+		}
+		addrs = append(addrs, b.Addr)
+	}
+	seen := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		if _, port, err := net.SplitHostPort(addr); err != nil || port == "" {
+			return errors.Errorf("backend %q: address must be host:port", addr)
+		}
+		if seen[addr] {
+			return errors.Errorf("backend %s: duplicate address", addr)
+		}
+		seen[addr] = true
+	}
+	return nil
 }
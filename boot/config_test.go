@@ -0,0 +1,59 @@
+package boot
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConfigValid(t *testing.T) {
+	for _, path := range []string{"testdata/valid.json", "../config.json.example"} {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := parseConfig(b); err != nil {
+			t.Errorf("%s: %v", path, err)
+		}
+	}
+
+	config, err := loadConfig("testdata/valid.json")
+	if err != nil {
+		t.Fatalf("loadConfig(): %v", err)
+	}
+	proxyConfig, err := config.toProxyConfig()
+	if err != nil {
+		t.Fatalf("toProxyConfig(): %v", err)
+	}
+	if proxyConfig.BufferSize != 8192 || proxyConfig.DrainTimeout != 30*time.Second {
+		t.Errorf("proxy config is %+v", proxyConfig)
+	}
+	app := proxyConfig.Apps[0]
+	if app.Name != "web" || app.MaxConnAge != 10*time.Minute || len(app.Targets) != 2 || app.Backends[0].Weight != 3 {
+		t.Errorf("app config is %+v", app)
+	}
+}
+
+func TestParseConfigInvalid(t *testing.T) {
+	for config, want := range map[string]string{
+		`{"Apps": []}`: "no apps",
+		`{"Apps": [{"Ports": [1], "Targets": ["a:1"]}]}`:                                                               "Name is required",
+		`{"Apps": [{"Name": "a", "Ports": [1], "Targets": ["a:1"]}, {"Name": "a", "Ports": [2], "Targets": ["a:1"]}]}`: "duplicate Name",
+		`{"Apps": [{"Name": "a", "Targets": ["a:1"]}]}`:                                                                "Ports or ListenUnix are required",
+		`{"Apps": [{"Name": "a", "Ports": [70000], "Targets": ["a:1"]}]}`:                                              "out of range",
+		`{"Apps": [{"Name": "a", "Ports": [1]}]}`:                                                                      "one of Targets",
+		`{"Apps": [{"Name": "a", "Ports": [1], "Targets": ["a"]}]}`:                                                    "host:port",
+		`{"Apps": [{"Name": "a", "Ports": [1], "Targets": ["a:1", "a:1"]}]}`:                                           "duplicate address",
+		`{"Apps": [{"Name": "a", "Ports": [1], "Backends": [{"Addr": "a:1", "Weight": 1001}]}]}`:                       "Weight is above",
+		`{"Apps": [{"Name": "a", "Ports": [1], "Targets": ["a:1"], "MaxConnAge": 10}]}`:                                "duration must be a string",
+		`{"Apps": [{"Name": "a", "Ports": [1], "Targets": ["a:1"], "Unknown": 1}]}`:                                    "unknown field",
+		"{\"Apps\": [\n{\"Name\": \"a\",}]}":                                                                           "line 2",
+		`{"AccessLogFormat": "xml", "Apps": [{"Name": "a", "Ports": [1], "Targets": ["a:1"]}]}`:                        "xml",
+	} {
+		_, err := parseConfig([]byte(config))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: error %v, want %q", config, err, want)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package service
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// AccessLogFormatter formats the access log line of a finished connection pair including the trailing newline.
+type AccessLogFormatter func(stats SessionStats) []byte
+
+// AccessLogFormat returns the built-in access log formatter by its name: "tsv" (TSVAccessLog) or "json"
+// (JSONAccessLog). Empty name means "tsv".
+func AccessLogFormat(name string) (AccessLogFormatter, error) {
+	switch name {
+	case "", "tsv":
+		return TSVAccessLog, nil
+	case "json":
+		return JSONAccessLog, nil
+	default:
+		return nil, errors.Errorf("unknown access log format %q", name)
+	}
+}
+
+// accessLogTime is the timestamp format of access logs: RFC 3339 in UTC with milliseconds.
+const accessLogTime = "2006-01-02T15:04:05.000Z07:00"
+
+// TSVAccessLog formats a tab-separated line with the fields: timestamp of the end of the pair, client address,
+// backend address, duration in seconds, bytes in, bytes out, close reason (see closeReasonName) and labels
+// encoded like a URL query, e.g. "env=prod&tenant=acme". Unknown values and empty labels are "-".
+func TSVAccessLog(stats SessionStats) []byte {
+	b := make([]byte, 0, 128)
+	b = append(b, stats.Started.Add(stats.Duration).UTC().Format(accessLogTime)...)
+	b = append(b, '\t')
+	b = append(b, accessLogAddr(stats.Client)...)
+	b = append(b, '\t')
+	b = append(b, accessLogAddr(stats.Backend)...)
+	b = append(b, '\t')
+	b = strconv.AppendFloat(b, stats.Duration.Seconds(), 'f', 3, 64)
+	b = append(b, '\t')
+	b = strconv.AppendInt(b, stats.BytesIn, 10)
+	b = append(b, '\t')
+	b = strconv.AppendInt(b, stats.BytesOut, 10)
+	b = append(b, '\t')
+	b = append(b, closeReasonName(stats.Reason)...)
+	b = append(b, '\t')
+	b = append(b, encodeLabels(stats.Labels)...)
+	return append(b, '\n')
+}
+
+// JSONAccessLog formats a JSON object with the fields of TSVAccessLog. Labels are an object, which is omitted
+// if there are none.
+func JSONAccessLog(stats SessionStats) []byte {
+	b, _ := json.Marshal(struct {
+		Timestamp   string            `json:"timestamp"`
+		Client      string            `json:"client"`
+		Backend     string            `json:"backend"`
+		Duration    float64           `json:"duration"`
+		BytesIn     int64             `json:"bytes_in"`
+		BytesOut    int64             `json:"bytes_out"`
+		CloseReason string            `json:"close_reason"`
+		Labels      map[string]string `json:"labels,omitempty"`
+	}{
+		Timestamp:   stats.Started.Add(stats.Duration).UTC().Format(accessLogTime),
+		Client:      accessLogAddr(stats.Client),
+		Backend:     accessLogAddr(stats.Backend),
+		Duration:    stats.Duration.Seconds(),
+		BytesIn:     stats.BytesIn,
+		BytesOut:    stats.BytesOut,
+		CloseReason: closeReasonName(stats.Reason),
+		Labels:      stats.Labels,
+	})
+	return append(b, '\n')
+}
+
+func accessLogAddr(addr net.Addr) string {
+	if addr == nil {
+		return "-"
+	}
+	return addr.String()
+}
+
+// closeReasonName returns the token of the cause of the close reason: client_closed, backend_closed, timeout,
+// closed_by_proxy or shutdown.
+func closeReasonName(reason *CopyError) string {
+	if reason == nil {
+		return "-"
+	}
+	switch reason.Cause {
+	case ErrClientClosed:
+		return "client_closed"
+	case ErrBackendClosed:
+		return "backend_closed"
+	case ErrTimeout:
+		return "timeout"
+	case ErrClosedByProxy:
+		return "closed_by_proxy"
+	case ErrShutdown:
+		return "shutdown"
+	default:
+		return "-"
+	}
+}
+
+// accessLog writes access log lines of finished connection pairs of all apps. Lines are written whole.
+type accessLog struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format AccessLogFormatter
+	logger *proxyLogger
+	// errLog throttles logs of write errors.
+	errLog logThrottle
+}
+
+// newAccessLog returns the access log to w or nil if w is nil. Nil format means TSVAccessLog.
+func newAccessLog(logger *proxyLogger, w io.Writer, format AccessLogFormatter) *accessLog {
+	if w == nil {
+		return nil
+	}
+	if format == nil {
+		format = TSVAccessLog
+	}
+	return &accessLog{w: w, format: format, logger: logger, errLog: logThrottle{period: time.Second}}
+}
+
+// write writes the line of the connection pair. It does nothing if the access log is nil.
+func (l *accessLog) write(stats SessionStats) {
+	if l == nil {
+		return
+	}
+	line := l.format(stats)
+	l.mu.Lock()
+	_, err := l.w.Write(line)
+	l.mu.Unlock()
+	if err != nil {
+		if ok, suppressed := l.errLog.allow(); ok {
+			l.logger.Error("unable to write access log", fields{"error": err, "suppressed": suppressed})
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package service
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLogFormats(t *testing.T) {
+	stats := SessionStats{
+		App:      "test",
+		Client:   &net.TCPAddr{IP: net.IPv4(192, 0, 2, 7), Port: 51234},
+		Backend:  &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 80},
+		Started:  time.Date(2024, 5, 1, 10, 0, 0, 0, time.FixedZone("CEST", 2*3600)),
+		Duration: 1500 * time.Millisecond,
+		BytesIn:  12,
+		BytesOut: 3456,
+		Reason:   &CopyError{Cause: ErrBackendClosed},
+		Labels:   map[string]string{"tenant": "acme", "env": "prod"},
+	}
+	want := "2024-05-01T08:00:01.500Z\t192.0.2.7:51234\t10.0.0.1:80\t1.500\t12\t3456\tbackend_closed\tenv=prod&tenant=acme\n"
+	if got := string(TSVAccessLog(stats)); got != want {
+		t.Errorf("TSV line is\n%q, want\n%q", got, want)
+	}
+	want = `{"timestamp":"2024-05-01T08:00:01.500Z","client":"192.0.2.7:51234","backend":"10.0.0.1:80","duration":1.5,` +
+		`"bytes_in":12,"bytes_out":3456,"close_reason":"backend_closed","labels":{"env":"prod","tenant":"acme"}}` + "\n"
+	if got := string(JSONAccessLog(stats)); got != want {
+		t.Errorf("JSON line is\n%s, want\n%s", got, want)
+	}
+
+	// unknown values
+	empty := SessionStats{Started: stats.Started}
+	want = "2024-05-01T08:00:00.000Z\t-\t-\t0.000\t0\t0\t-\t-\n"
+	if got := string(TSVAccessLog(empty)); got != want {
+		t.Errorf("TSV line of unknown values is\n%q, want\n%q", got, want)
+	}
+	if got := string(JSONAccessLog(empty)); strings.Contains(got, "labels") {
+		t.Errorf("JSON line without labels is %s", got)
+	}
+
+	for name, want := range map[string]bool{"": true, "tsv": true, "json": true, "xml": false} {
+		if _, err := AccessLogFormat(name); (err == nil) != want {
+			t.Errorf("AccessLogFormat(%q): %v", name, err)
+		}
+	}
+}
+
+func TestAccessLogWritten(t *testing.T) {
+	backend := startBackend(t, echo)
+	var buf bytes.Buffer
+	stats := make(chan SessionStats, 1)
+	p := startProxy(t, ProxyConfig{
+		AccessLog: &buf,
+		Apps: []ConfigApp{{
+			Targets:      []string{backend},
+			OnDisconnect: func(s SessionStats) { stats <- s },
+		}},
+	})
+	conn := openExchange(t, p)
+	client := conn.LocalAddr().String()
+	conn.Close()
+	// the line is written before OnDisconnect is called
+	<-stats
+
+	fields := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\t")
+	if len(fields) != 8 {
+		t.Fatalf("access log is %q, want one line of 8 fields", buf.String())
+	}
+	if _, err := time.Parse(accessLogTime, fields[0]); err != nil {
+		t.Errorf("timestamp %q: %v", fields[0], err)
+	}
+	for i, want := range map[int]string{1: client, 2: backend, 4: "4", 5: "4", 6: "client_closed", 7: "-"} {
+		if fields[i] != want {
+			t.Errorf("field %d is %q, want %q", i, fields[i], want)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package service
+
+import (
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// accessList decides if a client IP is allowed by allow and deny CIDR lists.
+// Deny takes precedence over allow. An empty allow list allows all.
+type accessList struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func newAccessList(allow, deny []string) (*accessList, error) {
+	allowNets, err := parseCIDRs(allow)
+	if err != nil {
+		return nil, errors.Wrap(err, "allow list")
+	}
+	denyNets, err := parseCIDRs(deny)
+	if err != nil {
+		return nil, errors.Wrap(err, "deny list")
+	}
+	return &accessList{
+		allow: allowNets,
+		deny:  denyNets,
+	}, nil
+}
+
+// parseCIDRs parses IPv4 and IPv6 CIDRs. A single IP is treated as a host network.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, errors.Errorf("invalid IP %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.Wrap(err, "ParseCIDR()")
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// allowed reports whether the IP is allowed.
+func (l *accessList) allowed(ip net.IP) bool {
+	for _, ipNet := range l.deny {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	if len(l.allow) == 0 {
+		return true
+	}
+	for _, ipNet := range l.allow {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns IP of the remote side of the connection or nil if the connection isn't IP-based.
+func remoteIP(conn net.Conn) net.IP {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
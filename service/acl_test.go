@@ -0,0 +1,71 @@
+package service
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAccessList(t *testing.T) {
+	l, err := newAccessList([]string{"10.0.0.0/8", "2001:db8::/32", "192.168.1.7"}, []string{"10.1.0.0/16", "2001:db8::1"})
+	if err != nil {
+		t.Fatalf("newAccessList(): %v", err)
+	}
+	for ip, want := range map[string]bool{
+		"10.2.3.4":        true,
+		"10.1.2.3":        false,
+		"192.168.1.7":     true,
+		"192.168.1.8":     false,
+		"2001:db8::2":     true,
+		"2001:db8::1":     false,
+		"2001:db9::1":     false,
+		"::ffff:10.2.3.4": true,
+	} {
+		if got := l.allowed(net.ParseIP(ip)); got != want {
+			t.Errorf("allowed(%s) = %t, want %t", ip, got, want)
+		}
+	}
+
+	denyOnly, _ := newAccessList(nil, []string{"127.0.0.0/8"})
+	if denyOnly.allowed(net.ParseIP("127.0.0.1")) || !denyOnly.allowed(net.ParseIP("8.8.8.8")) {
+		t.Error("empty allow list with a deny list")
+	}
+	for _, invalid := range []string{"10.0.0.0/33", "not-an-ip"} {
+		if _, err := newAccessList([]string{invalid}, nil); err == nil {
+			t.Errorf("invalid CIDR %q is accepted", invalid)
+		}
+	}
+}
+
+func TestDeniedClientClosed(t *testing.T) {
+	backend := startBackend(t, echo)
+	denied := startProxy(t, ProxyConfig{Apps: []ConfigApp{{Targets: []string{backend}, Deny: []string{"127.0.0.0/8"}}}})
+	conn := dialProxy(t, denied, 0)
+	conn.SetDeadline(time.Now().Add(time.Second))
+	conn.Write([]byte("ping"))
+	if n, _ := io.ReadFull(conn, make([]byte, 4)); n != 0 {
+		t.Error("denied client is proxied")
+	}
+
+	allowed := startProxy(t, ProxyConfig{Apps: []ConfigApp{{Targets: []string{backend}, Allow: []string{"127.0.0.1"}}}})
+	openExchange(t, allowed)
+}
+
+func TestRejectDelay(t *testing.T) {
+	const delay = 300 * time.Millisecond
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Targets:     []string{startBackend(t, echo)},
+		Deny:        []string{"127.0.0.0/8"},
+		RejectDelay: delay,
+	}}})
+	conn := dialProxy(t, p, 0)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	if n, err := conn.Read(make([]byte, 1)); n != 0 || err == nil {
+		t.Fatalf("rejected connection read %d bytes: %v", n, err)
+	}
+	if elapsed := time.Since(start); elapsed < delay-50*time.Millisecond || elapsed > 2*delay {
+		t.Errorf("rejected connection is closed after %s, want about %s", elapsed, delay)
+	}
+}
@@ -0,0 +1,240 @@
+package service
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// AdminHandler returns http.Handler of the admin API:
+//   - GET /connections lists proxied connection pairs;
+//   - POST /connections/close?id=ID closes the connection pair by the id of its incoming connection;
+//   - POST /backends/drain?app=NAME&addr=ADDR stops new connections to the backend, established ones keep flowing;
+//   - POST /backends/undrain?app=NAME&addr=ADDR returns the drained backend to selection;
+//   - POST /backends/weight?app=NAME&addr=ADDR&weight=N changes the weight of the backend until the next reload;
+//   - POST /frontends/pause?app=NAME[&port=PORT] stops accepting on ports of the app, established connections keep flowing;
+//   - POST /frontends/resume?app=NAME[&port=PORT] resumes accepting;
+//   - GET /managers lists frontends and backends with their connection counts, backends also with the last
+//     dial or probe error and the time of the last active state change;
+//   - GET /metrics returns metrics in expvar JSON format;
+//   - GET /ready returns 200 if every app has an active backend and 503 otherwise;
+//   - GET /live always returns 200.
+func (p Proxy) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", expvar.Handler())
+	mux.HandleFunc("/connections", p.handleConnections)
+	mux.HandleFunc("/connections/close", p.handleCloseConnection)
+	mux.HandleFunc("/backends/drain", p.handleDrain(true))
+	mux.HandleFunc("/backends/undrain", p.handleDrain(false))
+	mux.HandleFunc("/backends/weight", p.handleWeight)
+	mux.HandleFunc("/frontends/pause", p.handlePause(true))
+	mux.HandleFunc("/frontends/resume", p.handlePause(false))
+	mux.HandleFunc("/managers", p.handleManagers)
+	mux.HandleFunc("/ready", p.handleReady)
+	mux.HandleFunc("/live", handleLive)
+	return mux
+}
+
+type adminConnection struct {
+	ID       int    `json:"id"`
+	Frontend string `json:"frontend"`
+	Client   string `json:"client"`
+	Backend  string `json:"backend"`
+}
+
+func (p Proxy) handleConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	conns := make([]adminConnection, 0)
+	for _, fnd := range p.fnds {
+		for _, sess := range fnd.sessions() {
+			conns = append(conns, adminConnection{
+				ID:       sess.client.id,
+				Frontend: fnd.name(),
+				Client:   sess.client.RemoteAddr().String(),
+				Backend:  sess.remote.RemoteAddr().String(),
+			})
+		}
+	}
+	writeJSON(w, conns)
+}
+
+func (p Proxy) handleCloseConnection(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	for _, fnd := range p.fnds {
+		if fnd.closeConn(id) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	http.Error(w, "connection not found", http.StatusNotFound)
+}
+
+// handleDrain puts the backend into maintenance or returns it from maintenance.
+func (p Proxy) handleDrain(drain bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		app := p.findApp(r.URL.Query().Get("app"))
+		if app == nil {
+			http.Error(w, "app not found", http.StatusNotFound)
+			return
+		}
+		if err := app.setBackendDrained(r.URL.Query().Get("addr"), drain); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleWeight changes the weight of the backend.
+func (p Proxy) handleWeight(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	weight, err := strconv.Atoi(r.URL.Query().Get("weight"))
+	if err != nil || weight < 1 || weight > MaxWeight {
+		http.Error(w, fmt.Sprintf("weight must be a number from 1 to %d", MaxWeight), http.StatusBadRequest)
+		return
+	}
+	app := p.findApp(r.URL.Query().Get("app"))
+	if app == nil {
+		http.Error(w, "app not found", http.StatusNotFound)
+		return
+	}
+	if err := app.setBackendWeight(r.URL.Query().Get("addr"), weight); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, errBackendNotFound) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlePause pauses or resumes accepting on all ports of the app or on the port if it is set.
+// The port is the configured one (the actual one for ephemeral ports).
+func (p Proxy) handlePause(pause bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		appName := r.URL.Query().Get("app")
+		port := -1
+		if s := r.URL.Query().Get("port"); s != "" {
+			var err error
+			if port, err = strconv.Atoi(s); err != nil {
+				http.Error(w, "invalid port", http.StatusBadRequest)
+				return
+			}
+		}
+		var found bool
+		for _, fnd := range p.fnds {
+			if fnd.app.name != appName || (port >= 0 && !fnd.hasPort(port)) {
+				continue
+			}
+			found = true
+			var err error
+			if pause {
+				err = fnd.pause()
+			} else {
+				err = fnd.resume()
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+		}
+		if !found {
+			http.Error(w, "frontend not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type adminManager struct {
+	Name        string `json:"name"`
+	Connections int    `json:"connections"`
+	// the fields below are set only for backends
+	LastError      string     `json:"last_error,omitempty"`
+	LastErrorAt    *time.Time `json:"last_error_at,omitempty"`
+	StateChangedAt *time.Time `json:"state_changed_at,omitempty"`
+}
+
+func (p Proxy) handleManagers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	managers := p.managers()
+	resp := make([]adminManager, 0, len(managers))
+	for _, m := range managers {
+		manager := adminManager{Name: m.identity(), Connections: m.getConnCount()}
+		if bnd, ok := m.(*backend); ok {
+			if lastErr := bnd.lastError.Load(); lastErr != nil {
+				manager.LastError = lastErr.msg
+				manager.LastErrorAt = &lastErr.at
+			}
+			if at := bnd.stateChangedTime(); !at.IsZero() {
+				manager.StateChangedAt = &at
+			}
+		}
+		resp = append(resp, manager)
+	}
+	writeJSON(w, resp)
+}
+
+// handleReady reports apps without active backends. It only reads the state set by health checks.
+func (p Proxy) handleReady(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var down []string
+	for _, app := range p.apps {
+		if !app.hasActiveBackend() {
+			down = append(down, app.name)
+		}
+	}
+	if len(down) > 0 {
+		http.Error(w, "no active backends: "+strings.Join(down, ", "), http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+func handleLive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,401 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// adminRequest sends the request to the admin API of the proxy and returns the status code.
+func adminRequest(p Proxy, method, target string) int {
+	rec := httptest.NewRecorder()
+	p.AdminHandler().ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+	return rec.Code
+}
+
+// openExchange connects to the proxy and sends ping through it. The connection is left open.
+func openExchange(t *testing.T, p Proxy) net.Conn {
+	t.Helper()
+	conn := dialProxy(t, p, 0)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("ping"))
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Fatalf("exchange: %v", err)
+	}
+	return conn
+}
+
+func TestWeightChangeMidTraffic(t *testing.T) {
+	first, second := startBackend(t, echo), startBackend(t, echo)
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Targets:  []string{first, second},
+		Strategy: "weighted_least_conn",
+	}}})
+	waitBackendsActive(t, p)
+	a := p.apps[0]
+	counts := func() (int, int) {
+		a.rmu.RLock()
+		defer a.rmu.RUnlock()
+		return a.backendByAddr(first).getConnCount(), a.backendByAddr(second).getConnCount()
+	}
+
+	var open []net.Conn
+	for i := 0; i < 4; i++ {
+		open = append(open, openExchange(t, p))
+	}
+	if c1, c2 := counts(); c1 != 2 || c2 != 2 {
+		t.Fatalf("connections are %d:%d with equal weights, want 2:2", c1, c2)
+	}
+
+	if code := adminRequest(p, http.MethodPost, "/backends/weight?app=test&addr="+second+"&weight=3"); code != http.StatusNoContent {
+		t.Fatalf("weight change returned %d", code)
+	}
+	// established connections keep flowing
+	for _, conn := range open {
+		conn.Write([]byte("pong"))
+		if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+			t.Fatalf("established connection after weight change: %v", err)
+		}
+	}
+	for i := 0; i < 12; i++ {
+		openExchange(t, p)
+	}
+	if c1, c2 := counts(); c1 != 4 || c2 != 12 {
+		t.Errorf("connections are %d:%d after weight 3 of the second backend, want 4:12", c1, c2)
+	}
+}
+
+func TestWeightChangeLimits(t *testing.T) {
+	backend := startBackend(t, echo)
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{Targets: []string{backend}}}})
+	for target, want := range map[string]int{
+		"/backends/weight?app=test&addr=" + backend + "&weight=1000": http.StatusNoContent,
+		"/backends/weight?app=test&addr=" + backend + "&weight=1001": http.StatusBadRequest,
+		"/backends/weight?app=test&addr=" + backend + "&weight=0":    http.StatusBadRequest,
+		"/backends/weight?app=test&addr=" + backend + "&weight=x":    http.StatusBadRequest,
+		"/backends/weight?app=test&addr=127.0.0.1:1&weight=2":        http.StatusNotFound,
+		"/backends/weight?app=other&addr=" + backend + "&weight=2":   http.StatusNotFound,
+	} {
+		if code := adminRequest(p, http.MethodPost, target); code != want {
+			t.Errorf("%s returned %d, want %d", target, code, want)
+		}
+	}
+	if err := p.apps[0].setBackendWeight(backend, MaxWeight+1); err == nil {
+		t.Error("weight above MaxWeight is set")
+	}
+}
+
+func TestConfigWeightLimit(t *testing.T) {
+	logger := zerolog.Nop()
+	_, err := NewProxy(context.Background(), &logger, ProxyConfig{Apps: []ConfigApp{{
+		Name:     "test",
+		Backends: []ConfigBackend{{Addr: "127.0.0.1:1", Weight: MaxWeight + 1}},
+	}}})
+	if err == nil {
+		t.Fatal("weight above MaxWeight is accepted")
+	}
+}
+
+func TestAdminCloseRacesEOF(t *testing.T) {
+	const rounds = 50
+	var disconnects atomic.Int32
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		// the backend answers and closes, so the pair ends naturally while the admin API closes it
+		Targets: []string{startBackend(t, func(conn net.Conn) {
+			io.ReadFull(conn, make([]byte, 4))
+			conn.Write([]byte("done"))
+		})},
+		OnDisconnect: func(s SessionStats) {
+			disconnects.Add(1)
+			if s.Reason == nil {
+				t.Error("session ended without a reason")
+			}
+		},
+	}}})
+	fnd := p.fnds[0]
+
+	for i := 0; i < rounds; i++ {
+		conn := dialProxy(t, p, 0)
+		var sessions []*session
+		if !waitFor(t, time.Second, func() bool { sessions = fnd.sessions(); return len(sessions) == 1 }) {
+			t.Fatalf("%d sessions are open, want 1", len(sessions))
+		}
+		id := sessions[0].client.id
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			adminRequest(p, http.MethodPost, "/connections/close?id="+strconv.Itoa(id))
+		}()
+		conn.Write([]byte("ping"))
+		io.ReadAll(conn)
+		<-closed
+		if !waitFor(t, time.Second, func() bool { return fnd.getConnCount() == 0 }) {
+			t.Fatalf("round %d: connection isn't removed", i)
+		}
+	}
+	if !waitFor(t, time.Second, func() bool { return disconnects.Load() == rounds }) {
+		t.Errorf("%d disconnects of %d sessions", disconnects.Load(), rounds)
+	}
+}
+
+func TestManagersConnCounts(t *testing.T) {
+	first, second := startBackend(t, echo), startBackend(t, echo)
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Targets:  []string{first, second},
+		Strategy: roundRobinName,
+	}}})
+	for i := 0; i < 3; i++ {
+		openExchange(t, p)
+	}
+
+	rec := httptest.NewRecorder()
+	p.AdminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/managers", nil))
+	var managers []adminManager
+	if err := json.Unmarshal(rec.Body.Bytes(), &managers); err != nil {
+		t.Fatalf("managers response %q: %v", rec.Body, err)
+	}
+	got := make(map[string]int)
+	for _, m := range managers {
+		got[m.Name] = m.Connections
+	}
+	want := map[string]int{
+		p.fnds[0].identity(): 3,
+		"test/" + first:      2,
+		"test/" + second:     1,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("manager connections are %v, want %v", got, want)
+	}
+}
+
+func TestCloseConnectionByID(t *testing.T) {
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{Targets: []string{startBackend(t, echo)}}}})
+	fnd := p.fnds[0]
+	clients := make(map[int]net.Conn)
+	for i := 0; i < 3; i++ {
+		conn := openExchange(t, p)
+		for _, sess := range fnd.sessions() {
+			if sess.client.RemoteAddr().String() == conn.LocalAddr().String() {
+				clients[sess.client.id] = conn
+			}
+		}
+	}
+	if len(clients) != 3 {
+		t.Fatalf("%d sessions are found, want 3", len(clients))
+	}
+
+	var closedID int
+	for id := range clients {
+		closedID = id
+		break
+	}
+	if code := adminRequest(p, http.MethodPost, "/connections/close?id="+strconv.Itoa(closedID)); code != http.StatusNoContent {
+		t.Fatalf("close returned %d", code)
+	}
+	if _, err := clients[closedID].Read(make([]byte, 1)); err == nil {
+		t.Error("cancelled session is open")
+	}
+	for id, conn := range clients {
+		if id == closedID {
+			continue
+		}
+		conn.Write([]byte("pong"))
+		if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+			t.Errorf("session %d is affected by closing session %d: %v", id, closedID, err)
+		}
+	}
+	if !waitFor(t, time.Second, func() bool { return fnd.getConnCount() == 2 }) {
+		t.Errorf("%d connections after closing one of 3", fnd.getConnCount())
+	}
+	if code := adminRequest(p, http.MethodPost, "/connections/close?id="+strconv.Itoa(closedID)); code != http.StatusNotFound {
+		t.Errorf("closing a closed session returned %d", code)
+	}
+}
+
+func TestReadyAndLive(t *testing.T) {
+	p := newTestProxy(t, ProxyConfig{Apps: []ConfigApp{
+		{Name: "web", Targets: []string{startBackend(t, echo)}},
+		{Name: "db", Targets: []string{deadAddr(t)}},
+	}})
+	if code := adminRequest(p, http.MethodGet, "/ready"); code != http.StatusServiceUnavailable {
+		t.Errorf("/ready before health checks returns %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	runProxy(t, p)
+	web, db := p.apps[0].bnds[0], p.apps[1].bnds[0]
+	if !waitFor(t, 5*time.Second, func() bool { return web.eligible() && db.lastError.Load() != nil }) {
+		t.Fatal("health checks don't finish")
+	}
+
+	for _, step := range []struct {
+		dbActive  bool
+		wantReady int
+	}{
+		{false, http.StatusServiceUnavailable},
+		{true, http.StatusOK},
+	} {
+		db.active.Store(step.dbActive)
+		if code := adminRequest(p, http.MethodGet, "/ready"); code != step.wantReady {
+			t.Errorf("/ready returns %d with db backend active %t, want %d", code, step.dbActive, step.wantReady)
+		}
+		if code := adminRequest(p, http.MethodGet, "/live"); code != http.StatusOK {
+			t.Errorf("/live returns %d with db backend active %t, want %d", code, step.dbActive, http.StatusOK)
+		}
+	}
+	for _, target := range []string{"/ready", "/live"} {
+		if code := adminRequest(p, http.MethodPost, target); code != http.StatusMethodNotAllowed {
+			t.Errorf("POST %s returns %d, want %d", target, code, http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func TestAdminDrainBackend(t *testing.T) {
+	drained, other := startBackend(t, echo), startBackend(t, echo)
+	// the established connections report to the channel when they are closed at the end of the test
+	stats := make(chan SessionStats, 4)
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Targets:      []string{drained, other},
+		Strategy:     roundRobinName,
+		OnDisconnect: func(s SessionStats) { stats <- s },
+	}}})
+	waitBackendsActive(t, p)
+	a := p.apps[0]
+	a.rmu.RLock()
+	bnd := a.backendByAddr(drained)
+	a.rmu.RUnlock()
+	// connections to both backends are established before the drain
+	var established []net.Conn
+	for i := 0; i < 2; i++ {
+		established = append(established, openExchange(t, p))
+	}
+	if bnd.getConnCount() != 1 {
+		t.Fatalf("backend has %d connections before the drain, want 1", bnd.getConnCount())
+	}
+
+	target := "/backends/drain?app=test&addr=" + url.QueryEscape(drained)
+	if code := adminRequest(p, http.MethodPost, target); code != http.StatusNoContent {
+		t.Fatalf("drain returns %d, want %d", code, http.StatusNoContent)
+	}
+	for i := 0; i < 4; i++ {
+		exchange(t, p)
+		if s := <-stats; s.Backend.String() == drained {
+			t.Errorf("new connection %d goes to the drained backend", i)
+		}
+	}
+	for i, conn := range established {
+		conn.Write([]byte("pong"))
+		if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+			t.Errorf("established connection %d after the drain: %v", i, err)
+		}
+	}
+	if bnd.getConnCount() != 1 {
+		t.Errorf("drained backend has %d connections, want the established one", bnd.getConnCount())
+	}
+
+	if code := adminRequest(p, http.MethodPost, "/backends/undrain?app=test&addr="+url.QueryEscape(drained)); code != http.StatusNoContent {
+		t.Fatalf("undrain returns %d, want %d", code, http.StatusNoContent)
+	}
+	got := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		exchange(t, p)
+		got[(<-stats).Backend.String()]++
+	}
+	if got[drained] != 2 {
+		t.Errorf("undrained backend gets %d of 4 new connections, want 2", got[drained])
+	}
+	if code := adminRequest(p, http.MethodPost, "/backends/drain?app=test&addr=127.0.0.1:1"); code != http.StatusNotFound {
+		t.Errorf("drain of an unknown backend returns %d, want %d", code, http.StatusNotFound)
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{Targets: []string{startBackend(t, echo)}}}})
+	addr := p.ListenAddrs()[0].String()
+	established := openExchange(t, p)
+
+	if code := adminRequest(p, http.MethodPost, "/frontends/pause?app=test"); code != http.StatusNoContent {
+		t.Fatalf("pause returns %d, want %d", code, http.StatusNoContent)
+	}
+	if conn, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		conn.Close()
+		t.Error("paused frontend accepts connections")
+	}
+	established.Write([]byte("pong"))
+	if _, err := io.ReadFull(established, make([]byte, 4)); err != nil {
+		t.Errorf("established connection while paused: %v", err)
+	}
+
+	if code := adminRequest(p, http.MethodPost, "/frontends/resume?app=test"); code != http.StatusNoContent {
+		t.Fatalf("resume returns %d, want %d", code, http.StatusNoContent)
+	}
+	if got := p.ListenAddrs()[0].String(); got != addr {
+		t.Errorf("resumed frontend listens on %s, want %s", got, addr)
+	}
+	exchange(t, p)
+
+	if code := adminRequest(p, http.MethodPost, "/frontends/pause?app=unknown"); code != http.StatusNotFound {
+		t.Errorf("pause of an unknown app returns %d, want %d", code, http.StatusNotFound)
+	}
+}
+
+func TestManagersLastError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	addr := ln.Addr().String()
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Targets:             []string{addr},
+		HealthcheckInterval: 50 * time.Millisecond,
+	}}})
+	manager := func() adminManager {
+		rec := httptest.NewRecorder()
+		p.AdminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/managers", nil))
+		var managers []adminManager
+		if err := json.Unmarshal(rec.Body.Bytes(), &managers); err != nil {
+			t.Fatalf("managers response %q: %v", rec.Body, err)
+		}
+		for _, m := range managers {
+			if m.Name == "test/"+addr {
+				return m
+			}
+		}
+		t.Fatalf("no manager of %s in %q", addr, rec.Body)
+		return adminManager{}
+	}
+	if m := manager(); m.LastError != "" || m.LastErrorAt != nil {
+		t.Errorf("healthy backend has last error %q at %v", m.LastError, m.LastErrorAt)
+	}
+
+	failed := time.Now()
+	ln.Close()
+	var m adminManager
+	if !waitFor(t, 5*time.Second, func() bool {
+		m = manager()
+		return m.LastError != "" && m.StateChangedAt != nil && m.StateChangedAt.After(failed)
+	}) {
+		t.Fatalf("backend with a failed probe reports last error %q at %v, state changed at %v", m.LastError, m.LastErrorAt, m.StateChangedAt)
+	}
+	if m.LastErrorAt == nil || m.LastErrorAt.Before(failed) || m.LastErrorAt.After(time.Now()) {
+		t.Errorf("last error is at %v, the probe failed after %v", m.LastErrorAt, failed)
+	}
+}
@@ -2,61 +2,605 @@ package service
 
 import (
 	"context"
+	"expvar"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
-	"github.com/rs/zerolog"
 )
 
 type application struct {
-	logger *zerolog.Logger
-	name   string
-	bnds   []*backend
+	ctx     context.Context
+	logger  *proxyLogger
+	name    string
+	rmu     sync.RWMutex
+	bnds    []*backend
+	bndOpts backendOptions
+	// bwg waits for backends of the application.
+	bwg         sync.WaitGroup
+	discovery   Discovery
+	drainPeriod time.Duration
+	// drains limits the number of backends drained at once. It is nil if drains are unlimited.
+	drains    chan struct{}
+	maxDrains int
+	// setupBudget bounds the whole backend selection and connection setup of a client including retries.
+	// Zero means no limit.
+	setupBudget time.Duration
+	// dialRetries is the number of other backends tried when a connection to the chosen backend fails.
+	dialRetries atomic.Int64
+	// retryBackoff and retryJitter space out dial retries of a client setup. Zero values mean immediate retries.
+	retryBackoff time.Duration
+	retryJitter  time.Duration
+	// limiter is the global throughput limiter shared by all connections. It is nil if throughput is unlimited.
+	limiter *tokenBucket
+	// strategy is the load balancing strategy.
+	strategy strategy
+	// weightsIgnored is set when uneven weights of discovered backends are reported as ignored by the strategy.
+	weightsIgnored   atomic.Bool
+	selectionLatency *histogram
+	// choices caches the last backend choice per client IP. It is nil if caching is disabled.
+	choices *choiceCache
+	// accepted, bytesIn and bytesOut are totals reported by Stats.
+	accepted atomic.Int64
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+	// selector overrides the strategy if it is set.
+	selector Selector
+	// onConnect and onDisconnect are optional hooks of connection pairs.
+	onConnect    ConnectHook
+	onDisconnect DisconnectHook
+	// accessLog is shared by all apps. It is nil if access logs are disabled.
+	accessLog *accessLog
+	// totals are totals of finished sessions for the shutdown report.
+	totals sessionTotals
+	// availability is the last availability state reported by checkAvailability.
+	availability atomic.Int32
+	// activeChanged is closed and replaced by every checkAvailability, so waiters re-check active backends.
+	// It is guarded by activeMu.
+	activeMu      sync.Mutex
+	activeChanged chan struct{}
 }
 
-func newApplication(ctx context.Context, logger *zerolog.Logger, name string, bnds []*backend) *application {
-	return &application{
-		logger: logger,
-		name:   name,
-		bnds:   bnds,
+// appOptions contains optional application settings.
+type appOptions struct {
+	discovery    Discovery
+	dialRetries  int
+	setupBudget  time.Duration
+	retryBackoff time.Duration
+	retryJitter  time.Duration
+	onConnect    ConnectHook
+	onDisconnect DisconnectHook
+	accessLog    *accessLog
+	selector     Selector
+	limiter      *tokenBucket
+	strategy     strategy
+	maxDrains    int
+	choiceTTL    time.Duration
+	affinityTTL  time.Duration
+}
+
+func newApplication(ctx context.Context, logger *proxyLogger, name string, bnds []*backend, bndOpts backendOptions, opts appOptions) *application {
+	a := &application{
+		ctx:           ctx,
+		logger:        logger,
+		name:          name,
+		bnds:          bnds,
+		bndOpts:       bndOpts,
+		discovery:     opts.discovery,
+		drainPeriod:   time.Second,
+		limiter:       opts.limiter,
+		strategy:      opts.strategy,
+		maxDrains:     opts.maxDrains,
+		choices:       newChoiceCache(opts.choiceTTL, false),
+		setupBudget:   opts.setupBudget,
+		retryBackoff:  opts.retryBackoff,
+		retryJitter:   opts.retryJitter,
+		onConnect:     opts.onConnect,
+		onDisconnect:  opts.onDisconnect,
+		accessLog:     opts.accessLog,
+		selector:      opts.selector,
+		activeChanged: make(chan struct{}),
+	}
+	if opts.affinityTTL > 0 {
+		a.choices = newChoiceCache(opts.affinityTTL, true)
+	}
+	if opts.maxDrains > 0 {
+		a.drains = make(chan struct{}, opts.maxDrains)
 	}
+	if a.strategy == nil {
+		a.strategy = leastConnStrategy{}
+	}
+	a.dialRetries.Store(int64(opts.dialRetries))
+	a.selectionLatency = selectionLatency.with(a.strategy.name())
+	appAvailable.Set(name, expvar.Func(func() any {
+		if a.availability.Load() == availabilityDown {
+			return 0
+		}
+		return 1
+	}))
+	return a
+}
+
+// selectionKey describes the client connection a backend is selected for.
+type selectionKey struct {
+	clientIP string
+	// client is the address of the client. It may be nil.
+	client net.Addr
+	// origDst is the original destination of a transparently proxied connection. It is empty if unknown.
+	origDst string
+	// origDstAddr is origDst as an address. It is nil if unknown.
+	origDstAddr net.Addr
 }
 
 var (
 	errNoActiveBackend = errors.New("no active backends")
+	errSetupBudget     = errors.New("connection setup budget exhausted")
+	errBackendNotFound = errors.New("backend not found")
 )
 
-// nextBackend chooses the next available backend with MIN number of connections.
-func (a *application) nextBackend() (*backend, error) {
-	var next *backend
-	var minConnCount int
+// run is a blocking function. It starts backends of the application and, if discovery is configured,
+// applies discovered backend sets until ctx is done. It exits when all backends finish work.
+func (a *application) run(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	a.rmu.RLock()
 	for _, bnd := range a.bnds {
-		if bnd.active.Load() {
-			if next == nil {
-				next = bnd
-				minConnCount = bnd.getConnCount()
+		a.startBackend(bnd)
+	}
+	a.rmu.RUnlock()
+
+	if a.discovery != nil {
+		a.runDiscovery()
+	}
+
+	<-a.ctx.Done()
+	a.bwg.Wait()
+	a.totals.close()
+	report := a.totals.report(a.name)
+	a.logger.Info("app stopped", fields{
+		"app":          a.name,
+		"served":       report.Served,
+		"force_closed": report.ForceClosed,
+		"bytes_in":     report.BytesIn,
+		"bytes_out":    report.BytesOut,
+		"backends":     report.Backends,
+	})
+}
+
+// finishSession records the stats of a finished session of the backend, writes its access log line
+// and calls the OnDisconnect hook.
+func (a *application) finishSession(addr string, stats SessionStats) {
+	a.accessLog.write(stats)
+	if a.onDisconnect != nil {
+		a.onDisconnect(stats)
+	}
+	a.totals.finish(addr, stats)
+}
+
+// startBackend runs the backend. Backends are waited by run.
+func (a *application) startBackend(bnd *backend) {
+	bnd.onActiveChange = a.checkAvailability
+	bnd.onRemove = func() {
+		a.removeBackend(bnd)
+	}
+	a.bwg.Add(1)
+	go bnd.run(&a.bwg)
+}
+
+// runDiscovery is a blocking function. It applies discovered backend sets until ctx is done.
+func (a *application) runDiscovery() {
+	updates := make(chan DiscoveryUpdate)
+	go a.discovery.Watch(a.ctx, updates)
+
+	for {
+		select {
+		case <-a.ctx.Done():
+			return
+		case update := <-updates:
+			if update.Err != nil {
+				a.logger.Warn("backend discovery failed, keeping current backends", fields{"error": update.Err, "app": a.name})
 				continue
 			}
-			if bnd.getConnCount() < minConnCount {
-				next = bnd
+			a.reconcile(update.Backends)
+		}
+	}
+}
+
+// reconcile applies the backend set: it starts new backends and drains the ones which disappeared.
+// Backends queued for draining keep serving until their drain starts, a backend which reappears
+// while queued stays in service.
+func (a *application) reconcile(discovered []DiscoveredBackend) {
+	wanted := make(map[string]DiscoveredBackend, len(discovered))
+	for _, d := range discovered {
+		wanted[d.Addr] = d
+		if d.Weight > 1 && ignoresWeights(a.strategy) && !a.weightsIgnored.Swap(true) {
+			a.logger.Warn("backend weights are ignored by the strategy, use a weighted strategy", fields{"app": a.name, "strategy": a.strategy.name()})
+		}
+	}
+
+	// runs after the unlock, removed backends may leave the app without active backends
+	defer a.checkAvailability()
+	a.rmu.Lock()
+	defer a.rmu.Unlock()
+
+	// backends can't be started after shutdown
+	if a.ctx.Err() != nil {
+		return
+	}
+
+	bnds := make([]*backend, 0, len(discovered))
+	for _, bnd := range a.bnds {
+		if d, ok := wanted[bnd.addr]; ok && !bnd.removed.Load() {
+			delete(wanted, bnd.addr)
+			bnd.draining.Store(false)
+			bnd.setWeight(d.Weight, d.Priority)
+			bnds = append(bnds, bnd)
+			continue
+		}
+		if !bnd.draining.Load() {
+			bnd.draining.Store(true)
+			go a.drainBackend(bnd)
+		}
+		if !bnd.removed.Load() {
+			bnds = append(bnds, bnd)
+		}
+	}
+	for _, d := range discovered {
+		if _, ok := wanted[d.Addr]; !ok {
+			continue
+		}
+		delete(wanted, d.Addr)
+		bnd, err := newBackend(a.ctx, a.logger, d.Addr, a.bndOpts.withTLS(d.TLS))
+		if err != nil {
+			a.logger.Error("unable to add discovered backend", fields{"error": err, "app": a.name, "backend": d.Addr})
+			continue
+		}
+		bnd.setWeight(d.Weight, d.Priority)
+		a.logger.Info("backend added", fields{"app": a.name, "backend": d.Addr, "weight": bnd.weight, "priority": bnd.priority})
+		bnds = append(bnds, bnd)
+		a.startBackend(bnd)
+	}
+	a.bnds = bnds
+}
+
+// drainBackend is a blocking function. It waits for a drain slot if drains are limited, then excludes the backend
+// from selection, waits until its connections are closed and stops it.
+func (a *application) drainBackend(bnd *backend) {
+	if a.drains != nil {
+		select {
+		case a.drains <- struct{}{}:
+			defer func() { <-a.drains }()
+		case <-a.ctx.Done():
+			return
+		}
+	}
+
+	a.rmu.Lock()
+	// the backend is wanted again
+	if !bnd.draining.Load() {
+		a.rmu.Unlock()
+		return
+	}
+	bnd.removed.Store(true)
+	a.bndOpts.status.send(StatusDraining, a.name, bnd.addr)
+	for i, b := range a.bnds {
+		if b == bnd {
+			a.bnds = append(a.bnds[:i:i], a.bnds[i+1:]...)
+			break
+		}
+	}
+	a.rmu.Unlock()
+
+	a.logger.Info("draining removed backend", fields{"app": a.name, "backend": bnd.addr, "connections": bnd.getConnCount()})
+
+	ticker := time.NewTicker(a.drainPeriod)
+	defer ticker.Stop()
+	for bnd.getConnCount() > 0 {
+		select {
+		case <-a.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+	a.stopBackend(bnd)
+}
+
+// removeBackend detaches the backend which removed itself: it is deleted from the backend set and stopped.
+func (a *application) removeBackend(bnd *backend) {
+	a.rmu.Lock()
+	for i, b := range a.bnds {
+		if b == bnd {
+			a.bnds = append(a.bnds[:i:i], a.bnds[i+1:]...)
+			break
+		}
+	}
+	a.rmu.Unlock()
+	a.stopBackend(bnd)
+}
+
+// stopBackend stops the backend which isn't in the backend set anymore and deletes its metrics.
+func (a *application) stopBackend(bnd *backend) {
+	bnd.cancel()
+	backendConnections.Delete(bnd.metricKey)
+	backendDialFailures.Delete(bnd.metricKey)
+	backendDialLatency.delete(bnd.metricKey)
+	backendHandshakeLatency.delete(bnd.metricKey)
+	a.logger.Info("backend removed", fields{"app": a.name, "backend": bnd.addr})
+}
+
+// nextBackend chooses the next available backend by the application strategy among backends
+// from the tier with the lowest priority value. Backends from the tried set are skipped,
+// as well as backends ejected by outlier detection until their ejection time passes.
+// At debug log level the reason of every skipped backend is logged.
+func (a *application) nextBackend(key selectionKey, tried map[*backend]bool) (*backend, error) {
+	clientIP := key.clientIP
+	a.rmu.RLock()
+	defer a.rmu.RUnlock()
+
+	var skipped map[string]string
+	if a.logger.debugEnabled() {
+		skipped = make(map[string]string)
+	}
+	var candidates []*backend
+	for _, bnd := range a.bnds {
+		if tried[bnd] || !bnd.eligible() {
+			if skipped != nil {
+				skipped[bnd.addr] = bnd.skipReason(tried[bnd])
 			}
+			continue
+		}
+		if len(candidates) > 0 && bnd.priority > candidates[0].priority {
+			continue
 		}
+		if len(candidates) > 0 && bnd.priority < candidates[0].priority {
+			candidates = candidates[:0]
+		}
+		candidates = append(candidates, bnd)
 	}
-	if next == nil {
+	if len(candidates) == 0 {
+		if skipped != nil {
+			a.logger.Debug("no backend selected", fields{"app": a.name, "client": clientIP, "skipped": skipped})
+		}
 		return nil, errNoActiveBackend
 	}
-	return next, nil
+	chosen := a.selectBackend(candidates, key)
+	if chosen == nil {
+		chosen = a.strategy.choose(candidates, key)
+	}
+	if skipped != nil {
+		for _, bnd := range a.bnds {
+			if !tried[bnd] && bnd.eligible() && bnd.priority > candidates[0].priority {
+				skipped[bnd.addr] = fmt.Sprintf("priority %d, tier %d is available", bnd.priority, candidates[0].priority)
+			}
+		}
+		a.logger.Debug("backend selected", fields{"app": a.name, "client": clientIP, "backend": chosen.addr, "skipped": skipped})
+	}
+	return chosen, nil
+}
+
+// Availability states of the app.
+const (
+	availabilityUnknown int32 = iota
+	availabilityUp
+	availabilityDown
+)
+
+// checkAvailability logs and publishes transitions between "all backends are down" and "some backend is active",
+// so the state change is reported once instead of on every failed dial.
+func (a *application) checkAvailability() {
+	a.activeMu.Lock()
+	close(a.activeChanged)
+	a.activeChanged = make(chan struct{})
+	a.activeMu.Unlock()
+
+	state := availabilityDown
+	if a.hasActiveBackend() {
+		state = availabilityUp
+	}
+	prev := a.availability.Swap(state)
+	if prev == state || (prev == availabilityUnknown && state == availabilityUp) {
+		return
+	}
+	a.rmu.RLock()
+	status := a.bndOpts.status
+	a.rmu.RUnlock()
+	if state == availabilityDown {
+		a.logger.Error("all backends are down", fields{"app": a.name})
+		status.send(StatusAllBackendsDown, a.name, "")
+		return
+	}
+	a.logger.Info("backends recovered", fields{"app": a.name})
+	status.send(StatusBackendsRecovered, a.name, "")
+}
+
+// waitReady blocks until at least one backend of the app is active (probed healthy) or ctx is done.
+func (a *application) waitReady(ctx context.Context) error {
+	for {
+		a.activeMu.Lock()
+		changed := a.activeChanged
+		a.activeMu.Unlock()
+		if a.hasActiveBackend() {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "app %s has no active backends", a.name)
+		case <-changed:
+		}
+	}
+}
+
+// hasActiveBackend reports whether at least one backend of the app is active.
+func (a *application) hasActiveBackend() bool {
+	a.rmu.RLock()
+	defer a.rmu.RUnlock()
+	for _, bnd := range a.bnds {
+		if bnd.active.Load() {
+			return true
+		}
+	}
+	return false
+}
+
+// preferredTierAvailable reports whether an eligible backend has a lower priority value than bnd.
+func (a *application) preferredTierAvailable(bnd *backend) bool {
+	a.rmu.RLock()
+	defer a.rmu.RUnlock()
+	for _, other := range a.bnds {
+		if other.priority < bnd.priority && other.eligible() {
+			return true
+		}
+	}
+	return false
 }
 
-// createRemoteConnection creates new outgoing connection Conn.
-func (a *application) createRemoteConnection() (*Conn, error) {
-	nextBackend, err := a.nextBackend()
-	if err != nil {
-		return nil, errors.Wrap(err, "unable to get next backend")
+// backendByAddr returns the current backend by its address or nil. It must be called under the application lock.
+func (a *application) backendByAddr(addr string) *backend {
+	for _, bnd := range a.bnds {
+		if bnd.addr == addr {
+			return bnd
+		}
+	}
+	return nil
+}
+
+// setBackendWeight changes the weight of the backend at runtime, the priority is kept. Selections after the call
+// use the new weight. The weight is replaced by the configured one on the next reload or discovery update.
+func (a *application) setBackendWeight(addr string, weight int) error {
+	if weight < 1 || weight > MaxWeight {
+		return errors.Errorf("weight %d is out of range 1-%d", weight, MaxWeight)
+	}
+	a.rmu.Lock()
+	defer a.rmu.Unlock()
+	bnd := a.backendByAddr(addr)
+	if bnd == nil {
+		return errors.Wrap(errBackendNotFound, addr)
+	}
+	old := bnd.weight
+	bnd.setWeight(weight, bnd.priority)
+	a.logger.Info("backend weight changed", fields{"app": a.name, "backend": addr, "old_weight": old, "weight": weight})
+	return nil
+}
+
+// setBackendDrained puts the backend into maintenance or returns it from maintenance at runtime.
+// Selections after the call see the new state.
+func (a *application) setBackendDrained(addr string, drained bool) error {
+	a.rmu.Lock()
+	defer a.rmu.Unlock()
+	bnd := a.backendByAddr(addr)
+	if bnd == nil {
+		return errors.Wrap(errBackendNotFound, addr)
+	}
+	if drained {
+		bnd.drain()
+	} else {
+		bnd.undrain()
+	}
+	return nil
+}
+
+// cachedChoice returns the cached backend of the client if it is still eligible for selection, otherwise nil.
+// A cached backend of a failover tier isn't used after a backend of a preferred tier recovers.
+func (a *application) cachedChoice(clientIP string) *backend {
+	if a.choices == nil {
+		return nil
+	}
+	bnd := a.choices.get(clientIP)
+	if bnd == nil || !bnd.eligible() || a.preferredTierAvailable(bnd) {
+		return nil
 	}
-	rNetConn, err := nextBackend.createConn()
-	if err != nil {
-		// TODO add feature to find another next backend
-		return nil, errors.Wrap(err, "unable to connect to remote backend")
+	return bnd
+}
+
+// createRemoteConnection creates new outgoing connection Conn for the client and returns it with its backend.
+// A fresh cached choice of the client is tried first if it is still eligible. With client affinity its TTL
+// is restarted when it is used.
+// If the connection to the chosen backend fails, it tries next backends up to dialRetries times.
+// The whole process is bounded by setupBudget if it is set: attempts get the remaining budget and
+// no attempts are made after it is exhausted.
+// A backend may turn ineligible (inactive, drained, ejected or removed) after it is selected. It is re-checked
+// before and after the dial, then the next backend is selected without spending a retry, so connections
+// to ineligible backends are never returned.
+func (a *application) createRemoteConnection(key selectionKey) (*Conn, *backend, error) {
+	clientIP := key.clientIP
+	tried := make(map[*backend]bool)
+	var deadline time.Time
+	if a.setupBudget > 0 {
+		deadline = time.Now().Add(a.setupBudget)
 	}
-	return newConn(rNetConn, nextBackend), nil
+	var lastErr error
+	// failures is the number of failed dials, waited is the number of failures paused for by the retry backoff.
+	var failures, waited int
+	if bnd := a.cachedChoice(clientIP); bnd != nil {
+		rNetConn, err := bnd.createConn(deadline)
+		switch {
+		case err != nil:
+			a.logger.Debug("unable to connect to cached backend", fields{"error": err, "app": a.name, "backend": bnd.addr})
+			lastErr = err
+			failures++
+		case !bnd.eligible():
+			a.logger.Debug("backend turned ineligible during dial", fields{"app": a.name, "backend": bnd.addr, "reason": bnd.skipReason(false)})
+			rNetConn.Close()
+		default:
+			a.choices.touch(clientIP, bnd)
+			return newConn(rNetConn, bnd), bnd, nil
+		}
+		tried[bnd] = true
+	}
+	retries := int(a.dialRetries.Load())
+	for attempt := 0; attempt <= retries; {
+		if budgetExhausted(deadline) {
+			return nil, nil, errors.Wrapf(errSetupBudget, "%s, last error: %v", a.setupBudget, lastErr)
+		}
+		start := time.Now()
+		nextBackend, err := a.nextBackend(key, tried)
+		a.selectionLatency.observe(time.Since(start))
+		if err != nil {
+			if lastErr != nil {
+				return nil, nil, errors.Wrap(lastErr, "unable to connect to remote backend")
+			}
+			return nil, nil, errors.Wrap(err, "unable to get next backend")
+		}
+		if !nextBackend.eligible() {
+			tried[nextBackend] = true
+			continue
+		}
+		if failures > waited {
+			waited = failures
+			if err := a.waitRetry(deadline, failures, lastErr); err != nil {
+				return nil, nil, err
+			}
+		}
+		rNetConn, err := nextBackend.createConn(deadline)
+		if err != nil {
+			a.logger.Debug("unable to connect to backend", fields{"error": err, "app": a.name, "backend": nextBackend.addr, "attempt": attempt})
+			tried[nextBackend] = true
+			lastErr = err
+			failures++
+			attempt++
+			continue
+		}
+		if !nextBackend.eligible() {
+			a.logger.Debug("backend turned ineligible during dial", fields{"app": a.name, "backend": nextBackend.addr, "reason": nextBackend.skipReason(false)})
+			rNetConn.Close()
+			tried[nextBackend] = true
+			continue
+		}
+		if a.choices != nil {
+			a.choices.set(clientIP, nextBackend)
+		}
+		return newConn(rNetConn, nextBackend), nextBackend, nil
+	}
+	if budgetExhausted(deadline) {
+		return nil, nil, errors.Wrapf(errSetupBudget, "%s, last error: %v", a.setupBudget, lastErr)
+	}
+	return nil, nil, errors.Wrap(lastErr, "unable to connect to remote backend")
+}
+
+// budgetExhausted reports whether the setup deadline is set and has passed.
+func budgetExhausted(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
 }
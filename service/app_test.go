@@ -0,0 +1,262 @@
+package service
+
+import (
+	"context"
+	"expvar"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestInactiveBackendNotSelected(t *testing.T) {
+	stable, flapping := startBackend(t, echo), startBackend(t, echo)
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Targets:  []string{stable, flapping},
+		Strategy: roundRobinName,
+	}}})
+	a := p.apps[0]
+	a.rmu.RLock()
+	victim := a.backendByAddr(flapping)
+	a.rmu.RUnlock()
+	if !waitFor(t, 5*time.Second, victim.eligible) {
+		t.Fatal("backend isn't active")
+	}
+
+	for round := 0; round < 20; round++ {
+		victim.active.Store(true)
+		var inactive atomic.Bool
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 20; i++ {
+					// the flip happened before the selection started
+					flipped := inactive.Load()
+					conn, bnd, err := a.createRemoteConnection(selectionKey{clientIP: "127.0.0.1"})
+					if err != nil {
+						t.Errorf("createRemoteConnection(): %v", err)
+						return
+					}
+					conn.Close()
+					if flipped && bnd == victim {
+						t.Errorf("inactive backend is selected in round %d", round)
+					}
+				}
+			}()
+		}
+		time.Sleep(time.Millisecond)
+		victim.active.Store(false)
+		inactive.Store(true)
+		wg.Wait()
+	}
+}
+
+// gateDialer makes pipe connections like pipeDialer. Once armed, dials to addr block until release is closed.
+type gateDialer struct {
+	addr    string
+	armed   atomic.Bool
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (d *gateDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if addr == d.addr && d.armed.CompareAndSwap(true, false) {
+		close(d.entered)
+		select {
+		case <-d.release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return pipeDialer{}.DialContext(ctx, network, addr)
+}
+
+func TestBackendInactiveDuringDial(t *testing.T) {
+	const stableAddr, victimAddr = "192.0.2.1:80", "192.0.2.2:80"
+	for name, cacheTTL := range map[string]time.Duration{"selected": 0, "cached": time.Hour} {
+		t.Run(name, func(t *testing.T) {
+			dialer := &gateDialer{addr: victimAddr, entered: make(chan struct{}), release: make(chan struct{})}
+			p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+				Targets:        []string{stableAddr, victimAddr},
+				Dialer:         dialer,
+				ChoiceCacheTTL: cacheTTL,
+			}}})
+			waitBackendsActive(t, p)
+			a := p.apps[0]
+			a.rmu.RLock()
+			stable, victim := a.backendByAddr(stableAddr), a.backendByAddr(victimAddr)
+			a.rmu.RUnlock()
+			key := selectionKey{clientIP: "127.0.0.1"}
+
+			// only the victim is selectable, with the cache its choice is remembered
+			stable.active.Store(false)
+			if cacheTTL > 0 {
+				conn, bnd, err := a.createRemoteConnection(key)
+				if err != nil || bnd != victim {
+					t.Fatalf("first connection goes to %v: %v", bnd, err)
+				}
+				conn.Close()
+				stable.active.Store(true)
+			}
+
+			dialer.armed.Store(true)
+			type result struct {
+				conn *Conn
+				bnd  *backend
+				err  error
+			}
+			done := make(chan result, 1)
+			go func() {
+				conn, bnd, err := a.createRemoteConnection(key)
+				done <- result{conn, bnd, err}
+			}()
+			select {
+			case <-dialer.entered:
+			case <-time.After(5 * time.Second):
+				t.Fatal("victim backend isn't dialed")
+			}
+			victim.active.Store(false)
+			stable.active.Store(true)
+			close(dialer.release)
+
+			res := <-done
+			if res.err != nil {
+				t.Fatalf("createRemoteConnection(): %v", res.err)
+			}
+			res.conn.Close()
+			if res.bnd != stable {
+				t.Errorf("connection goes to %s which turned inactive during the dial, want %s", res.bnd.addr, stableAddr)
+			}
+		})
+	}
+}
+
+// deadAddr returns a loopback address which refuses connections.
+func deadAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func TestDialRetryNextBackend(t *testing.T) {
+	dead, live := deadAddr(t), startBackend(t, echo)
+	stats := make(chan SessionStats, 1)
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Targets:      []string{dead, live},
+		Strategy:     roundRobinName,
+		DialRetries:  1,
+		OnDisconnect: func(s SessionStats) { stats <- s },
+	}}})
+	a := p.apps[0]
+	a.rmu.RLock()
+	deadBnd := a.backendByAddr(dead)
+	a.rmu.RUnlock()
+	// the dead backend passes selection until a health check notices it
+	deadBnd.active.Store(true)
+
+	for i := 0; i < 4; i++ {
+		exchange(t, p)
+		if s := <-stats; s.Backend.String() != live {
+			t.Errorf("connection %d went to %s, want %s", i, s.Backend, live)
+		}
+	}
+}
+
+// stallDialer dials in-memory echo connections like pipeDialer until stalled is set, then its dials hang
+// until their context is done.
+type stallDialer struct {
+	stalled atomic.Bool
+	dials   atomic.Int32
+}
+
+func (d *stallDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if !d.stalled.Load() {
+		return pipeDialer{}.DialContext(ctx, network, addr)
+	}
+	d.dials.Add(1)
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestSetupBudget(t *testing.T) {
+	const budget = 300 * time.Millisecond
+	dialer := &stallDialer{}
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Targets:     []string{"192.0.2.1:80", "192.0.2.2:80", "192.0.2.3:80"},
+		Dialer:      dialer,
+		DialRetries: 2,
+		SetupBudget: budget,
+	}}})
+	waitBackendsActive(t, p)
+	dialer.stalled.Store(true)
+
+	conn := dialProxy(t, p, 0)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("client of stalled backends reads data")
+	}
+	// without the budget every retry would take the whole dial timeout
+	if elapsed := time.Since(start); elapsed < budget || elapsed > budget+time.Second {
+		t.Errorf("client is closed after %s, want about the budget of %s", elapsed, budget)
+	}
+	if n := dialer.dials.Load(); n != 1 {
+		t.Errorf("%d dials within the budget, want only the first one which exhausts it", n)
+	}
+	// the backends aren't blamed for the exhausted budget of the client
+	a := p.apps[0]
+	a.rmu.RLock()
+	defer a.rmu.RUnlock()
+	for _, bnd := range a.bnds {
+		if !bnd.active.Load() || bnd.lastError.Load() != nil {
+			t.Errorf("backend %s is marked failed by the exhausted budget", bnd.addr)
+		}
+	}
+}
+
+func TestAvailabilityTransitionsLoggedOnce(t *testing.T) {
+	logger := &fakeLogger{}
+	p := startProxy(t, ProxyConfig{Logger: logger, Apps: []ConfigApp{{
+		Name:    "availability",
+		Targets: []string{startBackend(t, echo), startBackend(t, echo)},
+	}}})
+	waitBackendsActive(t, p)
+	a := p.apps[0]
+	a.rmu.RLock()
+	first, second := a.bnds[0], a.bnds[1]
+	a.rmu.RUnlock()
+	available := func() any { return appAvailable.Get("availability").(expvar.Func).Value() }
+
+	first.setActive(false)
+	if n := len(logger.find("all backends are down")); n != 0 {
+		t.Fatalf("%d down events while a backend is active", n)
+	}
+	second.setActive(false)
+	// repeated checks, e.g. after every failed dial, don't repeat the event
+	a.checkAvailability()
+	a.checkAvailability()
+	if n := len(logger.find("all backends are down")); n != 1 {
+		t.Errorf("%d down events, want 1", n)
+	}
+	if v := available(); v != 0 {
+		t.Errorf("availability gauge is %v while all backends are down, want 0", v)
+	}
+
+	first.setActive(true)
+	second.setActive(true)
+	a.checkAvailability()
+	if n := len(logger.find("backends recovered")); n != 1 {
+		t.Errorf("%d recovery events, want 1", n)
+	}
+	if v := available(); v != 1 {
+		t.Errorf("availability gauge is %v after recovery, want 1", v)
+	}
+}
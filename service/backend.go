@@ -2,57 +2,272 @@ package service
 
 import (
 	"context"
+	"crypto/tls"
 	"net"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/pkg/errors"
-	"github.com/rs/zerolog"
 )
 
 type backend struct {
-	ctx         context.Context
-	logger      *zerolog.Logger
-	addr        string
-	dialler     net.Dialer
-	active      atomic.Bool
+	ctx      context.Context
+	cancel   context.CancelFunc
+	logger   *proxyLogger
+	addr     string
+	host     string
+	dialer   Dialer
+	resolver resolver
+	checker  HealthChecker
+	active   atomic.Bool
+	removed  atomic.Bool
+	// draining is set when the backend is queued for draining or is being drained. It is changed under the application lock.
+	draining atomic.Bool
+	// maintenance is set by an operator to stop new connections to the backend while established ones finish.
+	// Unlike draining, it doesn't remove the backend and it is independent of health checks.
+	maintenance atomic.Bool
+	// activatedAt is the time (unix nanoseconds) of the last transition to the active state.
+	activatedAt atomic.Int64
+	// stateChangedAt is the time (unix nanoseconds) of the last transition of the active state. Zero if it never changed.
+	stateChangedAt atomic.Int64
+	// lastError is the last dial or probe error. It is nil if there was none.
+	lastError   atomic.Pointer[backendError]
 	rmu         sync.RWMutex
 	connections map[int]*Conn
+	// connCount is the size of connections. It is updated under rmu and read without locks.
+	connCount atomic.Int64
+	// metricKey is the identity of the backend and its key in metrics.
+	metricKey string
 
-	healthcheckInterval time.Duration
+	// weight and priority are guarded by the application lock.
+	weight   int
+	priority int
+
+	// healthcheckInterval is the period (nanoseconds) of active health checks. It can be changed at runtime.
+	healthcheckInterval atomic.Int64
+	// resolveRemoveAfter is the duration of sustained resolution failure after which the backend is removed.
+	// Zero disables auto-removal.
+	resolveRemoveAfter time.Duration
+	resolveFailedSince time.Time
+	// slowStart is the duration during which the selection weight of a newly active backend
+	// ramps up from slowStartMinFactor to full. Zero disables slow start.
+	slowStart time.Duration
+	outlier   *outlierDetector
+	// downReminder is the period of "still down" logs while health checks fail. Zero disables reminders.
+	downReminder time.Duration
+	// downSince and lastReminder are used only by the healthcheck goroutine.
+	downSince    time.Time
+	lastReminder time.Time
+	// keepAlive is the TCP keep-alive period of backend connections. Zero leaves Go defaults.
+	keepAlive time.Duration
+	// nagle enables Nagle's algorithm (disables TCP_NODELAY) on backend connections.
+	nagle bool
+	// connectTimeout bounds the whole connection setup: the dial and handshakes. Zero means only the dial timeout applies.
+	connectTimeout time.Duration
+	// firstByteTimeout is how long a new connection waits for the first byte from the backend. Zero disables waiting.
+	firstByteTimeout time.Duration
+	// onActiveChange is called after the active state changes. It is set by the application before the backend runs.
+	onActiveChange func()
+	// onRemove is called when the backend removes itself, e.g. after a sustained resolution failure.
+	// It is set by the application before the backend runs.
+	onRemove func()
+	// status receives backend up and down updates. It may be nil.
+	status  *statusNotifier
+	appName string
+	// pool keeps idle backend connections for reuse. It is nil if pooling is disabled.
+	pool *connPool
 }
 
 var _ connManager = (*backend)(nil)
 
-func newBackend(ctx context.Context, logger *zerolog.Logger, address string) (*backend, error) {
-	_, _, err := net.SplitHostPort(address)
+// backendError is a dial or probe error of a backend and its time.
+type backendError struct {
+	msg string
+	at  time.Time
+}
+
+// backendOptions contains optional backend settings.
+type backendOptions struct {
+	appName             string
+	status              *statusNotifier
+	dialer              Dialer
+	sourceAddr          string
+	fallbackDelay       time.Duration
+	dialKeepAlive       time.Duration
+	dialControl         func(network, address string, c syscall.RawConn) error
+	healthChecker       HealthChecker
+	healthcheckKind     string
+	healthcheckPath     string
+	healthcheckInterval time.Duration
+	resolveRemoveAfter  time.Duration
+	slowStart           time.Duration
+	outlierErrorRate    float64
+	outlierMinSessions  int
+	outlierEjectTime    time.Duration
+	outlierHalfOpen     bool
+	downReminder        time.Duration
+	keepAlive           time.Duration
+	nagle               bool
+	connectTimeout      time.Duration
+	firstByteTimeout    time.Duration
+	poolSize            int
+	poolMaxIdle         time.Duration
+	tlsConfig           *tls.Config
+}
+
+// withTLS returns the options with the TLS config overridden by the config of a backend if it is set.
+func (o backendOptions) withTLS(config *tls.Config) backendOptions {
+	if config != nil {
+		o.tlsConfig = config
+	}
+	return o
+}
+
+// Dialer creates backend connections. It is implemented by *net.Dialer. Custom dialers may return
+// connections of any net.Conn type, e.g. TLS connections.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+const (
+	dialTimeout                = 2 * time.Second
+	slowStartMinFactor         = 0.1
+	defaultHealthcheckInterval = 5 * time.Second
+)
+
+// resolver is implemented by *net.Resolver. It allows to substitute name resolution of backend hosts.
+type resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+var (
+	errNoRecords      = errors.New("backend hostname resolved to no addresses")
+	errConnectTimeout = errors.New("backend connection setup timed out")
+)
+
+func newBackend(ctx context.Context, logger *proxyLogger, address string, opts backendOptions) (*backend, error) {
+	host, _, err := net.SplitHostPort(address)
 	if err != nil {
 		return nil, errors.Wrap(err, "SplitHostPort()")
 	}
-	dialer := net.Dialer{
-		Timeout: 2 * time.Second,
+	localAddr, err := resolveSourceAddr(opts.sourceAddr)
+	if err != nil {
+		return nil, err
+	}
+	dialer := opts.dialer
+	switch {
+	case dialer != nil && localAddr != nil:
+		return nil, errors.New("source address can't be used with a custom dialer")
+	case dialer != nil && (opts.dialKeepAlive != 0 || opts.dialControl != nil):
+		return nil, errors.New("dial keep-alive and control can't be used with a custom dialer")
+	case dialer == nil:
+		// for dual-stack hostnames net.Dialer races the address families (Happy Eyeballs, RFC 6555):
+		// the fallback family starts after FallbackDelay, the first connected address wins
+		d := &net.Dialer{
+			Timeout:       dialTimeout,
+			FallbackDelay: opts.fallbackDelay,
+			KeepAlive:     opts.dialKeepAlive,
+			Control:       opts.dialControl,
+		}
+		if localAddr != nil {
+			d.LocalAddr = localAddr
+		}
+		dialer = d
+	}
+	if opts.tlsConfig != nil {
+		dialer = newTLSDialer(dialer, opts.tlsConfig, host)
+	}
+	checker := opts.healthChecker
+	if checker == nil {
+		checker, err = newHealthChecker(opts.healthcheckKind, opts.healthcheckPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "newHealthChecker()")
+		}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	b := &backend{
+		ctx:                ctx,
+		cancel:             cancel,
+		logger:             logger,
+		addr:               address,
+		host:               host,
+		dialer:             dialer,
+		resolver:           net.DefaultResolver,
+		checker:            checker,
+		connections:        make(map[int]*Conn),
+		weight:             1,
+		resolveRemoveAfter: opts.resolveRemoveAfter,
+		slowStart:          opts.slowStart,
+		outlier:            newOutlierDetector(opts.outlierErrorRate, opts.outlierMinSessions, opts.outlierEjectTime, opts.outlierHalfOpen),
+		downReminder:       opts.downReminder,
+		keepAlive:          opts.keepAlive,
+		nagle:              opts.nagle,
+		connectTimeout:     opts.connectTimeout,
+		firstByteTimeout:   opts.firstByteTimeout,
+		status:             opts.status,
+		appName:            opts.appName,
+		pool:               newConnPool(opts.poolSize, opts.poolMaxIdle),
+		metricKey:          opts.appName + "/" + address,
+	}
+	b.setHealthcheckInterval(opts.healthcheckInterval)
+	publishGauge(backendConnections, b.metricKey, &b.connCount)
+	return b, nil
+}
+
+// resolveSourceAddr resolves the local address backend connections originate from. Empty address returns nil.
+// IPv6 addresses may be bracketed like in "host:port" addresses.
+func resolveSourceAddr(addr string) (*net.TCPAddr, error) {
+	if addr == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(addr, "[") && strings.HasSuffix(addr, "]") {
+		addr = addr[1 : len(addr)-1]
+	}
+	localAddr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(addr, "0"))
+	if err != nil {
+		return nil, errors.Wrap(err, "ResolveTCPAddr() source address")
+	}
+	return localAddr, nil
+}
+
+// setWeight sets backend weight and priority. Weights less than 1 are treated as 1, weights above MaxWeight
+// as MaxWeight. It must be called under the application lock.
+func (b *backend) setWeight(weight, priority int) {
+	if weight < 1 {
+		weight = 1
+	}
+	if weight > MaxWeight {
+		weight = MaxWeight
 	}
-	return &backend{
-		ctx:                 ctx,
-		logger:              logger,
-		addr:                address,
-		dialler:             dialer,
-		connections:         make(map[int]*Conn),
-		healthcheckInterval: 5 * time.Second,
-	}, nil
+	b.weight = weight
+	b.priority = priority
 }
 
-// addConn adds connection to the connections map or closes this connection.
-func (b *backend) addConn(conn *Conn) {
+// setHealthcheckInterval sets the period of active health checks. Zero sets the default 5s.
+func (b *backend) setHealthcheckInterval(interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultHealthcheckInterval
+	}
+	b.healthcheckInterval.Store(int64(interval))
+}
+
+// addConn adds connection to the connections map. It returns false without adding if the backend is stopped.
+func (b *backend) addConn(conn *Conn) bool {
 	select {
 	case <-b.ctx.Done():
-		conn.Close()
+		return false
 	default:
 	}
 	b.rmu.Lock()
 	defer b.rmu.Unlock()
-	b.connections[conn.fd] = conn
+	if _, ok := b.connections[conn.id]; !ok {
+		b.connCount.Add(1)
+	}
+	b.connections[conn.id] = conn
+	return true
 }
 
 // delConn deletes connection from the connections map or does nothing.
@@ -64,14 +279,19 @@ func (b *backend) delConn(conn *Conn) {
 	}
 	b.rmu.Lock()
 	defer b.rmu.Unlock()
-	delete(b.connections, conn.fd)
+	if _, ok := b.connections[conn.id]; ok {
+		b.connCount.Add(-1)
+	}
+	delete(b.connections, conn.id)
 }
 
-// getConnCount returns connections count.
+// getConnCount returns connections count. It doesn't take the lock of connections.
 func (b *backend) getConnCount() int {
-	b.rmu.RLock()
-	defer b.rmu.RUnlock()
-	return len(b.connections)
+	return int(b.connCount.Load())
+}
+
+func (b *backend) identity() string {
+	return b.metricKey
 }
 
 // run is a blocking function. It starts runHealthcheck goroutine.
@@ -83,7 +303,10 @@ func (b *backend) run(wg *sync.WaitGroup) {
 
 	// waiting for the graceful shutdown. after this it closes connections
 	<-b.ctx.Done()
-	b.logger.Info().Str("backend", b.addr).Msg("closing connections")
+	b.logger.Info("closing connections", fields{"backend": b.addr})
+	if b.pool != nil {
+		b.pool.close()
+	}
 
 	b.rmu.RLock()
 	defer b.rmu.RUnlock()
@@ -95,16 +318,13 @@ func (b *backend) run(wg *sync.WaitGroup) {
 // runHealthcheck is blocking method. It is responsible for active health checks of the target backend.
 // It exits if backend ctx is done.
 func (b *backend) runHealthcheck() {
-	ticker := time.NewTicker(b.healthcheckInterval)
+	interval := time.Duration(b.healthcheckInterval.Load())
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
 	// First check right after run
-	netConn, err := b.dialler.DialContext(b.ctx, "tcp", b.addr)
-	if err != nil {
-		b.setActive(false)
-	} else {
-		netConn.Close()
-		b.setActive(true)
+	if !b.healthcheck() {
+		return
 	}
 
 	for {
@@ -112,31 +332,315 @@ func (b *backend) runHealthcheck() {
 		case <-b.ctx.Done():
 			return
 		case <-ticker.C:
-			netConn, err = b.dialler.DialContext(b.ctx, "tcp", b.addr)
-			if err != nil {
-				b.setActive(false)
-				continue
+			if !b.healthcheck() {
+				return
+			}
+			if b.pool != nil {
+				b.pool.expire()
+			}
+			if current := time.Duration(b.healthcheckInterval.Load()); current != interval {
+				interval = current
+				ticker.Reset(interval)
 			}
-			netConn.Close()
-			b.setActive(true)
 		}
 	}
 }
 
+// healthcheck probes the backend once and updates its active status.
+// It returns false if the backend has been removed and health checks must stop.
+func (b *backend) healthcheck() bool {
+	err := b.probe()
+	if b.outlier.probe(err == nil) {
+		b.logger.Info("backend circuit closed after successful probe", fields{"backend": b.addr})
+	}
+	if err == nil {
+		b.resolveFailedSince = time.Time{}
+		b.downSince = time.Time{}
+		b.setActive(true)
+		return true
+	}
+	b.recordError(err)
+	b.setActive(false)
+	b.remindDown(err)
+	if !errors.Is(err, errNoRecords) {
+		b.resolveFailedSince = time.Time{}
+		return true
+	}
+
+	if b.resolveFailedSince.IsZero() {
+		b.resolveFailedSince = time.Now()
+		b.logger.Warn("unable to resolve backend host", fields{"error": err, "backend": b.addr})
+	}
+	if b.resolveRemoveAfter > 0 && time.Since(b.resolveFailedSince) >= b.resolveRemoveAfter {
+		b.removed.Store(true)
+		b.logger.Error("backend removed after sustained resolution failure", fields{"error": err, "backend": b.addr, "after": b.resolveRemoveAfter})
+		if b.onRemove != nil {
+			b.onRemove()
+		}
+		return false
+	}
+	return true
+}
+
+// remindDown periodically logs that the backend is still down, so a long outage doesn't disappear
+// from operator awareness after the single status change log.
+func (b *backend) remindDown(err error) {
+	now := time.Now()
+	if b.downSince.IsZero() {
+		b.downSince = now
+		b.lastReminder = now
+		return
+	}
+	if b.downReminder <= 0 || now.Sub(b.lastReminder) < b.downReminder {
+		return
+	}
+	b.lastReminder = now
+	b.logger.Warn("backend is still down", fields{"error": err, "backend": b.addr, "down_for": now.Sub(b.downSince)})
+}
+
+// probe checks that the backend host resolves and passes the health check of its app.
+func (b *backend) probe() error {
+	if !isIPLiteral(b.host) {
+		ctx, cancel := context.WithTimeout(b.ctx, dialTimeout)
+		addrs, err := b.resolver.LookupIPAddr(ctx, b.host)
+		cancel()
+		if err != nil {
+			return classifyDialError(err)
+		}
+		if len(addrs) == 0 {
+			return errors.Wrap(errNoRecords, b.host)
+		}
+	}
+	ctx, cancel := context.WithTimeout(b.ctx, dialTimeout)
+	defer cancel()
+	return classifyDialError(b.checker.Check(ctx, b.dialer, b.addr))
+}
+
+// isIPLiteral reports whether the host of a backend address is an IP address, which needs no resolution.
+// IPv6 addresses may have a zone, e.g. "fe80::1%eth0".
+func isIPLiteral(host string) bool {
+	if i := strings.LastIndexByte(host, '%'); i >= 0 && strings.Contains(host[:i], ":") {
+		host = host[:i]
+	}
+	return net.ParseIP(host) != nil
+}
+
+// classifyDialError marks resolution failures with errNoRecords so they can be told apart from connection failures.
+func classifyDialError(err error) error {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return &noRecordsError{err: err}
+	}
+	return err
+}
+
+// noRecordsError is a resolution failure of a backend host. It matches errNoRecords and keeps the original error in the chain.
+type noRecordsError struct {
+	err error
+}
+
+func (e *noRecordsError) Error() string {
+	return errNoRecords.Error() + ": " + e.err.Error()
+}
+
+func (e *noRecordsError) Unwrap() error {
+	return e.err
+}
+
+func (e *noRecordsError) Is(target error) bool {
+	return target == errNoRecords
+}
+
 func (b *backend) setActive(t bool) {
 	if b.active.CompareAndSwap(!t, t) {
-		b.logger.Info().Str("backend", b.addr).Bool("active", t).Msg("changed active status")
+		now := time.Now().UnixNano()
+		b.stateChangedAt.Store(now)
+		if t {
+			b.activatedAt.Store(now)
+			b.status.send(StatusBackendUp, b.appName, b.addr)
+		} else {
+			b.status.send(StatusBackendDown, b.appName, b.addr)
+		}
+		b.logger.Info("changed active status", fields{"backend": b.addr, "active": t})
+		if b.onActiveChange != nil {
+			b.onActiveChange()
+		}
+	}
+}
+
+// recordError keeps the dial or probe error as the last error of the backend.
+func (b *backend) recordError(err error) {
+	b.lastError.Store(&backendError{msg: err.Error(), at: time.Now()})
+}
+
+// stateChangedTime returns the time of the last transition of the active state or zero time if it never changed.
+func (b *backend) stateChangedTime() time.Time {
+	if at := b.stateChangedAt.Load(); at != 0 {
+		return time.Unix(0, at)
+	}
+	return time.Time{}
+}
+
+// eligible reports whether the backend can be selected for new connections.
+func (b *backend) eligible() bool {
+	return b.active.Load() && !b.removed.Load() && !b.maintenance.Load() && !b.outlier.ejected()
+}
+
+// drain puts the backend into maintenance: it gets no new connections, established connections are untouched.
+func (b *backend) drain() {
+	if b.maintenance.CompareAndSwap(false, true) {
+		b.status.send(StatusDraining, b.appName, b.addr)
+		b.logger.Info("backend drained for maintenance", fields{"backend": b.addr, "connections": b.getConnCount()})
+	}
+}
+
+// undrain returns the backend from maintenance.
+func (b *backend) undrain() {
+	if b.maintenance.CompareAndSwap(true, false) {
+		b.logger.Info("backend undrained", fields{"backend": b.addr})
+	}
+}
+
+// skipReason returns why the backend isn't eligible for selection.
+func (b *backend) skipReason(tried bool) string {
+	switch {
+	case tried:
+		return "connection failed in this selection"
+	case b.removed.Load() && b.draining.Load():
+		return "draining"
+	case b.removed.Load():
+		return "removed"
+	case b.maintenance.Load():
+		return "maintenance"
+	case !b.active.Load():
+		return "inactive"
+	case b.outlier.ejected():
+		return "circuit " + b.outlier.state()
+	default:
+		return "eligible"
 	}
 }
 
-// createConn creates new net.Conn to the backend.
-func (b *backend) createConn() (net.Conn, error) {
-	conn, err := b.dialler.DialContext(b.ctx, "tcp", b.addr)
+// recordSession counts the result of a finished session for outlier detection.
+func (b *backend) recordSession(failed bool) {
+	if b.outlier.record(failed) {
+		b.logger.Warn("backend ejected as outlier", fields{"backend": b.addr, "eject_time": b.outlier.ejectTime})
+	}
+}
+
+// slowStartFactor returns the share (slowStartMinFactor..1) of the full selection weight
+// the backend has during its slow start window.
+func (b *backend) slowStartFactor() float64 {
+	if b.slowStart <= 0 {
+		return 1
+	}
+	elapsed := time.Since(time.Unix(0, b.activatedAt.Load()))
+	if elapsed >= b.slowStart {
+		return 1
+	}
+	return slowStartMinFactor + (1-slowStartMinFactor)*float64(elapsed)/float64(b.slowStart)
+}
+
+// createConn returns an idle pooled connection or dials a new one. The setup ends by the deadline if it isn't zero.
+func (b *backend) createConn(deadline time.Time) (net.Conn, error) {
+	if b.pool != nil {
+		if conn := b.pool.get(); conn != nil {
+			b.logger.Debug("reused remote connection", fields{"backend": b.addr, "connection": conn.LocalAddr().String()})
+			return conn, nil
+		}
+	}
+	ctx := b.ctx
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	budgetCtx := ctx
+	if b.connectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.connectTimeout)
+		defer cancel()
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+	dialStart := time.Now()
+	conn, err := b.dialer.DialContext(dialCtx, "tcp", b.addr)
 	if err != nil {
-		// passive healthcheck
-		b.setActive(false)
+		backendDialFailures.Add(b.metricKey, 1)
+		// passive healthcheck. the backend isn't blamed for the exhausted setup budget of the client
+		err = b.setupError(ctx, classifyDialError(err))
+		if budgetCtx.Err() == nil {
+			b.recordError(err)
+			b.setActive(false)
+		}
 		return nil, errors.Wrap(err, "Dial()")
 	}
-	b.logger.Debug().Str("backend", b.addr).Str("connection", conn.LocalAddr().String()).Msg("new remote connection")
+	backendDialLatency.with(b.metricKey).observe(time.Since(dialStart))
+	if err := b.setupConn(ctx, conn); err != nil {
+		conn.Close()
+		err = b.setupError(ctx, err)
+		if budgetCtx.Err() == nil {
+			b.recordError(err)
+		}
+		return nil, errors.Wrap(err, "setupConn()")
+	}
+	if b.firstByteTimeout > 0 {
+		timeout := b.firstByteTimeout
+		if !deadline.IsZero() && time.Until(deadline) < timeout {
+			timeout = time.Until(deadline)
+		}
+		fbConn, err := awaitFirstByte(conn, timeout)
+		if err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, "awaitFirstByte()")
+		}
+		conn = fbConn
+	}
+	b.logger.Debug("new remote connection", fields{"backend": b.addr, "connection": conn.LocalAddr().String()})
 	return conn, nil
 }
+
+// handshaker is implemented by connections with a handshake, e.g. *tls.Conn of TLS to backends or of a custom dialer.
+type handshaker interface {
+	HandshakeContext(ctx context.Context) error
+}
+
+// setupConn prepares a new backend connection for use. Handshakes are bounded by ctx.
+func (b *backend) setupConn(ctx context.Context, conn net.Conn) error {
+	if hs, ok := conn.(handshaker); ok {
+		start := time.Now()
+		if err := hs.HandshakeContext(ctx); err != nil {
+			return errors.Wrap(err, "Handshake()")
+		}
+		backendHandshakeLatency.with(b.metricKey).observe(time.Since(start))
+		if tc, ok := conn.(*tls.Conn); ok {
+			b.logger.Debug("backend TLS handshake completed", fields{"backend": b.addr, "alpn": tc.ConnectionState().NegotiatedProtocol})
+		}
+	}
+	if err := setKeepAlive(conn, b.keepAlive); err != nil {
+		b.logger.Warn("unable to set keep-alive", fields{"error": err, "backend": b.addr})
+	}
+	if b.nagle {
+		if err := setNoDelay(conn, false); err != nil {
+			b.logger.Warn("unable to enable Nagle's algorithm", fields{"error": err, "backend": b.addr})
+		}
+	}
+	return nil
+}
+
+// setupError marks err with errConnectTimeout if the connection setup timeout of ctx has expired.
+func (b *backend) setupError(ctx context.Context, err error) error {
+	if b.connectTimeout > 0 && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return errors.Wrapf(errConnectTimeout, "%s: %s", b.connectTimeout, err)
+	}
+	return err
+}
+
+// release returns the connection, which is not used by a session anymore, to the pool or closes it.
+func (b *backend) release(conn net.Conn) {
+	if b.pool != nil && conn.SetDeadline(time.Time{}) == nil && b.ctx.Err() == nil && b.pool.put(conn) {
+		b.logger.Debug("remote connection returned to pool", fields{"backend": b.addr, "connection": conn.LocalAddr().String()})
+		return
+	}
+	conn.Close()
+}
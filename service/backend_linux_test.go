@@ -0,0 +1,78 @@
+package service
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// blackholeListener listens on the IPv6 loopback port with a full accept queue, so new connections to it
+// aren't answered and their dials hang until a timeout.
+func blackholeListener(t *testing.T, port int) {
+	t.Helper()
+	fd, err := syscall.Socket(syscall.AF_INET6, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Skipf("IPv6 socket: %v", err)
+	}
+	t.Cleanup(func() { syscall.Close(fd) })
+	if err := syscall.Bind(fd, &syscall.SockaddrInet6{Port: port, Addr: [16]byte{15: 1}}); err != nil {
+		t.Skipf("bind IPv6 loopback: %v", err)
+	}
+	if err := syscall.Listen(fd, 0); err != nil {
+		t.Fatal(err)
+	}
+	addr := net.JoinHostPort("::1", strconv.Itoa(port))
+	for i := 0; ; i++ {
+		conn, err := net.DialTimeout("tcp", addr, 100*time.Millisecond)
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { conn.Close() })
+		if i == 10 {
+			t.Fatal("accept queue doesn't fill up")
+		}
+	}
+}
+
+func TestFallbackDelayUsesFastAddress(t *testing.T) {
+	const fallbackDelay = 50 * time.Millisecond
+	fast := startBackend(t, echo)
+	_, port, _ := net.SplitHostPort(fast)
+	p, _ := strconv.Atoi(port)
+	blackholeListener(t, p)
+	dns := &dnsStub{v4: net.ParseIP("127.0.0.1"), v6: net.IPv6loopback}
+	resolver := &net.Resolver{PreferGo: true, Dial: dns.dial}
+	// the loopback IPv6 address is sorted first (RFC 6724), so it is the primary address family
+	addrs, err := resolver.LookupIPAddr(context.Background(), "dual.test")
+	if err != nil || len(addrs) != 2 || addrs[0].IP.To4() != nil {
+		t.Fatalf("stub resolves %v, %v, want IPv6 and IPv4 addresses", addrs, err)
+	}
+
+	stats := make(chan SessionStats, 1)
+	proxy := newTestProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Targets:       []string{net.JoinHostPort("dual.test", port)},
+		FallbackDelay: fallbackDelay,
+		OnDisconnect:  func(s SessionStats) { stats <- s },
+	}}})
+	bnd := proxy.apps[0].bnds[0]
+	bnd.resolver = resolver
+	bnd.dialer.(*net.Dialer).Resolver = resolver
+	runProxy(t, proxy)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := proxy.WaitReady(ctx); err != nil {
+		t.Fatalf("WaitReady(): %v", err)
+	}
+
+	start := time.Now()
+	exchange(t, proxy)
+	if elapsed := time.Since(start); elapsed < fallbackDelay || elapsed > dialTimeout/2 {
+		t.Errorf("exchange took %s, want the fallback delay %s and no dial timeout", elapsed, fallbackDelay)
+	}
+	if s := <-stats; s.Backend.String() != fast {
+		t.Errorf("backend connection goes to %s, want %s", s.Backend, fast)
+	}
+}
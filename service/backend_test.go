@@ -0,0 +1,314 @@
+package service
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// stubResolver resolves hosts from its map. Unknown hosts aren't found.
+type stubResolver struct {
+	mu    sync.Mutex
+	hosts map[string][]net.IPAddr
+}
+
+func (r *stubResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	addrs, ok := r.hosts[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+func (r *stubResolver) set(host string, addrs ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.hosts == nil {
+		r.hosts = make(map[string][]net.IPAddr)
+	}
+	ipAddrs := make([]net.IPAddr, 0, len(addrs))
+	for _, addr := range addrs {
+		ipAddrs = append(ipAddrs, net.IPAddr{IP: net.ParseIP(addr)})
+	}
+	r.hosts[host] = ipAddrs
+}
+
+func TestClassifyDialError(t *testing.T) {
+	dnsErr := &net.DNSError{Err: "no such host", Name: "backend.test", IsNotFound: true}
+	err := classifyDialError(errors.Wrap(dnsErr, "dial"))
+	if !errors.Is(err, errNoRecords) {
+		t.Error("resolution failure doesn't match errNoRecords")
+	}
+	var found *net.DNSError
+	if !errors.As(err, &found) || found != dnsErr {
+		t.Error("resolution failure lost the original error")
+	}
+
+	refused := errors.New("connection refused")
+	if err := classifyDialError(refused); err != refused {
+		t.Errorf("connection failure is classified as %v", err)
+	}
+}
+
+func TestResolveFailureRemovesBackend(t *testing.T) {
+	healthy := startBackend(t, echo)
+	_, port, _ := net.SplitHostPort(healthy)
+	p := newTestProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Targets:             []string{healthy, net.JoinHostPort("backend.test", port)},
+		HealthcheckInterval: 10 * time.Millisecond,
+		ResolveRemoveAfter:  50 * time.Millisecond,
+	}}})
+	a := p.apps[0]
+	removed := a.bnds[1]
+	removed.resolver = &stubResolver{}
+	runProxy(t, p)
+
+	if !waitFor(t, time.Second, func() bool { return removed.ctx.Err() != nil }) {
+		t.Fatal("backend which doesn't resolve isn't stopped")
+	}
+	if last := removed.lastError.Load(); last == nil {
+		t.Error("resolution failure isn't recorded")
+	}
+	if stats := a.Stats(); len(stats.Backends) != 1 || stats.Backends[0].Addr != healthy {
+		t.Errorf("stats have backends %+v", stats.Backends)
+	}
+}
+
+func TestDownReminder(t *testing.T) {
+	for reminder, want := range map[time.Duration][2]int{
+		100 * time.Millisecond: {3, 6},
+		0:                      {0, 0},
+	} {
+		logger := &fakeLogger{}
+		p := newTestProxy(t, ProxyConfig{
+			Logger: logger,
+			Apps: []ConfigApp{{
+				Targets:             []string{deadAddr(t)},
+				HealthcheckInterval: 10 * time.Millisecond,
+				DownReminder:        reminder,
+			}},
+		})
+		runProxy(t, p)
+		time.Sleep(550 * time.Millisecond)
+		p.cancel()
+		if n := len(logger.find("backend is still down")); n < want[0] || n > want[1] {
+			t.Errorf("%d reminders in 550ms with DownReminder %s, want %d..%d", n, reminder, want[0], want[1])
+		}
+	}
+}
+
+// pipeDialer dials in-memory connections served by echo.
+type pipeDialer struct{}
+
+func (pipeDialer) DialContext(context.Context, string, string) (net.Conn, error) {
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		echo(server)
+	}()
+	return client, nil
+}
+
+func TestNonTCPBackendConn(t *testing.T) {
+	stats := make(chan SessionStats, 1)
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Targets:      []string{"192.0.2.1:80"},
+		Dialer:       pipeDialer{},
+		KeepAlive:    time.Second,
+		Nagle:        true,
+		OnDisconnect: func(s SessionStats) { stats <- s },
+	}}})
+	for i := 0; i < 3; i++ {
+		exchange(t, p)
+		if s := <-stats; s.BytesIn != 4 || s.BytesOut != 4 {
+			t.Errorf("pipe backend pair copied %d/%d bytes, want 4/4", s.BytesIn, s.BytesOut)
+		}
+	}
+}
+
+func TestSourceAddr(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("only Linux routes the whole 127.0.0.0/8 to loopback")
+	}
+	const source = "127.0.0.2"
+	peers := make(chan string, 16)
+	target := startBackend(t, func(conn net.Conn) {
+		host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		peers <- host
+		echo(conn)
+	})
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Targets:    []string{target},
+		SourceAddr: source,
+	}}})
+
+	// both the health check and the client connection originate from the source address
+	exchange(t, p)
+	for i := 0; i < 2; i++ {
+		if peer := <-peers; peer != source {
+			t.Errorf("backend connection %d comes from %s, want %s", i, peer, source)
+		}
+	}
+
+	logger := zerolog.Nop()
+	if _, err := NewProxy(context.Background(), &logger, ProxyConfig{Apps: []ConfigApp{{
+		Name:       "test",
+		Ports:      []int{0},
+		Targets:    []string{target},
+		SourceAddr: "no.such.host.invalid",
+	}}}); err == nil {
+		t.Error("unresolvable source address is accepted")
+	}
+}
+
+// dnsStub answers A and AAAA queries for any name with its addresses over stream connections.
+type dnsStub struct {
+	v4, v6 net.IP
+}
+
+// dial is the Dial function of net.Resolver. Every query gets an answer over an in-memory stream connection.
+func (s *dnsStub) dial(context.Context, string, string) (net.Conn, error) {
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		for {
+			var size [2]byte
+			if _, err := io.ReadFull(server, size[:]); err != nil {
+				return
+			}
+			query := make([]byte, binary.BigEndian.Uint16(size[:]))
+			if _, err := io.ReadFull(server, query); err != nil {
+				return
+			}
+			resp := s.answer(query)
+			if _, err := server.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...)); err != nil {
+				return
+			}
+		}
+	}()
+	return client, nil
+}
+
+// answer builds the response to the query with a single question.
+func (s *dnsStub) answer(query []byte) []byte {
+	end := 12
+	for query[end] != 0 {
+		end += int(query[end]) + 1
+	}
+	end += 5
+	qtype := binary.BigEndian.Uint16(query[end-4:])
+	ip := s.v4.To4()
+	if qtype == 28 {
+		ip = s.v6.To16()
+	}
+	// the header with the query ID, the response, recursion desired and available flags, one question and answer
+	resp := append([]byte(nil), query[:2]...)
+	resp = append(resp, 0x81, 0x80, 0, 1, 0, 1, 0, 0, 0, 0)
+	resp = append(resp, query[12:end]...)
+	// the answer refers to the name of the question
+	resp = append(resp, 0xc0, 12)
+	resp = binary.BigEndian.AppendUint16(resp, qtype)
+	resp = append(resp, 0, 1, 0, 0, 0, 60)
+	resp = binary.BigEndian.AppendUint16(resp, uint16(len(ip)))
+	return append(resp, ip...)
+}
+
+func TestDialControl(t *testing.T) {
+	backend := startBackend(t, echo)
+	var calls atomic.Int32
+	var fail atomic.Bool
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Targets: []string{backend},
+		DialControl: func(network, address string, c syscall.RawConn) error {
+			if address != backend {
+				t.Errorf("DialControl is called for %s %s, want %s", network, address, backend)
+			}
+			calls.Add(1)
+			if fail.Load() {
+				return errors.New("control failed")
+			}
+			return nil
+		},
+	}}})
+	// the first health check
+	if n := calls.Load(); n != 1 {
+		t.Errorf("DialControl is called %d times by the health check, want 1", n)
+	}
+	exchange(t, p)
+	if n := calls.Load(); n != 2 {
+		t.Errorf("DialControl is called %d times after a connection, want 2", n)
+	}
+
+	fail.Store(true)
+	conn := dialProxy(t, p, 0)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("ping"))
+	if n, _ := io.ReadFull(conn, make([]byte, 4)); n != 0 {
+		t.Error("connection is proxied after DialControl failed")
+	}
+
+	logger := zerolog.Nop()
+	if _, err := NewProxy(context.Background(), &logger, ProxyConfig{Apps: []ConfigApp{{
+		Name:        "test",
+		Ports:       []int{0},
+		Targets:     []string{backend},
+		Dialer:      pipeDialer{},
+		DialControl: func(string, string, syscall.RawConn) error { return nil },
+	}}}); err == nil {
+		t.Error("DialControl is accepted along with Dialer")
+	}
+}
+
+func TestIPv6Backend(t *testing.T) {
+	if ln, err := net.Listen("tcp", "[::1]:0"); err != nil {
+		t.Skipf("IPv6 loopback: %v", err)
+	} else {
+		ln.Close()
+	}
+	backend := startBackendOn(t, "[::1]:0", echo)
+	stats := make(chan SessionStats, 1)
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Targets:      []string{backend, deadAddr(t)},
+		Strategy:     srcHashName,
+		SourceAddr:   "[::1]",
+		OnDisconnect: func(s SessionStats) { stats <- s },
+	}}})
+	a := p.apps[0]
+	a.rmu.RLock()
+	bnd := a.backendByAddr(backend)
+	a.rmu.RUnlock()
+	if !bnd.active.Load() {
+		t.Fatalf("health check of %s fails: %v", backend, bnd.lastError.Load())
+	}
+	// the dead backend is inactive, so every client is hashed to the IPv6 one
+	for i := 0; i < 3; i++ {
+		exchange(t, p)
+		if s := <-stats; s.Backend.String() != backend {
+			t.Errorf("connection went to %s, want %s", s.Backend, backend)
+		}
+	}
+
+	for host, want := range map[string]bool{
+		"::1":          true,
+		"fe80::1%eth0": true,
+		"127.0.0.1":    true,
+		"localhost":    false,
+		"host%eth0":    false,
+	} {
+		if got := isIPLiteral(host); got != want {
+			t.Errorf("isIPLiteral(%q) = %t, want %t", host, got, want)
+		}
+	}
+}
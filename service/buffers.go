@@ -0,0 +1,64 @@
+package service
+
+import (
+	"sync"
+)
+
+// bufferPool provides copy buffers. Every copy direction holds its buffer for the lifetime of the connection.
+type bufferPool interface {
+	get() *[]byte
+	put(buf *[]byte)
+}
+
+// newBufferPool returns the pool of buffers of the size. Zero arena means sync.Pool, otherwise a bufferArena
+// of arena buffers.
+func newBufferPool(size, arena int) bufferPool {
+	if arena > 0 {
+		return &bufferArena{size: size, free: make(chan *[]byte, arena)}
+	}
+	return &syncBufferPool{pool: sync.Pool{
+		New: func() any {
+			b := make([]byte, size)
+			return &b
+		},
+	}}
+}
+
+// syncBufferPool is a bufferPool backed by sync.Pool. Idle buffers are released on garbage collections,
+// so churning connections may reallocate them.
+type syncBufferPool struct {
+	pool sync.Pool
+}
+
+func (p *syncBufferPool) get() *[]byte {
+	return p.pool.Get().(*[]byte)
+}
+
+func (p *syncBufferPool) put(buf *[]byte) {
+	p.pool.Put(buf)
+}
+
+// bufferArena is a bounded bufferPool which keeps up to cap(free) idle buffers for the lifetime of the proxy,
+// they aren't released on garbage collections. Buffers are allocated when the arena is empty, buffers returned
+// to a full arena are left to GC.
+type bufferArena struct {
+	size int
+	free chan *[]byte
+}
+
+func (a *bufferArena) get() *[]byte {
+	select {
+	case buf := <-a.free:
+		return buf
+	default:
+		b := make([]byte, a.size)
+		return &b
+	}
+}
+
+func (a *bufferArena) put(buf *[]byte) {
+	select {
+	case a.free <- buf:
+	default:
+	}
+}
@@ -0,0 +1,51 @@
+package service
+
+import (
+	"runtime"
+	"testing"
+)
+
+// longLivedConns is the number of connections which hold their copy buffers, two per connection.
+const longLivedConns = 1000
+
+// cycleBuffers takes the buffers of longLivedConns connections from the pool, lets garbage collections
+// run while they are held and returns them, like a wave of connections which live across GC cycles.
+func cycleBuffers(pool bufferPool, held []*[]byte) {
+	for i := range held {
+		held[i] = pool.get()
+	}
+	runtime.GC()
+	for _, buf := range held {
+		pool.put(buf)
+	}
+	// idle buffers survive the victim cache of sync.Pool only for one more cycle
+	runtime.GC()
+	runtime.GC()
+}
+
+func BenchmarkBufferPoolLongLived(b *testing.B) {
+	for name, arena := range map[string]int{"sync.Pool": 0, "arena": 2 * longLivedConns} {
+		b.Run(name, func(b *testing.B) {
+			pool := newBufferPool(defaultBufferSize, arena)
+			held := make([]*[]byte, 2*longLivedConns)
+			cycleBuffers(pool, held)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				cycleBuffers(pool, held)
+			}
+		})
+	}
+}
+
+func TestBufferArenaKeepsBuffers(t *testing.T) {
+	pool := newBufferPool(defaultBufferSize, 2*longLivedConns)
+	held := make([]*[]byte, 2*longLivedConns)
+	cycleBuffers(pool, held)
+	if allocs := testing.AllocsPerRun(3, func() { cycleBuffers(pool, held) }); allocs > 0 {
+		t.Errorf("arena of %d buffers allocates %.0f times per wave of %d connections", len(held), allocs, longLivedConns)
+	}
+	if buf := pool.get(); len(*buf) != defaultBufferSize {
+		t.Errorf("buffer length is %d, want %d", len(*buf), defaultBufferSize)
+	}
+}
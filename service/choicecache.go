@@ -0,0 +1,82 @@
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+// maxCachedChoices is the max number of clients in the choice cache. Expired entries are swept when it is reached,
+// if all entries are fresh, new choices aren't cached.
+const maxCachedChoices = 65536
+
+// choiceCache remembers the last successful backend choice per client IP for a short TTL,
+// so bursts of short connections from the same client skip backend selection.
+// A sliding cache keeps client affinity: every connection through the cached backend restarts its TTL.
+type choiceCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	sliding bool
+	entries map[string]cachedChoice
+}
+
+type cachedChoice struct {
+	bnd     *backend
+	expires time.Time
+}
+
+// newChoiceCache returns a choice cache or nil if ttl isn't positive.
+func newChoiceCache(ttl time.Duration, sliding bool) *choiceCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &choiceCache{
+		ttl:     ttl,
+		sliding: sliding,
+		entries: make(map[string]cachedChoice),
+	}
+}
+
+// get returns the cached backend of the client or nil if there is no fresh choice.
+func (c *choiceCache) get(clientIP string) *backend {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	choice, ok := c.entries[clientIP]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(choice.expires) {
+		delete(c.entries, clientIP)
+		return nil
+	}
+	return choice.bnd
+}
+
+// touch restarts the TTL of the cached choice of the client if the cache is sliding and the choice is still bnd.
+func (c *choiceCache) touch(clientIP string, bnd *backend) {
+	if !c.sliding {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if choice, ok := c.entries[clientIP]; ok && choice.bnd == bnd {
+		c.entries[clientIP] = cachedChoice{bnd: bnd, expires: time.Now().Add(c.ttl)}
+	}
+}
+
+// set caches the backend choice of the client for the TTL.
+func (c *choiceCache) set(clientIP string, bnd *backend) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if _, ok := c.entries[clientIP]; !ok && len(c.entries) >= maxCachedChoices {
+		for ip, choice := range c.entries {
+			if now.After(choice.expires) {
+				delete(c.entries, ip)
+			}
+		}
+		if len(c.entries) >= maxCachedChoices {
+			return
+		}
+	}
+	c.entries[clientIP] = cachedChoice{bnd: bnd, expires: now.Add(c.ttl)}
+}
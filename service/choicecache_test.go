@@ -0,0 +1,83 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestChoiceCacheTTL(t *testing.T) {
+	const ttl = 200 * time.Millisecond
+	first, second := startBackend(t, echo), startBackend(t, echo)
+	stats := make(chan SessionStats, 1)
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Targets:        []string{first, second},
+		Strategy:       roundRobinName,
+		ChoiceCacheTTL: ttl,
+		OnDisconnect:   func(s SessionStats) { stats <- s },
+	}}})
+	waitBackendsActive(t, p)
+	selections := selectionLatency.with(roundRobinName)
+	before := selections.count.Load()
+
+	// round robin alternates, the cached choice repeats
+	for i := 0; i < 3; i++ {
+		exchange(t, p)
+		if s := <-stats; s.Backend.String() != first {
+			t.Errorf("connection %d within the TTL went to %s, want cached %s", i, s.Backend, first)
+		}
+	}
+	if n := selections.count.Load() - before; n != 1 {
+		t.Errorf("%d selections within the TTL, want 1", n)
+	}
+
+	time.Sleep(ttl + 50*time.Millisecond)
+	exchange(t, p)
+	if s := <-stats; s.Backend.String() != second {
+		t.Errorf("connection after the TTL went to %s, want reselected %s", s.Backend, second)
+	}
+}
+
+func TestAffinityTTL(t *testing.T) {
+	const ttl = 200 * time.Millisecond
+	first, second := startBackend(t, echo), startBackend(t, echo)
+	stats := make(chan SessionStats, 1)
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Targets:      []string{first, second},
+		Strategy:     roundRobinName,
+		AffinityTTL:  ttl,
+		OnDisconnect: func(s SessionStats) { stats <- s },
+	}}})
+	waitBackendsActive(t, p)
+
+	// every connection restarts the TTL, so the client sticks for longer than one TTL
+	for i := 0; i < 4; i++ {
+		exchange(t, p)
+		if s := <-stats; s.Backend.String() != first {
+			t.Errorf("connection %d within the TTL went to %s, want %s", i, s.Backend, first)
+		}
+		time.Sleep(ttl / 2)
+	}
+
+	time.Sleep(ttl + 50*time.Millisecond)
+	exchange(t, p)
+	if s := <-stats; s.Backend.String() != second {
+		t.Errorf("connection after the TTL went to %s, want rebalanced %s", s.Backend, second)
+	}
+}
+
+func TestAffinityWithChoiceCache(t *testing.T) {
+	logger := zerolog.Nop()
+	_, err := NewProxy(context.Background(), &logger, ProxyConfig{Apps: []ConfigApp{{
+		Name:           "test",
+		Ports:          []int{0},
+		Targets:        []string{"127.0.0.1:1"},
+		ChoiceCacheTTL: time.Second,
+		AffinityTTL:    time.Second,
+	}}})
+	if err == nil {
+		t.Error("proxy with ChoiceCacheTTL and AffinityTTL is created")
+	}
+}
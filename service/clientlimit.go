@@ -0,0 +1,70 @@
+package service
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// clientCounter limits the number of simultaneous connections per client IP.
+// Connections are counted even without a limit, so the limit can be changed at runtime.
+type clientCounter struct {
+	// limit is the max number of connections per IP. Zero means unlimited.
+	limit  atomic.Int64
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func newClientCounter(limit int) *clientCounter {
+	c := &clientCounter{
+		counts: make(map[string]int),
+	}
+	c.setLimit(limit)
+	return c
+}
+
+// setLimit sets the max number of connections per IP. Zero means unlimited.
+func (c *clientCounter) setLimit(limit int) {
+	c.limit.Store(int64(limit))
+}
+
+// acquire counts a new connection of the IP. It returns false if the IP reached the limit.
+func (c *clientCounter) acquire(ip string) bool {
+	limit := int(c.limit.Load())
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if limit > 0 && c.counts[ip] >= limit {
+		return false
+	}
+	c.counts[ip]++
+	return true
+}
+
+// release uncounts a closed connection of the IP.
+func (c *clientCounter) release(ip string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts[ip] <= 1 {
+		delete(c.counts, ip)
+		return
+	}
+	c.counts[ip]--
+}
+
+// logThrottle allows a log message at most once per period and counts suppressed ones.
+type logThrottle struct {
+	period     time.Duration
+	last       atomic.Int64
+	suppressed atomic.Int64
+}
+
+// allow reports whether the message may be logged now and returns the number of messages suppressed since the last one.
+func (t *logThrottle) allow() (bool, int64) {
+	now := time.Now().UnixNano()
+	last := t.last.Load()
+	if now-last < int64(t.period) || !t.last.CompareAndSwap(last, now) {
+		t.suppressed.Add(1)
+		return false, 0
+	}
+	return true, t.suppressed.Swap(0)
+}
@@ -0,0 +1,107 @@
+package service
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// Causes of the end of a session. Close reasons of sessions match one of them with errors.Is.
+var (
+	ErrClientClosed  = errors.New("client closed connection")
+	ErrBackendClosed = errors.New("backend closed connection")
+	ErrTimeout       = errors.New("connection timed out")
+	ErrClosedByProxy = errors.New("connection closed by proxy")
+	ErrShutdown      = errors.New("proxy is shutting down")
+)
+
+// CopyError is the classified reason of the end of a session.
+type CopyError struct {
+	// Cause is one of ErrClientClosed, ErrBackendClosed, ErrTimeout, ErrClosedByProxy and ErrShutdown.
+	Cause error
+	// Err is the original error of copying. It is nil if a peer closed its side cleanly or the proxy closed the session
+	// without a copy error.
+	Err error
+}
+
+func (e *CopyError) Error() string {
+	if e.Err == nil {
+		return e.Cause.Error()
+	}
+	return e.Cause.Error() + ": " + e.Err.Error()
+}
+
+func (e *CopyError) Unwrap() error {
+	return e.Err
+}
+
+func (e *CopyError) Is(target error) bool {
+	return target == e.Cause
+}
+
+// sideError is a copy error tagged with the side of the copy it happened on. The tag tells failed reads
+// from failed writes even if the error itself doesn't, e.g. errors of splice(2) or of wrapped writers.
+type sideError struct {
+	err   error
+	write bool
+}
+
+func (e *sideError) Error() string {
+	return e.err.Error()
+}
+
+func (e *sideError) Unwrap() error {
+	return e.err
+}
+
+// readError tags err as an error of reading from the source. nil and io.EOF are returned as is.
+func readError(err error) error {
+	if err == nil || err == io.EOF {
+		return err
+	}
+	return &sideError{err: err}
+}
+
+// writeError tags err as an error of writing to the destination. nil is returned as is.
+func writeError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &sideError{err: err, write: true}
+}
+
+// failedWrite reports whether err happened writing to the destination. Untagged errors are judged by their operation.
+func failedWrite(err error) bool {
+	var sideErr *sideError
+	if errors.As(err, &sideErr) {
+		return sideErr.write
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "write"
+}
+
+// classifyCopyError classifies the result of copying from the backend (fromRemote) or from the client.
+// ctx is the parent context of the session, sessCtx is the context of the session.
+func classifyCopyError(ctx, sessCtx context.Context, err error, fromRemote bool) *CopyError {
+	var cause error
+	switch {
+	case ctx.Err() != nil:
+		cause = ErrShutdown
+	case sessCtx.Err() != nil:
+		cause = ErrClosedByProxy
+	case errors.Is(err, errSlowTransfer):
+		cause = ErrClosedByProxy
+	case errors.Is(err, errStuckWrite), errors.Is(err, errIdleRead), errors.Is(err, os.ErrDeadlineExceeded), errors.Is(err, syscall.ETIMEDOUT):
+		cause = ErrTimeout
+	// a failed write is caused by the destination, anything else by the source
+	case fromRemote != failedWrite(err):
+		cause = ErrBackendClosed
+	default:
+		cause = ErrClientClosed
+	}
+	return &CopyError{Cause: cause, Err: err}
+}
@@ -0,0 +1,127 @@
+package service
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// reset closes the connection with RST instead of FIN.
+func reset(conn net.Conn) {
+	conn.(*net.TCPConn).SetLinger(0)
+	conn.Close()
+}
+
+func TestCloseReason(t *testing.T) {
+	scenarios := []struct {
+		name    string
+		backend func(conn net.Conn)
+		client  func(conn net.Conn)
+		want    error
+	}{
+		{
+			name:    "client closes",
+			backend: echo,
+			client: func(conn net.Conn) {
+				conn.Write([]byte("ping"))
+				conn.(*net.TCPConn).CloseWrite()
+				io.Copy(io.Discard, conn)
+			},
+			want: ErrClientClosed,
+		},
+		{
+			name:    "backend closes",
+			backend: func(conn net.Conn) {},
+			client: func(conn net.Conn) {
+				io.Copy(io.Discard, conn)
+			},
+			want: ErrBackendClosed,
+		},
+		{
+			// writes to the reset client fail, the backend isn't to blame
+			name: "client resets during download",
+			backend: func(conn net.Conn) {
+				buf := make([]byte, 64<<10)
+				for {
+					if _, err := conn.Write(buf); err != nil {
+						return
+					}
+				}
+			},
+			client: func(conn net.Conn) {
+				io.ReadFull(conn, make([]byte, 1<<10))
+				reset(conn)
+			},
+			want: ErrClientClosed,
+		},
+		{
+			// writes to the reset backend fail, the client isn't to blame
+			name: "backend resets during upload",
+			backend: func(conn net.Conn) {
+				io.ReadFull(conn, make([]byte, 1<<10))
+				reset(conn)
+			},
+			client: func(conn net.Conn) {
+				buf := make([]byte, 64<<10)
+				for {
+					if _, err := conn.Write(buf); err != nil {
+						return
+					}
+				}
+			},
+			want: ErrBackendClosed,
+		},
+	}
+	for _, splice := range []bool{true, false} {
+		for _, sc := range scenarios {
+			sc := sc
+			name := sc.name + "/buffered"
+			if splice {
+				name = sc.name + "/splice"
+			}
+			t.Run(name, func(t *testing.T) {
+				stats := make(chan SessionStats, 1)
+				app := ConfigApp{
+					Targets:      []string{startBackend(t, sc.backend)},
+					OnDisconnect: func(s SessionStats) { stats <- s },
+				}
+				if !splice {
+					// a read timeout wraps the connection, so data is copied through a buffer
+					app.ClientReadTimeout = time.Hour
+					app.BackendReadTimeout = time.Hour
+				}
+				p := startProxy(t, ProxyConfig{Apps: []ConfigApp{app}})
+				conn := dialProxy(t, p, 0)
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				sc.client(conn)
+				select {
+				case s := <-stats:
+					if !errors.Is(s.Reason, sc.want) {
+						t.Errorf("reason is %v, want %v", s.Reason, sc.want)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("session didn't finish")
+				}
+			})
+		}
+	}
+}
+
+func TestFailedWrite(t *testing.T) {
+	readErr := &net.OpError{Op: "readfrom", Err: errors.New("broken pipe")}
+	if failedWrite(readErr) {
+		t.Error("untagged readfrom error is a write error")
+	}
+	if !failedWrite(writeError(readErr)) {
+		t.Error("tagged write error isn't a write error")
+	}
+	if failedWrite(readError(&net.OpError{Op: "write"})) {
+		t.Error("tagged read error is a write error")
+	}
+	if readError(io.EOF) != io.EOF {
+		t.Error("EOF is tagged")
+	}
+}
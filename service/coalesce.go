@@ -0,0 +1,81 @@
+package service
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// defaultCoalesceDelay is the flush delay of coalesced writes if only the buffer size is set.
+const defaultCoalesceDelay = time.Millisecond
+
+// coalescingWriter buffers small writes and writes them at once when the buffer fills or the delay
+// since the first buffered byte passes. It trades a little latency for fewer write syscalls of chatty protocols.
+// Errors of delayed flushes are returned by the next Write or flush.
+type coalescingWriter struct {
+	mu    sync.Mutex
+	w     io.Writer
+	buf   []byte
+	delay time.Duration
+	timer *time.Timer
+	err   error
+}
+
+func newCoalescingWriter(w io.Writer, size int, delay time.Duration) *coalescingWriter {
+	if delay <= 0 {
+		delay = defaultCoalesceDelay
+	}
+	cw := &coalescingWriter{
+		w:     w,
+		buf:   make([]byte, 0, size),
+		delay: delay,
+	}
+	cw.timer = time.AfterFunc(delay, func() {
+		cw.mu.Lock()
+		defer cw.mu.Unlock()
+		cw.flushLocked()
+	})
+	cw.timer.Stop()
+	return cw
+}
+
+func (cw *coalescingWriter) Write(p []byte) (int, error) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	if len(cw.buf)+len(p) > cap(cw.buf) {
+		if err := cw.flushLocked(); err != nil {
+			return 0, err
+		}
+		// writes which don't fit into the buffer aren't delayed
+		if len(p) >= cap(cw.buf) {
+			n, err := cw.w.Write(p)
+			cw.err = err
+			return n, err
+		}
+	}
+	if len(cw.buf) == 0 {
+		cw.timer.Reset(cw.delay)
+	}
+	cw.buf = append(cw.buf, p...)
+	return len(p), nil
+}
+
+// flush writes buffered data and stops the delayed flush. It must be called when copying ends.
+func (cw *coalescingWriter) flush() error {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	return cw.flushLocked()
+}
+
+func (cw *coalescingWriter) flushLocked() error {
+	cw.timer.Stop()
+	if cw.err != nil || len(cw.buf) == 0 {
+		return cw.err
+	}
+	_, cw.err = cw.w.Write(cw.buf)
+	cw.buf = cw.buf[:0]
+	return cw.err
+}
@@ -0,0 +1,121 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordWriter records writes and their data.
+type recordWriter struct {
+	mu     sync.Mutex
+	writes int
+	data   bytes.Buffer
+}
+
+func (w *recordWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.writes++
+	return w.data.Write(p)
+}
+
+func (w *recordWriter) result() (int, string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.writes, w.data.String()
+}
+
+func TestCoalescingWriter(t *testing.T) {
+	rec := &recordWriter{}
+	cw := newCoalescingWriter(rec, 100, time.Hour)
+	var want bytes.Buffer
+	for i := 0; i < 50; i++ {
+		chunk := []byte{byte('a' + i%26), byte('a' + i%26)}
+		cw.Write(chunk)
+		want.Write(chunk)
+	}
+	// a write which doesn't fit into the buffer goes out right after the buffered data
+	large := bytes.Repeat([]byte("L"), 150)
+	cw.Write(large)
+	want.Write(large)
+	cw.Write([]byte("tail"))
+	want.WriteString("tail")
+	if err := cw.flush(); err != nil {
+		t.Fatalf("flush(): %v", err)
+	}
+	writes, data := rec.result()
+	if data != want.String() {
+		t.Errorf("written data is %q, want %q", data, want.String())
+	}
+	// 100 bytes of small writes, the large write and the tail
+	if writes != 3 {
+		t.Errorf("51 writes and a flush make %d writes, want 3", writes)
+	}
+}
+
+func TestCoalescingWriterDelay(t *testing.T) {
+	const delay = 20 * time.Millisecond
+	rec := &recordWriter{}
+	cw := newCoalescingWriter(rec, 1024, delay)
+	defer cw.flush()
+	cw.Write([]byte("ping"))
+	if writes, _ := rec.result(); writes != 0 {
+		t.Fatal("small write isn't delayed")
+	}
+	if !waitFor(t, time.Second, func() bool { _, data := rec.result(); return data == "ping" }) {
+		t.Fatalf("buffered data isn't flushed after the delay %s", delay)
+	}
+}
+
+func TestCopyCoalesced(t *testing.T) {
+	const total, chunk = 64 * 1024, 16
+	f := copyFrontend(defaultBufferSize)
+	f.coalesceSize = 4096
+	f.coalesceDelay = time.Millisecond
+	src, client := net.Pipe()
+	dst, sink := net.Pipe()
+	recorder := &writeSizeConn{Conn: dst}
+	go func() {
+		data := make([]byte, chunk)
+		for sent := 0; sent < total; sent += chunk {
+			client.Write(data)
+		}
+		client.Close()
+	}()
+	received := make(chan int, 1)
+	go func() {
+		n, _ := io.Copy(io.Discard, sink)
+		received <- int(n)
+	}()
+	written, err := f.copyData(context.Background(), newConn(recorder, nil), newConn(src, nil), 0, nil)
+	if err != nil {
+		t.Fatalf("copyData(): %v", err)
+	}
+	dst.Close()
+	if n := <-received; written != total || n != total {
+		t.Errorf("copied %d bytes and received %d, want %d", written, n, total)
+	}
+	if len(recorder.sizes) > total/chunk/10 {
+		t.Errorf("%d writes of %d-byte reads, want coalesced", len(recorder.sizes), chunk)
+	}
+}
+
+func BenchmarkCoalescing(b *testing.B) {
+	const chunk = 64
+	for name, size := range map[string]int{"off": 0, "4KB": 4096} {
+		b.Run(name, func(b *testing.B) {
+			f := copyFrontend(defaultBufferSize)
+			f.coalesceSize = size
+			b.SetBytes(chunk)
+			b.ReportAllocs()
+			src, client := net.Pipe()
+			b.ResetTimer()
+			copyThroughPipes(b, f, src, client, b.N*chunk, chunk)
+		})
+	}
+}
@@ -2,28 +2,65 @@ package service
 
 import (
 	"net"
-	"reflect"
 	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
 )
 
+// connManager tracks connections of a frontend or a backend.
 type connManager interface {
-	addConn(*Conn)
+	// addConn tracks the connection. It returns false without tracking if the manager is stopped.
+	addConn(*Conn) bool
 	delConn(*Conn)
+	// getConnCount returns the number of tracked connections without locking.
+	getConnCount() int
+	// identity returns "app/address" of the manager, which is unique within the proxy.
+	identity() string
 }
 
 type Conn struct {
 	net.Conn
-	fd      int
+	// id is the unique id of the connection within the process. It doesn't depend on the net.Conn type.
+	id      int
 	closed  atomic.Bool
 	manager connManager
+	created time.Time
+	session *session
+	peer    *Conn
+	// clientAddr is the original client address received in the PROXY protocol header. It may be nil.
+	clientAddr net.Addr
+	// origDst is the original destination of a transparently proxied connection. It may be nil.
+	origDst net.Addr
 }
 
+var errOriginalDstUnsupported = errors.New("original destination isn't supported on this platform")
+
+// connIDs is the last assigned connection id.
+var connIDs atomic.Int64
+
 func newConn(conn net.Conn, manager connManager) *Conn {
 	return &Conn{
 		Conn:    conn,
-		fd:      fdFromConn(conn),
+		id:      int(connIDs.Add(1)),
 		manager: manager,
+		created: time.Now(),
+	}
+}
+
+// Peer returns the other side of the proxied pair: the backend connection for an incoming connection
+// and vice versa. It returns nil if the connection isn't paired yet.
+func (c *Conn) Peer() *Conn {
+	return c.peer
+}
+
+// RemoteAddr returns the original client address if it was received in the PROXY protocol header,
+// otherwise the remote address of the connection.
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.clientAddr != nil {
+		return c.clientAddr
 	}
+	return c.Conn.RemoteAddr()
 }
 
 // Close closes net.Conn and prevents repeated connection close.
@@ -34,10 +71,46 @@ func (c *Conn) Close() error {
 	return nil
 }
 
-// fdFromConn extracts fd from net.Conn.
-func fdFromConn(conn net.Conn) int {
-	tcpConn := reflect.Indirect(reflect.ValueOf(conn)).FieldByName("conn")
-	fdVal := tcpConn.FieldByName("fd")
-	pfdVal := reflect.Indirect(fdVal).FieldByName("pfd")
-	return int(pfdVal.FieldByName("Sysfd").Int())
+// setKeepAlive enables TCP keep-alive with the period on TCP connections. Zero period leaves the connection as is.
+func setKeepAlive(conn net.Conn, period time.Duration) error {
+	if period <= 0 {
+		return nil
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if err := tcpConn.SetKeepAlive(true); err != nil {
+		return errors.Wrap(err, "SetKeepAlive()")
+	}
+	return errors.Wrap(tcpConn.SetKeepAlivePeriod(period), "SetKeepAlivePeriod()")
+}
+
+// setResetOnClose makes Close of TCP connections send RST instead of FIN (SO_LINGER with zero timeout),
+// unsent data is discarded and the connection doesn't enter TIME_WAIT.
+func setResetOnClose(conn net.Conn) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	return errors.Wrap(tcpConn.SetLinger(0), "SetLinger()")
+}
+
+// setNoDelay sets TCP_NODELAY on TCP connections. Go enables it by default, false enables Nagle's algorithm.
+func setNoDelay(conn net.Conn, noDelay bool) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	return errors.Wrap(tcpConn.SetNoDelay(noDelay), "SetNoDelay()")
+}
+
+// closeWrite shuts down the writing side of connections which support half-close (TCP and Unix sockets):
+// the peer reads all written data and then EOF.
+func closeWrite(conn net.Conn) error {
+	cw, ok := conn.(interface{ CloseWrite() error })
+	if !ok {
+		return errors.New("half-close isn't supported")
+	}
+	return errors.Wrap(cw.CloseWrite(), "CloseWrite()")
 }
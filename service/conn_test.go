@@ -0,0 +1,101 @@
+package service
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestConnPeer(t *testing.T) {
+	backend := startBackend(t, echo)
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{Targets: []string{backend}}}})
+	conn := openExchange(t, p)
+
+	sessions := p.fnds[0].sessions()
+	if len(sessions) != 1 {
+		t.Fatalf("%d sessions are open, want 1", len(sessions))
+	}
+	client, remote := sessions[0].client, sessions[0].remote
+	if client.Peer() != remote {
+		t.Error("peer of the client connection isn't the backend connection")
+	}
+	if remote.Peer() != client {
+		t.Error("peer of the backend connection isn't the client connection")
+	}
+	if client.RemoteAddr().String() != conn.LocalAddr().String() || remote.RemoteAddr().String() != backend {
+		t.Errorf("pair is %s - %s", client.RemoteAddr(), remote.RemoteAddr())
+	}
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	if peer := newConn(a, nil).Peer(); peer != nil {
+		t.Error("unpaired connection has a peer")
+	}
+}
+
+func TestResetOnClose(t *testing.T) {
+	// readErr returns the error of a read from the connection closed by the proxy
+	readErr := func(conn net.Conn) error {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := conn.Read(make([]byte, 1))
+		return err
+	}
+	for _, reset := range []bool{false, true} {
+		want := io.EOF
+		if reset {
+			want = syscall.ECONNRESET
+		}
+		denied := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+			Targets:      []string{startBackend(t, echo)},
+			Deny:         []string{"127.0.0.0/8"},
+			ResetOnClose: reset,
+		}}})
+		// the reset may fail the dial itself
+		conn, err := net.DialTimeout("tcp", denied.ListenAddrs()[0].String(), time.Second)
+		if err == nil {
+			err = readErr(conn)
+			conn.Close()
+		}
+		if !errors.Is(err, want) {
+			t.Errorf("rejected client with ResetOnClose %t reads %v, want %v", reset, err, want)
+		}
+
+		backendErrs := make(chan error, 1)
+		p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+			Targets: []string{startBackend(t, func(conn net.Conn) {
+				// health checks don't send data, only errors of proxied connections are reported
+				buf := make([]byte, 4)
+				for proxied := false; ; proxied = true {
+					n, err := conn.Read(buf)
+					if err != nil {
+						if proxied {
+							backendErrs <- err
+						}
+						return
+					}
+					conn.Write(buf[:n])
+				}
+			})},
+			ResetOnClose: reset,
+		}}})
+		conn = openExchange(t, p)
+		p.fnds[0].sessions()[0].close()
+		if err := readErr(conn); !errors.Is(err, want) {
+			t.Errorf("forcibly closed client with ResetOnClose %t reads %v, want %v", reset, err, want)
+		}
+		if err := <-backendErrs; !errors.Is(err, want) {
+			t.Errorf("forcibly closed backend with ResetOnClose %t reads %v, want %v", reset, err, want)
+		}
+
+		// a clean end by the client is graceful
+		conn = openExchange(t, p)
+		conn.Close()
+		if err := <-backendErrs; err != io.EOF {
+			t.Errorf("backend of the closed client with ResetOnClose %t reads %v, want EOF", reset, err)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package service
+
+import (
+	"context"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	errStuckWrite = errors.New("write is stuck")
+	errIdleRead   = errors.New("no data received")
+)
+
+// copyData copies data from src to dst until EOF or an error. It returns the number of copied bytes.
+// If readTimeout is set, src must send data within readTimeout after the previous data, otherwise errIdleRead is returned.
+// Every write to dst must complete within writeTimeout if it is set, otherwise errStuckWrite is returned.
+// Writes to dst are split into chunks of at most maxWriteChunk bytes if it is set.
+// Small writes are coalesced if coalesceSize is set, buffered data is flushed before return.
+// The throughput is throttled until ctx is done by the connection limiter (if not nil) and the global limiter of the application.
+// If dumpBytes is set, the first dumpBytes bytes read from src are logged.
+// If minThroughput is set, copying fails with errSlowTransfer when src trickles data slower than that.
+// If there are no limits and the platform allows, data is moved between sockets by the kernel without user-space buffers.
+func (f *frontend) copyData(ctx context.Context, dst, src *Conn, readTimeout time.Duration, connLimiter *tokenBucket) (written int64, err error) {
+	var limiters []*tokenBucket
+	if connLimiter != nil {
+		limiters = append(limiters, connLimiter)
+	}
+	if f.app.limiter != nil {
+		limiters = append(limiters, f.app.limiter)
+	}
+
+	var r io.Reader = src
+	switch {
+	case src.session != nil && src == src.session.remote && src.session.bnd.pool != nil:
+		r = &settleReader{ctx: ctx, sess: src.session, timeout: readTimeout}
+	case readTimeout > 0:
+		r = &deadlineReader{ctx: ctx, conn: src, timeout: readTimeout}
+	}
+	if len(limiters) > 0 {
+		r = &limitedReader{ctx: ctx, r: r, limiters: limiters}
+	}
+	if f.dumpBytes > 0 {
+		dr := f.newDumpReader(r, dst, src)
+		defer dr.flush()
+		r = dr
+	}
+	if f.minThroughput > 0 {
+		tr := newThroughputReader(r, src, f.minThroughput, f.minThroughputWindow)
+		watchCtx, stopWatch := context.WithCancel(ctx)
+		defer stopWatch()
+		go tr.watch(watchCtx)
+		r = tr
+	}
+	var w io.Writer = dst
+	if f.writeTimeout > 0 {
+		w = &deadlineWriter{ctx: ctx, conn: dst, timeout: f.writeTimeout}
+	}
+	if f.maxWriteChunk > 0 {
+		w = &chunkedWriter{w: w, maxChunk: f.maxWriteChunk}
+	}
+	if f.coalesceSize > 0 {
+		cw := newCoalescingWriter(w, f.coalesceSize, f.coalesceDelay)
+		defer func() {
+			if flushErr := cw.flush(); err == nil {
+				err = writeError(flushErr)
+			}
+		}()
+		w = cw
+	}
+	if r == io.Reader(src) && w == io.Writer(dst) {
+		if ok, written, err := spliceData(dst, src); ok {
+			return written, err
+		}
+	}
+	// io.CopyBuffer doesn't tell which side failed, so errors are tagged by the side
+	r = sideReader{r}
+	w = sideWriter{w}
+
+	buf := f.bufPool.get()
+	defer f.bufPool.put(buf)
+	for {
+		n, err := io.CopyBuffer(w, r, *buf)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			return written, nil
+		}
+	}
+}
+
+// sideReader tags errors of reading from the source.
+type sideReader struct {
+	r io.Reader
+}
+
+func (sr sideReader) Read(p []byte) (int, error) {
+	n, err := sr.r.Read(p)
+	return n, readError(err)
+}
+
+// sideWriter tags errors of writing to the destination.
+type sideWriter struct {
+	w io.Writer
+}
+
+func (sw sideWriter) Write(p []byte) (int, error) {
+	n, err := sw.w.Write(p)
+	return n, writeError(err)
+}
+
+// newConnLimiter returns a token bucket for one direction of a connection or nil if throughput isn't limited.
+func (f *frontend) newConnLimiter() *tokenBucket {
+	rate := f.connRateLimit.Load()
+	if rate <= 0 {
+		return nil
+	}
+	return newTokenBucket(rate, rate)
+}
+
+// chunkedWriter splits every write into chunks of at most maxChunk bytes.
+// It controls packetization for downstream middleboxes sensitive to large bursts.
+type chunkedWriter struct {
+	w        io.Writer
+	maxChunk int
+}
+
+func (cw *chunkedWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > cw.maxChunk {
+			chunk = chunk[:cw.maxChunk]
+		}
+		n, err := cw.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// deadlineWriter is a watchdog of stuck writes. It sets the write deadline before every write,
+// so a write to a peer which doesn't read fails with errStuckWrite instead of blocking forever.
+// It doesn't write once ctx is done: the deadline it sets could override the expired deadline set by the session close.
+type deadlineWriter struct {
+	ctx     context.Context
+	conn    *Conn
+	timeout time.Duration
+}
+
+func (dw *deadlineWriter) Write(p []byte) (int, error) {
+	if err := dw.conn.SetWriteDeadline(time.Now().Add(dw.timeout)); err != nil {
+		return 0, errors.Wrap(err, "SetWriteDeadline()")
+	}
+	if err := dw.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := dw.conn.Write(p)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return n, errors.Wrapf(errStuckWrite, "no progress for %s", dw.timeout)
+	}
+	return n, err
+}
+
+// deadlineReader is an idle watchdog of one direction. It sets the read deadline before every read,
+// so a peer which sends nothing for timeout fails the read with errIdleRead.
+// Like deadlineWriter, it doesn't read once ctx is done.
+type deadlineReader struct {
+	ctx     context.Context
+	conn    *Conn
+	timeout time.Duration
+}
+
+func (dr *deadlineReader) Read(p []byte) (int, error) {
+	if err := dr.conn.SetReadDeadline(time.Now().Add(dr.timeout)); err != nil {
+		return 0, errors.Wrap(err, "SetReadDeadline()")
+	}
+	if err := dr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := dr.conn.Read(p)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return n, errors.Wrapf(errIdleRead, "no data for %s", dr.timeout)
+	}
+	return n, err
+}
@@ -0,0 +1,294 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// readSizeConn records the largest buffer passed to Read.
+type readSizeConn struct {
+	net.Conn
+	maxRead int
+}
+
+func (c *readSizeConn) Read(p []byte) (int, error) {
+	if len(p) > c.maxRead {
+		c.maxRead = len(p)
+	}
+	return c.Conn.Read(p)
+}
+
+// copyFrontend returns a frontend which only copies data with buffers of the size.
+func copyFrontend(size int) *frontend {
+	return &frontend{app: &application{}, bufPool: newBufferPool(size, 0)}
+}
+
+// copyThroughPipes copies total bytes written in chunks of chunk bytes from src to dst through in-memory pipes,
+// so the copy buffer is always used, and returns the number of copied bytes.
+func copyThroughPipes(tb testing.TB, f *frontend, src net.Conn, client net.Conn, total, chunk int) int64 {
+	tb.Helper()
+	dst, sink := net.Pipe()
+	go func() {
+		data := make([]byte, chunk)
+		for sent := 0; sent < total; sent += chunk {
+			if _, err := client.Write(data); err != nil {
+				break
+			}
+		}
+		client.Close()
+	}()
+	go io.Copy(io.Discard, sink)
+	written, err := f.copyData(context.Background(), newConn(dst, nil), newConn(src, nil), 0, nil)
+	if err != nil {
+		tb.Fatalf("copyData(): %v", err)
+	}
+	dst.Close()
+	return written
+}
+
+func BenchmarkCopy(b *testing.B) {
+	const chunk = 64 * 1024
+	for name, size := range map[string]int{"4KB": 4 * 1024, "64KB": 64 * 1024} {
+		b.Run(name, func(b *testing.B) {
+			f := copyFrontend(size)
+			b.SetBytes(chunk)
+			b.ReportAllocs()
+			src, client := net.Pipe()
+			b.ResetTimer()
+			copyThroughPipes(b, f, src, client, b.N*chunk, chunk)
+		})
+	}
+}
+
+func TestCopyBufferSize(t *testing.T) {
+	for _, size := range []int{minBufferSize, defaultBufferSize, 64 * 1024} {
+		src, client := net.Pipe()
+		recorder := &readSizeConn{Conn: src}
+		if n := copyThroughPipes(t, copyFrontend(size), recorder, client, 256*1024, 32*1024); n != 256*1024 {
+			t.Errorf("copied %d bytes, want %d", n, 256*1024)
+		}
+		if recorder.maxRead != size {
+			t.Errorf("copy with buffers of %d bytes reads up to %d bytes", size, recorder.maxRead)
+		}
+	}
+}
+
+func TestConfigBufferSize(t *testing.T) {
+	logger := zerolog.Nop()
+	for configured, want := range map[int]int{0: defaultBufferSize, 64 * 1024: 64 * 1024} {
+		p := newTestProxy(t, ProxyConfig{
+			BufferSize: configured,
+			Apps:       []ConfigApp{{Targets: []string{"127.0.0.1:1"}}},
+		})
+		if buf := p.fnds[0].bufPool.get(); len(*buf) != want {
+			t.Errorf("buffers of BufferSize %d are %d bytes, want %d", configured, len(*buf), want)
+		}
+	}
+	if _, err := NewProxy(context.Background(), &logger, ProxyConfig{BufferSize: minBufferSize - 1}); err == nil {
+		t.Errorf("buffer size below %d is accepted", minBufferSize)
+	}
+}
+
+// writeSizeConn records the sizes of writes.
+type writeSizeConn struct {
+	net.Conn
+	sizes []int
+}
+
+func (c *writeSizeConn) Write(p []byte) (int, error) {
+	c.sizes = append(c.sizes, len(p))
+	return c.Conn.Write(p)
+}
+
+func TestCopyWriteChunks(t *testing.T) {
+	const maxChunk, total = 1000, 100_000
+	f := copyFrontend(64 * 1024)
+	f.maxWriteChunk = maxChunk
+	src, client := net.Pipe()
+	dst, sink := net.Pipe()
+	recorder := &writeSizeConn{Conn: dst}
+	go func() {
+		client.Write(make([]byte, total))
+		client.Close()
+	}()
+	received := make(chan int64, 1)
+	go func() {
+		n, _ := io.Copy(io.Discard, sink)
+		received <- n
+	}()
+	written, err := f.copyData(context.Background(), newConn(recorder, nil), newConn(src, nil), 0, nil)
+	if err != nil {
+		t.Fatalf("copyData(): %v", err)
+	}
+	dst.Close()
+	if n := <-received; written != total || n != total {
+		t.Errorf("copied %d bytes and received %d, want %d", written, n, total)
+	}
+	largest := 0
+	for _, size := range recorder.sizes {
+		if size > largest {
+			largest = size
+		}
+	}
+	if largest != maxChunk {
+		t.Errorf("largest write is %d bytes, want %d", largest, maxChunk)
+	}
+}
+
+// noCloseConn is a connection whose Close doesn't interrupt blocked calls, only deadlines do.
+type noCloseConn struct {
+	net.Conn
+}
+
+func (noCloseConn) Close() error { return nil }
+
+// stuckDialer dials in-memory connections to a backend which neither reads nor writes.
+type stuckDialer struct {
+	mu      sync.Mutex
+	servers []net.Conn
+}
+
+func (d *stuckDialer) DialContext(context.Context, string, string) (net.Conn, error) {
+	client, server := net.Pipe()
+	d.mu.Lock()
+	d.servers = append(d.servers, server)
+	d.mu.Unlock()
+	return noCloseConn{client}, nil
+}
+
+func (d *stuckDialer) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, conn := range d.servers {
+		conn.Close()
+	}
+}
+
+func TestCloseUnblocksCopiers(t *testing.T) {
+	dialer := &stuckDialer{}
+	t.Cleanup(dialer.close)
+	stats := make(chan SessionStats, 1)
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Targets: []string{"192.0.2.1:80"},
+		Dialer:  dialer,
+		// the timeouts would extend expired deadlines of the closed session
+		WriteTimeout:       time.Minute,
+		ClientReadTimeout:  time.Minute,
+		BackendReadTimeout: time.Minute,
+		OnDisconnect:       func(s SessionStats) { stats <- s },
+	}}})
+	conn := dialProxy(t, p, 0)
+	// the client copier is blocked in a write to the backend, the backend copier in a read from it
+	conn.Write(make([]byte, 1024))
+	fnd := p.fnds[0]
+	if !waitFor(t, 5*time.Second, func() bool { return len(fnd.sessions()) == 1 }) {
+		t.Fatal("session isn't started")
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	fnd.sessions()[0].close()
+	select {
+	case <-stats:
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("copiers exit %s after the close", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("copiers don't exit after the close")
+	}
+}
+
+func TestCopyCancelledDoesntBlock(t *testing.T) {
+	f := copyFrontend(1024)
+	f.writeTimeout = time.Minute
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, readTimeout := range []time.Duration{0, time.Minute} {
+		src, client := net.Pipe()
+		dst, sink := net.Pipe()
+		go client.Write([]byte("ping"))
+		done := make(chan error, 1)
+		go func() {
+			// nobody reads sink, a write to dst blocks until its deadline
+			_, err := f.copyData(ctx, newConn(dst, nil), newConn(src, nil), readTimeout, nil)
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("cancelled copy with read timeout %s fails with %v, want %v", readTimeout, err, context.Canceled)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("cancelled copy with read timeout %s blocks", readTimeout)
+		}
+		for _, conn := range []net.Conn{src, client, dst, sink} {
+			conn.Close()
+		}
+	}
+}
+
+func TestReadTimeoutsPerDirection(t *testing.T) {
+	const (
+		short = 150 * time.Millisecond
+		tick  = 30 * time.Millisecond
+	)
+	// talk writes a byte every tick until the connection fails
+	talk := func(conn net.Conn) {
+		for {
+			if _, err := conn.Write([]byte{0}); err != nil {
+				return
+			}
+			time.Sleep(tick)
+		}
+	}
+	for _, tc := range []struct {
+		name         string
+		client       time.Duration
+		backend      time.Duration
+		backendTalks bool
+		clientTalks  bool
+	}{
+		{name: "silent client", client: short, backend: time.Hour, backendTalks: true},
+		{name: "silent backend", client: time.Hour, backend: short, clientTalks: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			stats := make(chan SessionStats, 1)
+			p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+				Targets: []string{startBackend(t, func(conn net.Conn) {
+					if tc.backendTalks {
+						go talk(conn)
+					}
+					io.Copy(io.Discard, conn)
+				})},
+				ClientReadTimeout:  tc.client,
+				BackendReadTimeout: tc.backend,
+				OnDisconnect:       func(s SessionStats) { stats <- s },
+			}}})
+			conn := dialProxy(t, p, 0)
+			if tc.clientTalks {
+				go talk(conn)
+			}
+			go io.Copy(io.Discard, conn)
+
+			select {
+			case s := <-stats:
+				if !errors.Is(s.Reason, ErrTimeout) || !errors.Is(s.Reason, errIdleRead) {
+					t.Fatalf("reason is %v, want idle %v", s.Reason, ErrTimeout)
+				}
+				// the other direction keeps flowing, so only the timeout of the silent side fires
+				if s.Duration < short || s.Duration > short+time.Second {
+					t.Errorf("silent side is closed after %s, want %s", s.Duration, short)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("silent side isn't closed")
+			}
+		})
+	}
+}
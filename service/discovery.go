@@ -0,0 +1,198 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Discovery is an external source of application backends (service registry, DNS, etc.).
+type Discovery interface {
+	// Watch blocks until ctx is done. It sends the complete current backend set to updates
+	// every time the set changes, or an error if the set can't be obtained.
+	Watch(ctx context.Context, updates chan<- DiscoveryUpdate)
+}
+
+// DiscoveryUpdate is a complete backend set or an error of discovery.
+type DiscoveryUpdate struct {
+	Backends []DiscoveredBackend
+	Err      error
+}
+
+// MaxWeight is the max backend weight. Every unit of weight adds points to the hash ring of hash strategies,
+// so weights are bounded. Bigger weights of discovered backends, e.g. SRV weights, are treated as MaxWeight.
+const MaxWeight = 1000
+
+// DiscoveredBackend describes a discovered backend.
+type DiscoveredBackend struct {
+	Addr string
+	// Weight is a relative weight of the backend within its priority tier. Values less than 1 are treated as 1,
+	// values above MaxWeight as MaxWeight.
+	Weight int
+	// Priority is the backend tier. Backends with higher priority values get connections only
+	// if there are no available backends with lower values.
+	Priority int
+	// TLS overrides the TLS config of the app for this backend. It is applied when the backend is added.
+	TLS *tls.Config
+}
+
+// srvResolver is implemented by *net.Resolver.
+type srvResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// SRVDiscovery discovers backends by DNS SRV record. SRV priority and weight are mapped
+// to backend priority tiers and weights.
+type SRVDiscovery struct {
+	name     string
+	interval time.Duration
+	resolver srvResolver
+}
+
+var _ Discovery = (*SRVDiscovery)(nil)
+
+const defaultSRVInterval = 30 * time.Second
+
+// NewSRVDiscovery creates a discovery which resolves SRV record name (e.g. "_db._tcp.example.com")
+// every interval. Default interval is 30s.
+func NewSRVDiscovery(name string, interval time.Duration) *SRVDiscovery {
+	if interval <= 0 {
+		interval = defaultSRVInterval
+	}
+	return &SRVDiscovery{
+		name:     name,
+		interval: interval,
+		resolver: net.DefaultResolver,
+	}
+}
+
+// Watch resolves the SRV record right away and then every interval. It sends only changed backend sets.
+func (d *SRVDiscovery) Watch(ctx context.Context, updates chan<- DiscoveryUpdate) {
+	watchLookup(ctx, d.interval, d.lookup, updates)
+}
+
+// watchLookup calls lookup right away and then every interval until ctx is done. It sends only changed backend sets
+// and all errors.
+func watchLookup(ctx context.Context, interval time.Duration, lookup func(context.Context) ([]DiscoveredBackend, error), updates chan<- DiscoveryUpdate) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var last []DiscoveredBackend
+	for {
+		bnds, err := lookup(ctx)
+		if err != nil || !reflect.DeepEqual(bnds, last) {
+			if err == nil {
+				last = bnds
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case updates <- DiscoveryUpdate{Backends: bnds, Err: err}:
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// lookup resolves the SRV record into a sorted backend set.
+func (d *SRVDiscovery) lookup(ctx context.Context) ([]DiscoveredBackend, error) {
+	_, srvs, err := d.resolver.LookupSRV(ctx, "", "", d.name)
+	if err != nil {
+		return nil, errors.Wrap(err, "LookupSRV()")
+	}
+	bnds := make([]DiscoveredBackend, 0, len(srvs))
+	for _, srv := range srvs {
+		host := strings.TrimSuffix(srv.Target, ".")
+		bnds = append(bnds, DiscoveredBackend{
+			Addr:     net.JoinHostPort(host, strconv.Itoa(int(srv.Port))),
+			Weight:   int(srv.Weight),
+			Priority: int(srv.Priority),
+		})
+	}
+	sort.Slice(bnds, func(i, j int) bool {
+		return bnds[i].Addr < bnds[j].Addr
+	})
+	return bnds, nil
+}
+
+// DNSDiscovery discovers backends by resolving hostnames of targets into IP addresses (A and AAAA records).
+// Every address becomes a separate backend with the port, weight and priority of its target,
+// so connections are balanced across all addresses. Targets with IP addresses are used as is.
+type DNSDiscovery struct {
+	targets  []DiscoveredBackend
+	interval time.Duration
+	resolver resolver
+}
+
+var _ Discovery = (*DNSDiscovery)(nil)
+
+// NewDNSDiscovery creates a discovery which resolves "host:port" targets every interval. Default interval is 30s.
+func NewDNSDiscovery(targets []DiscoveredBackend, interval time.Duration) *DNSDiscovery {
+	if interval <= 0 {
+		interval = defaultSRVInterval
+	}
+	return &DNSDiscovery{
+		targets:  targets,
+		interval: interval,
+		resolver: net.DefaultResolver,
+	}
+}
+
+// Watch resolves the targets right away and then every interval. It sends only changed backend sets.
+func (d *DNSDiscovery) Watch(ctx context.Context, updates chan<- DiscoveryUpdate) {
+	watchLookup(ctx, d.interval, d.lookup, updates)
+}
+
+// lookup resolves the targets into a sorted backend set. Every resolution is limited by the dial timeout.
+// If any target fails to resolve, the error is returned, so the current backends are kept.
+func (d *DNSDiscovery) lookup(ctx context.Context) ([]DiscoveredBackend, error) {
+	seen := make(map[string]bool)
+	var bnds []DiscoveredBackend
+	add := func(t DiscoveredBackend, addr string) {
+		if seen[addr] {
+			return
+		}
+		seen[addr] = true
+		t.Addr = addr
+		bnds = append(bnds, t)
+	}
+	for _, t := range d.targets {
+		host, port, err := net.SplitHostPort(t.Addr)
+		if err != nil {
+			return nil, errors.Wrap(err, "SplitHostPort()")
+		}
+		if isIPLiteral(host) {
+			add(t, t.Addr)
+			continue
+		}
+		lookupCtx, cancel := context.WithTimeout(ctx, dialTimeout)
+		addrs, err := d.resolver.LookupIPAddr(lookupCtx, host)
+		cancel()
+		if err != nil {
+			return nil, errors.Wrap(err, "LookupIPAddr()")
+		}
+		if len(addrs) == 0 {
+			return nil, errors.Wrap(errNoRecords, host)
+		}
+		for _, addr := range addrs {
+			// the zone of link-local IPv6 addresses is kept
+			add(t, net.JoinHostPort(addr.String(), port))
+		}
+	}
+	sort.Slice(bnds, func(i, j int) bool {
+		return bnds[i].Addr < bnds[j].Addr
+	})
+	return bnds, nil
+}
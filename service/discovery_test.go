@@ -0,0 +1,270 @@
+package service
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// stubSRVResolver answers every SRV lookup with its records.
+type stubSRVResolver struct {
+	mu   sync.Mutex
+	srvs []*net.SRV
+}
+
+func (r *stubSRVResolver) LookupSRV(_ context.Context, _, _, _ string) (string, []*net.SRV, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return "", r.srvs, nil
+}
+
+// srvRecord returns the SRV record of the backend address.
+func srvRecord(t *testing.T, addr string, weight uint16) *net.SRV {
+	t.Helper()
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := strconv.Atoi(port)
+	return &net.SRV{Target: host + ".", Port: uint16(p), Weight: weight}
+}
+
+// countBackends makes n connections through the proxy and returns the number of connections per backend.
+func countBackends(t *testing.T, p Proxy, stats <-chan SessionStats, n int) map[string]int {
+	t.Helper()
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		exchange(t, p)
+		s := <-stats
+		counts[s.Backend.String()]++
+	}
+	return counts
+}
+
+func TestSRVWeights(t *testing.T) {
+	light, heavy := startBackend(t, echo), startBackend(t, echo)
+	resolver := &stubSRVResolver{srvs: []*net.SRV{srvRecord(t, light, 1), srvRecord(t, heavy, 3)}}
+	stats := make(chan SessionStats, 1)
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Strategy:     "round_robin",
+		Discovery:    &SRVDiscovery{name: "_test._tcp.example.com", interval: time.Hour, resolver: resolver},
+		OnDisconnect: func(s SessionStats) { stats <- s },
+	}}})
+	waitBackendsActive(t, p)
+
+	counts := countBackends(t, p, stats, 8)
+	if counts[light] != 2 || counts[heavy] != 6 {
+		t.Errorf("connections are %d:%d with SRV weights 1:3, want 2:6", counts[light], counts[heavy])
+	}
+}
+
+func TestSRVWeightsIgnored(t *testing.T) {
+	resolver := &stubSRVResolver{srvs: []*net.SRV{
+		srvRecord(t, startBackend(t, echo), 1),
+		srvRecord(t, startBackend(t, echo), 3),
+	}}
+	logger := &fakeLogger{}
+	startProxy(t, ProxyConfig{
+		Logger: logger,
+		Apps: []ConfigApp{{
+			Discovery: &SRVDiscovery{name: "_test._tcp.example.com", interval: time.Hour, resolver: resolver},
+		}},
+	})
+	if warnings := logger.find("backend weights are ignored"); len(warnings) != 1 {
+		t.Errorf("%d warnings about ignored weights, want 1", len(warnings))
+	}
+}
+
+func TestStaticWeightsRejected(t *testing.T) {
+	logger := zerolog.Nop()
+	_, err := NewProxy(context.Background(), &logger, ProxyConfig{Apps: []ConfigApp{{
+		Name:     "test",
+		Strategy: "least_conn",
+		Backends: []ConfigBackend{{Addr: "127.0.0.1:1", Weight: 2}},
+	}}})
+	if err == nil {
+		t.Fatal("weights are accepted by a strategy which ignores them")
+	}
+}
+
+// fakeDiscovery passes updates sent to it to the watching app.
+type fakeDiscovery struct {
+	updates chan DiscoveryUpdate
+}
+
+func (d *fakeDiscovery) Watch(ctx context.Context, updates chan<- DiscoveryUpdate) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case u := <-d.updates:
+			updates <- u
+		}
+	}
+}
+
+// backendAddrs returns the sorted addresses of the app backends.
+func backendAddrs(a *application) []string {
+	var addrs []string
+	for _, bnd := range a.Stats().Backends {
+		addrs = append(addrs, bnd.Addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+func TestDiscoveryReconciles(t *testing.T) {
+	first, second := startBackend(t, echo), startBackend(t, echo)
+	discovery := &fakeDiscovery{updates: make(chan DiscoveryUpdate, 1)}
+	discovery.updates <- DiscoveryUpdate{Backends: []DiscoveredBackend{{Addr: first}}}
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{Discovery: discovery}}})
+	a := p.apps[0]
+
+	for _, step := range []struct {
+		update DiscoveryUpdate
+		want   []string
+	}{
+		{DiscoveryUpdate{Backends: []DiscoveredBackend{{Addr: first}, {Addr: second}}}, []string{first, second}},
+		{DiscoveryUpdate{Backends: []DiscoveredBackend{{Addr: second}}}, []string{second}},
+		// a failed discovery keeps the current set
+		{DiscoveryUpdate{Err: errors.New("registry unavailable")}, []string{second}},
+		{DiscoveryUpdate{Backends: []DiscoveredBackend{{Addr: first}}}, []string{first}},
+	} {
+		discovery.updates <- step.update
+		want := append([]string(nil), step.want...)
+		sort.Strings(want)
+		if !waitFor(t, time.Second, func() bool { return reflect.DeepEqual(backendAddrs(a), want) }) {
+			t.Fatalf("backends are %v after update %+v, want %v", backendAddrs(a), step.update, want)
+		}
+	}
+	// the backend added again is checked before it gets connections
+	if !waitFor(t, 5*time.Second, func() bool {
+		a.rmu.RLock()
+		defer a.rmu.RUnlock()
+		return a.backendByAddr(first).eligible()
+	}) {
+		t.Fatal("backend added again isn't active")
+	}
+	exchange(t, p)
+}
+
+func TestConcurrentDrainsLimited(t *testing.T) {
+	const maxDrains = 2
+	var removed []DiscoveredBackend
+	for i := 0; i < 4; i++ {
+		removed = append(removed, DiscoveredBackend{Addr: startBackend(t, echo)})
+	}
+	kept := DiscoveredBackend{Addr: startBackend(t, echo)}
+	discovery := &fakeDiscovery{updates: make(chan DiscoveryUpdate, 1)}
+	discovery.updates <- DiscoveryUpdate{Backends: append(append([]DiscoveredBackend(nil), removed...), kept)}
+	p := newTestProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Discovery:           discovery,
+		Strategy:            roundRobinName,
+		MaxConcurrentDrains: maxDrains,
+	}}})
+	a := p.apps[0]
+	a.drainPeriod = 10 * time.Millisecond
+	runProxy(t, p)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.WaitReady(ctx); err != nil {
+		t.Fatalf("WaitReady(): %v", err)
+	}
+
+	var bnds []*backend
+	if !waitFor(t, 5*time.Second, func() bool {
+		a.rmu.RLock()
+		defer a.rmu.RUnlock()
+		if len(a.bnds) != 5 {
+			return false
+		}
+		for _, bnd := range a.bnds {
+			if !bnd.eligible() {
+				return false
+			}
+		}
+		bnds = append([]*backend(nil), a.bnds[:4]...)
+		return true
+	}) {
+		t.Fatal("backends aren't active")
+	}
+	// every removed backend keeps a connection, so its drain lasts until the connection is closed
+	var clients []net.Conn
+	for i := 0; i < 4; i++ {
+		clients = append(clients, openExchange(t, p))
+	}
+	// draining counts the removed backends which are drained but not stopped yet
+	draining := func() (n, done int) {
+		for _, bnd := range bnds {
+			switch {
+			case bnd.ctx.Err() != nil:
+				done++
+			case bnd.removed.Load():
+				n++
+			}
+		}
+		return n, done
+	}
+
+	discovery.updates <- DiscoveryUpdate{Backends: []DiscoveredBackend{kept}}
+	if !waitFor(t, time.Second, func() bool { n, _ := draining(); return n == maxDrains }) {
+		t.Fatal("drains don't start")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n, _ := draining(); n != maxDrains {
+		t.Fatalf("%d backends are drained at once, want %d", n, maxDrains)
+	}
+	for _, conn := range clients {
+		conn.Close()
+		// a freed slot is taken by the next queued backend
+		time.Sleep(30 * time.Millisecond)
+		if n, _ := draining(); n > maxDrains {
+			t.Fatalf("%d backends are drained at once, limit is %d", n, maxDrains)
+		}
+	}
+	if !waitFor(t, time.Second, func() bool { _, done := draining(); return done == 4 }) {
+		t.Error("removed backends aren't stopped after their connections are closed")
+	}
+}
+
+func TestDNSDiscoveryTracksAddresses(t *testing.T) {
+	resolver := &stubResolver{}
+	resolver.set("backend.test", "127.0.0.2", "127.0.0.3")
+	discovery := NewDNSDiscovery([]DiscoveredBackend{{Addr: "backend.test:7000"}, {Addr: "127.0.0.9:7000"}}, 20*time.Millisecond)
+	discovery.resolver = resolver
+	// nothing listens on the addresses, the proxy runs without active backends
+	p := newTestProxy(t, ProxyConfig{Apps: []ConfigApp{{Discovery: discovery}}})
+	runProxy(t, p)
+	a := p.apps[0]
+
+	for _, step := range []struct {
+		addrs []string
+		want  []string
+	}{
+		{[]string{"127.0.0.2", "127.0.0.3"}, []string{"127.0.0.2:7000", "127.0.0.3:7000", "127.0.0.9:7000"}},
+		{[]string{"127.0.0.3", "127.0.0.4", "::1"}, []string{"127.0.0.3:7000", "127.0.0.4:7000", "127.0.0.9:7000", "[::1]:7000"}},
+		{[]string{"127.0.0.4"}, []string{"127.0.0.4:7000", "127.0.0.9:7000"}},
+	} {
+		resolver.set("backend.test", step.addrs...)
+		want := append([]string(nil), step.want...)
+		sort.Strings(want)
+		if !waitFor(t, time.Second, func() bool { return reflect.DeepEqual(backendAddrs(a), want) }) {
+			t.Fatalf("backends are %v after the host resolves to %v, want %v", backendAddrs(a), step.addrs, want)
+		}
+	}
+
+	// a host without records keeps the current set
+	resolver.set("backend.test")
+	time.Sleep(100 * time.Millisecond)
+	if got, want := backendAddrs(a), []string{"127.0.0.4:7000", "127.0.0.9:7000"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("backends are %v after the host lost its records, want %v", got, want)
+	}
+}
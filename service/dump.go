@@ -0,0 +1,60 @@
+package service
+
+import (
+	"encoding/hex"
+	"io"
+)
+
+// dumpReader passes data of r through unchanged and calls dump once with a copy of the first limit bytes
+// or less if reading ends earlier. Data after the first limit bytes isn't copied.
+type dumpReader struct {
+	r     io.Reader
+	limit int
+	buf   []byte
+	done  bool
+	dump  func(data []byte)
+}
+
+func (d *dumpReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	if !d.done {
+		take := d.limit - len(d.buf)
+		if take > n {
+			take = n
+		}
+		d.buf = append(d.buf, p[:take]...)
+		if len(d.buf) >= d.limit || err != nil {
+			d.flush()
+		}
+	}
+	return n, err
+}
+
+// flush dumps the collected bytes if they aren't dumped yet.
+func (d *dumpReader) flush() {
+	if d.done {
+		return
+	}
+	d.done = true
+	if len(d.buf) > 0 {
+		d.dump(d.buf)
+	}
+	d.buf = nil
+}
+
+// newDumpReader returns the reader which logs a hex/ASCII dump of the first dumpBytes bytes read from src.
+func (f *frontend) newDumpReader(r io.Reader, dst, src *Conn) *dumpReader {
+	return &dumpReader{
+		r:     r,
+		limit: f.dumpBytes,
+		dump: func(data []byte) {
+			f.logger.Info("first bytes of connection", fields{
+				"frontend": f.name(),
+				"from":     src.RemoteAddr().String(),
+				"to":       dst.RemoteAddr().String(),
+				"bytes":    len(data),
+				"dump":     hex.Dump(data),
+			})
+		},
+	}
+}
@@ -0,0 +1,70 @@
+package service
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDumpBytes(t *testing.T) {
+	const dumpBytes = 16
+	logger := &fakeLogger{}
+	stats := make(chan SessionStats, 1)
+	p := startProxy(t, ProxyConfig{
+		Logger: logger,
+		Apps: []ConfigApp{{
+			Targets:      []string{startBackend(t, echo)},
+			DumpBytes:    dumpBytes,
+			OnDisconnect: func(s SessionStats) { stats <- s },
+		}},
+	})
+	data := make([]byte, 100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	conn := dialProxy(t, p, 0)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// the dump spans several writes
+	for _, chunk := range [][]byte{data[:5], data[5:50], data[50:]} {
+		conn.Write(chunk)
+		time.Sleep(10 * time.Millisecond)
+	}
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("exchange: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("dumped data is changed")
+	}
+	conn.Close()
+	<-stats
+
+	events := logger.find("first bytes of connection")
+	if len(events) != 2 {
+		t.Fatalf("%d dumps, want one per direction", len(events))
+	}
+	for _, e := range events {
+		if e.fields["bytes"] != dumpBytes || e.fields["dump"] != hex.Dump(data[:dumpBytes]) {
+			t.Errorf("dump of %v bytes is\n%v", e.fields["bytes"], e.fields["dump"])
+		}
+	}
+}
+
+func TestDumpReaderShortRead(t *testing.T) {
+	var dumps [][]byte
+	r := &dumpReader{
+		r:     strings.NewReader("ping"),
+		limit: 16,
+		dump:  func(data []byte) { dumps = append(dumps, data) },
+	}
+	if data, err := io.ReadAll(r); err != nil || string(data) != "ping" {
+		t.Fatalf("read %q, %v", data, err)
+	}
+	r.flush()
+	if len(dumps) != 1 || string(dumps[0]) != "ping" {
+		t.Errorf("dumps of a short read are %q, want one of the whole data", dumps)
+	}
+}
@@ -0,0 +1,46 @@
+package service
+
+import (
+	"net"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var errNoFirstByte = errors.New("backend sent no data")
+
+// awaitFirstByte waits up to timeout for the first byte from a backend of a server-speaks-first protocol.
+// The returned connection replays the byte to its reader.
+func awaitFirstByte(conn net.Conn, timeout time.Duration) (net.Conn, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, errors.Wrap(err, "SetReadDeadline()")
+	}
+	first := make([]byte, 1)
+	if _, err := conn.Read(first); err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, errors.Wrapf(errNoFirstByte, "within %s", timeout)
+		}
+		return nil, err
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, errors.Wrap(err, "SetReadDeadline()")
+	}
+	return &firstByteConn{Conn: conn, first: first}, nil
+}
+
+// firstByteConn returns the byte read by awaitFirstByte before reading from the connection.
+// Data of such connections is copied through user-space buffers instead of splice.
+type firstByteConn struct {
+	net.Conn
+	first []byte
+}
+
+func (c *firstByteConn) Read(p []byte) (int, error) {
+	if len(c.first) > 0 && len(p) > 0 {
+		n := copy(p, c.first)
+		c.first = c.first[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
@@ -0,0 +1,49 @@
+package service
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFirstByteTimeoutSkipsSilentBackend(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	silent := startBackend(t, func(conn net.Conn) {
+		io.Copy(io.Discard, conn)
+	})
+	greeting := startBackend(t, func(conn net.Conn) {
+		conn.Write([]byte("hello"))
+		echo(conn)
+	})
+	stats := make(chan SessionStats, 1)
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Targets:          []string{silent, greeting},
+		Strategy:         roundRobinName,
+		DialRetries:      1,
+		FirstByteTimeout: timeout,
+		OnDisconnect:     func(s SessionStats) { stats <- s },
+	}}})
+
+	var slowest time.Duration
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		conn := dialProxy(t, p, 0)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		hello := make([]byte, 5)
+		if _, err := io.ReadFull(conn, hello); err != nil || string(hello) != "hello" {
+			t.Fatalf("connection %d gets greeting %q, %v", i, hello, err)
+		}
+		if elapsed := time.Since(start); elapsed > slowest {
+			slowest = elapsed
+		}
+		conn.Close()
+		if s := <-stats; s.Backend.String() != greeting {
+			t.Errorf("connection %d went to %s, want %s", i, s.Backend, greeting)
+		}
+	}
+	// one of the connections waited for the silent backend first
+	if slowest < timeout {
+		t.Errorf("slowest greeting came in %s, before the first byte timeout %s", slowest, timeout)
+	}
+}
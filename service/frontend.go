@@ -3,56 +3,331 @@ package service
 import (
 	"context"
 	"fmt"
-	"io"
 	"net"
-	"strings"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/pkg/errors"
-	"github.com/rs/zerolog"
 )
 
 // frontend is ...
 type frontend struct {
-	ctx         context.Context
-	logger      *zerolog.Logger
-	app         *application
-	laddr       *net.TCPAddr
-	tcpListener *net.TCPListener
+	ctx    context.Context
+	logger *proxyLogger
+	app    *application
+	// laddr is the configured listen address of a TCP frontend. It is changed by rebind.
+	laddr atomic.Pointer[net.TCPAddr]
+	// unixAddr is the address of the Unix domain socket of a local-only frontend. It is nil for TCP frontends,
+	// then laddr is set.
+	unixAddr *net.UnixAddr
+	// lmu guards listener and serializes listener creation and rebinds.
+	lmu      sync.Mutex
+	listener net.Listener
+	// host is the configured listen host. Empty means all interfaces.
+	host string
+	// network is "tcp", "tcp4" or "tcp6". With "tcp" and empty host the listener is a dual-stack socket.
+	network string
+	// listening is closed when the first listener is created.
+	listening chan struct{}
+	// bindFailed is closed when the frontend gives up creating the first listener, bindErr is the last error then.
+	bindFailed chan struct{}
+	bindErr    error
+	// listenRetries is the number of retries of a failed first bind. Zero retries forever, negative doesn't retry.
+	listenRetries int
+	// paused is set when accepting is paused and the listener is closed. It is guarded by lmu.
+	paused bool
+	// stopping is closed under lmu when the frontend stops accepting for good before shutdown.
+	// Binding isn't retried and accepting isn't resumed after it.
+	stopping     chan struct{}
+	stopAccepted sync.Once
+	// boundAddr is the actual listener address. It is nil until the listener is created.
+	boundAddr   atomic.Pointer[net.TCPAddr]
 	rmu         sync.RWMutex
 	connections map[int]*Conn
-	bufPool     *sync.Pool
+	// connCount is the size of connections. It is updated under rmu and read without locks.
+	connCount atomic.Int64
+	// pendingSetups is the number of accepted connections handed to handleNewConnection which don't copy data yet.
+	pendingSetups atomic.Int64
+	// metricKey is the identity of the frontend and its key in metrics.
+	metricKey string
+	bufPool   bufferPool
+
+	// maxConnAge is the age after which connection pairs are closed regardless of activity to let clients reconnect
+	// and be rebalanced across backends. Zero disables it.
+	maxConnAge time.Duration
+	// connRateLimit is the max throughput in bytes per second of every connection direction. Zero means unlimited.
+	connRateLimit atomic.Int64
+	// maxWriteChunk is the max size of a single write to a connection. Zero means no limit.
+	maxWriteChunk int
+	// coalesceSize is the buffer size of coalesced writes. Zero disables coalescing.
+	coalesceSize  int
+	coalesceDelay time.Duration
+	// writeTimeout is the max duration of a single write. A stuck write tears the connection pair down.
+	// Zero means no timeout.
+	writeTimeout time.Duration
+	// clientReadTimeout and backendReadTimeout are the max durations without data from the client and the backend.
+	// They are applied independently to the two copy directions. Zero disables the timeout of the direction.
+	clientReadTimeout  time.Duration
+	backendReadTimeout time.Duration
+	// minThroughput is the min throughput in bytes per second of every connection direction which transfers data,
+	// measured in minThroughputWindow. Zero disables the watchdog.
+	minThroughput       int64
+	minThroughputWindow time.Duration
+	// dumpBytes is the number of first bytes of every connection direction which are logged. Zero disables it.
+	dumpBytes int
+	// copiers is the number of running copy goroutines. It is twice connCount unless copy goroutines leak.
+	copiers atomic.Int64
+	// copyAuditInterval is the period of comparing copiers with connCount. Zero disables the audit.
+	copyAuditInterval time.Duration
+	acl               *accessList
+	clients           *clientCounter
+	limitLog          logThrottle
+	// rejectDelay is the time a rejected connection is held open before closing. Zero closes it immediately.
+	rejectDelay time.Duration
+	// resetOnClose makes forced closes of sessions and rejected connections send RST instead of FIN.
+	resetOnClose bool
+	// acceptProxy makes the frontend read the PROXY protocol header of accepted connections.
+	acceptProxy bool
+	// preambleTimeout and preambleMaxBytes bound the time and the length of the PROXY protocol header.
+	preambleTimeout  time.Duration
+	preambleMaxBytes int
+	// preambleSlots limits the number of connections reading the PROXY protocol header at once. It is nil if unlimited.
+	// A connection waits for a slot up to preambleQueueTimeout.
+	preambleSlots        chan struct{}
+	preambleQueueTimeout time.Duration
+	// originalDst makes the frontend read the original destination of accepted connections for backend selection.
+	originalDst bool
+	// workers limits the number of accepted connections being set up at once. It is nil if unlimited.
+	workers chan struct{}
+	// setupSoftLimit is the number of pending setups above which accepts are delayed. Zero disables it.
+	setupSoftLimit int64
+	// tarpitted is the number of rejected connections being held open.
+	tarpitted atomic.Int64
+	// listenKeepAlive is the keep-alive period inherited by all accepted connections.
+	// Zero means Go default (enabled), negative disables keep-alive.
+	listenKeepAlive time.Duration
+	// keepAlive is the TCP keep-alive period set on every accepted connection. Zero leaves the listener settings.
+	keepAlive time.Duration
+	// nagle enables Nagle's algorithm (disables TCP_NODELAY) on accepted connections.
+	nagle bool
+	// allowEphemeralPort allows rebinding to port 0.
+	allowEphemeralPort bool
+	// reusePort sets SO_REUSEPORT on TCP listeners, so other processes can listen on the same port.
+	reusePort bool
 }
 
 var _ connManager = (*frontend)(nil)
 
-func newFrontend(ctx context.Context, logger *zerolog.Logger, port int, app *application, bufPool *sync.Pool) (*frontend, error) {
-	addr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf(":%d", port))
+// frontendOptions contains optional frontend settings.
+type frontendOptions struct {
+	maxConnAge    time.Duration
+	connRateLimit int64
+	maxWriteChunk int
+	coalesceSize  int
+	coalesceDelay time.Duration
+	// allowEphemeralPort allows port 0, which makes the OS choose a free port.
+	allowEphemeralPort  bool
+	allow               []string
+	deny                []string
+	maxConnsPerIP       int
+	listenKeepAlive     time.Duration
+	keepAlive           time.Duration
+	writeTimeout        time.Duration
+	clientReadTimeout   time.Duration
+	backendReadTimeout  time.Duration
+	nagle               bool
+	rejectDelay         time.Duration
+	resetOnClose        bool
+	acceptProxy         bool
+	acceptWorkers       int
+	setupSoftLimit      int
+	originalDst         bool
+	network             string
+	reusePort           bool
+	minThroughput       int64
+	minThroughputWindow time.Duration
+	dumpBytes           int
+	copyAuditInterval   time.Duration
+	listenRetries       int
+	preambleTimeout     time.Duration
+	preambleMaxBytes    int
+	// preambleConcurrency limits connections reading the PROXY header at once, zero means unlimited.
+	preambleConcurrency  int
+	preambleQueueTimeout time.Duration
+}
+
+// maxTarpitted is the max number of rejected connections held open by a frontend at once.
+// Rejected connections over the limit are closed immediately, so a flood can't exhaust file descriptors.
+const maxTarpitted = 1024
+
+var (
+	errEphemeralPort        = errors.New("port 0 (ephemeral) is not allowed")
+	errReusePortUnsupported = errors.New("SO_REUSEPORT isn't supported on this platform")
+)
+
+// listenNetwork validates the listen network. Empty network means "tcp".
+func listenNetwork(network string) (string, error) {
+	switch network {
+	case "":
+		return "tcp", nil
+	case "tcp", "tcp4", "tcp6":
+		return network, nil
+	default:
+		return "", errors.Errorf("unknown listen network %q", network)
+	}
+}
+
+// newFrontend creates the frontend of the port on the host. Empty host means all interfaces.
+func newFrontend(ctx context.Context, logger *proxyLogger, host string, port int, app *application, bufPool bufferPool, opts frontendOptions) (*frontend, error) {
+	if port == 0 && !opts.allowEphemeralPort {
+		return nil, errEphemeralPort
+	}
+	network, err := listenNetwork(opts.network)
+	if err != nil {
+		return nil, err
+	}
+	if opts.reusePort && !reusePortSupported {
+		return nil, errReusePortUnsupported
+	}
+	addr, err := net.ResolveTCPAddr(network, net.JoinHostPort(host, strconv.Itoa(port)))
 	if err != nil {
 		return nil, errors.Wrap(err, "ResolveTCPAddr()")
 	}
-	return &frontend{
-		ctx:         ctx,
-		logger:      logger,
-		app:         app,
-		laddr:       addr,
-		connections: make(map[int]*Conn),
-		bufPool:     bufPool,
-	}, nil
+	f, err := buildFrontend(ctx, logger, addr.String(), app, bufPool, opts)
+	if err != nil {
+		return nil, err
+	}
+	f.host = host
+	f.network = network
+	f.reusePort = opts.reusePort
+	f.laddr.Store(addr)
+	return f, nil
+}
+
+// buildFrontend creates the frontend without a listen address. name is the listen address in metrics.
+func buildFrontend(ctx context.Context, logger *proxyLogger, name string, app *application, bufPool bufferPool, opts frontendOptions) (*frontend, error) {
+	if opts.preambleMaxBytes != 0 && opts.preambleMaxBytes < proxyV1MaxLen {
+		return nil, errors.Errorf("preamble max bytes %d is less than minimum %d", opts.preambleMaxBytes, proxyV1MaxLen)
+	}
+	acl, err := newAccessList(opts.allow, opts.deny)
+	if err != nil {
+		return nil, errors.Wrap(err, "newAccessList()")
+	}
+	f := &frontend{
+		ctx:           ctx,
+		logger:        logger,
+		app:           app,
+		connections:   make(map[int]*Conn),
+		bufPool:       bufPool,
+		maxConnAge:    opts.maxConnAge,
+		maxWriteChunk: opts.maxWriteChunk,
+		coalesceSize:  opts.coalesceSize,
+		coalesceDelay: opts.coalesceDelay,
+		acl:           acl,
+		clients:       newClientCounter(opts.maxConnsPerIP),
+		limitLog:      logThrottle{period: time.Second},
+
+		listenKeepAlive:     opts.listenKeepAlive,
+		keepAlive:           opts.keepAlive,
+		writeTimeout:        opts.writeTimeout,
+		clientReadTimeout:   opts.clientReadTimeout,
+		backendReadTimeout:  opts.backendReadTimeout,
+		minThroughput:       opts.minThroughput,
+		minThroughputWindow: opts.minThroughputWindow,
+		dumpBytes:           opts.dumpBytes,
+		copyAuditInterval:   opts.copyAuditInterval,
+		listenRetries:       opts.listenRetries,
+		preambleTimeout:     opts.preambleTimeout,
+		preambleMaxBytes:    opts.preambleMaxBytes,
+		nagle:               opts.nagle,
+		rejectDelay:         opts.rejectDelay,
+		resetOnClose:        opts.resetOnClose,
+		allowEphemeralPort:  opts.allowEphemeralPort,
+		acceptProxy:         opts.acceptProxy,
+		originalDst:         opts.originalDst,
+		setupSoftLimit:      int64(opts.setupSoftLimit),
+	}
+	if f.preambleTimeout <= 0 {
+		f.preambleTimeout = defaultPreambleTimeout
+	}
+	if f.preambleMaxBytes <= 0 {
+		f.preambleMaxBytes = defaultPreambleMaxBytes
+	}
+	if opts.acceptWorkers > 0 {
+		f.workers = make(chan struct{}, opts.acceptWorkers)
+	}
+	if opts.acceptProxy && opts.preambleConcurrency > 0 {
+		f.preambleSlots = make(chan struct{}, opts.preambleConcurrency)
+		f.preambleQueueTimeout = opts.preambleQueueTimeout
+		if f.preambleQueueTimeout <= 0 {
+			f.preambleQueueTimeout = f.preambleTimeout
+		}
+	}
+	f.listening = make(chan struct{})
+	f.bindFailed = make(chan struct{})
+	f.stopping = make(chan struct{})
+	f.connRateLimit.Store(opts.connRateLimit)
+	f.metricKey = app.name + "/" + name
+	publishGauge(frontendConnections, f.metricKey, &f.connCount)
+	publishGauge(frontendPendingSetups, f.metricKey, &f.pendingSetups)
+	publishGauge(frontendCopyGoroutines, f.metricKey, &f.copiers)
+	return f, nil
+}
+
+// listenRetryDelay is the pause between retries of a failed first bind.
+const listenRetryDelay = 5 * time.Second
+
+// bindError returns the error of the first bind if the frontend gave up listening, otherwise nil.
+func (f *frontend) bindError() error {
+	select {
+	case <-f.bindFailed:
+		return errors.Wrapf(f.bindErr, "frontend %s", f.name())
+	default:
+		return nil
+	}
+}
+
+// addr returns the actual listener address or nil if the listener isn't created yet.
+func (f *frontend) addr() net.Addr {
+	if f.unixAddr != nil {
+		select {
+		case <-f.listening:
+			return f.unixAddr
+		default:
+			return nil
+		}
+	}
+	if bound := f.boundAddr.Load(); bound != nil {
+		return bound
+	}
+	return nil
+}
+
+// name returns the configured listen address of the frontend: the socket path of a Unix socket frontend.
+func (f *frontend) name() string {
+	if f.unixAddr != nil {
+		return f.unixAddr.Name
+	}
+	return f.laddr.Load().String()
 }
 
-// addConn adds new connection to the connections map or closes this connection.
-func (f *frontend) addConn(conn *Conn) {
+// addConn adds new connection to the connections map. It returns false without adding if the frontend is stopped.
+func (f *frontend) addConn(conn *Conn) bool {
 	select {
 	case <-f.ctx.Done():
-		conn.Close()
+		return false
 	default:
 	}
 	f.rmu.Lock()
 	defer f.rmu.Unlock()
-	f.connections[conn.fd] = conn
-
+	if _, ok := f.connections[conn.id]; !ok {
+		f.connCount.Add(1)
+	}
+	f.connections[conn.id] = conn
+	return true
 }
 
 // delConn deletes connection from the connections map or does nothing.
@@ -64,38 +339,73 @@ func (f *frontend) delConn(conn *Conn) {
 	}
 	f.rmu.Lock()
 	defer f.rmu.Unlock()
-	delete(f.connections, conn.fd)
+	if _, ok := f.connections[conn.id]; ok {
+		f.connCount.Add(-1)
+	}
+	delete(f.connections, conn.id)
+}
+
+// getConnCount returns connections count. It doesn't take the lock of connections.
+func (f *frontend) getConnCount() int {
+	return int(f.connCount.Load())
+}
+
+func (f *frontend) identity() string {
+	return f.metricKey
 }
 
-// run is a blocking function. It tries to create tcpListener.
+// run is a blocking function. It tries to create the listener with listener-level keep-alive settings.
 // It starts listenForNewConn goroutine.
-// It exits on ctx is done and closes tcpListener and all connections.
+// It exits on ctx is done and closes the listener and all connections. Closing a Unix socket listener unlinks its file.
 func (f *frontend) run(wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	for {
+	for failures := 1; ; failures++ {
 		select {
 		case <-f.ctx.Done():
 			return
 		default:
 		}
-		tcpListener, err := net.ListenTCP("tcp", f.laddr)
+		f.lmu.Lock()
+		if f.isStopping() {
+			f.lmu.Unlock()
+			f.logger.Info("frontend is stopping, binding canceled", fields{"frontend": f.name()})
+			return
+		}
+		listener, err := f.listen(f.laddr.Load())
 		if err != nil {
-			f.logger.Error().Err(err).Str("frontend", f.laddr.String()).Msg("ListenTCP()")
-			time.Sleep(5 * time.Second)
+			f.lmu.Unlock()
+			if f.listenRetries < 0 || (f.listenRetries > 0 && failures > f.listenRetries) {
+				f.logger.Error("unable to listen, giving up", fields{"error": err, "frontend": f.name(), "retries": failures - 1})
+				f.bindErr = err
+				close(f.bindFailed)
+				return
+			}
+			f.logger.Error("Listen()", fields{"error": err, "frontend": f.name()})
+			select {
+			case <-f.ctx.Done():
+				return
+			case <-f.stopping:
+			case <-time.After(listenRetryDelay):
+			}
 			continue
 		}
-		f.tcpListener = tcpListener
+		f.listener = listener
+		f.lmu.Unlock()
 		break
 	}
-
-	go f.listenForNewConn()
+	close(f.listening)
+	if f.copyAuditInterval > 0 {
+		go f.auditCopiers()
+	}
 
 	// waiting for the graceful shutdown. after this it closes the listener and closes connections
 	<-f.ctx.Done()
-	f.logger.Info().Str("frontend", f.laddr.String()).Msg("closing listener and connections")
+	f.logger.Info("closing listener and connections", fields{"frontend": f.name()})
 
-	f.tcpListener.Close()
+	f.lmu.Lock()
+	f.listener.Close()
+	f.lmu.Unlock()
 
 	f.rmu.RLock()
 	defer f.rmu.RUnlock()
@@ -104,88 +414,580 @@ func (f *frontend) run(wg *sync.WaitGroup) {
 	}
 }
 
-// listenForNewConn is a blocking function. It is responsible for accepting new incoming connections.
-func (f *frontend) listenForNewConn() {
+// listen creates the listener with listener-level keep-alive settings and starts accepting connections on it.
+// addr is ignored by Unix socket frontends.
+// It must be called under lmu.
+func (f *frontend) listen(addr *net.TCPAddr) (net.Listener, error) {
+	if f.unixAddr != nil {
+		return f.listenUnix()
+	}
+	lc := net.ListenConfig{
+		KeepAlive: f.listenKeepAlive,
+	}
+	if f.reusePort {
+		lc.Control = reusePortControl
+	}
+	l, err := lc.Listen(f.ctx, f.network, addr.String())
+	if err != nil {
+		return nil, err
+	}
+	listener := l.(*net.TCPListener)
+	boundAddr := listener.Addr().(*net.TCPAddr)
+	f.boundAddr.Store(boundAddr)
+	if addr.Port == 0 {
+		f.logger.Info("listening on ephemeral port", fields{"frontend": addr.String(), "address": boundAddr.String()})
+	}
+	go f.listenForNewConn(listener)
+	return listener, nil
+}
+
+// rebind moves the frontend to the port without dropping connections: it starts accepting on a new listener
+// and closes the old one. Established connections stay intact until they close naturally.
+// If the new listener can't be created, the frontend keeps the old one.
+func (f *frontend) rebind(port int) error {
+	if port == 0 && !f.allowEphemeralPort {
+		return errEphemeralPort
+	}
+	f.lmu.Lock()
+	defer f.lmu.Unlock()
+
+	old := f.laddr.Load()
+	addr := &net.TCPAddr{IP: old.IP, Port: port, Zone: old.Zone}
+	// the listener isn't created yet, run creates it on the new address; a paused frontend listens on resume
+	if f.listener == nil || f.paused {
+		f.laddr.Store(addr)
+		return nil
+	}
+	listener, err := f.listen(addr)
+	if err != nil {
+		return errors.Wrap(err, "Listen()")
+	}
+	oldListener := f.listener
+	f.listener = listener
+	f.laddr.Store(addr)
+	oldListener.Close()
+	f.logger.Info("frontend rebound", fields{"frontend": addr.String(), "previous": old.String()})
+	return nil
+}
+
+// hasPort reports whether the frontend is configured with the port or bound to it.
+// Unix socket frontends have no ports.
+func (f *frontend) hasPort(port int) bool {
+	if f.unixAddr != nil {
+		return false
+	}
+	if f.laddr.Load().Port == port {
+		return true
+	}
+	bound := f.boundAddr.Load()
+	return bound != nil && bound.Port == port
+}
+
+// pause stops accepting: the listener is closed, so new connections are refused by the OS.
+// Established connections stay intact.
+func (f *frontend) pause() error {
+	f.lmu.Lock()
+	defer f.lmu.Unlock()
+	if f.paused {
+		return nil
+	}
+	if f.listener == nil {
+		return errors.New("frontend isn't listening yet")
+	}
+	if err := f.listener.Close(); err != nil {
+		return errors.Wrap(err, "Close()")
+	}
+	f.paused = true
+	f.logger.Info("accepting paused", fields{"frontend": f.name()})
+	return nil
+}
+
+// stopAccepting stops accepting for good before shutdown. A bound listener is closed like on pause,
+// a frontend which isn't bound yet stops retrying the bind.
+func (f *frontend) stopAccepting() error {
+	f.lmu.Lock()
+	defer f.lmu.Unlock()
+	f.stopAccepted.Do(func() { close(f.stopping) })
+	if f.paused || f.listener == nil {
+		return nil
+	}
+	if err := f.listener.Close(); err != nil {
+		return errors.Wrap(err, "Close()")
+	}
+	f.paused = true
+	return nil
+}
+
+// isStopping reports whether stopAccepting was called.
+func (f *frontend) isStopping() bool {
+	select {
+	case <-f.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// resume starts accepting on a new listener at the address of the paused one, so an ephemeral port is kept
+// if it is still free.
+func (f *frontend) resume() error {
+	f.lmu.Lock()
+	defer f.lmu.Unlock()
+	if f.isStopping() {
+		return errors.New("frontend is stopping")
+	}
+	if !f.paused {
+		return nil
+	}
+	addr := f.laddr.Load()
+	if addr != nil && addr.Port == 0 {
+		addr = f.boundAddr.Load()
+	}
+	listener, err := f.listen(addr)
+	if err != nil {
+		return errors.Wrap(err, "Listen()")
+	}
+	f.listener = listener
+	f.paused = false
+	f.logger.Info("accepting resumed", fields{"frontend": f.name()})
+	return nil
+}
+
+// listenForNewConn is a blocking function. It is responsible for accepting new incoming connections on the listener.
+// If accept workers are limited, a connection is accepted only when a worker is free, so a connection storm
+// waits in the listen backlog instead of spawning unbounded goroutines.
+// It exits when the listener is closed on shutdown or rebind.
+func (f *frontend) listenForNewConn(listener net.Listener) {
+	var backoff time.Duration
 	for {
 		select {
 		case <-f.ctx.Done():
 			return
 		default:
 		}
-		netConn, err := f.tcpListener.AcceptTCP()
+		// with preamble slots connections give their workers back while they read headers and take them again after,
+		// so the loop takes the worker after Accept: holding one while waiting for connections could starve them
+		workerFirst := f.preambleSlots == nil
+		if workerFirst && !f.acquireWorker() {
+			return
+		}
+		f.throttleAccept()
+		netConn, err := listener.Accept()
 		if err != nil {
-			if strings.Contains(err.Error(), "use of closed network connection") {
-				break
+			if workerFirst {
+				f.releaseWorker()
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if !isTemporaryAcceptError(err) {
+				f.logger.Error("Accept() failed permanently, stopped accepting", fields{"error": err, "frontend": f.name()})
+				return
+			}
+			backoff = nextAcceptBackoff(backoff)
+			f.logger.Info("Accept()", fields{"error": err, "frontend": f.name(), "backoff": backoff})
+			select {
+			case <-f.ctx.Done():
+				return
+			case <-time.After(backoff):
 			}
-			f.logger.Info().Err(err).Str("frontend", f.laddr.String()).Msg("AcceptTCP()")
 			continue
 		}
+		backoff = 0
+		// the connection may be accepted concurrently with the shutdown, nobody would close it later
+		if f.ctx.Err() != nil {
+			if workerFirst {
+				f.releaseWorker()
+			}
+			netConn.Close()
+			return
+		}
+		if !workerFirst && !f.acquireWorker() {
+			netConn.Close()
+			return
+		}
 
-		f.logger.Debug().Str("frontend", f.laddr.String()).Str("connection", netConn.RemoteAddr().String()).Msg("accepted new connection")
+		f.app.accepted.Add(1)
+		f.pendingSetups.Add(1)
+		f.logger.Debug("accepted new connection", fields{"frontend": f.name(), "connection": netConn.RemoteAddr().String()})
 
 		go f.handleNewConnection(netConn)
 	}
 }
 
+// originalDestination returns the destination of the connection before it was redirected to the frontend.
+// If it is unknown (e.g. with TPROXY or if the platform doesn't support SO_ORIGINAL_DST), the local address
+// of the connection is returned, which is the original destination with TPROXY.
+func (f *frontend) originalDestination(conn net.Conn) net.Addr {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return conn.LocalAddr()
+	}
+	addr, err := originalDst(tcpConn)
+	if err != nil {
+		f.logger.Debug("original destination is unknown, using local address", fields{"error": err, "frontend": f.name(), "connection": conn.RemoteAddr().String()})
+		return conn.LocalAddr()
+	}
+	return addr
+}
+
+const (
+	// softLimitPoll is the period of checks of pending setups while accepts are delayed by the soft limit.
+	softLimitPoll = time.Millisecond
+	// softLimitMaxWait bounds the delay of one accept by the soft limit, so accepting slows down but never stops.
+	softLimitMaxWait = 100 * time.Millisecond
+)
+
+// throttleAccept delays the next accept while pending setups exceed the soft limit, up to softLimitMaxWait.
+// It smooths bursts of connections without blocking accepts like AcceptWorkers.
+func (f *frontend) throttleAccept() {
+	if f.setupSoftLimit <= 0 || f.pendingSetups.Load() < f.setupSoftLimit {
+		return
+	}
+	frontendAcceptDelays.Add(f.metricKey, 1)
+	timeout := time.NewTimer(softLimitMaxWait)
+	defer timeout.Stop()
+	poll := time.NewTicker(softLimitPoll)
+	defer poll.Stop()
+	for f.pendingSetups.Load() >= f.setupSoftLimit {
+		select {
+		case <-poll.C:
+		case <-timeout.C:
+			return
+		case <-f.ctx.Done():
+			return
+		}
+	}
+}
+
+const (
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
+// nextAcceptBackoff doubles the delay before the next accept after a temporary error up to maxAcceptBackoff.
+func nextAcceptBackoff(backoff time.Duration) time.Duration {
+	if backoff == 0 {
+		return minAcceptBackoff
+	}
+	if backoff *= 2; backoff > maxAcceptBackoff {
+		return maxAcceptBackoff
+	}
+	return backoff
+}
+
+// isTemporaryAcceptError reports whether accepting may succeed later, e.g. after file descriptors are freed.
+func isTemporaryAcceptError(err error) bool {
+	for _, errno := range []syscall.Errno{syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM, syscall.ECONNABORTED, syscall.EINTR} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// releaseWorker frees the accept worker slot if workers are limited.
+func (f *frontend) releaseWorker() {
+	if f.workers != nil {
+		<-f.workers
+	}
+}
+
+// acquireWorker waits for a free accept worker slot if workers are limited. It fails if the frontend is stopped.
+func (f *frontend) acquireWorker() bool {
+	if f.workers == nil {
+		return true
+	}
+	select {
+	case f.workers <- struct{}{}:
+		return true
+	case <-f.ctx.Done():
+		return false
+	}
+}
+
+// acquirePreambleSlot waits up to preambleQueueTimeout for a free slot to read the PROXY header.
+// It fails on the timeout or if the frontend is stopped.
+func (f *frontend) acquirePreambleSlot() bool {
+	select {
+	case f.preambleSlots <- struct{}{}:
+		return true
+	default:
+	}
+	timer := time.NewTimer(f.preambleQueueTimeout)
+	defer timer.Stop()
+	select {
+	case f.preambleSlots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-f.ctx.Done():
+		return false
+	}
+}
+
+// releasePreambleSlot frees the slot to read the PROXY header if preamble slots are limited.
+func (f *frontend) releasePreambleSlot() {
+	if f.preambleSlots != nil {
+		<-f.preambleSlots
+	}
+}
+
 // handleNewConnection processes new incoming connections. It tries to find available backend and create remote connection.
 // This function creates TWO goroutines to transfer data between incoming and outgoing connections.
-func (f *frontend) handleNewConnection(netConn *net.TCPConn) {
+// The connection stops being a pending setup and frees its accept worker when the function returns:
+// it is rejected or copying is started.
+func (f *frontend) handleNewConnection(netConn net.Conn) {
+	defer f.pendingSetups.Add(-1)
+	holdsWorker := true
+	defer func() {
+		if holdsWorker {
+			f.releaseWorker()
+		}
+	}()
+	var clientAddr net.Addr
+	if f.acceptProxy {
+		if f.preambleSlots != nil {
+			// the connection waits for a slot with its worker, so waiting connections are bounded by workers,
+			// and gives the worker back while it reads the header, so slow headers can't occupy all workers
+			if !f.acquirePreambleSlot() {
+				if ok, suppressed := f.limitLog.allow(); ok {
+					f.logger.Warn("no free slot to read PROXY header", fields{"frontend": f.name(), "connection": netConn.RemoteAddr().String(), "suppressed": suppressed})
+				}
+				f.reject(netConn)
+				return
+			}
+			f.releaseWorker()
+			holdsWorker = false
+		}
+		addr, err := readProxyHeader(netConn, f.preambleTimeout, f.preambleMaxBytes)
+		f.releasePreambleSlot()
+		if err != nil {
+			f.logger.Warn("unable to read PROXY header", fields{"error": err, "frontend": f.name(), "connection": netConn.RemoteAddr().String()})
+			netConn.Close()
+			return
+		}
+		if !holdsWorker {
+			if holdsWorker = f.acquireWorker(); !holdsWorker {
+				netConn.Close()
+				return
+			}
+		}
+		clientAddr = addr
+	}
+
+	ip := remoteIP(netConn)
+	if addr, ok := clientAddr.(*net.TCPAddr); ok {
+		ip = addr.IP
+	}
+	if ip != nil && !f.acl.allowed(ip) {
+		f.logger.Info("connection denied by access list", fields{"frontend": f.name(), "client": netConn.RemoteAddr().String()})
+		f.reject(netConn)
+		return
+	}
+
+	// clients of Unix sockets have no IP, they share the empty key
+	key := selectionKey{client: clientAddr}
+	if ip != nil {
+		key.clientIP = ip.String()
+	}
+	if key.client == nil {
+		key.client = netConn.RemoteAddr()
+	}
+	var origDst net.Addr
+	if f.originalDst {
+		origDst = f.originalDestination(netConn)
+		key.origDst = origDst.String()
+		key.origDstAddr = origDst
+	}
+
+	clientIP := key.clientIP
+	if !f.clients.acquire(clientIP) {
+		if ok, suppressed := f.limitLog.allow(); ok {
+			f.logger.Warn("connection limit per IP exceeded", fields{"frontend": f.name(), "client": clientIP, "suppressed": suppressed})
+		}
+		f.reject(netConn)
+		return
+	}
+
+	if err := setKeepAlive(netConn, f.keepAlive); err != nil {
+		f.logger.Warn("unable to set keep-alive", fields{"error": err, "frontend": f.name()})
+	}
+	if f.nagle {
+		if err := setNoDelay(netConn, false); err != nil {
+			f.logger.Warn("unable to enable Nagle's algorithm", fields{"error": err, "frontend": f.name()})
+		}
+	}
+
 	// creating a remote connection for the local connection
-	rConn, err := f.app.createRemoteConnection()
+	rConn, bnd, err := f.app.createRemoteConnection(key)
 	if err != nil {
-		f.logger.Error().Err(err).Str("frontend", f.laddr.String()).Msg("can't find next backend")
-		f.logger.Debug().Msgf("closing connection %s -> %s", netConn.RemoteAddr().String(), netConn.LocalAddr().String())
+		if errors.Is(err, errSetupBudget) {
+			f.logger.Warn("connection setup timed out", fields{"error": err, "frontend": f.name(), "client": clientIP})
+		} else {
+			f.logger.Error("can't find next backend", fields{"error": err, "frontend": f.name()})
+		}
+		f.logger.Debugf("closing connection %s -> %s", netConn.RemoteAddr().String(), netConn.LocalAddr().String())
 		netConn.Close()
+		f.clients.release(clientIP)
 		return
 	}
-	rConn.manager.addConn(rConn)
-
 	conn := newConn(netConn, f)
-	conn.manager.addConn(conn)
-
-	closeOnce := sync.Once{}
-	closeAll := func() {
-		f.logger.Debug().Msgf("closing connection %s -> %s", conn.RemoteAddr().String(), conn.LocalAddr().String())
-		conn.Close()
-		f.logger.Debug().Msgf("closing connection %s -> %s", rConn.LocalAddr().String(), rConn.RemoteAddr().String())
+	conn.clientAddr = clientAddr
+	conn.origDst = origDst
+	labels := &Labels{}
+	if err := f.app.connectHook(conn.RemoteAddr(), rConn.RemoteAddr(), labels); err != nil {
+		f.logger.Info("connection rejected by OnConnect hook", fields{"error": err, "frontend": f.name(), "client": conn.RemoteAddr().String()})
+		rConn.Close()
+		netConn.Close()
+		f.clients.release(clientIP)
+		return
+	}
+	// sessions can't be started after the app stopped, its shutdown report is final
+	if !f.app.totals.start() {
 		rConn.Close()
-		conn.manager.delConn(conn)
-		rConn.manager.delConn(rConn)
+		netConn.Close()
+		f.clients.release(clientIP)
+		return
+	}
+	sess := newSession(f.ctx, f.logger, conn, rConn, bnd)
+	sess.resetOnClose = f.resetOnClose
+	// labels set by a hook which timed out aren't taken, the connection is rejected then
+	sess.labels = labels.snapshot()
+	sess.onDone = func(stats SessionStats) {
+		f.app.finishSession(bnd.addr, stats)
+	}
+	sess.onClose = func() {
+		f.clients.release(clientIP)
+	}
+	sess.watch(f.maxConnAge)
+
+	// from here the session owns the connections: every failure must abort it, which closes both connections,
+	// deletes them from their managers and reports the session as done
+	if !rConn.manager.addConn(rConn) || !conn.manager.addConn(conn) {
+		sess.abort()
+		return
 	}
 
 	go func() {
-		buf := f.getBuf()
-		defer f.bufPool.Put(buf)
-		for {
-			n, err := io.CopyBuffer(conn, rConn, *buf)
-			if err != nil {
-				f.logger.Info().Err(err).Msgf("can't copy data %s -> %s", rConn.RemoteAddr().String(), conn.LocalAddr().String())
-				break
-			}
-			if n == 0 {
-				break
-			}
+		f.copiers.Add(1)
+		defer f.copiers.Add(-1)
+		n, err := f.copyData(sess.ctx, conn, rConn, f.backendReadTimeout, f.newConnLimiter())
+		f.app.bytesOut.Add(n)
+		if reason := sess.finish(true, n, err); reason != nil {
+			f.logCopyError(reason, rConn.RemoteAddr(), conn.LocalAddr())
 		}
-		closeOnce.Do(closeAll)
 	}()
 
 	go func() {
-		buf := f.getBuf()
-		defer f.bufPool.Put(buf)
-		for {
-			n, err := io.CopyBuffer(rConn, conn, *buf)
-			if err != nil {
-				f.logger.Info().Err(err).Msgf("can't copy data %s -> %s", conn.LocalAddr().String(), rConn.RemoteAddr().String())
-				break
-			}
-			if n == 0 {
-				break
-			}
+		f.copiers.Add(1)
+		defer f.copiers.Add(-1)
+		n, err := f.copyData(sess.ctx, rConn, conn, f.clientReadTimeout, f.newConnLimiter())
+		f.app.bytesIn.Add(n)
+		if reason := sess.finish(false, n, err); reason != nil {
+			f.logCopyError(reason, conn.LocalAddr(), rConn.RemoteAddr())
 		}
-		closeOnce.Do(closeAll)
 	}()
 }
 
-func (f *frontend) getBuf() *[]byte {
-	return f.bufPool.Get().(*[]byte)
+// auditCopiers logs the number of copy goroutines and connections every copyAuditInterval until shutdown.
+// Every connection has two copy goroutines, but the numbers briefly differ while sessions start and close,
+// so only a divergence seen by two checks in a row is reported as a leak of copy goroutines.
+func (f *frontend) auditCopiers() {
+	ticker := time.NewTicker(f.copyAuditInterval)
+	defer ticker.Stop()
+	diverged := false
+	for {
+		select {
+		case <-f.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		copiers, conns := f.copiers.Load(), f.connCount.Load()
+		f.logger.Debug("copy goroutines audit", fields{"frontend": f.name(), "copiers": copiers, "connections": conns})
+		if copiers == 2*conns {
+			diverged = false
+			continue
+		}
+		if diverged {
+			f.logger.Warn("copy goroutines don't match connections, they may leak", fields{"frontend": f.name(), "copiers": copiers, "connections": conns})
+		}
+		diverged = true
+	}
+}
+
+// logCopyError logs the error of copying data from src to dst which ended the session. Clean closes aren't logged.
+func (f *frontend) logCopyError(reason *CopyError, src, dst net.Addr) {
+	if reason.Err == nil {
+		return
+	}
+	if errors.Is(reason, errStuckWrite) {
+		f.logger.Warn(fmt.Sprintf("stuck write watchdog fired %s -> %s", src.String(), dst.String()), fields{"error": reason, "frontend": f.name()})
+		return
+	}
+	if errors.Is(reason, errIdleRead) {
+		f.logger.Info(fmt.Sprintf("read timeout %s -> %s", src.String(), dst.String()), fields{"error": reason, "frontend": f.name()})
+		return
+	}
+	if errors.Is(reason, errSlowTransfer) {
+		f.logger.Warn(fmt.Sprintf("min throughput watchdog fired %s -> %s", src.String(), dst.String()), fields{"error": reason, "frontend": f.name()})
+		return
+	}
+	f.logger.Info(fmt.Sprintf("can't copy data %s -> %s", src.String(), dst.String()), fields{"error": reason, "cause": reason.Cause.Error(), "frontend": f.name()})
+}
+
+// closeConn cancels the session of the incoming connection by its id, which closes the connection pair.
+// It returns false if there is no such connection.
+func (f *frontend) closeConn(id int) bool {
+	f.rmu.RLock()
+	conn, ok := f.connections[id]
+	f.rmu.RUnlock()
+	if !ok {
+		return false
+	}
+	conn.session.cancel()
+	return true
+}
+
+// sessions returns sessions of the frontend.
+func (f *frontend) sessions() []*session {
+	f.rmu.RLock()
+	defer f.rmu.RUnlock()
+	sessions := make([]*session, 0, len(f.connections))
+	for _, conn := range f.connections {
+		sessions = append(sessions, conn.session)
+	}
+	return sessions
+}
+
+// reject closes a rejected connection. If rejectDelay is set, the connection is held open for the delay
+// before closing (tarpitting), so abusive clients can't retry instantly.
+// The connection is held in its own goroutine, so the caller doesn't wait.
+func (f *frontend) reject(netConn net.Conn) {
+	if f.resetOnClose {
+		if err := setResetOnClose(netConn); err != nil {
+			f.logger.Debug("unable to reset rejected connection", fields{"error": err, "frontend": f.name()})
+		}
+	}
+	if f.rejectDelay <= 0 {
+		netConn.Close()
+		return
+	}
+	if f.tarpitted.Add(1) > maxTarpitted {
+		f.tarpitted.Add(-1)
+		netConn.Close()
+		return
+	}
+
+	go func() {
+		defer f.tarpitted.Add(-1)
+		defer netConn.Close()
+		timer := time.NewTimer(f.rejectDelay)
+		defer timer.Stop()
+		select {
+		case <-f.ctx.Done():
+		case <-timer.C:
+		}
+	}()
 }
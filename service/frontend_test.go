@@ -0,0 +1,387 @@
+package service
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+func TestEphemeralPort(t *testing.T) {
+	logger := zerolog.Nop()
+	_, err := NewProxy(context.Background(), &logger, ProxyConfig{Apps: []ConfigApp{{
+		Name:       "test",
+		Ports:      []int{0},
+		ListenHost: "127.0.0.1",
+		Targets:    []string{"127.0.0.1:1"},
+	}}})
+	if !errors.Is(err, errEphemeralPort) {
+		t.Fatalf("port 0 without AllowEphemeralPort: %v", err)
+	}
+
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{Targets: []string{startBackend(t, echo)}}}})
+	addrs := p.ListenAddrs()
+	if len(addrs) != 1 {
+		t.Fatalf("listen addresses are %v", addrs)
+	}
+	if port := addrs[0].(*net.TCPAddr).Port; port == 0 {
+		t.Error("bound port isn't reported")
+	}
+	openExchange(t, p)
+}
+
+func TestMaxConnsPerIP(t *testing.T) {
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Targets:       []string{startBackend(t, echo)},
+		MaxConnsPerIP: 2,
+	}}})
+	first := openExchange(t, p)
+	openExchange(t, p)
+
+	over := dialProxy(t, p, 0)
+	over.SetDeadline(time.Now().Add(time.Second))
+	over.Write([]byte("ping"))
+	if n, _ := io.ReadFull(over, make([]byte, 4)); n != 0 {
+		t.Error("connection over the per-IP limit is proxied")
+	}
+
+	first.Close()
+	if !waitFor(t, time.Second, func() bool { return p.fnds[0].getConnCount() == 1 }) {
+		t.Fatal("closed connection isn't released")
+	}
+	openExchange(t, p)
+}
+
+func TestPortsRouteToOwnPools(t *testing.T) {
+	backendA, backendB := startBackend(t, echo), startBackend(t, echo)
+	stats := make(chan SessionStats, 1)
+	onDisconnect := func(s SessionStats) { stats <- s }
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{
+		{Name: "a", Targets: []string{backendA}, OnDisconnect: onDisconnect},
+		{Name: "b", Targets: []string{backendB}, OnDisconnect: onDisconnect},
+	}})
+	if addrs := p.ListenAddrs(); len(addrs) != 2 || addrs[0].String() == addrs[1].String() {
+		t.Fatalf("listen addresses are %v", addrs)
+	}
+
+	want := []struct{ app, backend string }{{"a", backendA}, {"b", backendB}}
+	for round := 0; round < 3; round++ {
+		for i, w := range want {
+			conn := dialProxy(t, p, i)
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			conn.Write([]byte("ping"))
+			if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+				t.Fatalf("port %d: %v", i, err)
+			}
+			conn.Close()
+			if s := <-stats; s.App != w.app || s.Backend.String() != w.backend {
+				t.Errorf("port %d is routed to app %s backend %s, want %s %s", i, s.App, s.Backend, w.app, w.backend)
+			}
+		}
+	}
+}
+
+func TestAcceptWorkersBoundSetups(t *testing.T) {
+	const workers, clients = 3, 10
+	var mu sync.Mutex
+	running, peak := 0, 0
+	release := make(chan struct{})
+	p := startProxy(t, ProxyConfig{
+		Apps: []ConfigApp{{
+			Targets:       []string{startBackend(t, echo)},
+			AcceptWorkers: workers,
+			OnConnect: func(context.Context, net.Addr, net.Addr) error {
+				mu.Lock()
+				running++
+				if running > peak {
+					peak = running
+				}
+				mu.Unlock()
+				<-release
+				mu.Lock()
+				running--
+				mu.Unlock()
+				return nil
+			},
+		}},
+	})
+	inSetup := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return running
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		conn := dialProxy(t, p, 0)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			conn.Write([]byte("ping"))
+			if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+				t.Errorf("exchange: %v", err)
+			}
+		}()
+	}
+	if !waitFor(t, 5*time.Second, func() bool { return inSetup() == workers }) {
+		t.Fatalf("%d connections are being set up, want %d", inSetup(), workers)
+	}
+	// the rest of the clients wait in the backlog
+	time.Sleep(100 * time.Millisecond)
+	if n := inSetup(); n != workers {
+		t.Errorf("%d connections are being set up with %d workers", n, workers)
+	}
+	close(release)
+	wg.Wait()
+	if peak != workers {
+		t.Errorf("up to %d connections were set up at once, want %d", peak, workers)
+	}
+}
+
+// failingListener fails accepts with its errors in turn, then with net.ErrClosed. It records the times of accepts.
+type failingListener struct {
+	net.Listener
+	mu    sync.Mutex
+	errs  []error
+	calls []time.Time
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.calls = append(l.calls, time.Now())
+	if len(l.errs) == 0 {
+		return nil, net.ErrClosed
+	}
+	err := l.errs[0]
+	l.errs = l.errs[1:]
+	return nil, err
+}
+
+func TestAcceptBackoff(t *testing.T) {
+	emfile := &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept4", syscall.EMFILE)}
+	ln := &failingListener{errs: []error{emfile, emfile, emfile, emfile}}
+	p := newTestProxy(t, ProxyConfig{Apps: []ConfigApp{{Targets: []string{"127.0.0.1:1"}}}})
+	p.fnds[0].listenForNewConn(ln)
+
+	if len(ln.calls) != 5 {
+		t.Fatalf("%d accepts, want 4 failed and the closing one", len(ln.calls))
+	}
+	for i, want := range []time.Duration{5, 10, 20, 40} {
+		if gap := ln.calls[i+1].Sub(ln.calls[i]); gap < want*time.Millisecond {
+			t.Errorf("accept %d is retried after %s, want backoff %s", i, gap, want*time.Millisecond)
+		}
+	}
+}
+
+func TestAcceptPermanentError(t *testing.T) {
+	logger := &fakeLogger{}
+	ln := &failingListener{errs: []error{errors.New("listener is broken")}}
+	p := newTestProxy(t, ProxyConfig{
+		Logger: logger,
+		Apps:   []ConfigApp{{Targets: []string{"127.0.0.1:1"}}},
+	})
+	p.fnds[0].listenForNewConn(ln)
+	if len(ln.calls) != 1 {
+		t.Errorf("%d accepts after a permanent error, want 1", len(ln.calls))
+	}
+	if len(logger.find("Accept() failed permanently")) != 1 {
+		t.Error("permanent accept error isn't logged")
+	}
+}
+
+func TestNextAcceptBackoff(t *testing.T) {
+	var backoff time.Duration
+	for _, want := range []time.Duration{minAcceptBackoff, 2 * minAcceptBackoff, 4 * minAcceptBackoff} {
+		if backoff = nextAcceptBackoff(backoff); backoff != want {
+			t.Errorf("backoff is %s, want %s", backoff, want)
+		}
+	}
+	if backoff = nextAcceptBackoff(maxAcceptBackoff); backoff != maxAcceptBackoff {
+		t.Errorf("backoff after the max is %s, want %s", backoff, maxAcceptBackoff)
+	}
+}
+
+// externalIP returns a non-loopback IPv4 address of the host or skips the test.
+func externalIP(t *testing.T) net.IP {
+	t.Helper()
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		t.Skipf("InterfaceAddrs(): %v", err)
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+			return ipNet.IP
+		}
+	}
+	t.Skip("no non-loopback IPv4 address")
+	return nil
+}
+
+func TestListenHostLoopbackOnly(t *testing.T) {
+	external := externalIP(t)
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Targets:    []string{startBackend(t, echo)},
+		ListenHost: "127.0.0.1",
+	}}})
+	addr := p.ListenAddrs()[0].(*net.TCPAddr)
+	if !addr.IP.IsLoopback() {
+		t.Errorf("listener is bound to %s, want loopback", addr.IP)
+	}
+	exchange(t, p)
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(external.String(), strconv.Itoa(addr.Port)), time.Second)
+	if err == nil {
+		conn.Close()
+		t.Errorf("listener bound to loopback accepts connections to %s", external)
+	}
+}
+
+func TestListenHostSharesPort(t *testing.T) {
+	port := freePort(t)
+	app := func(name, host string) ConfigApp {
+		return ConfigApp{Name: name, Targets: []string{"127.0.0.1:1"}, Ports: []int{port}, ListenHost: host}
+	}
+	logger := zerolog.Nop()
+	for _, tc := range []struct {
+		hosts [2]string
+		ok    bool
+	}{
+		{[2]string{"127.0.0.1", "127.0.0.2"}, true},
+		{[2]string{"127.0.0.1", "127.0.0.1"}, false},
+		{[2]string{"127.0.0.1", ""}, false},
+	} {
+		_, err := NewProxy(context.Background(), &logger, ProxyConfig{Apps: []ConfigApp{app("a", tc.hosts[0]), app("b", tc.hosts[1])}})
+		if (err == nil) != tc.ok {
+			t.Errorf("port %d of hosts %q and %q: error %v, want ok %t", port, tc.hosts[0], tc.hosts[1], err, tc.ok)
+		}
+	}
+}
+
+func TestListenNetwork(t *testing.T) {
+	backend := startBackend(t, echo)
+	for _, tc := range []struct {
+		network, host string
+		v4, v6        bool
+	}{
+		// the unspecified IPv6 address of "tcp" is a dual-stack socket
+		{"", "::", true, true},
+		{"tcp4", "0.0.0.0", true, false},
+		{"tcp6", "::", false, true},
+	} {
+		p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+			Targets:       []string{backend},
+			ListenHost:    tc.host,
+			ListenNetwork: tc.network,
+		}}})
+		port := strconv.Itoa(p.ListenAddrs()[0].(*net.TCPAddr).Port)
+		for ip, want := range map[string]bool{"127.0.0.1": tc.v4, "::1": tc.v6} {
+			conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip, port), time.Second)
+			if err != nil {
+				if want {
+					t.Errorf("%q listener on %s: %v", tc.network, tc.host, err)
+				}
+				continue
+			}
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			conn.Write([]byte("ping"))
+			_, err = io.ReadFull(conn, make([]byte, 4))
+			conn.Close()
+			if (err == nil) != want {
+				t.Errorf("%q listener on %s proxies connections to %s: %v, want %t", tc.network, tc.host, ip, err, want)
+			}
+		}
+	}
+
+	logger := zerolog.Nop()
+	if _, err := NewProxy(context.Background(), &logger, ProxyConfig{Apps: []ConfigApp{{
+		Name:          "test",
+		Ports:         []int{0},
+		Targets:       []string{backend},
+		ListenNetwork: "udp",
+	}}}); err == nil {
+		t.Error("unknown listen network is accepted")
+	}
+}
+
+func TestCopyGoroutinesCounted(t *testing.T) {
+	const interval = 20 * time.Millisecond
+	logger := &fakeLogger{}
+	p := startProxy(t, ProxyConfig{
+		Logger: logger,
+		Apps: []ConfigApp{{
+			Targets:           []string{startBackend(t, echo)},
+			CopyAuditInterval: interval,
+		}},
+	})
+	fnd := p.fnds[0]
+	gauge := func() string { return frontendCopyGoroutines.Get(fnd.metricKey).String() }
+
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		conns = append(conns, openExchange(t, p))
+	}
+	if !waitFor(t, time.Second, func() bool { return gauge() == "6" }) {
+		t.Errorf("copy goroutines gauge is %s with 3 connections, want 6", gauge())
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+	if !waitFor(t, time.Second, func() bool { return gauge() == "0" }) {
+		t.Errorf("copy goroutines gauge is %s after the connections are closed, want 0", gauge())
+	}
+	time.Sleep(5 * interval)
+	if len(logger.find("copy goroutines audit")) == 0 {
+		t.Error("audit isn't logged")
+	}
+	if events := logger.find("copy goroutines don't match"); len(events) != 0 {
+		t.Fatalf("leak is reported without leaks: %v", events[0].fields)
+	}
+
+	// a leaked goroutine
+	fnd.copiers.Add(1)
+	defer fnd.copiers.Add(-1)
+	if !waitFor(t, time.Second, func() bool { return len(logger.find("copy goroutines don't match")) > 0 }) {
+		t.Error("leak isn't reported")
+	}
+}
+
+func TestBindFailureStopsRun(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	p := newTestProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Targets:       []string{startBackend(t, echo)},
+		Ports:         []int{taken.Addr().(*net.TCPAddr).Port},
+		ListenRetries: -1,
+	}}})
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Run()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.WaitReady(ctx); !errors.Is(err, syscall.EADDRINUSE) {
+		t.Errorf("WaitReady() = %v, want the bind error", err)
+	}
+	select {
+	case err := <-done:
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			t.Errorf("Run() = %v, want the bind error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("proxy keeps running after the bind failed")
+	}
+}
@@ -0,0 +1,101 @@
+package service
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// defaultHashReplicas is the number of points of a backend with weight 1 on the hash ring.
+const defaultHashReplicas = 100
+
+// hashRing maps keys to backends with consistent hashing, so adding or removing a backend
+// remaps only the keys of its neighbors on the ring. Every backend has replicas*weight points on the ring.
+type hashRing struct {
+	points []ringPoint
+}
+
+type ringPoint struct {
+	hash uint64
+	bnd  *backend
+}
+
+func newHashRing(bnds []*backend, replicas int) *hashRing {
+	r := &hashRing{}
+	for _, bnd := range bnds {
+		for i := 0; i < replicas*bnd.weight; i++ {
+			r.points = append(r.points, ringPoint{hash: hashKey(bnd.addr + "#" + strconv.Itoa(i)), bnd: bnd})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		return r.points[i].hash < r.points[j].hash
+	})
+	return r
+}
+
+// get returns the backend of the first point clockwise from the key hash.
+func (r *hashRing) get(key string) *backend {
+	if len(r.points) == 0 {
+		return nil
+	}
+	h := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= h
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].bnd
+}
+
+// hashKey hashes the key onto the ring. FNV-1a alone changes mostly the low bits for keys which differ in the last
+// characters, like IPv6 addresses of one subnet, so such keys would land between the same two points.
+// The murmur3 finalizer spreads every input bit over the whole hash.
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// ringCache keeps the hash ring of the last candidate set, so the ring is rebuilt only when the set
+// or weights of its backends change.
+type ringCache struct {
+	mu       sync.Mutex
+	replicas int
+	members  []*backend
+	weights  []int
+	ring     *hashRing
+}
+
+func (c *ringCache) get(candidates []*backend) *hashRing {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ring == nil || !c.same(candidates) {
+		c.members = append(c.members[:0], candidates...)
+		c.weights = c.weights[:0]
+		for _, bnd := range candidates {
+			c.weights = append(c.weights, bnd.weight)
+		}
+		c.ring = newHashRing(candidates, c.replicas)
+	}
+	return c.ring
+}
+
+func (c *ringCache) same(candidates []*backend) bool {
+	if len(c.members) != len(candidates) {
+		return false
+	}
+	for i, bnd := range candidates {
+		if c.members[i] != bnd || c.weights[i] != bnd.weight {
+			return false
+		}
+	}
+	return true
+}
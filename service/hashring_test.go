@@ -0,0 +1,69 @@
+package service
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestHashRingRemoval(t *testing.T) {
+	const n, keys = 5, 10000
+	bnds := testBackends(n)
+	before := newHashRing(bnds, defaultHashReplicas)
+	after := newHashRing(bnds[1:], defaultHashReplicas)
+
+	moved, removed := 0, 0
+	for i := 0; i < keys; i++ {
+		key := "10.1." + strconv.Itoa(i/256) + "." + strconv.Itoa(i%256)
+		was, is := before.get(key), after.get(key)
+		if was == bnds[0] {
+			removed++
+		} else if was != is {
+			moved++
+		}
+	}
+	// only keys of the removed backend are remapped
+	if moved != 0 {
+		t.Errorf("%d keys of remaining backends moved", moved)
+	}
+	if share := float64(removed) / keys; share < 0.6/n || share > 1.4/n {
+		t.Errorf("removal of 1 of %d backends remaps %.3f of keys, want about %.3f", n, share, 1.0/n)
+	}
+}
+
+func TestHashRingWeights(t *testing.T) {
+	const keys = 10000
+	bnds := testBackends(2)
+	bnds[1].weight = 3
+	ring := newHashRing(bnds, defaultHashReplicas)
+	heavy := 0
+	for i := 0; i < keys; i++ {
+		if ring.get("client-"+strconv.Itoa(i)) == bnds[1] {
+			heavy++
+		}
+	}
+	if share := float64(heavy) / keys; share < 0.65 || share > 0.85 {
+		t.Errorf("backend with 3 of 4 weight units gets %.2f of keys, want about 0.75", share)
+	}
+}
+
+func TestHashRingEmpty(t *testing.T) {
+	if bnd := newHashRing(nil, defaultHashReplicas).get("key"); bnd != nil {
+		t.Errorf("empty ring maps a key to %s", bnd.addr)
+	}
+}
+
+func TestHashRingIPv6Subnet(t *testing.T) {
+	const n, keys = 4, 1024
+	bnds := testBackends(n)
+	ring := newHashRing(bnds, defaultHashReplicas)
+	counts := make(map[*backend]int)
+	// clients of one subnet differ only in the last characters
+	for i := 0; i < keys; i++ {
+		counts[ring.get("2001:db8::"+strconv.FormatInt(int64(i), 16))]++
+	}
+	for _, bnd := range bnds {
+		if share := float64(counts[bnd]) / keys; share < 0.5/n || share > 1.5/n {
+			t.Errorf("backend %s gets %.3f of IPv6 clients of a subnet, want about %.3f", bnd.addr, share, 1.0/n)
+		}
+	}
+}
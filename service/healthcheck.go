@@ -0,0 +1,99 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// HealthChecker probes a backend address with the backend dialer. A custom checker can be set per app.
+type HealthChecker interface {
+	Check(ctx context.Context, dialer Dialer, addr string) error
+}
+
+const (
+	healthcheckTCP  = "tcp"
+	healthcheckHTTP = "http"
+)
+
+// newHealthChecker returns the built-in health checker of the kind. Empty kind means "tcp".
+func newHealthChecker(kind, path string) (HealthChecker, error) {
+	switch kind {
+	case "", healthcheckTCP:
+		return tcpHealthChecker{}, nil
+	case healthcheckHTTP:
+		if path == "" {
+			path = "/"
+		}
+		return httpHealthChecker{path: path}, nil
+	default:
+		return nil, errors.Errorf("unknown health check kind %q", kind)
+	}
+}
+
+// tcpHealthChecker considers the backend healthy if it accepts connections. Handshakes of connections
+// with a handshake (e.g. TLS to backends) must complete too.
+type tcpHealthChecker struct{}
+
+func (tcpHealthChecker) Check(ctx context.Context, dialer Dialer, addr string) error {
+	conn, err := dialHealthcheck(ctx, dialer, addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// dialHealthcheck dials the backend and completes the handshake of connections with a handshake,
+// so health checks of TLS backends verify the certificates and present the client certificate like data connections.
+func dialHealthcheck(ctx context.Context, dialer Dialer, addr string) (net.Conn, error) {
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if hs, ok := conn.(handshaker); ok {
+		if err := hs.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, "Handshake()")
+		}
+	}
+	return conn, nil
+}
+
+// httpHealthChecker considers the backend healthy if it answers GET path with a status below 400.
+type httpHealthChecker struct {
+	path string
+}
+
+func (c httpHealthChecker) Check(ctx context.Context, dialer Dialer, addr string) error {
+	conn, err := dialHealthcheck(ctx, dialer, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return errors.Wrap(err, "SetDeadline()")
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+c.path, nil)
+	if err != nil {
+		return errors.Wrap(err, "NewRequest()")
+	}
+	req.Close = true
+	if err := req.Write(conn); err != nil {
+		return errors.Wrap(err, "write health check request")
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return errors.Wrap(err, "read health check response")
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return errors.Errorf("health check %s returned %s", c.path, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPoolHealthcheckKinds(t *testing.T) {
+	raw := startBackend(t, echo)
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer web.Close()
+	webAddr := strings.TrimPrefix(web.URL, "http://")
+
+	p := newTestProxy(t, ProxyConfig{Apps: []ConfigApp{
+		{Name: "tcp", Targets: []string{raw}, HealthcheckKind: "tcp"},
+		{Name: "http", Targets: []string{raw, webAddr}, HealthcheckKind: "http", HealthcheckPath: "/health"},
+		{Name: "http-root", Targets: []string{webAddr}, HealthcheckKind: "http"},
+	}})
+	runProxy(t, p)
+
+	eligible := func(app, addr string) bool {
+		a := p.findApp(app)
+		a.rmu.RLock()
+		defer a.rmu.RUnlock()
+		return a.backendByAddr(addr).eligible()
+	}
+	if !waitFor(t, 5*time.Second, func() bool { return eligible("tcp", raw) && eligible("http", webAddr) }) {
+		t.Fatal("backends passing their health checks aren't active")
+	}
+	failed := func(app, addr string) bool {
+		a := p.findApp(app)
+		a.rmu.RLock()
+		defer a.rmu.RUnlock()
+		return a.backendByAddr(addr).lastError.Load() != nil
+	}
+	if !waitFor(t, 5*time.Second, func() bool { return failed("http", raw) && failed("http-root", webAddr) }) {
+		t.Fatal("failed health checks aren't recorded")
+	}
+	if eligible("http", raw) {
+		t.Error("backend which doesn't speak HTTP passes the HTTP health check")
+	}
+	if eligible("http-root", webAddr) {
+		t.Error("backend answering 503 at the default path passes the HTTP health check")
+	}
+}
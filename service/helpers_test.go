@@ -0,0 +1,174 @@
+package service
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// startBackend starts a TCP server on a loopback port which serves every connection with handle.
+// The connection is closed when handle returns. It returns the address of the server.
+func startBackend(t testing.TB, handle func(conn net.Conn)) string {
+	t.Helper()
+	return startBackendOn(t, "127.0.0.1:0", handle)
+}
+
+// startBackendOn starts a TCP server on the address like startBackend.
+func startBackendOn(t testing.TB, addr string, handle func(conn net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	// the accept loop is counted too, so connections aren't added to the group while the cleanup waits for it
+	var wg sync.WaitGroup
+	wg.Add(1)
+	t.Cleanup(func() {
+		ln.Close()
+		wg.Wait()
+	})
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// echo sends back everything it receives until EOF.
+func echo(conn net.Conn) {
+	io.Copy(conn, conn)
+}
+
+// startProxy runs the proxy of config until the end of the test and waits until it is ready
+// and the first health checks of all backends are over, so tests don't race them.
+func startProxy(t testing.TB, config ProxyConfig) Proxy {
+	t.Helper()
+	p := newTestProxy(t, config)
+	runProxy(t, p)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.WaitReady(ctx); err != nil {
+		t.Fatalf("WaitReady(): %v", err)
+	}
+	for _, a := range p.apps {
+		a.rmu.RLock()
+		bnds := append([]*backend(nil), a.bnds...)
+		a.rmu.RUnlock()
+		for _, bnd := range bnds {
+			if !waitFor(t, 5*time.Second, func() bool { return bnd.active.Load() || bnd.lastError.Load() != nil }) {
+				t.Fatalf("backend %s isn't checked", bnd.addr)
+			}
+		}
+	}
+	return p
+}
+
+// newTestProxy creates the proxy of config. Apps without ports and sockets listen on an ephemeral loopback port,
+// health checks are effectively disabled. The proxy is stopped at the end of the test.
+func newTestProxy(t testing.TB, config ProxyConfig) Proxy {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return newTestProxyContext(t, ctx, config)
+}
+
+// newTestProxyContext creates the proxy of config like newTestProxy with ctx as the context of NewProxy.
+func newTestProxyContext(t testing.TB, ctx context.Context, config ProxyConfig) Proxy {
+	t.Helper()
+	for i := range config.Apps {
+		app := &config.Apps[i]
+		if app.Name == "" {
+			app.Name = "test"
+		}
+		if len(app.Ports) == 0 && len(app.ListenUnix) == 0 {
+			app.Ports = []int{0}
+			app.AllowEphemeralPort = true
+		}
+		if app.ListenHost == "" {
+			app.ListenHost = "127.0.0.1"
+		}
+		if app.HealthcheckInterval == 0 {
+			app.HealthcheckInterval = time.Hour
+		}
+	}
+	logger := zerolog.Nop()
+	p, err := NewProxy(ctx, &logger, config)
+	if err != nil {
+		t.Fatalf("NewProxy(): %v", err)
+	}
+	return p
+}
+
+// runProxy runs the proxy until the end of the test. The proxy must be created by newTestProxy.
+func runProxy(t testing.TB, p Proxy) {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Run()
+	}()
+	t.Cleanup(func() {
+		p.cancel()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Errorf("proxy didn't stop")
+		}
+	})
+}
+
+// dialProxy connects to the i-th listener of the proxy.
+func dialProxy(t testing.TB, p Proxy, i int) net.Conn {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", p.ListenAddrs()[i].String(), time.Second)
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	return conn
+}
+
+// waitFor polls cond until it is true or timeout passes.
+func waitFor(t testing.TB, timeout time.Duration, cond func() bool) bool {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
+
+// waitBackendsActive waits until the first health checks of all backends of the proxy pass.
+func waitBackendsActive(t testing.TB, p Proxy) {
+	t.Helper()
+	for _, a := range p.apps {
+		a.rmu.RLock()
+		bnds := append([]*backend(nil), a.bnds...)
+		a.rmu.RUnlock()
+		for _, bnd := range bnds {
+			if !waitFor(t, 5*time.Second, bnd.eligible) {
+				t.Fatalf("backend %s isn't active", bnd.addr)
+			}
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package service
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// connectHookTimeout bounds OnConnect hooks, so a stuck hook doesn't hold an accept worker forever.
+const connectHookTimeout = 5 * time.Second
+
+// ConnectHook is called when a connection pair is established, before any data flows.
+// The connection pair is rejected and closed if it returns an error. ctx is done when connectHookTimeout passes,
+// then the connection is rejected without waiting for the hook. The hook may label the pair with ContextLabels(ctx).
+type ConnectHook func(ctx context.Context, client, backend net.Addr) error
+
+// DisconnectHook is called when both directions of a connection pair stop copying.
+// It runs in the copy goroutine, so it should be fast.
+type DisconnectHook func(stats SessionStats)
+
+// SessionStats describes a finished connection pair.
+type SessionStats struct {
+	App     string
+	Client  net.Addr
+	Backend net.Addr
+	Started time.Time
+	// Duration is the time from accepting the client connection to the end of copying.
+	Duration time.Duration
+	// BytesIn is the number of bytes copied from the client to the backend.
+	BytesIn int64
+	// BytesOut is the number of bytes copied from the backend to the client.
+	BytesOut int64
+	// Reason is the reason of the end of the pair.
+	Reason *CopyError
+	// Labels are set by the OnConnect hook. It is nil if there are none.
+	Labels map[string]string
+}
+
+// connectHook runs the OnConnect hook of the app if it is set. The hook sets labels of the pair.
+func (a *application) connectHook(client, backend net.Addr, labels *Labels) error {
+	if a.onConnect == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.WithValue(a.ctx, labelsKey{}, labels), connectHookTimeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- a.onConnect(ctx, client, backend)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "OnConnect hook")
+	}
+}
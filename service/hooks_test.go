@@ -0,0 +1,77 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnectHookArgs(t *testing.T) {
+	backend := startBackend(t, echo)
+	type pair struct{ client, backend string }
+	connected := make(chan pair, 1)
+	stats := make(chan SessionStats, 1)
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Targets: []string{backend},
+		OnConnect: func(_ context.Context, client, backend net.Addr) error {
+			connected <- pair{client.String(), backend.String()}
+			return nil
+		},
+		OnDisconnect: func(s SessionStats) { stats <- s },
+	}}})
+	conn := openExchange(t, p)
+	client := conn.LocalAddr().String()
+	conn.Close()
+
+	if got := <-connected; got.client != client || got.backend != backend {
+		t.Errorf("OnConnect gets %s -> %s, want %s -> %s", got.client, got.backend, client, backend)
+	}
+	s := <-stats
+	if s.App != "test" || s.Client.String() != client || s.Backend.String() != backend {
+		t.Errorf("OnDisconnect gets %s: %s -> %s, want test: %s -> %s", s.App, s.Client, s.Backend, client, backend)
+	}
+	if s.BytesIn != 4 || s.BytesOut != 4 || !errors.Is(s.Reason, ErrClientClosed) {
+		t.Errorf("OnDisconnect gets %d/%d bytes and reason %v, want 4/4 and %v", s.BytesIn, s.BytesOut, s.Reason, ErrClientClosed)
+	}
+}
+
+func TestConnectHookRejects(t *testing.T) {
+	received := make(chan int, 2)
+	backend := startBackend(t, func(conn net.Conn) {
+		n, _ := io.Copy(io.Discard, conn)
+		received <- int(n)
+	})
+	disconnected := make(chan SessionStats, 1)
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Targets: []string{backend},
+		OnConnect: func(context.Context, net.Addr, net.Addr) error {
+			return errors.New("rejected")
+		},
+		OnDisconnect: func(s SessionStats) { disconnected <- s },
+	}}})
+	// the first health check
+	<-received
+
+	conn := dialProxy(t, p, 0)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("ping"))
+	if n, err := conn.Read(make([]byte, 1)); n != 0 || err == nil {
+		t.Errorf("rejected client reads %d bytes, %v", n, err)
+	}
+	select {
+	case n := <-received:
+		if n != 0 {
+			t.Errorf("backend of the rejected pair receives %d bytes", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("backend connection of the rejected pair isn't closed")
+	}
+	select {
+	case s := <-disconnected:
+		t.Errorf("OnDisconnect is called for the rejected pair: %+v", s)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
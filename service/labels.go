@@ -0,0 +1,78 @@
+package service
+
+import (
+	"context"
+	"net/url"
+	"sync"
+)
+
+// Labels are key/value metadata of a connection pair, e.g. a tenant id. The OnConnect hook sets them
+// with ContextLabels, then they are reported in SessionStats, access logs and the close log of the pair.
+// Labels are safe for concurrent use.
+type Labels struct {
+	mu sync.Mutex
+	m  map[string]string
+}
+
+type labelsKey struct{}
+
+// ContextLabels returns the labels of the connection pair of the OnConnect hook context or nil for other contexts.
+// Labels set after the hook returned or timed out are ignored.
+func ContextLabels(ctx context.Context) *Labels {
+	l, _ := ctx.Value(labelsKey{}).(*Labels)
+	return l
+}
+
+// Set sets the label. It does nothing if the labels are nil.
+func (l *Labels) Set(key, value string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.m == nil {
+		l.m = make(map[string]string)
+	}
+	l.m[key] = value
+}
+
+// Get returns the label and whether it is set.
+func (l *Labels) Get(key string) (string, bool) {
+	if l == nil {
+		return "", false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	value, ok := l.m[key]
+	return value, ok
+}
+
+// snapshot returns a copy of the labels or nil if there are none.
+func (l *Labels) snapshot() map[string]string {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.m) == 0 {
+		return nil
+	}
+	m := make(map[string]string, len(l.m))
+	for k, v := range l.m {
+		m[k] = v
+	}
+	return m
+}
+
+// encodeLabels encodes labels like a URL query sorted by keys, e.g. "env=prod&tenant=acme", so they fit
+// a single field of a line. Empty labels are "-".
+func encodeLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return "-"
+	}
+	values := make(url.Values, len(labels))
+	for k, v := range labels {
+		values.Set(k, v)
+	}
+	return values.Encode()
+}
@@ -0,0 +1,99 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// syncBuffer is a buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestConnectHookLabels(t *testing.T) {
+	var accessLog syncBuffer
+	logger := &fakeLogger{}
+	stats := make(chan SessionStats, 1)
+	backend := startBackend(t, echo)
+	p := startProxy(t, ProxyConfig{
+		Logger:    logger,
+		AccessLog: &accessLog,
+		Apps: []ConfigApp{{
+			Targets: []string{backend},
+			OnConnect: func(ctx context.Context, client, bnd net.Addr) error {
+				labels := ContextLabels(ctx)
+				if labels == nil {
+					return errors.New("no labels in the hook context")
+				}
+				labels.Set("tenant", "acme")
+				labels.Set("env", "test")
+				return nil
+			},
+			OnDisconnect: func(s SessionStats) { stats <- s },
+		}},
+	})
+	exchange(t, p)
+
+	want := map[string]string{"tenant": "acme", "env": "test"}
+	s := <-stats
+	if !reflect.DeepEqual(s.Labels, want) {
+		t.Errorf("session labels are %v, want %v", s.Labels, want)
+	}
+	line := strings.TrimSuffix(accessLog.String(), "\n")
+	if columns := strings.Split(line, "\t"); columns[len(columns)-1] != "env=test&tenant=acme" {
+		t.Errorf("access log line %q doesn't end with the labels", line)
+	}
+	var logged bool
+	for _, e := range logger.find("closing connection") {
+		if labels, ok := e.fields["labels"]; ok {
+			logged = true
+			if !reflect.DeepEqual(labels, want) {
+				t.Errorf("close log labels are %v, want %v", labels, want)
+			}
+		}
+	}
+	if !logged {
+		t.Error("close log has no labels")
+	}
+}
+
+func TestContextLabelsOutsideHook(t *testing.T) {
+	labels := ContextLabels(context.Background())
+	if labels != nil {
+		t.Fatalf("context without labels has %v", labels)
+	}
+	// setting labels outside the hook does nothing
+	labels.Set("tenant", "acme")
+	if _, ok := labels.Get("tenant"); ok {
+		t.Error("nil labels have a label")
+	}
+}
+
+func TestEncodeLabels(t *testing.T) {
+	if s := encodeLabels(nil); s != "-" {
+		t.Errorf("empty labels are encoded as %q", s)
+	}
+	if s := encodeLabels(map[string]string{"b": "x y", "a": "1&2"}); s != "a=1%262&b=x+y" {
+		t.Errorf("labels are encoded as %q", s)
+	}
+}
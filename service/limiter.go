@@ -0,0 +1,101 @@
+package service
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// tokenBucket limits throughput to rate bytes per second with bursts up to burst bytes.
+// Waiters reserve tokens in order of arrival, so the bucket never deadlocks on bursts bigger than its size:
+// a big reservation just makes the next waiters wait longer.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst int64) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// setRate changes the rate and the burst of the bucket.
+func (tb *tokenBucket) setRate(rate, burst int64) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.rate = float64(rate)
+	tb.burst = float64(burst)
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+}
+
+// wait blocks until n bytes are allowed to pass or ctx is done.
+func (tb *tokenBucket) wait(ctx context.Context, n int) error {
+	tb.mu.Lock()
+	now := time.Now()
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+	tb.tokens -= float64(n)
+	delay := time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+	tb.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// maxChunk returns the max number of bytes which should be read at once.
+func (tb *tokenBucket) maxChunk() int {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if tb.burst < 1 {
+		return 1
+	}
+	return int(tb.burst)
+}
+
+// limitedReader is a reader throttled by token buckets.
+// Reads are limited to the smallest burst of the buckets, so concurrent readers of a shared bucket
+// take turns in small portions and none of them is starved.
+type limitedReader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*tokenBucket
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	for _, limiter := range lr.limiters {
+		if limit := limiter.maxChunk(); len(p) > limit {
+			p = p[:limit]
+		}
+	}
+	n, err := lr.r.Read(p)
+	if n > 0 {
+		for _, limiter := range lr.limiters {
+			if werr := limiter.wait(lr.ctx, n); werr != nil {
+				return n, werr
+			}
+		}
+	}
+	return n, err
+}
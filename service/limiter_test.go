@@ -0,0 +1,50 @@
+package service
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGlobalBurst(t *testing.T) {
+	for rate, want := range map[int64]int64{
+		100:     minGlobalBurst,
+		10_000:  1_000,
+		1 << 20: 1 << 20 / 10,
+	} {
+		if burst := globalBurst(rate); burst != want {
+			t.Errorf("burst of rate %d is %d, want %d", rate, burst, want)
+		}
+	}
+}
+
+func TestConnRateLimitTiming(t *testing.T) {
+	const rate, size = 50 * 1024, 100 * 1024
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Targets:       []string{startBackend(t, func(conn net.Conn) { conn.Write(make([]byte, size)) })},
+		ConnRateLimit: rate,
+	}}})
+
+	// the limit applies per connection, so concurrent connections don't slow each other down
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		conn := dialProxy(t, p, 0)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, err := io.Copy(io.Discard, conn)
+			if err != nil || n != size {
+				t.Errorf("received %d bytes: %v", n, err)
+			}
+		}()
+	}
+	wg.Wait()
+	// the burst of the rate passes right away, the rest at the rate
+	want := time.Duration(size-rate) * time.Second / rate
+	if elapsed := time.Since(start); elapsed < want-100*time.Millisecond || elapsed > 2*want {
+		t.Errorf("%d bytes at %d B/s took %s, want about %s", size, rate, elapsed, want)
+	}
+}
@@ -0,0 +1,82 @@
+package service
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Logger receives log events of the proxy, so embedders can use their own logging library.
+// Fields contain the structured context of the event, e.g. "frontend" or "backend"; the error of the event,
+// if any, is in the "error" field. NewZerologLogger adapts a zerolog logger.
+type Logger interface {
+	Debug(msg string, fields map[string]any)
+	Info(msg string, fields map[string]any)
+	Warn(msg string, fields map[string]any)
+	Error(msg string, fields map[string]any)
+}
+
+// DebugEnabler is optionally implemented by a Logger to tell whether it writes debug events.
+// The proxy doesn't build debug events which would be dropped.
+type DebugEnabler interface {
+	DebugEnabled() bool
+}
+
+type fields = map[string]any
+
+// proxyLogger passes log events of proxy components to the Logger. Debug events are skipped without
+// calling the Logger when it doesn't write them, and a sampling logger passes only 1 of every sampleN of them.
+type proxyLogger struct {
+	out     Logger
+	enabler DebugEnabler
+	sampleN uint32
+	counter *atomic.Uint32
+}
+
+func newProxyLogger(out Logger) *proxyLogger {
+	enabler, _ := out.(DebugEnabler)
+	return &proxyLogger{out: out, enabler: enabler}
+}
+
+// sampled returns the logger which passes 1 of every n debug events. Info and more severe events are all passed.
+// The logger itself is returned if n is less than 2.
+func (l *proxyLogger) sampled(n uint32) *proxyLogger {
+	if n < 2 {
+		return l
+	}
+	return &proxyLogger{out: l.out, enabler: l.enabler, sampleN: n, counter: &atomic.Uint32{}}
+}
+
+// debugEnabled reports whether debug events are written. It is used to skip building expensive events.
+func (l *proxyLogger) debugEnabled() bool {
+	return l.enabler == nil || l.enabler.DebugEnabled()
+}
+
+// sample reports whether the next debug event is passed. The first event is always passed.
+func (l *proxyLogger) sample() bool {
+	return l.sampleN < 2 || l.counter.Add(1)%l.sampleN == 1
+}
+
+func (l *proxyLogger) Debug(msg string, fields map[string]any) {
+	if l.debugEnabled() && l.sample() {
+		l.out.Debug(msg, fields)
+	}
+}
+
+// Debugf passes the debug event with the formatted message and no fields. The message is formatted only if the event is passed.
+func (l *proxyLogger) Debugf(format string, args ...any) {
+	if l.debugEnabled() && l.sample() {
+		l.out.Debug(fmt.Sprintf(format, args...), nil)
+	}
+}
+
+func (l *proxyLogger) Info(msg string, fields map[string]any) {
+	l.out.Info(msg, fields)
+}
+
+func (l *proxyLogger) Warn(msg string, fields map[string]any) {
+	l.out.Warn(msg, fields)
+}
+
+func (l *proxyLogger) Error(msg string, fields map[string]any) {
+	l.out.Error(msg, fields)
+}
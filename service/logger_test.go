@@ -0,0 +1,229 @@
+package service
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type logEvent struct {
+	level  string
+	msg    string
+	fields map[string]any
+}
+
+// fakeLogger records log events. Debug events are dropped if noDebug is set.
+type fakeLogger struct {
+	noDebug bool
+	mu      sync.Mutex
+	events  []logEvent
+}
+
+func (l *fakeLogger) log(level, msg string, fields map[string]any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, logEvent{level: level, msg: msg, fields: fields})
+}
+
+func (l *fakeLogger) Debug(msg string, fields map[string]any) { l.log("debug", msg, fields) }
+func (l *fakeLogger) Info(msg string, fields map[string]any)  { l.log("info", msg, fields) }
+func (l *fakeLogger) Warn(msg string, fields map[string]any)  { l.log("warn", msg, fields) }
+func (l *fakeLogger) Error(msg string, fields map[string]any) { l.log("error", msg, fields) }
+func (l *fakeLogger) DebugEnabled() bool                      { return !l.noDebug }
+
+// find returns events whose message starts with prefix.
+func (l *fakeLogger) find(prefix string) []logEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var found []logEvent
+	for _, e := range l.events {
+		if strings.HasPrefix(e.msg, prefix) {
+			found = append(found, e)
+		}
+	}
+	return found
+}
+
+// exchange sends ping through the proxy to an echo backend and closes the connection.
+func exchange(t *testing.T, p Proxy) {
+	t.Helper()
+	conn := dialProxy(t, p, 0)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("ping"))
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Fatalf("exchange: %v", err)
+	}
+	conn.Close()
+}
+
+func TestLoggerEvents(t *testing.T) {
+	logger := &fakeLogger{}
+	done := make(chan SessionStats, 1)
+	p := startProxy(t, ProxyConfig{
+		Logger: logger,
+		Apps: []ConfigApp{{
+			Targets:      []string{startBackend(t, echo)},
+			OnDisconnect: func(s SessionStats) { done <- s },
+		}},
+	})
+	exchange(t, p)
+	<-done
+
+	accepted := logger.find("accepted new connection")
+	if len(accepted) != 1 {
+		t.Fatalf("%d accept events, want 1", len(accepted))
+	}
+	if e := accepted[0]; e.level != "debug" || e.fields["frontend"] != p.fnds[0].name() || e.fields["connection"] == nil {
+		t.Errorf("accept event is %+v", e)
+	}
+	closing := logger.find("closing connection")
+	if len(closing) != 2 {
+		t.Fatalf("%d close events, want 2", len(closing))
+	}
+	if reason := closing[0].fields["reason"]; reason != ErrClientClosed.Error() {
+		t.Errorf("close reason is %v, want %v", reason, ErrClientClosed)
+	}
+}
+
+func TestLoggerDebugDisabled(t *testing.T) {
+	logger := &fakeLogger{noDebug: true}
+	done := make(chan SessionStats, 1)
+	p := startProxy(t, ProxyConfig{
+		Logger: logger,
+		Apps: []ConfigApp{{
+			Targets:      []string{startBackend(t, echo)},
+			OnDisconnect: func(s SessionStats) { done <- s },
+		}},
+	})
+	exchange(t, p)
+	<-done
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	for _, e := range logger.events {
+		if e.level == "debug" {
+			t.Errorf("debug event %q is passed to the logger which doesn't write them", e.msg)
+		}
+	}
+}
+
+func TestSkipReasonsLogged(t *testing.T) {
+	logger := &fakeLogger{}
+	names := []string{"selected", "tried", "maintenance", "inactive", "ejected", "draining", "removed", "standby"}
+	addrs := make(map[string]string)
+	config := ConfigApp{Strategy: roundRobinName}
+	for _, name := range names {
+		addrs[name] = startBackend(t, echo)
+		b := ConfigBackend{Addr: addrs[name]}
+		if name == "standby" {
+			b.Priority = 1
+		}
+		config.Backends = append(config.Backends, b)
+	}
+	p := startProxy(t, ProxyConfig{Logger: logger, Apps: []ConfigApp{config}})
+	a := p.apps[0]
+	a.rmu.RLock()
+	bnds := make(map[string]*backend)
+	for _, name := range names {
+		bnds[name] = a.backendByAddr(addrs[name])
+	}
+	a.rmu.RUnlock()
+	for _, bnd := range bnds {
+		if !waitFor(t, 5*time.Second, bnd.eligible) {
+			t.Fatalf("backend %s isn't active", bnd.addr)
+		}
+	}
+
+	bnds["maintenance"].maintenance.Store(true)
+	bnds["inactive"].active.Store(false)
+	bnds["ejected"].outlier.ejectedUntil.Store(time.Now().Add(time.Hour).UnixNano())
+	bnds["draining"].draining.Store(true)
+	bnds["draining"].removed.Store(true)
+	bnds["removed"].removed.Store(true)
+	chosen, err := a.nextBackend(selectionKey{clientIP: "127.0.0.1"}, map[*backend]bool{bnds["tried"]: true})
+	if err != nil {
+		t.Fatalf("nextBackend(): %v", err)
+	}
+	if chosen != bnds["selected"] {
+		t.Fatalf("backend %s is selected, want %s", chosen.addr, addrs["selected"])
+	}
+
+	events := logger.find("backend selected")
+	if len(events) == 0 {
+		t.Fatal("selection isn't logged")
+	}
+	skipped, _ := events[len(events)-1].fields["skipped"].(map[string]string)
+	for name, want := range map[string]string{
+		"tried":       "connection failed in this selection",
+		"maintenance": "maintenance",
+		"inactive":    "inactive",
+		"ejected":     "circuit open",
+		"draining":    "draining",
+		"removed":     "removed",
+		"standby":     "priority 1, tier 0 is available",
+	} {
+		if got := skipped[addrs[name]]; got != want {
+			t.Errorf("%s backend is skipped as %q, want %q", name, got, want)
+		}
+	}
+	if len(skipped) != len(names)-1 {
+		t.Errorf("%d backends are skipped, want %d: %v", len(skipped), len(names)-1, skipped)
+	}
+}
+
+func TestConnLogSampling(t *testing.T) {
+	// debugEvents returns the number of debug events of 100 connections logged with the sampling
+	debugEvents := func(sampling uint32) int {
+		logger := &fakeLogger{}
+		p := startProxy(t, ProxyConfig{
+			Logger:          logger,
+			ConnLogSampling: sampling,
+			Apps:            []ConfigApp{{Targets: []string{startBackend(t, echo)}}},
+		})
+		// events of the start are not sampled
+		logger.mu.Lock()
+		logger.events = nil
+		logger.mu.Unlock()
+		for i := 0; i < 100; i++ {
+			exchange(t, p)
+		}
+		a := p.apps[0]
+		if !waitFor(t, time.Second, func() bool { return a.Stats().Active == 0 }) {
+			t.Fatal("connections aren't released")
+		}
+		logger.mu.Lock()
+		defer logger.mu.Unlock()
+		n := 0
+		for _, e := range logger.events {
+			if e.level == "debug" {
+				n++
+			}
+		}
+		return n
+	}
+
+	all, sampled := debugEvents(0), debugEvents(10)
+	if all < 100 {
+		t.Fatalf("%d debug events of 100 connections without sampling", all)
+	}
+	if sampled < all/10-2 || sampled > all/10+2 {
+		t.Errorf("%d of %d debug events are logged with 1 in 10 sampling", sampled, all)
+	}
+}
+
+func TestSampledLoggerPassesInfo(t *testing.T) {
+	out := &fakeLogger{}
+	logger := newProxyLogger(out).sampled(10)
+	for i := 0; i < 100; i++ {
+		logger.Debug("debug", nil)
+		logger.Info("info", nil)
+	}
+	if n := len(out.find("debug")); n != 10 {
+		t.Errorf("%d of 100 debug events are passed, want 10", n)
+	}
+	if n := len(out.find("info")); n != 100 {
+		t.Errorf("%d of 100 info events are passed", n)
+	}
+}
@@ -0,0 +1,99 @@
+package service
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestMaxConnAgeRebalances(t *testing.T) {
+	old, added := startBackend(t, echo), startBackend(t, echo)
+	config := ProxyConfig{Apps: []ConfigApp{{
+		Targets:    []string{old},
+		MaxConnAge: 200 * time.Millisecond,
+	}}}
+	p := startProxy(t, config)
+	a := p.apps[0]
+	counts := func() (int, int) {
+		a.rmu.RLock()
+		defer a.rmu.RUnlock()
+		n := 0
+		if bnd := a.backendByAddr(added); bnd != nil {
+			n = bnd.getConnCount()
+		}
+		return a.backendByAddr(old).getConnCount(), n
+	}
+
+	var clients []net.Conn
+	for i := 0; i < 4; i++ {
+		clients = append(clients, openExchange(t, p))
+	}
+	config.Apps[0].Targets = []string{old, added}
+	if err := p.Reload(config); err != nil {
+		t.Fatalf("Reload(): %v", err)
+	}
+	if !waitFor(t, 5*time.Second, func() bool {
+		a.rmu.RLock()
+		defer a.rmu.RUnlock()
+		bnd := a.backendByAddr(added)
+		return bnd != nil && bnd.eligible()
+	}) {
+		t.Fatal("added backend isn't active")
+	}
+	if c1, c2 := counts(); c1 != 4 || c2 != 0 {
+		t.Fatalf("connections are %d:%d before recycling, want 4:0", c1, c2)
+	}
+
+	// clients reconnect when the proxy closes their connections of max age
+	for _, conn := range clients {
+		if _, err := io.ReadAll(conn); err != nil {
+			t.Fatalf("recycled connection: %v", err)
+		}
+	}
+	if !waitFor(t, time.Second, func() bool { c1, c2 := counts(); return c1+c2 == 0 }) {
+		t.Fatal("recycled connections aren't released")
+	}
+	for i := 0; i < 4; i++ {
+		openExchange(t, p)
+	}
+	if c1, c2 := counts(); c1 != 2 || c2 != 2 {
+		t.Errorf("connections are %d:%d after recycling, want 2:2", c1, c2)
+	}
+}
+
+func TestMaxConnAgeClosesActiveTransfer(t *testing.T) {
+	const maxAge = 200 * time.Millisecond
+	stats := make(chan SessionStats, 1)
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Targets:      []string{startBackend(t, echo)},
+		MaxConnAge:   maxAge,
+		OnDisconnect: func(s SessionStats) { stats <- s },
+	}}})
+	conn := dialProxy(t, p, 0)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+
+	// the transfer never idles, only the age closes it
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			if _, err := conn.Write(buf); err != nil {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	if _, err := io.Copy(io.Discard, conn); err != nil && !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("transfer: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < maxAge || elapsed > maxAge+200*time.Millisecond {
+		t.Errorf("transfer is closed after %s, want %s", elapsed, maxAge)
+	}
+	s := <-stats
+	if !errors.Is(s.Reason, ErrClosedByProxy) || s.BytesIn == 0 {
+		t.Errorf("transfer of %d bytes ended with %v, want %v", s.BytesIn, s.Reason, ErrClosedByProxy)
+	}
+}
@@ -0,0 +1,134 @@
+package service
+
+import (
+	"expvar"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics are published with expvar, so they are available at /debug/vars of http.DefaultServeMux
+// and at /metrics of the admin API.
+var (
+	selectionLatency = newHistogramVec("tcp_proxy_selection_latency_seconds", []time.Duration{
+		time.Microsecond, 5 * time.Microsecond, 10 * time.Microsecond, 50 * time.Microsecond,
+		100 * time.Microsecond, 500 * time.Microsecond, time.Millisecond, 5 * time.Millisecond,
+	})
+	backendDialLatency      = newHistogramVec("tcp_proxy_backend_dial_seconds", connectBounds)
+	backendHandshakeLatency = newHistogramVec("tcp_proxy_backend_handshake_seconds", connectBounds)
+)
+
+// connectBounds are histogram bounds of backend connection setup steps.
+var connectBounds = []time.Duration{
+	100 * time.Microsecond, 500 * time.Microsecond, time.Millisecond, 5 * time.Millisecond, 10 * time.Millisecond,
+	50 * time.Millisecond, 100 * time.Millisecond, 500 * time.Millisecond, time.Second, 2 * time.Second,
+}
+
+var (
+	frontendConnections = expvar.NewMap("tcp_proxy_frontend_connections")
+	backendConnections  = expvar.NewMap("tcp_proxy_backend_connections")
+	// frontendPendingSetups is the number of accepted connections which are being set up.
+	frontendPendingSetups = expvar.NewMap("tcp_proxy_frontend_pending_setups")
+	// frontendAcceptDelays counts accepts delayed because pending setups exceeded SetupSoftLimit.
+	frontendAcceptDelays = expvar.NewMap("tcp_proxy_frontend_accept_delays")
+	// frontendCopyGoroutines is the number of running copy goroutines, twice the number of connections without leaks.
+	frontendCopyGoroutines = expvar.NewMap("tcp_proxy_frontend_copy_goroutines")
+	// backendDialFailures counts failed dials per backend. Failed dials aren't observed by backendDialLatency.
+	backendDialFailures = expvar.NewMap("tcp_proxy_backend_dial_failures")
+	// appAvailable is 0 while all backends of the app are down, otherwise 1.
+	appAvailable = expvar.NewMap("tcp_proxy_app_available")
+)
+
+// publishGauge publishes the value of v in m by the key.
+func publishGauge(m *expvar.Map, key string, v *atomic.Int64) {
+	m.Set(key, expvar.Func(func() any {
+		return v.Load()
+	}))
+}
+
+// histogram is a cumulative histogram of durations. It implements expvar.Var.
+type histogram struct {
+	bounds []time.Duration
+	// counts has an extra last bucket for values greater than all bounds.
+	counts []atomic.Int64
+	count  atomic.Int64
+	sum    atomic.Int64
+}
+
+func newHistogram(bounds []time.Duration) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]atomic.Int64, len(bounds)+1),
+	}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := 0
+	for i < len(h.bounds) && d > h.bounds[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.count.Add(1)
+	h.sum.Add(int64(d))
+}
+
+// String returns JSON with cumulative bucket counts keyed by upper bounds in seconds.
+func (h *histogram) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, `{"count": %d, "sum": %s, "buckets": {`, h.count.Load(), formatSeconds(time.Duration(h.sum.Load())))
+	var cumulative int64
+	for i := range h.counts {
+		cumulative += h.counts[i].Load()
+		bound := `"+Inf"`
+		if i < len(h.bounds) {
+			bound = strconv.Quote(formatSeconds(h.bounds[i]))
+		}
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%s: %d", bound, cumulative)
+	}
+	b.WriteString("}}")
+	return b.String()
+}
+
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'g', -1, 64)
+}
+
+// histogramVec is a set of histograms with the same bounds keyed by a label.
+type histogramVec struct {
+	m      *expvar.Map
+	bounds []time.Duration
+	mu     sync.Mutex
+}
+
+func newHistogramVec(name string, bounds []time.Duration) *histogramVec {
+	return &histogramVec{
+		m:      expvar.NewMap(name),
+		bounds: bounds,
+	}
+}
+
+// with returns the histogram for the label, creating it if needed.
+func (v *histogramVec) with(label string) *histogram {
+	if h, ok := v.m.Get(label).(*histogram); ok {
+		return h
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if h, ok := v.m.Get(label).(*histogram); ok {
+		return h
+	}
+	h := newHistogram(v.bounds)
+	v.m.Set(label, h)
+	return h
+}
+
+// delete removes the histogram of the label.
+func (v *histogramVec) delete(label string) {
+	v.m.Delete(label)
+}
@@ -0,0 +1,189 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram([]time.Duration{time.Millisecond, time.Second})
+	for _, d := range []time.Duration{time.Microsecond, time.Millisecond, 2 * time.Millisecond, time.Minute} {
+		h.observe(d)
+	}
+	var got struct {
+		Count   int64            `json:"count"`
+		Sum     float64          `json:"sum"`
+		Buckets map[string]int64 `json:"buckets"`
+	}
+	if err := json.Unmarshal([]byte(h.String()), &got); err != nil {
+		t.Fatalf("histogram isn't JSON: %v", err)
+	}
+	if got.Count != 4 || got.Buckets["0.001"] != 2 || got.Buckets["1"] != 3 || got.Buckets["+Inf"] != 4 {
+		t.Errorf("histogram is %s", h)
+	}
+}
+
+func TestSelectionLatencyObserved(t *testing.T) {
+	h := selectionLatency.with(srcHashName)
+	before := h.count.Load()
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Targets:  []string{startBackend(t, echo), startBackend(t, echo)},
+		Strategy: srcHashName,
+	}}})
+	for i := 0; i < 3; i++ {
+		exchange(t, p)
+	}
+	if n := h.count.Load() - before; n != 3 {
+		t.Errorf("%d selections are observed, want 3", n)
+	}
+}
+
+func TestConnectionGaugeMatchesMap(t *testing.T) {
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{Targets: []string{startBackend(t, echo)}}}})
+	fnd := p.fnds[0]
+	gauge := func() string { return frontendConnections.Get(fnd.metricKey).String() }
+	// consistent compares the gauge with the map under its lock, so both show the same moment
+	consistent := func() bool {
+		fnd.rmu.RLock()
+		defer fnd.rmu.RUnlock()
+		return gauge() == strconv.Itoa(len(fnd.connections))
+	}
+
+	stop := make(chan struct{})
+	checked := make(chan bool)
+	go func() {
+		ok := true
+		for {
+			select {
+			case <-stop:
+				checked <- ok
+				return
+			default:
+			}
+			ok = ok && consistent()
+		}
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				exchange(t, p)
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	if !<-checked {
+		t.Error("gauge differs from the connections map")
+	}
+	if !waitFor(t, time.Second, func() bool { return gauge() == "0" }) {
+		t.Errorf("gauge is %s after all connections are closed", gauge())
+	}
+}
+
+// slowDialer dials in-memory echo connections after delay.
+type slowDialer struct {
+	delay time.Duration
+}
+
+func (d slowDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	time.Sleep(d.delay)
+	return pipeDialer{}.DialContext(ctx, network, addr)
+}
+
+func TestDialLatencyObserved(t *testing.T) {
+	const delay = 20 * time.Millisecond
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Name:    "dial-latency",
+		Targets: []string{"192.0.2.1:80"},
+		Dialer:  slowDialer{delay: delay},
+	}}})
+	h := backendDialLatency.with("dial-latency/192.0.2.1:80")
+	count, sum := h.count.Load(), h.sum.Load()
+	for i := 0; i < 3; i++ {
+		exchange(t, p)
+	}
+	if n := h.count.Load() - count; n != 3 {
+		t.Errorf("%d dials are observed, want 3", n)
+	}
+	if d := time.Duration(h.sum.Load() - sum); d < 3*delay {
+		t.Errorf("observed dials took %s, want at least %s", d, 3*delay)
+	}
+}
+
+func TestPendingSetupsGauge(t *testing.T) {
+	dialer := &stallDialer{}
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Targets:     []string{"192.0.2.1:80"},
+		Dialer:      dialer,
+		SetupBudget: time.Second,
+	}}})
+	waitBackendsActive(t, p)
+	dialer.stalled.Store(true)
+	fnd := p.fnds[0]
+	gauge := func() string { return frontendPendingSetups.Get(fnd.metricKey).String() }
+
+	var clients []net.Conn
+	for i := 0; i < 3; i++ {
+		clients = append(clients, dialProxy(t, p, 0))
+	}
+	if !waitFor(t, 5*time.Second, func() bool { return gauge() == "3" }) {
+		t.Fatalf("pending setups gauge is %s with 3 stalled dials, want 3", gauge())
+	}
+	// the setups fail when the budget is exhausted
+	for _, conn := range clients {
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Read(make([]byte, 1))
+	}
+	if !waitFor(t, time.Second, func() bool { return gauge() == "0" }) {
+		t.Errorf("pending setups gauge is %s after the setups failed, want 0", gauge())
+	}
+
+	dialer.stalled.Store(false)
+	openExchange(t, p)
+	if !waitFor(t, time.Second, func() bool { return gauge() == "0" }) {
+		t.Errorf("pending setups gauge is %s with a copying connection, want 0", gauge())
+	}
+}
+
+func TestSetupSoftLimit(t *testing.T) {
+	const limit = 4
+	dialer := &stallDialer{}
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Targets:        []string{"192.0.2.1:80"},
+		Dialer:         dialer,
+		SetupBudget:    5 * time.Second,
+		SetupSoftLimit: limit,
+	}}})
+	waitBackendsActive(t, p)
+	dialer.stalled.Store(true)
+	fnd := p.fnds[0]
+	pending := func() int64 { return fnd.pendingSetups.Load() }
+
+	for i := 0; i < 5*limit; i++ {
+		dialProxy(t, p, 0)
+	}
+	if !waitFor(t, 5*time.Second, func() bool { return pending() >= limit }) {
+		t.Fatalf("%d pending setups after a flood, want at least %d", pending(), limit)
+	}
+	// every accept above the limit waits up to softLimitMaxWait
+	var max int64
+	for deadline := time.Now().Add(3 * softLimitMaxWait); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if n := pending(); n > max {
+			max = n
+		}
+	}
+	if max > limit+4 {
+		t.Errorf("%d pending setups within %v of the flood, want about %d", max, 3*softLimitMaxWait, limit)
+	}
+	if delays := frontendAcceptDelays.Get(fnd.metricKey); delays == nil || delays.String() == "0" {
+		t.Errorf("accept delays are %v, want some", delays)
+	}
+}
@@ -0,0 +1,76 @@
+//go:build linux
+
+package service
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST of linux/netfilter_ipv4.h, IP6T_SO_ORIGINAL_DST of linux/netfilter_ipv6/ip6_tables.h has the same value.
+const soOriginalDst = 80
+
+// originalDst returns the destination address of the connection before it was redirected by netfilter (REDIRECT, DNAT).
+func originalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, errors.Wrap(err, "SyscallConn()")
+	}
+	local, _ := conn.LocalAddr().(*net.TCPAddr)
+	v4 := local != nil && local.IP.To4() != nil
+
+	var addr *net.TCPAddr
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if v4 {
+			var mreq *syscall.IPv6Mreq
+			// sockaddr_in fits into the 16 bytes of the multicast address
+			mreq, sockErr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+			if sockErr == nil {
+				addr, sockErr = parseSockaddrInet4(mreq.Multiaddr[:])
+			}
+			return
+		}
+		var info *syscall.IPv6MTUInfo
+		// sockaddr_in6 is the first member of ip6_mtuinfo
+		info, sockErr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, soOriginalDst)
+		if sockErr == nil {
+			addr = sockaddrInet6ToTCPAddr(&info.Addr)
+		}
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Control()")
+	}
+	if sockErr != nil {
+		return nil, errors.Wrap(sockErr, "getsockopt(SO_ORIGINAL_DST)")
+	}
+	return addr, nil
+}
+
+// parseSockaddrInet4 parses struct sockaddr_in. The port and the address are in network byte order.
+func parseSockaddrInet4(b []byte) (*net.TCPAddr, error) {
+	if len(b) < 8 {
+		return nil, errors.Errorf("sockaddr_in is %d bytes", len(b))
+	}
+	family := *(*uint16)(unsafe.Pointer(&b[0]))
+	if family != syscall.AF_INET {
+		return nil, errors.Errorf("unexpected address family %d", family)
+	}
+	return &net.TCPAddr{
+		IP:   net.IPv4(b[4], b[5], b[6], b[7]),
+		Port: int(b[2])<<8 | int(b[3]),
+	}, nil
+}
+
+func sockaddrInet6ToTCPAddr(sa *syscall.RawSockaddrInet6) *net.TCPAddr {
+	port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, sa.Addr[:])
+	return &net.TCPAddr{
+		IP:   ip,
+		Port: int(port[0])<<8 | int(port[1]),
+	}
+}
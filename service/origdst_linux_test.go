@@ -0,0 +1,52 @@
+//go:build linux
+
+package service
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+func TestParseSockaddrInet4(t *testing.T) {
+	b := make([]byte, 16)
+	*(*uint16)(unsafe.Pointer(&b[0])) = syscall.AF_INET
+	copy(b[2:], []byte{0x1f, 0x90, 10, 1, 2, 3})
+	addr, err := parseSockaddrInet4(b)
+	if err != nil {
+		t.Fatalf("parseSockaddrInet4(): %v", err)
+	}
+	if addr.String() != "10.1.2.3:8080" {
+		t.Errorf("parsed address is %s, want 10.1.2.3:8080", addr)
+	}
+
+	if _, err := parseSockaddrInet4(b[:7]); err == nil {
+		t.Error("short sockaddr_in is parsed")
+	}
+	*(*uint16)(unsafe.Pointer(&b[0])) = syscall.AF_INET6
+	if _, err := parseSockaddrInet4(b); err == nil {
+		t.Error("sockaddr of another family is parsed")
+	}
+}
+
+func TestSockaddrInet6ToTCPAddr(t *testing.T) {
+	var sa syscall.RawSockaddrInet6
+	sa.Family = syscall.AF_INET6
+	port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+	port[0], port[1] = 0x01, 0xbb
+	copy(sa.Addr[:], net.ParseIP("2001:db8::7"))
+	if addr := sockaddrInet6ToTCPAddr(&sa); addr.String() != "[2001:db8::7]:443" {
+		t.Errorf("parsed address is %s, want [2001:db8::7]:443", addr)
+	}
+}
+
+func TestOriginalDstNotRedirected(t *testing.T) {
+	_, accepted := tcpPair(t)
+	// netfilter has no record of connections it didn't redirect
+	if addr, err := originalDst(accepted.(*net.TCPConn)); !errors.Is(err, syscall.ENOENT) {
+		t.Errorf("original destination of a connection which isn't redirected is %v, %v, want ENOENT", addr, err)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package service
+
+import (
+	"net"
+)
+
+// originalDst isn't supported on this platform.
+func originalDst(*net.TCPConn) (*net.TCPAddr, error) {
+	return nil, errOriginalDstUnsupported
+}
@@ -0,0 +1,115 @@
+package service
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	outlierWindow             = 10 * time.Second
+	defaultOutlierMinSessions = 10
+	defaultOutlierEjectTime   = 30 * time.Second
+)
+
+// outlierDetector tracks the rate of failed sessions of a backend and ejects the backend
+// when the rate exceeds the threshold. It works as a circuit breaker: the ejected backend's circuit is open.
+// With halfOpen enabled, the circuit becomes half-open when the ejection time passes: client traffic
+// still skips the backend, and only health check probes exercise it. A successful probe closes the circuit,
+// a failed one opens it again.
+type outlierDetector struct {
+	// errorRate is the share (0..1] of failed sessions which ejects the backend. Zero disables detection.
+	errorRate   float64
+	minSessions int
+	ejectTime   time.Duration
+	// halfOpen enables the half-open state after ejection.
+	halfOpen bool
+
+	mu          sync.Mutex
+	windowStart time.Time
+	total       int
+	failed      int
+	// ejectedUntil is the time (unix nanoseconds) until which the backend is ejected.
+	ejectedUntil atomic.Int64
+	// awaitingProbe is set on ejection if halfOpen is enabled and cleared by a successful probe after ejectedUntil.
+	awaitingProbe atomic.Bool
+}
+
+func newOutlierDetector(errorRate float64, minSessions int, ejectTime time.Duration, halfOpen bool) *outlierDetector {
+	if minSessions <= 0 {
+		minSessions = defaultOutlierMinSessions
+	}
+	if ejectTime <= 0 {
+		ejectTime = defaultOutlierEjectTime
+	}
+	return &outlierDetector{
+		errorRate:   errorRate,
+		minSessions: minSessions,
+		ejectTime:   ejectTime,
+		halfOpen:    halfOpen,
+	}
+}
+
+// record counts the session result. It returns true if the backend has just been ejected.
+func (d *outlierDetector) record(failed bool) bool {
+	if d.errorRate <= 0 {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(d.windowStart) > outlierWindow {
+		d.windowStart = now
+		d.total = 0
+		d.failed = 0
+	}
+	d.total++
+	if failed {
+		d.failed++
+	}
+	if d.total < d.minSessions || float64(d.failed)/float64(d.total) < d.errorRate {
+		return false
+	}
+	if d.ejected() {
+		return false
+	}
+	d.ejectedUntil.Store(now.Add(d.ejectTime).UnixNano())
+	if d.halfOpen {
+		d.awaitingProbe.Store(true)
+	}
+	d.windowStart = now
+	d.total = 0
+	d.failed = 0
+	return true
+}
+
+// ejected reports whether the backend is excluded from client traffic now: its circuit is open or half-open.
+func (d *outlierDetector) ejected() bool {
+	return time.Now().UnixNano() < d.ejectedUntil.Load() || d.awaitingProbe.Load()
+}
+
+// state returns the circuit state: "open", "half-open" or "closed".
+func (d *outlierDetector) state() string {
+	switch {
+	case time.Now().UnixNano() < d.ejectedUntil.Load():
+		return "open"
+	case d.awaitingProbe.Load():
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// probe applies the result of a health check probe to the half-open circuit.
+// It returns true if the circuit has just been closed.
+func (d *outlierDetector) probe(ok bool) bool {
+	if !d.awaitingProbe.Load() || time.Now().UnixNano() < d.ejectedUntil.Load() {
+		return false
+	}
+	if !ok {
+		d.ejectedUntil.Store(time.Now().Add(d.ejectTime).UnixNano())
+		return false
+	}
+	return d.awaitingProbe.CompareAndSwap(true, false)
+}
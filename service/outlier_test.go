@@ -0,0 +1,118 @@
+package service
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestOutlierEjectsDroppingBackend(t *testing.T) {
+	dropping := startBackend(t, func(conn net.Conn) {})
+	healthy := startBackend(t, echo)
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Targets:            []string{dropping, healthy},
+		Strategy:           "round_robin",
+		OutlierErrorRate:   0.5,
+		OutlierMinSessions: 4,
+		OutlierEjectTime:   time.Minute,
+	}}})
+	a := p.apps[0]
+	bnd := a.bnds[0]
+	if bnd.addr != dropping {
+		bnd = a.bnds[1]
+	}
+
+	for i := 0; i < 10 && !bnd.outlier.ejected(); i++ {
+		conn := dialProxy(t, p, 0)
+		conn.SetDeadline(time.Now().Add(time.Second))
+		conn.Write([]byte("ping"))
+		io.ReadFull(conn, make([]byte, 4))
+		conn.Close()
+		waitFor(t, time.Second, func() bool { return bnd.getConnCount() == 0 })
+	}
+	if !bnd.outlier.ejected() {
+		t.Fatal("backend closing connections right after accept isn't ejected")
+	}
+
+	// the ejected backend is skipped
+	for i := 0; i < 4; i++ {
+		conn := dialProxy(t, p, 0)
+		conn.SetDeadline(time.Now().Add(time.Second))
+		conn.Write([]byte("ping"))
+		if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+			t.Fatalf("connection after ejection: %v", err)
+		}
+		conn.Close()
+	}
+}
+
+func TestOutlierIgnoresClientCloses(t *testing.T) {
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Targets:            []string{startBackend(t, echo)},
+		OutlierErrorRate:   0.5,
+		OutlierMinSessions: 4,
+		OutlierEjectTime:   time.Minute,
+	}}})
+	bnd := p.apps[0].bnds[0]
+	for i := 0; i < 10; i++ {
+		conn := dialProxy(t, p, 0)
+		conn.Write([]byte("ping"))
+		io.ReadFull(conn, make([]byte, 4))
+		reset(conn)
+		waitFor(t, time.Second, func() bool { return bnd.getConnCount() == 0 })
+	}
+	if bnd.outlier.ejected() {
+		t.Fatal("backend is ejected because clients reset their connections")
+	}
+}
+
+func TestOutlierHalfOpenAwaitsProbe(t *testing.T) {
+	suspect, healthy := startBackend(t, echo), startBackend(t, echo)
+	stats := make(chan SessionStats, 1)
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Targets:            []string{suspect, healthy},
+		Strategy:           roundRobinName,
+		OutlierErrorRate:   0.5,
+		OutlierMinSessions: 2,
+		OutlierEjectTime:   100 * time.Millisecond,
+		OutlierHalfOpen:    true,
+		OnDisconnect:       func(s SessionStats) { stats <- s },
+	}}})
+	a := p.apps[0]
+	a.rmu.RLock()
+	bnd := a.backendByAddr(suspect)
+	a.rmu.RUnlock()
+	if !waitFor(t, 5*time.Second, bnd.eligible) {
+		t.Fatal("backend isn't active")
+	}
+	// backends returns the number of n sessions per backend
+	backends := func(n int) map[string]int {
+		got := make(map[string]int)
+		for i := 0; i < n; i++ {
+			exchange(t, p)
+			got[(<-stats).Backend.String()]++
+		}
+		return got
+	}
+
+	bnd.outlier.record(true)
+	if !bnd.outlier.record(true) {
+		t.Fatal("backend isn't ejected")
+	}
+	time.Sleep(150 * time.Millisecond)
+	if state := bnd.outlier.state(); state != "half-open" {
+		t.Fatalf("circuit is %s after the ejection time, want half-open", state)
+	}
+	if got := backends(4); got[suspect] != 0 {
+		t.Errorf("half-open backend gets %d of 4 sessions before a probe", got[suspect])
+	}
+
+	bnd.healthcheck()
+	if state := bnd.outlier.state(); state != "closed" {
+		t.Fatalf("circuit is %s after a successful probe, want closed", state)
+	}
+	if got := backends(4); got[suspect] != 2 {
+		t.Errorf("backend gets %d of 4 sessions after the circuit is closed, want 2", got[suspect])
+	}
+}
@@ -0,0 +1,171 @@
+package service
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultPoolMaxIdle = 30 * time.Second
+	// poolCheckTimeout is how long an idle connection is read before reuse to make sure it is still open.
+	poolCheckTimeout = time.Millisecond
+	// poolSettleTime is how long a backend must be quiet after the client closed its side
+	// before its response is considered complete and the connection is pooled.
+	poolSettleTime = 100 * time.Millisecond
+)
+
+// errSettled ends copying from a pooled backend connection when its response is complete.
+var errSettled = errors.New("backend response is complete")
+
+// connPool keeps a bounded set of idle backend connections for reuse.
+// It only makes sense for protocols which tolerate reuse of a connection by different clients.
+type connPool struct {
+	mu      sync.Mutex
+	idle    []idleConn
+	size    int
+	maxIdle time.Duration
+	closed  bool
+}
+
+type idleConn struct {
+	conn  net.Conn
+	since time.Time
+}
+
+// newConnPool returns a pool of at most size idle connections or nil if size isn't positive.
+func newConnPool(size int, maxIdle time.Duration) *connPool {
+	if size <= 0 {
+		return nil
+	}
+	if maxIdle <= 0 {
+		maxIdle = defaultPoolMaxIdle
+	}
+	return &connPool{
+		size:    size,
+		maxIdle: maxIdle,
+	}
+}
+
+// get returns the most recently used idle connection which is still open or nil if there is none.
+// Expired and closed connections are closed and dropped.
+func (p *connPool) get() net.Conn {
+	for {
+		p.mu.Lock()
+		if len(p.idle) == 0 {
+			p.mu.Unlock()
+			return nil
+		}
+		ic := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.mu.Unlock()
+
+		if time.Since(ic.since) < p.maxIdle && isIdleOpen(ic.conn) {
+			return ic.conn
+		}
+		ic.conn.Close()
+	}
+}
+
+// put returns the connection to the pool. It returns false if the pool is full or closed,
+// then the caller must close the connection.
+func (p *connPool) put(conn net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed || len(p.idle) >= p.size {
+		return false
+	}
+	p.idle = append(p.idle, idleConn{conn: conn, since: time.Now()})
+	return true
+}
+
+// expire closes connections idle longer than maxIdle.
+func (p *connPool) expire() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	kept := p.idle[:0]
+	for _, ic := range p.idle {
+		if time.Since(ic.since) >= p.maxIdle {
+			ic.conn.Close()
+			continue
+		}
+		kept = append(kept, ic)
+	}
+	p.idle = kept
+}
+
+// close closes all idle connections. Connections put after close are rejected.
+func (p *connPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, ic := range p.idle {
+		ic.conn.Close()
+	}
+	p.idle = nil
+}
+
+// isIdleOpen checks that the idle connection is neither closed by the backend nor has unexpected data to read.
+func isIdleOpen(conn net.Conn) bool {
+	if err := conn.SetReadDeadline(time.Now().Add(poolCheckTimeout)); err != nil {
+		return false
+	}
+	var b [1]byte
+	n, err := conn.Read(b[:])
+	if n > 0 || !errors.Is(err, os.ErrDeadlineExceeded) {
+		return false
+	}
+	return conn.SetReadDeadline(time.Time{}) == nil
+}
+
+// settleReader reads the remote connection of a session whose backend has a pool. Like deadlineReader,
+// it fails with errIdleRead if the backend sends nothing for timeout (if it is set). Once the session settles,
+// it fails with errSettled when the backend sends nothing for poolSettleTime.
+type settleReader struct {
+	ctx     context.Context
+	sess    *session
+	timeout time.Duration
+}
+
+func (sr *settleReader) Read(p []byte) (int, error) {
+	conn := sr.sess.remote
+	settling := sr.sess.settling.Load()
+	if err := conn.SetReadDeadline(sr.deadline(settling)); err != nil {
+		return 0, errors.Wrap(err, "SetReadDeadline()")
+	}
+	// the session may start settling after the check, then the deadline set by settle is overwritten
+	if !settling && sr.sess.settling.Load() {
+		settling = true
+		if err := conn.SetReadDeadline(sr.deadline(settling)); err != nil {
+			return 0, errors.Wrap(err, "SetReadDeadline()")
+		}
+	}
+	if err := sr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := conn.Read(p)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		if sr.sess.settling.Load() {
+			return n, errSettled
+		}
+		if sr.timeout > 0 {
+			return n, errors.Wrapf(errIdleRead, "no data for %s", sr.timeout)
+		}
+	}
+	return n, err
+}
+
+func (sr *settleReader) deadline(settling bool) time.Time {
+	switch {
+	case settling:
+		return time.Now().Add(poolSettleTime)
+	case sr.timeout > 0:
+		return time.Now().Add(sr.timeout)
+	default:
+		return time.Time{}
+	}
+}
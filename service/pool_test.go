@@ -0,0 +1,173 @@
+package service
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// idleCount returns the number of idle connections in the pool.
+func (p *connPool) idleCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.idle)
+}
+
+// request sends the request, closes the write side and reads the response until EOF.
+func request(t *testing.T, p Proxy, req []byte) []byte {
+	t.Helper()
+	conn := dialProxy(t, p, 0)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(req); err != nil {
+		t.Fatalf("write request: %v", err)
+	}
+	conn.(*net.TCPConn).CloseWrite()
+	resp, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	conn.Close()
+	return resp
+}
+
+// serveRequests answers every 4-byte request with respond until the connection is closed.
+// accepts counts connections with requests, health check connections aren't counted.
+func serveRequests(accepts *atomic.Int32, respond func(conn net.Conn)) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		req := make([]byte, 4)
+		for i := 0; ; i++ {
+			if _, err := io.ReadFull(conn, req); err != nil {
+				return
+			}
+			if i == 0 {
+				accepts.Add(1)
+			}
+			respond(conn)
+		}
+	}
+}
+
+func TestPoolReuse(t *testing.T) {
+	var accepts atomic.Int32
+	backend := startBackend(t, serveRequests(&accepts, func(conn net.Conn) {
+		conn.Write([]byte("pong"))
+	}))
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{Targets: []string{backend}, PoolSize: 2}}})
+	pool := p.apps[0].bnds[0].pool
+
+	for i := 0; i < 5; i++ {
+		if resp := request(t, p, []byte("ping")); string(resp) != "pong" {
+			t.Fatalf("response %d is %q", i, resp)
+		}
+		if !waitFor(t, time.Second, func() bool { return pool.idleCount() == 1 }) {
+			t.Fatalf("connection isn't pooled after request %d", i)
+		}
+	}
+	if n := accepts.Load(); n != 1 {
+		t.Errorf("backend accepted %d connections, want 1", n)
+	}
+}
+
+func TestPoolDelayedResponse(t *testing.T) {
+	var accepts atomic.Int32
+	want := bytes.Repeat([]byte("x"), 256<<10)
+	backend := startBackend(t, serveRequests(&accepts, func(conn net.Conn) {
+		// the response is late and long: the client has already closed its side
+		time.Sleep(poolSettleTime / 2)
+		conn.Write(want)
+	}))
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{Targets: []string{backend}, PoolSize: 2}}})
+
+	if resp := request(t, p, []byte("ping")); !bytes.Equal(resp, want) {
+		t.Fatalf("got %d bytes of response, want %d", len(resp), len(want))
+	}
+	pool := p.apps[0].bnds[0].pool
+	if !waitFor(t, time.Second, func() bool { return pool.idleCount() == 1 }) {
+		t.Fatal("connection isn't pooled after the response")
+	}
+	// the pooled connection has no leftovers of the previous response
+	if resp := request(t, p, []byte("ping")); !bytes.Equal(resp, want) {
+		t.Fatalf("got %d bytes of the second response, want %d", len(resp), len(want))
+	}
+	if n := accepts.Load(); n != 1 {
+		t.Errorf("backend accepted %d connections, want 1", n)
+	}
+}
+
+func TestPoolBackendCloses(t *testing.T) {
+	backend := startBackend(t, func(conn net.Conn) {
+		io.ReadFull(conn, make([]byte, 4))
+		conn.Write([]byte("pong"))
+	})
+	stats := make(chan SessionStats, 1)
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Targets:      []string{backend},
+		PoolSize:     2,
+		OnDisconnect: func(s SessionStats) { stats <- s },
+	}}})
+
+	if resp := request(t, p, []byte("ping")); string(resp) != "pong" {
+		t.Fatalf("response is %q", resp)
+	}
+	<-stats
+	if n := p.apps[0].bnds[0].pool.idleCount(); n != 0 {
+		t.Errorf("%d connections closed by the backend are pooled", n)
+	}
+}
+
+func TestConnPoolLimits(t *testing.T) {
+	pool := newConnPool(2, 50*time.Millisecond)
+	var peers []net.Conn
+	newConn := func() net.Conn {
+		conn, peer := net.Pipe()
+		peers = append(peers, peer)
+		return conn
+	}
+	defer func() {
+		for _, peer := range peers {
+			peer.Close()
+		}
+	}()
+
+	first, second := newConn(), newConn()
+	if !pool.put(first) || !pool.put(second) {
+		t.Fatal("put into a pool with free space failed")
+	}
+	if pool.put(newConn()) {
+		t.Fatal("put into a full pool succeeded")
+	}
+	if conn := pool.get(); conn != second {
+		t.Fatal("get doesn't return the most recently used connection")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	pool.expire()
+	if n := pool.idleCount(); n != 0 {
+		t.Fatalf("%d connections are kept after maxIdle", n)
+	}
+	if pool.get() != nil {
+		t.Fatal("get from an empty pool returned a connection")
+	}
+
+	pool.put(second)
+	pool.close()
+	if pool.idleCount() != 0 {
+		t.Fatal("close kept idle connections")
+	}
+	if pool.put(newConn()) {
+		t.Fatal("put into a closed pool succeeded")
+	}
+}
+
+func TestConnPoolDropsClosed(t *testing.T) {
+	pool := newConnPool(2, time.Minute)
+	conn, peer := net.Pipe()
+	pool.put(conn)
+	peer.Close()
+	if pool.get() != nil {
+		t.Fatal("get returned a connection closed by the peer")
+	}
+}
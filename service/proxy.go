@@ -2,7 +2,12 @@ package service
 
 import (
 	"context"
+	"crypto/tls"
+	"io"
+	"net"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
@@ -11,91 +16,724 @@ import (
 type Proxy struct {
 	ctx     context.Context
 	cancel  context.CancelFunc
-	logger  *zerolog.Logger
+	logger  *proxyLogger
 	apps    []*application
 	fnds    []*frontend
-	bnds    []*backend
-	bufPool *sync.Pool
+	bufPool bufferPool
+	limiter *tokenBucket
+	status  *statusNotifier
+	// stateFile is the file of the balancer state. It is empty if the state isn't saved.
+	stateFile string
+	// stateSaveInterval is the period of state saves while the proxy runs.
+	stateSaveInterval time.Duration
+	// parent is the context passed to NewProxy. If drainTimeout is set, ctx isn't derived from it:
+	// connections are drained for up to drainTimeout after parent is done, then ctx is cancelled.
+	parent       context.Context
+	drainTimeout time.Duration
 }
 
-func NewProxy(ctx context.Context, logger *zerolog.Logger, config ProxyConfig) (Proxy, error) {
+const (
+	defaultBufferSize = 4 * 1024
+	minBufferSize     = 512
+)
+
+// NewProxy creates the proxy of the config. Events are logged with the zerolog logger unless config.Logger is set.
+func NewProxy(ctx context.Context, zlogger *zerolog.Logger, config ProxyConfig) (Proxy, error) {
+	bufferSize := config.BufferSize
+	if bufferSize == 0 {
+		bufferSize = defaultBufferSize
+	}
+	if bufferSize < minBufferSize {
+		return Proxy{}, errors.Errorf("buffer size %d is less than minimum %d", bufferSize, minBufferSize)
+	}
+
+	if err := checkPorts(config.Apps); err != nil {
+		return Proxy{}, err
+	}
+	out := config.Logger
+	if out == nil {
+		out = NewZerologLogger(zlogger)
+	}
+	logger := newProxyLogger(out)
+	connLogger := logger.sampled(config.ConnLogSampling)
+
+	parent := ctx
+	if config.DrainTimeout > 0 {
+		// the proxy outlives ctx by the drain, Run cancels it when the drain is over
+		ctx = context.Background()
+	}
 	nCtx, cancel := context.WithCancel(ctx)
+	status := newStatusNotifier(config.StatusUpdates)
+	accessLog := newAccessLog(logger, config.AccessLog, config.AccessLogFormatter)
 
-	bufPool := sync.Pool{
-		New: func() any {
-			b := make([]byte, 4*1024)
-			return &b
-		},
+	bufPool := newBufferPool(bufferSize, config.BufferArena)
+
+	var limiter *tokenBucket
+	if config.RateLimit > 0 {
+		limiter = newTokenBucket(config.RateLimit, globalBurst(config.RateLimit))
 	}
 
 	apps := make([]*application, 0, len(config.Apps))
 	fnds := make([]*frontend, 0, len(config.Apps))
-	bnds := make([]*backend, 0, len(config.Apps))
 
 	for _, configApp := range config.Apps {
+		if _, err := resolveSourceAddr(configApp.SourceAddr); err != nil {
+			cancel()
+			return Proxy{}, errors.Wrapf(err, "app %s", configApp.Name)
+		}
+		if configApp.Dialer != nil && (configApp.DialKeepAlive != 0 || configApp.DialControl != nil) {
+			cancel()
+			return Proxy{}, errors.Errorf("app %s: DialKeepAlive and DialControl can't be used with Dialer", configApp.Name)
+		}
+		if configApp.ChoiceCacheTTL > 0 && configApp.AffinityTTL > 0 {
+			cancel()
+			return Proxy{}, errors.Errorf("app %s: ChoiceCacheTTL and AffinityTTL can't be used together", configApp.Name)
+		}
+		for _, b := range configApp.Backends {
+			if b.Weight > MaxWeight {
+				cancel()
+				return Proxy{}, errors.Errorf("app %s: weight %d of backend %s is above %d", configApp.Name, b.Weight, b.Addr, MaxWeight)
+			}
+		}
+		if configApp.HealthChecker == nil {
+			if _, err := newHealthChecker(configApp.HealthcheckKind, configApp.HealthcheckPath); err != nil {
+				cancel()
+				return Proxy{}, errors.Wrapf(err, "app %s", configApp.Name)
+			}
+		}
+
+		bndOpts := configApp.backendOptions()
+		bndOpts.status = status
+
 		// Create backends for the app
-		appBnds := make([]*backend, 0, len(configApp.Targets))
-		for _, target := range configApp.Targets {
-			bnd, err := newBackend(ctx, logger, target)
+		static := configApp.staticBackends()
+		appBnds := make([]*backend, 0, len(static))
+		for _, s := range static {
+			bnd, err := newBackend(nCtx, connLogger, s.Addr, bndOpts.withTLS(s.TLS))
 			if err != nil {
 				cancel()
 				return Proxy{}, errors.Wrap(err, "newBackend()")
 			}
+			bnd.setWeight(s.Weight, s.Priority)
 			appBnds = append(appBnds, bnd)
 		}
-		bnds = append(bnds, appBnds...)
 
 		// Create app
-		app := newApplication(nCtx, logger, configApp.Name, appBnds)
+		strategy, err := newStrategy(configApp.Strategy, configApp.HashReplicas)
+		if err != nil {
+			cancel()
+			return Proxy{}, errors.Wrapf(err, "app %s", configApp.Name)
+		}
+		if ignoresWeights(strategy) {
+			for _, b := range configApp.Backends {
+				if b.Weight > 1 {
+					cancel()
+					return Proxy{}, errors.Errorf("app %s: strategy %s ignores the weight of backend %s, use a weighted strategy", configApp.Name, strategy.name(), b.Addr)
+				}
+			}
+		}
+		appOpts := configApp.appOptions()
+		appOpts.limiter = limiter
+		appOpts.strategy = strategy
+		appOpts.accessLog = accessLog
+		app := newApplication(nCtx, connLogger, configApp.Name, appBnds, bndOpts, appOpts)
 		apps = append(apps, app)
 
 		// Create frontends for the app
 		for _, port := range configApp.Ports {
-			fnd, err := newFrontend(nCtx, logger, port, app, &bufPool)
+			fnd, err := newFrontend(nCtx, connLogger, configApp.ListenHost, port, app, bufPool, configApp.frontendOptions())
 			if err != nil {
 				cancel()
 				return Proxy{}, errors.Wrap(err, "newFrontend()")
 			}
 			fnds = append(fnds, fnd)
 		}
+		for _, path := range configApp.ListenUnix {
+			fnd, err := newUnixFrontend(nCtx, connLogger, path, app, bufPool, configApp.frontendOptions())
+			if err != nil {
+				cancel()
+				return Proxy{}, errors.Wrap(err, "newUnixFrontend()")
+			}
+			fnds = append(fnds, fnd)
+		}
 	}
 
-	return Proxy{
-		ctx:     nCtx,
-		cancel:  cancel,
-		logger:  logger,
-		apps:    apps,
-		fnds:    fnds,
-		bnds:    bnds,
-		bufPool: &bufPool,
-	}, nil
+	p := Proxy{
+		ctx:          nCtx,
+		cancel:       cancel,
+		logger:       logger,
+		apps:         apps,
+		fnds:         fnds,
+		bufPool:      bufPool,
+		limiter:      limiter,
+		status:       status,
+		stateFile:    config.StateFile,
+		parent:       parent,
+		drainTimeout: config.DrainTimeout,
+	}
+	if p.stateFile != "" {
+		p.stateSaveInterval = config.StateSaveInterval
+		if p.stateSaveInterval == 0 {
+			p.stateSaveInterval = defaultStateSaveInterval
+		}
+		if err := p.restoreState(p.stateFile); err != nil {
+			logger.Warn("unable to restore balancer state", fields{"error": err, "file": p.stateFile})
+		}
+	}
+	return p, nil
 }
 
-// Run blocks until all frontends and backends finish work (ctx is done).
-func (p Proxy) Run() {
+// checkPorts makes sure that every listen address belongs to a single app, so each address is routed to exactly one
+// backend pool. The same port may be used by apps listening on different hosts, an empty host overlaps with any host.
+// Port 0 (ephemeral) may be repeated, because the OS chooses distinct ports. Unix socket paths must be unique.
+func checkPorts(apps []ConfigApp) error {
+	type owner struct {
+		host, app string
+	}
+	owners := make(map[int][]owner)
+	sockets := make(map[string]string)
+	for _, app := range apps {
+		for _, path := range app.ListenUnix {
+			if other, ok := sockets[path]; ok {
+				return errors.Errorf("socket %s is used by apps %s and %s", path, other, app.Name)
+			}
+			sockets[path] = app.Name
+		}
+		for _, port := range app.Ports {
+			if port == 0 {
+				continue
+			}
+			for _, o := range owners[port] {
+				if o.host == app.ListenHost || o.host == "" || app.ListenHost == "" {
+					return errors.Errorf("port %d is used by apps %s and %s", port, o.app, app.Name)
+				}
+			}
+			owners[port] = append(owners[port], owner{host: app.ListenHost, app: app.Name})
+		}
+	}
+	return nil
+}
+
+// minGlobalBurst is the min burst of the global limiter. Reads are limited to the burst, so it keeps reads
+// of slow global rates from degrading to a few bytes.
+const minGlobalBurst = 512
+
+// globalBurst returns the burst of the global limiter. Small bursts make concurrent connections take turns often.
+func globalBurst(rate int64) int64 {
+	burst := rate / 10
+	if burst < minGlobalBurst {
+		burst = minGlobalBurst
+	}
+	return burst
+}
+
+// Run blocks until all frontends and backends finish work (ctx is done and connections are drained if DrainTimeout
+// is set). The balancer state is saved periodically while it runs and at the end if StateFile is set.
+func (p Proxy) Run() error {
 	var wg sync.WaitGroup
 
-	for _, bnd := range p.bnds {
-		bnd := bnd
+	p.status.send(StatusStarting, "", "")
+	go p.notifyReady()
+	if p.drainTimeout > 0 {
+		go p.drainOnShutdown()
+	}
+	if p.stateFile != "" {
+		go p.saveStatePeriodically()
+	}
+
+	for _, app := range p.apps {
+		app := app
 		wg.Add(1)
-		go bnd.run(&wg)
+		go app.run(&wg)
 	}
 	for _, fnd := range p.fnds {
 		fnd := fnd
 		wg.Add(1)
 		go fnd.run(&wg)
+		go func() {
+			// a frontend which gives up binding fails the startup: the proxy is stopped and Run returns the error
+			select {
+			case <-fnd.bindFailed:
+				p.cancel()
+			case <-p.ctx.Done():
+			}
+		}()
 	}
 
 	wg.Wait()
+
+	if p.stateFile != "" {
+		if err := p.saveState(p.stateFile); err != nil {
+			p.logger.Error("unable to save balancer state", fields{"error": err, "file": p.stateFile})
+		}
+	}
+	p.status.send(StatusStopped, "", "")
+	for _, fnd := range p.fnds {
+		if err := fnd.bindError(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findApp returns the app by its name or nil.
+func (p Proxy) findApp(name string) *application {
+	for _, app := range p.apps {
+		if app.name == name {
+			return app
+		}
+	}
+	return nil
+}
+
+// managers returns all frontends and current backends of the proxy.
+func (p Proxy) managers() []connManager {
+	managers := make([]connManager, 0, len(p.fnds))
+	for _, fnd := range p.fnds {
+		managers = append(managers, fnd)
+	}
+	for _, app := range p.apps {
+		app.rmu.RLock()
+		for _, bnd := range app.bnds {
+			managers = append(managers, bnd)
+		}
+		app.rmu.RUnlock()
+	}
+	return managers
+}
+
+// Stop stops the proxy right away: connections are closed without waiting for the shutdown drain,
+// e.g. on a second termination signal.
+func (p Proxy) Stop() {
+	p.cancel()
+}
+
+// Done returns a channel which is closed when the proxy is stopped and starts closing its connections.
+func (p Proxy) Done() <-chan struct{} {
+	return p.ctx.Done()
+}
+
+// Status returns the channel of coarse lifecycle updates: starting, ready, backend up and down, draining, stopped.
+// Updates are dropped if the channel is full. It returns nil if StatusUpdates is disabled.
+func (p Proxy) Status() <-chan Status {
+	if p.status == nil {
+		return nil
+	}
+	return p.status.ch
+}
+
+// notifyReady sends StatusReady when all frontends listen.
+func (p Proxy) notifyReady() {
+	for _, fnd := range p.fnds {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-fnd.listening:
+		}
+	}
+	p.status.send(StatusReady, "", "")
+}
+
+// WaitReady blocks until all frontends listen and every app has at least one active backend, i.e. a backend
+// which passed a health check. It fails if ctx is done, the proxy is stopped or a frontend gives up binding first.
+// Run must be called separately.
+func (p Proxy) WaitReady(ctx context.Context) error {
+	if p.ctx.Err() != nil {
+		return errors.New("proxy is stopped")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-p.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	for _, fnd := range p.fnds {
+		select {
+		case <-ctx.Done():
+			// the proxy is stopped when binding fails
+			if err := fnd.bindError(); err != nil {
+				return err
+			}
+			return errors.Wrapf(ctx.Err(), "frontend %s doesn't listen", fnd.name())
+		case <-fnd.bindFailed:
+			return fnd.bindError()
+		case <-fnd.listening:
+		}
+	}
+	for _, app := range p.apps {
+		if err := app.waitReady(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListenAddrs returns actual addresses of frontend listeners which are already created.
+// It is useful to find out ports chosen by the OS for ephemeral (0) ports.
+func (p Proxy) ListenAddrs() []net.Addr {
+	addrs := make([]net.Addr, 0, len(p.fnds))
+	for _, fnd := range p.fnds {
+		if addr := fnd.addr(); addr != nil {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
 }
 
 // ProxyConfig represents Proxy config file.
 type ProxyConfig struct {
 	Apps []ConfigApp
+	// BufferSize is the size of buffers used to copy data between connections. Default is 4KB.
+	BufferSize int
+	// BufferArena keeps up to BufferArena idle copy buffers in a bounded arena instead of sync.Pool, which releases
+	// idle buffers on garbage collections. It reduces reallocations with churning connections at the cost of
+	// retained memory. Zero means sync.Pool.
+	BufferArena int
+	// AccessLog receives one line per finished connection pair of all apps, independently of the logger.
+	// Writes are serialized. Nil disables access logs.
+	AccessLog io.Writer
+	// AccessLogFormatter formats lines of AccessLog. Default is TSVAccessLog, see also AccessLogFormat.
+	AccessLogFormatter AccessLogFormatter
+	// RateLimit is the max aggregate throughput in bytes per second of all connections. Zero means unlimited.
+	RateLimit int64
+	// DrainTimeout makes the shutdown graceful: when the context of NewProxy is done (e.g. on SIGTERM), frontends
+	// stop accepting and established connections keep flowing for up to DrainTimeout, then the remaining ones
+	// are closed. Zero closes all connections right away.
+	DrainTimeout time.Duration
+	// StateFile is the file where the selection state of stateful strategies (e.g. the round_robin cursor)
+	// is saved on shutdown and restored from on start. Empty disables it.
+	StateFile string
+	// StateSaveInterval is the period of state saves while the proxy runs, so a crash loses only recent selections.
+	// Default is 30s.
+	StateSaveInterval time.Duration
+	// Logger receives log events instead of the zerolog logger passed to NewProxy. It filters events by its own level.
+	Logger Logger
+	// ConnLogSampling logs only 1 of every N debug events of connection handling.
+	// Info and more severe events are always logged. Zero or 1 logs all events.
+	ConnLogSampling uint32
+	// StatusUpdates enables the channel of lifecycle updates returned by Proxy.Status.
+	StatusUpdates bool
 }
 
 type ConfigApp struct {
-	Name    string
-	Ports   []int
-	Targets []string
+	Name  string
+	Ports []int
+	// ListenHost is the IP or hostname of the interface the ports are bound to. Empty means all interfaces.
+	ListenHost string
+	// ListenNetwork selects the IP stack of the ports: "tcp" (default) listens on both IPv4 and IPv6,
+	// with empty ListenHost through a single dual-stack socket; "tcp4" and "tcp6" listen on one stack only.
+	ListenNetwork string
+	// ListenUnix are paths of Unix domain sockets the app listens on along with Ports for local-only clients.
+	ListenUnix []string
+	Targets    []string
+	// Backends are static backends with weights and priority tiers. They are used along with Targets.
+	Backends []ConfigBackend
+	// Strategy is the name of the load balancing strategy: "least_conn" (default), "round_robin",
+	// "weighted_least_conn", "src_hash" or "dst_hash".
+	Strategy string
+	// HashReplicas is the number of points per unit of backend weight on the consistent hash ring
+	// of "src_hash" and "dst_hash" strategies. More points spread keys more evenly. Default is 100.
+	HashReplicas int
+	// MaxConnAge is the max lifetime of accepted connections. Connection pairs are closed when it passes, even if they
+	// are active, so clients reconnect and get rebalanced. Zero disables it.
+	MaxConnAge time.Duration
+	// Discovery is an optional source of backends. If it is set, discovered backends replace Targets
+	// as soon as the first update arrives.
+	Discovery Discovery
+	// ConnRateLimit is the max throughput in bytes per second of every connection in each direction.
+	// Zero means unlimited.
+	ConnRateLimit int64
+	// MaxWriteChunk is the max size in bytes of a single write to a connection. Bigger writes are split.
+	// Zero means no limit.
+	MaxWriteChunk int
+	// CoalesceSize enables coalescing of small writes: writes to a connection are buffered up to CoalesceSize bytes
+	// and flushed when the buffer fills or CoalesceDelay (1ms by default) passes. Zero disables coalescing.
+	CoalesceSize  int
+	CoalesceDelay time.Duration
+	// AllowEphemeralPort allows port 0 in Ports, which makes the OS choose a free port. The chosen port is logged
+	// and available through Proxy.ListenAddrs().
+	AllowEphemeralPort bool
+	// Allow is a list of client CIDRs (IPv4 or IPv6) allowed to connect. Empty list allows all.
+	Allow []string
+	// Deny is a list of client CIDRs denied to connect. It takes precedence over Allow.
+	Deny []string
+	// MaxConnsPerIP is the max number of simultaneous connections from a single client IP. Zero means unlimited.
+	MaxConnsPerIP int
+	// ListenKeepAlive is the TCP keep-alive period set on the listener, so all accepted connections inherit it.
+	// Zero means Go default (enabled with 15s period), negative disables keep-alive.
+	ListenKeepAlive time.Duration
+	// KeepAlive enables TCP keep-alive with this period on every accepted and backend connection.
+	// Zero leaves Go and listener defaults.
+	KeepAlive time.Duration
+	// WriteTimeout is the max duration of a single write to a connection. If a peer doesn't read
+	// and a write is stuck longer, the connection pair is closed. Zero means no timeout.
+	WriteTimeout time.Duration
+	// ClientReadTimeout is the max duration without data from the client. When it passes, the connection pair
+	// is closed even if the backend still sends data. Zero disables it.
+	ClientReadTimeout time.Duration
+	// BackendReadTimeout is the max duration without data from the backend. When it passes, the connection pair
+	// is closed even if the client still sends data. Zero disables it.
+	BackendReadTimeout time.Duration
+	// MinThroughput is the min throughput in bytes per second of every connection direction. If a direction transfers
+	// data slower than that during MinThroughputWindow, the connection pair is closed. Windows without data
+	// don't count. Zero disables it.
+	MinThroughput int64
+	// MinThroughputWindow is the measurement window of MinThroughput. Default is 30s.
+	MinThroughputWindow time.Duration
+	// DumpBytes makes frontends log a hex dump of the first DumpBytes bytes of every connection direction
+	// for protocol debugging. The forwarded data isn't changed. Zero disables it.
+	DumpBytes int
+	// CopyAuditInterval makes frontends compare the number of running copy goroutines with twice the number
+	// of connections every interval and warn about a persistent divergence, which means a teardown leak.
+	// The numbers are logged at debug level. Zero disables the audit; the tcp_proxy_frontend_copy_goroutines
+	// metric is published anyway.
+	CopyAuditInterval time.Duration
+	// Nagle enables Nagle's algorithm (disables TCP_NODELAY) on client and backend connections.
+	// By default TCP_NODELAY is set, which is good for latency-sensitive protocols.
+	Nagle bool
+	// AcceptProxyProtocol makes frontends read the PROXY protocol (v1 or v2) header of accepted connections.
+	// The client address from the header is used for Allow/Deny, MaxConnsPerIP and logs. Connections without
+	// a valid header are closed.
+	AcceptProxyProtocol bool
+	// PreambleTimeout is the max time to receive the PROXY protocol header. Default is 5s.
+	PreambleTimeout time.Duration
+	// PreambleMaxBytes is the max length of the PROXY protocol header. Default is 1040, minimum is 107.
+	PreambleMaxBytes int
+	// PreambleConcurrency is the max number of connections of each frontend reading the PROXY protocol header at once.
+	// Connections wait for a free slot with their accept worker and give it back while they read the header,
+	// so connections with slow headers can't exhaust AcceptWorkers, and accepting still stops when all workers
+	// are busy: at most AcceptWorkers + PreambleConcurrency connections are being set up. Zero means unlimited.
+	PreambleConcurrency int
+	// PreambleQueueTimeout is the max time a connection waits for a free PreambleConcurrency slot, then it is rejected.
+	// Default is PreambleTimeout.
+	PreambleQueueTimeout time.Duration
+	// AcceptWorkers is the max number of accepted connections of each frontend being set up at once
+	// (PROXY header, access checks, backend dial). When all workers are busy, new connections wait in the listen backlog.
+	// Zero means unlimited.
+	AcceptWorkers int
+	// SetupSoftLimit is the number of connections of each frontend being set up above which accepting slows down:
+	// every accept waits up to 100ms for setups to finish. Unlike AcceptWorkers, accepting never stops.
+	// Zero disables it.
+	SetupSoftLimit int
+	// OriginalDst makes frontends read the original destination of connections redirected by netfilter
+	// (SO_ORIGINAL_DST on Linux) for transparent proxying. If it is unknown, the local address of the connection is used.
+	OriginalDst bool
+	// ReusePort sets SO_REUSEPORT on listeners of Ports, so several proxy processes can listen on the same ports
+	// and the kernel balances connections between them. Linux only.
+	ReusePort bool
+	// ListenRetries is the number of retries, 5s apart, of a failed bind of a frontend listener on start.
+	// When they are exhausted, the proxy is stopped and Run returns the bind error, so startup fails fast.
+	// Zero retries forever, negative fails on the first error.
+	ListenRetries int
+	// RejectDelay holds connections rejected by Allow/Deny or MaxConnsPerIP open for this duration before closing,
+	// which slows down connection floods. Zero closes them immediately.
+	RejectDelay time.Duration
+	// ResetOnClose makes forced closes send RST instead of graceful FIN, so closed connections don't accumulate
+	// in TIME_WAIT. Forced closes are closes of rejected connections and sessions torn down by an error,
+	// MaxConnAge, the admin API or shutdown. Sessions ended cleanly by a peer are always closed gracefully.
+	ResetOnClose bool
+	// SourceAddr is the local IP address or hostname backend connections and health checks originate from,
+	// e.g. on multi-homed hosts. It can't be used with Dialer. Empty means the OS chooses.
+	SourceAddr string
+	// DialKeepAlive is the TCP keep-alive period of the dialer of backend connections and health checks, so it is
+	// enabled on every backend connection including TLS ones. Zero means Go default (enabled), negative disables it.
+	// It can't be used with Dialer.
+	DialKeepAlive time.Duration
+	// DialControl is called with the raw socket of every backend connection and health check before it connects,
+	// e.g. to set SO_MARK or IP_TOS for firewall marks and DSCP. It can't be used with Dialer.
+	DialControl func(network, address string, c syscall.RawConn) error
+	// FallbackDelay is the head start of the first address family when a dual-stack backend hostname is dialed:
+	// then the other family is dialed in parallel and the first connected address is used (Happy Eyeballs).
+	// Zero means Go default 300ms, negative disables parallel dialing, so addresses are tried one by one.
+	FallbackDelay time.Duration
+	// Dialer is an optional custom dialer of backend connections and health checks.
+	// Default is net.Dialer with 2s timeout.
+	Dialer Dialer
+	// TLS makes connections and health checks to backends TLS with the config, over connections of the dialer.
+	// Certificates of the config are presented to backends which request a client certificate (mTLS).
+	// NextProtos of the config are offered via ALPN, the negotiated protocol is logged at debug level.
+	// Empty ServerName defaults to the host of the backend address, which is an IP address for DNSDiscovery.
+	// Backends may override the config. Nil means plain TCP.
+	TLS *tls.Config
+	// ConnectTimeout bounds the whole setup of a backend connection: the dial (which has its own 2s timeout)
+	// and handshakes of connections returned by custom dialers. A timed out setup makes the app try the next backend
+	// within DialRetries. Zero means only the dial timeout applies.
+	ConnectTimeout time.Duration
+	// FirstByteTimeout is for server-speaks-first protocols: a new backend connection which receives no data
+	// within this duration is closed and the next backend is tried within DialRetries. Zero disables waiting.
+	FirstByteTimeout time.Duration
+	// PoolSize enables reuse of backend connections: up to PoolSize idle connections per backend are kept
+	// after clients close their side cleanly and the backend answered (it is quiet for 100ms), then they are handed out
+	// to new clients instead of dialing.
+	// It is only safe for protocols which tolerate reuse of a connection by different clients. Zero disables pooling.
+	PoolSize int
+	// PoolMaxIdle is the max idle time of a pooled connection. Default is 30s.
+	PoolMaxIdle time.Duration
+	// MaxConcurrentDrains is the max number of backends of the app drained at once, e.g. after a big reload.
+	// Backends queued for draining keep serving until their drain starts. Zero means unlimited.
+	MaxConcurrentDrains int
+	// ChoiceCacheTTL enables caching of the last successful backend choice per client IP for this duration,
+	// so bursts of short connections from the same client skip backend selection. Zero disables caching.
+	ChoiceCacheTTL time.Duration
+	// AffinityTTL makes clients stick to the backend of their last connection: the backend is reused for
+	// connections of the client IP until no connection uses it for this duration, or while it is unavailable.
+	// Then the backend is selected by the strategy again. It can't be used with ChoiceCacheTTL.
+	// Zero disables affinity.
+	AffinityTTL time.Duration
+	// HealthcheckKind is the kind of active health checks of the app backends: "tcp" (default) checks that
+	// a backend accepts connections, "http" sends GET HealthcheckPath and expects a status below 400.
+	HealthcheckKind string
+	// HealthcheckPath is the request path of "http" health checks. Default is "/".
+	HealthcheckPath string
+	// HealthChecker is an optional custom health check of the app backends. It takes precedence over HealthcheckKind.
+	HealthChecker HealthChecker
+	// OnConnect is an optional hook called when a connection pair is established, before any data flows,
+	// e.g. for authorization. The pair is rejected if it returns an error or doesn't return within 5s.
+	// It may label the pair with ContextLabels, e.g. with a tenant id. The labels are reported in SessionStats,
+	// access logs and the close log of the pair.
+	OnConnect ConnectHook
+	// OnDisconnect is an optional hook called with stats of every finished connection pair, e.g. for accounting.
+	OnDisconnect DisconnectHook
+	// Selector is an optional custom backend choice, e.g. by client metadata. It overrides Strategy
+	// unless it returns nil or an error.
+	Selector Selector
+	// HealthcheckInterval is the period of active backend health checks. Default is 5s.
+	HealthcheckInterval time.Duration
+	// DialRetries is the number of other backends tried when a connection to the chosen backend fails.
+	DialRetries int
+	// SetupBudget bounds the whole backend selection and connection setup of a client including all DialRetries.
+	// Attempts get the remaining budget, no attempts are made after it is exhausted. Zero means no limit.
+	SetupBudget time.Duration
+	// RetryBackoff is the pause before the first retry after a failed dial. It doubles with every failed dial
+	// of the client setup up to 1s. Zero means immediate retries. The pauses are within SetupBudget:
+	// the setup fails instead of a pause which would exhaust it.
+	RetryBackoff time.Duration
+	// RetryJitter is the max random duration added to every pause of RetryBackoff.
+	RetryJitter time.Duration
+	// SlowStart is the duration during which a newly active backend gets a linearly growing share of new connections.
+	// Zero disables slow start.
+	SlowStart time.Duration
+	// OutlierErrorRate is the share (0..1] of failed sessions of a backend which ejects it for OutlierEjectTime.
+	// A session failed if the backend dropped it with an error or without sending any data. Zero disables ejection.
+	OutlierErrorRate float64
+	// OutlierMinSessions is the minimal number of sessions in the 10s window to evaluate the error rate. Default is 10.
+	OutlierMinSessions int
+	// OutlierEjectTime is the ejection duration. Default is 30s.
+	OutlierEjectTime time.Duration
+	// OutlierHalfOpen keeps an ejected backend out of client traffic after OutlierEjectTime until a health check
+	// probe succeeds, so clients never hit a backend whose recovery isn't confirmed. A failed probe ejects it again.
+	OutlierHalfOpen bool
+	// DownReminder is the period of "still down" logs for backends failing health checks. Zero disables reminders.
+	DownReminder time.Duration
+	// ResolveRemoveAfter removes a backend whose host doesn't resolve for this duration. Zero disables removal.
+	ResolveRemoveAfter time.Duration
+}
+
+// ConfigBackend is a static backend of an app.
+type ConfigBackend struct {
+	Addr string
+	// Weight is a relative weight of the backend within its priority tier. Values less than 1 are treated as 1.
+	Weight int
+	// Priority is the backend tier. Backends with higher priority values get connections only
+	// if there are no available backends with lower values.
+	Priority int
+	// TLS overrides the TLS config of the app for this backend, e.g. with a distinct client certificate.
+	TLS *tls.Config
+}
+
+// staticBackends returns Targets and Backends of the app as one backend set.
+func (c ConfigApp) staticBackends() []DiscoveredBackend {
+	bnds := make([]DiscoveredBackend, 0, len(c.Targets)+len(c.Backends))
+	for _, target := range c.Targets {
+		bnds = append(bnds, DiscoveredBackend{Addr: target, Weight: 1})
+	}
+	for _, b := range c.Backends {
+		bnds = append(bnds, DiscoveredBackend(b))
+	}
+	return bnds
+}
+
+func (c ConfigApp) appOptions() appOptions {
+	return appOptions{
+		discovery:    c.Discovery,
+		dialRetries:  c.DialRetries,
+		setupBudget:  c.SetupBudget,
+		retryBackoff: c.RetryBackoff,
+		retryJitter:  c.RetryJitter,
+		onConnect:    c.OnConnect,
+		onDisconnect: c.OnDisconnect,
+		selector:     c.Selector,
+		maxDrains:    c.MaxConcurrentDrains,
+		choiceTTL:    c.ChoiceCacheTTL,
+		affinityTTL:  c.AffinityTTL,
+	}
+}
+
+func (c ConfigApp) frontendOptions() frontendOptions {
+	return frontendOptions{
+		maxConnAge:           c.MaxConnAge,
+		connRateLimit:        c.ConnRateLimit,
+		maxWriteChunk:        c.MaxWriteChunk,
+		coalesceSize:         c.CoalesceSize,
+		coalesceDelay:        c.CoalesceDelay,
+		allowEphemeralPort:   c.AllowEphemeralPort,
+		allow:                c.Allow,
+		deny:                 c.Deny,
+		maxConnsPerIP:        c.MaxConnsPerIP,
+		listenKeepAlive:      c.ListenKeepAlive,
+		keepAlive:            c.KeepAlive,
+		writeTimeout:         c.WriteTimeout,
+		clientReadTimeout:    c.ClientReadTimeout,
+		backendReadTimeout:   c.BackendReadTimeout,
+		minThroughput:        c.MinThroughput,
+		minThroughputWindow:  c.MinThroughputWindow,
+		dumpBytes:            c.DumpBytes,
+		copyAuditInterval:    c.CopyAuditInterval,
+		preambleTimeout:      c.PreambleTimeout,
+		preambleMaxBytes:     c.PreambleMaxBytes,
+		preambleConcurrency:  c.PreambleConcurrency,
+		preambleQueueTimeout: c.PreambleQueueTimeout,
+		nagle:                c.Nagle,
+		rejectDelay:          c.RejectDelay,
+		resetOnClose:         c.ResetOnClose,
+		acceptProxy:          c.AcceptProxyProtocol,
+		acceptWorkers:        c.AcceptWorkers,
+		setupSoftLimit:       c.SetupSoftLimit,
+		originalDst:          c.OriginalDst,
+		reusePort:            c.ReusePort,
+		listenRetries:        c.ListenRetries,
+		network:              c.ListenNetwork,
+	}
+}
+
+func (c ConfigApp) backendOptions() backendOptions {
+	return backendOptions{
+		appName:             c.Name,
+		dialer:              c.Dialer,
+		sourceAddr:          c.SourceAddr,
+		dialKeepAlive:       c.DialKeepAlive,
+		dialControl:         c.DialControl,
+		fallbackDelay:       c.FallbackDelay,
+		healthChecker:       c.HealthChecker,
+		healthcheckKind:     c.HealthcheckKind,
+		healthcheckPath:     c.HealthcheckPath,
+		healthcheckInterval: c.HealthcheckInterval,
+		resolveRemoveAfter:  c.ResolveRemoveAfter,
+		slowStart:           c.SlowStart,
+		outlierErrorRate:    c.OutlierErrorRate,
+		outlierMinSessions:  c.OutlierMinSessions,
+		outlierEjectTime:    c.OutlierEjectTime,
+		outlierHalfOpen:     c.OutlierHalfOpen,
+		downReminder:        c.DownReminder,
+		keepAlive:           c.KeepAlive,
+		nagle:               c.Nagle,
+		connectTimeout:      c.ConnectTimeout,
+		firstByteTimeout:    c.FirstByteTimeout,
+		poolSize:            c.PoolSize,
+		poolMaxIdle:         c.PoolMaxIdle,
+		tlsConfig:           c.TLS,
+	}
 }
@@ -0,0 +1,57 @@
+package service
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWaitReady(t *testing.T) {
+	addr := deadAddr(t)
+	p := newTestProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Targets:             []string{addr},
+		HealthcheckInterval: 50 * time.Millisecond,
+	}}})
+	ready := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		ready <- p.WaitReady(ctx)
+	}()
+	// neither the frontend listens nor the backend is up before Run
+	time.Sleep(100 * time.Millisecond)
+	runProxy(t, p)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := p.WaitReady(ctx); err == nil {
+		t.Fatal("proxy without active backends is ready")
+	}
+	select {
+	case err := <-ready:
+		t.Fatalf("WaitReady() returns %v before the backend is up", err)
+	default:
+	}
+	if len(p.ListenAddrs()) != 1 {
+		t.Fatal("frontend doesn't listen")
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("port of the backend is taken: %v", err)
+	}
+	defer ln.Close()
+	if err := <-ready; err != nil {
+		t.Fatalf("WaitReady(): %v", err)
+	}
+	a := p.apps[0]
+	if !a.hasActiveBackend() {
+		t.Error("proxy is ready without an active backend")
+	}
+
+	p.cancel()
+	if err := p.WaitReady(context.Background()); err == nil {
+		t.Error("stopped proxy is ready")
+	}
+}
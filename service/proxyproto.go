@@ -0,0 +1,138 @@
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// defaultPreambleTimeout is the default max time to receive the PROXY protocol header of an accepted connection.
+	defaultPreambleTimeout = 5 * time.Second
+	// defaultPreambleMaxBytes is the default max length of a PROXY protocol header: a v2 header with proxyV2MaxLen
+	// bytes of addresses and TLVs.
+	defaultPreambleMaxBytes = proxyV2HeaderLen + proxyV2MaxLen
+	// proxyV1MaxLen is the max length of a v1 header including CRLF.
+	proxyV1MaxLen = 107
+	// proxyMinLen is the length of the shortest v1 header "PROXY UNKNOWN\r\n". It is less than
+	// the fixed part of a v2 header, so it can be read without reading beyond any header.
+	proxyMinLen = 15
+	// proxyV2HeaderLen is the length of the fixed part of a v2 header.
+	proxyV2HeaderLen = 16
+	// proxyV2MaxLen is the default max length of v2 addresses and TLVs accepted.
+	proxyV2MaxLen = 1024
+)
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	errProxyHeader = errors.New("invalid PROXY protocol header")
+)
+
+// readProxyHeader reads the PROXY protocol (v1 or v2) header from the connection. It returns the original
+// client address or nil if the header doesn't carry it (v1 UNKNOWN, v2 LOCAL or non-TCP families).
+// The header may arrive in several segments, so it is read until complete, but never beyond its end:
+// the data after the header stays in the connection.
+// The whole header must be received within timeout and be at most maxLen bytes long, so a client dribbling
+// the header can't hold the connection setup forever.
+func readProxyHeader(conn net.Conn, timeout time.Duration, maxLen int) (net.Addr, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, errors.Wrap(err, "SetReadDeadline()")
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, proxyMinLen, proxyV1MaxLen)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, errors.Wrap(err, "read PROXY header")
+	}
+	switch {
+	case bytes.HasPrefix(buf, proxyV1Prefix):
+		return readProxyV1(conn, buf, maxLen)
+	case bytes.HasPrefix(buf, proxyV2Signature):
+		return readProxyV2(conn, buf, maxLen)
+	default:
+		return nil, errProxyHeader
+	}
+}
+
+// readProxyV1 reads the rest of the v1 header byte by byte until CRLF and parses it.
+// The header is at most proxyV1MaxLen or maxLen bytes long.
+func readProxyV1(conn net.Conn, buf []byte, maxLen int) (net.Addr, error) {
+	if maxLen > proxyV1MaxLen {
+		maxLen = proxyV1MaxLen
+	}
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(buf, []byte("\r\n")) {
+		if len(buf) >= maxLen {
+			return nil, errors.Wrap(errProxyHeader, "v1 header is too long")
+		}
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return nil, errors.Wrap(err, "read PROXY header")
+		}
+		buf = append(buf, b[0])
+	}
+
+	fields := strings.Fields(string(buf[:len(buf)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.Wrapf(errProxyHeader, "v1 header %q", buf)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, errors.Wrapf(errProxyHeader, "v1 source %s", net.JoinHostPort(fields[2], fields[4]))
+	}
+	// IPv4 sources are dotted, IPv6 ones have colons
+	if (fields[1] == "TCP4") == strings.Contains(fields[2], ":") {
+		return nil, errors.Wrapf(errProxyHeader, "v1 source %s doesn't match %s", fields[2], fields[1])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads the rest of the fixed part and the declared length of the v2 header and parses it.
+// The whole header is at most maxLen bytes long.
+func readProxyV2(conn net.Conn, buf []byte, maxLen int) (net.Addr, error) {
+	buf = buf[:proxyV2HeaderLen]
+	if _, err := io.ReadFull(conn, buf[proxyMinLen:]); err != nil {
+		return nil, errors.Wrap(err, "read PROXY header")
+	}
+	if buf[12]>>4 != 2 {
+		return nil, errors.Wrapf(errProxyHeader, "v2 version %d", buf[12]>>4)
+	}
+	length := int(binary.BigEndian.Uint16(buf[14:16]))
+	if proxyV2HeaderLen+length > maxLen {
+		return nil, errors.Wrapf(errProxyHeader, "v2 header length %d is more than %d", proxyV2HeaderLen+length, maxLen)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return nil, errors.Wrap(err, "read PROXY header")
+	}
+
+	// LOCAL command: health checks of the sending proxy, the connection endpoints are real
+	if buf[12]&0x0f == 0 {
+		return nil, nil
+	}
+	switch buf[13] {
+	case 0x11: // TCP over IPv4
+		if length < 12 {
+			return nil, errors.Wrap(errProxyHeader, "v2 IPv4 addresses are truncated")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if length < 36 {
+			return nil, errors.Wrap(errProxyHeader, "v2 IPv6 addresses are truncated")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	default:
+		return nil, nil
+	}
+}
@@ -0,0 +1,215 @@
+package service
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyV2Header returns a v2 PROXY header of a TCP over IPv4 connection from src.
+func proxyV2Header(src *net.TCPAddr) []byte {
+	h := append([]byte(nil), proxyV2Signature...)
+	h = append(h, 0x21, 0x11, 0, 12)
+	h = append(h, src.IP.To4()...)
+	h = append(h, 10, 0, 0, 1)
+	h = binary.BigEndian.AppendUint16(h, uint16(src.Port))
+	h = binary.BigEndian.AppendUint16(h, 80)
+	return h
+}
+
+// sendSplit writes data in segments of size bytes, so the reader gets the header in parts.
+func sendSplit(conn net.Conn, data []byte, size int) {
+	for len(data) > 0 {
+		n := size
+		if n > len(data) {
+			n = len(data)
+		}
+		if _, err := conn.Write(data[:n]); err != nil {
+			return
+		}
+		data = data[n:]
+	}
+}
+
+func TestReadSplitProxyHeader(t *testing.T) {
+	src := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 7).To4(), Port: 51234}
+	for name, header := range map[string][]byte{
+		"v1": []byte("PROXY TCP4 192.0.2.7 10.0.0.1 51234 80\r\n"),
+		"v2": proxyV2Header(src),
+	} {
+		for _, size := range []int{1, 3, 16} {
+			client, server := net.Pipe()
+			go sendSplit(client, append(header, "payload"...), size)
+
+			addr, err := readProxyHeader(server, time.Second, defaultPreambleMaxBytes)
+			if err != nil {
+				t.Fatalf("%s in segments of %d bytes: %v", name, size, err)
+			}
+			if addr.String() != src.String() {
+				t.Errorf("%s in segments of %d bytes: source %s, want %s", name, size, addr, src)
+			}
+			// the data after the header stays in the connection
+			rest := make([]byte, len("payload"))
+			if _, err := io.ReadFull(server, rest); err != nil || string(rest) != "payload" {
+				t.Errorf("%s in segments of %d bytes: data after the header is %q: %v", name, size, rest, err)
+			}
+			client.Close()
+			server.Close()
+		}
+	}
+}
+
+func TestReadProxyHeaderWithoutSource(t *testing.T) {
+	local := append(append([]byte(nil), proxyV2Signature...), 0x20, 0x00, 0, 0)
+	for name, header := range map[string][]byte{
+		"v1 unknown": []byte("PROXY UNKNOWN\r\n"),
+		"v2 local":   local,
+	} {
+		client, server := net.Pipe()
+		go sendSplit(client, header, 2)
+		addr, err := readProxyHeader(server, time.Second, defaultPreambleMaxBytes)
+		if err != nil || addr != nil {
+			t.Errorf("%s: source %v: %v", name, addr, err)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestReadInvalidProxyHeader(t *testing.T) {
+	for name, header := range map[string]string{
+		"not a header":    "GET / HTTP/1.1\r\nHost: x\r\n\r\n",
+		"family mismatch": "PROXY TCP4 2001:db8::1 10.0.0.1 1 80\r\n",
+		"bad port":        "PROXY TCP4 192.0.2.7 10.0.0.1 70000 80\r\n",
+		"missing fields":  "PROXY TCP4 192.0.2.7 10.0.0.1\r\n",
+	} {
+		client, server := net.Pipe()
+		go sendSplit(client, []byte(header), 4)
+		if _, err := readProxyHeader(server, time.Second, defaultPreambleMaxBytes); err == nil {
+			t.Errorf("%s: header is accepted", name)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestReadOversizedProxyHeader(t *testing.T) {
+	const maxLen = 120
+	v2 := append(append([]byte(nil), proxyV2Signature...), 0x21, 0x11)
+	v2 = binary.BigEndian.AppendUint16(v2, 200)
+	v2 = append(v2, make([]byte, 200)...)
+	for name, header := range map[string][]byte{
+		"v1": []byte("PROXY TCP4 192.0.2.7 10.0.0.1 51234 80" + strings.Repeat(" ", 100) + "\r\n"),
+		"v2": v2,
+	} {
+		client, server := net.Pipe()
+		go sendSplit(client, header, 16)
+		if _, err := readProxyHeader(server, time.Second, maxLen); !errors.Is(err, errProxyHeader) {
+			t.Errorf("%s header of %d bytes with max %d: %v, want %v", name, len(header), maxLen, err, errProxyHeader)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestDribbledProxyHeaderRejected(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Targets:             []string{startBackend(t, echo)},
+		AcceptProxyProtocol: true,
+		PreambleTimeout:     timeout,
+	}}})
+	conn := dialProxy(t, p, 0)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	// every byte comes in time for a per-read timeout, but not the whole header
+	go func() {
+		for _, b := range []byte("PROXY TCP4 192.0.2.7 10.0.0.1 51234 80\r\n") {
+			if _, err := conn.Write([]byte{b}); err != nil {
+				return
+			}
+			time.Sleep(timeout / 4)
+		}
+	}()
+	if n, err := conn.Read(make([]byte, 1)); n != 0 || err == nil {
+		t.Fatalf("dribbling client reads %d bytes, %v", n, err)
+	}
+	if elapsed := time.Since(start); elapsed > timeout+time.Second {
+		t.Errorf("dribbling client is closed after %s with the preamble timeout of %s", elapsed, timeout)
+	}
+}
+
+func TestPreambleConcurrency(t *testing.T) {
+	t.Run("stalled headers don't hold workers", func(t *testing.T) {
+		p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+			Targets:             []string{startBackend(t, echo)},
+			AcceptProxyProtocol: true,
+			PreambleTimeout:     10 * time.Second,
+			AcceptWorkers:       1,
+			PreambleConcurrency: 8,
+		}}})
+		for i := 0; i < 4; i++ {
+			// never sends the header
+			dialProxy(t, p, 0)
+		}
+		conn := dialProxy(t, p, 0)
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		if _, err := conn.Write([]byte("PROXY TCP4 192.0.2.7 10.0.0.1 51234 80\r\nping")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+			t.Fatalf("healthy connection behind stalled headers reads %q: %v", buf, err)
+		}
+	})
+
+	t.Run("accepting stays bounded", func(t *testing.T) {
+		const workers, slots = 2, 2
+		p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+			Targets:             []string{startBackend(t, echo)},
+			AcceptProxyProtocol: true,
+			PreambleTimeout:     10 * time.Second,
+			AcceptWorkers:       workers,
+			PreambleConcurrency: slots,
+		}}})
+		a := p.apps[0]
+		for i := 0; i < 10*(workers+slots); i++ {
+			dialProxy(t, p, 0)
+		}
+		// slots read headers, workers wait for slots, the loop holds one more connection waiting for a worker
+		const bound = workers + slots + 1
+		if !waitFor(t, 5*time.Second, func() bool { return a.accepted.Load() >= workers+slots }) {
+			t.Fatalf("%d connections are accepted, want at least %d", a.accepted.Load(), workers+slots)
+		}
+		time.Sleep(200 * time.Millisecond)
+		if n := a.accepted.Load(); n > bound {
+			t.Errorf("%d connections with stalled headers are accepted, want at most %d", n, bound)
+		}
+	})
+
+	t.Run("waiting for a slot times out", func(t *testing.T) {
+		p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+			Targets:              []string{startBackend(t, echo)},
+			AcceptProxyProtocol:  true,
+			PreambleTimeout:      10 * time.Second,
+			PreambleConcurrency:  2,
+			PreambleQueueTimeout: 100 * time.Millisecond,
+		}}})
+		for i := 0; i < 2; i++ {
+			dialProxy(t, p, 0)
+		}
+		conn := dialProxy(t, p, 0)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		start := time.Now()
+		if n, err := conn.Read(make([]byte, 1)); n != 0 || err == nil {
+			t.Fatalf("connection without a free slot reads %d bytes, %v", n, err)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("connection without a free slot is rejected after %v", elapsed)
+		}
+	})
+}
@@ -0,0 +1,153 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Reload applies the config without dropping established connections. Apps are matched by name.
+// Backends of apps are added, removed (removed backends are drained) and reweighted, backend settings for new backends,
+// dial retries, health check intervals, connection rate limits, per-IP limits and the global rate limit are updated.
+// Changed ports are rebound: frontends move to new listeners, their established connections stay intact.
+// Adding or removing apps, changing the number of ports of an app and other listener or buffer settings
+// require a restart; such changes are ignored and reported in the returned error.
+func (p Proxy) Reload(config ProxyConfig) error {
+	var unsupported []string
+
+	switch {
+	case p.limiter != nil && config.RateLimit > 0:
+		p.limiter.setRate(config.RateLimit, globalBurst(config.RateLimit))
+	case (p.limiter != nil) != (config.RateLimit > 0):
+		unsupported = append(unsupported, "enabling or disabling RateLimit")
+	}
+
+	portsErr := checkPorts(config.Apps)
+	if portsErr != nil {
+		unsupported = append(unsupported, "ports: "+portsErr.Error())
+	}
+
+	apps := make(map[string]*application, len(p.apps))
+	for _, app := range p.apps {
+		apps[app.name] = app
+	}
+	for _, configApp := range config.Apps {
+		app, ok := apps[configApp.Name]
+		if !ok {
+			unsupported = append(unsupported, "new app "+configApp.Name)
+			continue
+		}
+		delete(apps, configApp.Name)
+
+		if strategy, err := newStrategy(configApp.Strategy, configApp.HashReplicas); err != nil || !sameStrategy(strategy, app.strategy) {
+			unsupported = append(unsupported, "strategy of app "+configApp.Name)
+		}
+		if configApp.MaxConcurrentDrains != app.maxDrains {
+			unsupported = append(unsupported, "MaxConcurrentDrains of app "+configApp.Name)
+		}
+		app.reload(configApp)
+		var fnds []*frontend
+		var sockets []string
+		for _, fnd := range p.fnds {
+			if fnd.app != app {
+				continue
+			}
+			fnd.reload(configApp)
+			if fnd.unixAddr != nil {
+				sockets = append(sockets, fnd.unixAddr.Name)
+				continue
+			}
+			fnds = append(fnds, fnd)
+		}
+		if strings.Join(sockets, "\x00") != strings.Join(configApp.ListenUnix, "\x00") {
+			unsupported = append(unsupported, "ListenUnix of app "+configApp.Name)
+		}
+		if len(fnds) > 0 && fnds[0].reusePort != configApp.ReusePort {
+			unsupported = append(unsupported, "ReusePort of app "+configApp.Name)
+		}
+		if len(fnds) > 0 && fnds[0].host != configApp.ListenHost {
+			unsupported = append(unsupported, "ListenHost of app "+configApp.Name)
+		}
+		if network, err := listenNetwork(configApp.ListenNetwork); len(fnds) > 0 && (err != nil || fnds[0].network != network) {
+			unsupported = append(unsupported, "ListenNetwork of app "+configApp.Name)
+		}
+		if portsErr == nil {
+			if err := rebindPorts(fnds, configApp.Ports); err != nil {
+				unsupported = append(unsupported, "ports of app "+configApp.Name+": "+err.Error())
+			}
+		}
+		p.logger.Info("app config reloaded", fields{"app": configApp.Name})
+	}
+	for name := range apps {
+		unsupported = append(unsupported, "removed app "+name)
+	}
+
+	if len(unsupported) > 0 {
+		return errors.Errorf("changes require restart: %s", strings.Join(unsupported, ", "))
+	}
+	return nil
+}
+
+// rebindPorts moves frontends listening on ports which are not in the list to the new ports of the list.
+func rebindPorts(fnds []*frontend, ports []int) error {
+	if len(fnds) != len(ports) {
+		return errors.Errorf("number of ports changed from %d to %d", len(fnds), len(ports))
+	}
+	added := make(map[int]int, len(ports))
+	for _, port := range ports {
+		added[port]++
+	}
+	var freed []*frontend
+	for _, fnd := range fnds {
+		port := fnd.laddr.Load().Port
+		if added[port] > 0 {
+			added[port]--
+			continue
+		}
+		freed = append(freed, fnd)
+	}
+
+	var failed []string
+	for _, port := range ports {
+		if added[port] == 0 {
+			continue
+		}
+		added[port]--
+		fnd := freed[0]
+		freed = freed[1:]
+		if err := fnd.rebind(port); err != nil {
+			failed = append(failed, fmt.Sprintf("rebind %s to port %d: %s", fnd.laddr.Load(), port, err))
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// reload applies the reloadable part of the app config. Established connections are untouched.
+func (a *application) reload(c ConfigApp) {
+	opts := c.backendOptions()
+	opts.status = a.bndOpts.status
+
+	a.rmu.Lock()
+	a.bndOpts = opts
+	for _, bnd := range a.bnds {
+		bnd.setHealthcheckInterval(opts.healthcheckInterval)
+	}
+	a.rmu.Unlock()
+
+	a.dialRetries.Store(int64(c.DialRetries))
+
+	// discovered backends are managed by discovery
+	if a.discovery == nil {
+		a.reconcile(c.staticBackends())
+	}
+}
+
+// reload applies the reloadable part of the app config to the frontend. Established connections are untouched.
+func (f *frontend) reload(c ConfigApp) {
+	f.connRateLimit.Store(c.ConnRateLimit)
+	f.clients.setLimit(c.MaxConnsPerIP)
+}
@@ -0,0 +1,83 @@
+package service
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestReloadAddsBackend(t *testing.T) {
+	old, added := startBackend(t, echo), startBackend(t, echo)
+	stats := make(chan SessionStats, 1)
+	config := ProxyConfig{Apps: []ConfigApp{{
+		Targets:      []string{old},
+		Strategy:     roundRobinName,
+		OnDisconnect: func(s SessionStats) { stats <- s },
+	}}}
+	p := startProxy(t, config)
+	established := openExchange(t, p)
+
+	config.Apps[0].Targets = []string{old, added}
+	if err := p.Reload(config); err != nil {
+		t.Fatalf("Reload(): %v", err)
+	}
+	a := p.apps[0]
+	if !waitFor(t, 5*time.Second, func() bool {
+		a.rmu.RLock()
+		defer a.rmu.RUnlock()
+		bnd := a.backendByAddr(added)
+		return bnd != nil && bnd.eligible()
+	}) {
+		t.Fatal("added backend isn't active")
+	}
+
+	counts := countBackends(t, p, stats, 4)
+	if counts[added] == 0 {
+		t.Errorf("new connections don't reach the added backend: %v", counts)
+	}
+	established.Write([]byte("pong"))
+	if _, err := io.ReadFull(established, make([]byte, 4)); err != nil {
+		t.Errorf("established connection after reload: %v", err)
+	}
+}
+
+// freePort returns a loopback port which is free at the moment.
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestReloadRebindsPort(t *testing.T) {
+	oldPort, newPort := freePort(t), freePort(t)
+	config := ProxyConfig{Apps: []ConfigApp{{
+		Targets: []string{startBackend(t, echo)},
+		Ports:   []int{oldPort},
+	}}}
+	p := startProxy(t, config)
+	established := openExchange(t, p)
+
+	config.Apps[0].Ports = []int{newPort}
+	if err := p.Reload(config); err != nil {
+		t.Fatalf("Reload(): %v", err)
+	}
+	if port := p.ListenAddrs()[0].(*net.TCPAddr).Port; port != newPort {
+		t.Errorf("frontend listens on port %d, want %d", port, newPort)
+	}
+	if conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(oldPort)), time.Second); err == nil {
+		conn.Close()
+		t.Error("old port accepts connections after rebind")
+	}
+	openExchange(t, p)
+
+	established.Write([]byte("pong"))
+	if _, err := io.ReadFull(established, make([]byte, 4)); err != nil {
+		t.Errorf("connection established on the old port: %v", err)
+	}
+}
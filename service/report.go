@@ -0,0 +1,118 @@
+package service
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ShutdownReport is a summary of the work of an app. The report is final after Proxy.Run returns.
+type ShutdownReport struct {
+	App string
+	// Served is the number of finished connection pairs.
+	Served int64
+	// ForceClosed is the number of connection pairs closed by the shutdown.
+	ForceClosed int64
+	// BytesIn is the number of bytes copied from clients to backends of finished connection pairs.
+	BytesIn int64
+	// BytesOut is the number of bytes copied from backends to clients of finished connection pairs.
+	BytesOut int64
+	// Backends are totals per backend including removed backends, ordered by address.
+	Backends []BackendReport
+}
+
+// BackendReport is a summary of the work of a backend.
+type BackendReport struct {
+	Addr     string
+	Served   int64
+	BytesIn  int64
+	BytesOut int64
+}
+
+// sessionTotals accumulates totals of finished sessions of an app. It waits for running sessions on shutdown,
+// so the totals are final.
+type sessionTotals struct {
+	mu sync.Mutex
+	// closed is set on shutdown, then new sessions aren't started.
+	closed      bool
+	running     sync.WaitGroup
+	served      int64
+	forceClosed int64
+	bytesIn     int64
+	bytesOut    int64
+	backends    map[string]*BackendReport
+}
+
+// start registers a new session. It returns false after shutdown, then the session must not be started.
+func (t *sessionTotals) start() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return false
+	}
+	t.running.Add(1)
+	return true
+}
+
+// finish adds the stats of a finished session of the backend started by start.
+func (t *sessionTotals) finish(addr string, stats SessionStats) {
+	defer t.running.Done()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.served++
+	if stats.Reason != nil && errors.Is(stats.Reason, ErrShutdown) {
+		t.forceClosed++
+	}
+	t.bytesIn += stats.BytesIn
+	t.bytesOut += stats.BytesOut
+	if t.backends == nil {
+		t.backends = make(map[string]*BackendReport)
+	}
+	bnd, ok := t.backends[addr]
+	if !ok {
+		bnd = &BackendReport{Addr: addr}
+		t.backends[addr] = bnd
+	}
+	bnd.Served++
+	bnd.BytesIn += stats.BytesIn
+	bnd.BytesOut += stats.BytesOut
+}
+
+// close stops new sessions and waits for running ones.
+func (t *sessionTotals) close() {
+	t.mu.Lock()
+	t.closed = true
+	t.mu.Unlock()
+	t.running.Wait()
+}
+
+// report returns the current totals.
+func (t *sessionTotals) report(app string) ShutdownReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	report := ShutdownReport{
+		App:         app,
+		Served:      t.served,
+		ForceClosed: t.forceClosed,
+		BytesIn:     t.bytesIn,
+		BytesOut:    t.bytesOut,
+		Backends:    make([]BackendReport, 0, len(t.backends)),
+	}
+	for _, bnd := range t.backends {
+		report.Backends = append(report.Backends, *bnd)
+	}
+	sort.Slice(report.Backends, func(i, j int) bool {
+		return report.Backends[i].Addr < report.Backends[j].Addr
+	})
+	return report
+}
+
+// ShutdownReport returns summaries of all apps. They are final after Run returns.
+func (p Proxy) ShutdownReport() []ShutdownReport {
+	reports := make([]ShutdownReport, 0, len(p.apps))
+	for _, app := range p.apps {
+		reports = append(reports, app.totals.report(app.name))
+	}
+	return reports
+}
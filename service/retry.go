@@ -0,0 +1,58 @@
+package service
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// maxRetryBackoff caps the exponential part of pauses between dial retries.
+const maxRetryBackoff = time.Second
+
+var (
+	// jitterRand is seeded explicitly: the global source isn't seeded for this module's Go version,
+	// so all proxy processes would pause for the same durations.
+	jitterMu   sync.Mutex
+	jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// retryDelay returns the pause before the retry which follows failures failed dials of a client setup.
+// retryBackoff doubles with every failure up to maxRetryBackoff, a random jitter up to retryJitter is added,
+// so retries of many clients don't hit a recovering backend at once.
+func (a *application) retryDelay(failures int) time.Duration {
+	delay := a.retryBackoff
+	for i := 1; i < failures && delay < maxRetryBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryBackoff {
+		delay = maxRetryBackoff
+	}
+	if a.retryJitter > 0 {
+		jitterMu.Lock()
+		delay += time.Duration(jitterRand.Int63n(int64(a.retryJitter)))
+		jitterMu.Unlock()
+	}
+	return delay
+}
+
+// waitRetry pauses before the retry which follows failures failed dials. It fails right away if the pause
+// would exhaust the setup budget, which ends at deadline unless it is zero, and fails if the app is stopped.
+func (a *application) waitRetry(deadline time.Time, failures int, lastErr error) error {
+	delay := a.retryDelay(failures)
+	if delay <= 0 {
+		return nil
+	}
+	if !deadline.IsZero() && time.Until(deadline) <= delay {
+		return errors.Wrapf(errSetupBudget, "%s, no time for retry backoff, last error: %v", a.setupBudget, lastErr)
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-a.ctx.Done():
+		return errors.Wrap(a.ctx.Err(), "retry backoff")
+	}
+}
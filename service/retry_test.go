@@ -0,0 +1,87 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	a := &application{retryBackoff: 100 * time.Millisecond, retryJitter: 50 * time.Millisecond}
+	for failures, base := range map[int]time.Duration{
+		1: 100 * time.Millisecond,
+		2: 200 * time.Millisecond,
+		3: 400 * time.Millisecond,
+		4: 800 * time.Millisecond,
+		5: time.Second,
+		9: time.Second,
+	} {
+		for i := 0; i < 100; i++ {
+			if d := a.retryDelay(failures); d < base || d >= base+a.retryJitter {
+				t.Fatalf("delay after %d failures is %s, want %s plus jitter up to %s", failures, d, base, a.retryJitter)
+			}
+		}
+	}
+}
+
+// failDialer dials in-memory echo connections like pipeDialer until failing is set, then it fails dials
+// and records their times.
+type failDialer struct {
+	failing atomic.Bool
+	mu      sync.Mutex
+	dials   []time.Time
+}
+
+func (d *failDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if !d.failing.Load() {
+		return pipeDialer{}.DialContext(ctx, network, addr)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dials = append(d.dials, time.Now())
+	return nil, errors.New("connection refused")
+}
+
+func TestRetryBackoffWithinBudget(t *testing.T) {
+	const (
+		backoff = 100 * time.Millisecond
+		jitter  = 20 * time.Millisecond
+		budget  = 250 * time.Millisecond
+	)
+	dialer := &failDialer{}
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Targets:      []string{"192.0.2.1:80", "192.0.2.2:80", "192.0.2.3:80"},
+		Dialer:       dialer,
+		DialRetries:  2,
+		RetryBackoff: backoff,
+		RetryJitter:  jitter,
+		SetupBudget:  budget,
+	}}})
+	waitBackendsActive(t, p)
+	dialer.failing.Store(true)
+
+	conn := dialProxy(t, p, 0)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("client of failing backends reads data")
+	}
+	elapsed := time.Since(start)
+
+	dialer.mu.Lock()
+	defer dialer.mu.Unlock()
+	// the second pause of 200ms doesn't fit into the rest of the budget, so the setup fails without it
+	if len(dialer.dials) != 2 {
+		t.Fatalf("%d dials, want 2", len(dialer.dials))
+	}
+	if gap := dialer.dials[1].Sub(dialer.dials[0]); gap < backoff || gap > backoff+jitter+50*time.Millisecond {
+		t.Errorf("retry follows the failed dial after %s, want %s plus jitter up to %s", gap, backoff, jitter)
+	}
+	if elapsed > budget {
+		t.Errorf("setup fails after %s, want within the budget of %s", elapsed, budget)
+	}
+}
@@ -0,0 +1,26 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+
+package service
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// soReusePort is SO_REUSEPORT of asm-generic/socket.h. The syscall package doesn't define it on Linux.
+const soReusePort = 0xf
+
+const reusePortSupported = true
+
+// reusePortControl sets SO_REUSEPORT on the listener socket before bind, so several processes can listen
+// on the same port and the kernel balances connections between them.
+func reusePortControl(_, _ string, c syscall.RawConn) error {
+	var sockErr error
+	if err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	}); err != nil {
+		return errors.Wrap(err, "Control()")
+	}
+	return errors.Wrap(sockErr, "setsockopt(SO_REUSEPORT)")
+}
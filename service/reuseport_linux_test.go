@@ -0,0 +1,33 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+
+package service
+
+import (
+	"testing"
+)
+
+func TestReusePortSharesPort(t *testing.T) {
+	port := freePort(t)
+	backend := startBackend(t, echo)
+	stats := make(chan string, 32)
+	var proxies []Proxy
+	for _, name := range []string{"first", "second"} {
+		name := name
+		proxies = append(proxies, startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+			Targets:      []string{backend},
+			Ports:        []int{port},
+			ReusePort:    true,
+			OnDisconnect: func(SessionStats) { stats <- name },
+		}}}))
+	}
+
+	// the kernel spreads connections between the listeners by their addresses
+	got := make(map[string]int)
+	for i := 0; i < 32; i++ {
+		exchange(t, proxies[0])
+		got[<-stats]++
+	}
+	if got["first"] == 0 || got["second"] == 0 {
+		t.Errorf("connections are spread as %v, want both listeners to accept", got)
+	}
+}
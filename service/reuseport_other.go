@@ -0,0 +1,14 @@
+//go:build !linux || mips || mipsle || mips64 || mips64le
+
+package service
+
+import (
+	"syscall"
+)
+
+const reusePortSupported = false
+
+// reusePortControl isn't supported on this platform.
+func reusePortControl(string, string, syscall.RawConn) error {
+	return errReusePortUnsupported
+}
@@ -0,0 +1,60 @@
+package service
+
+import (
+	"net"
+)
+
+// ClientInfo describes the client connection a backend is selected for.
+type ClientInfo struct {
+	App    string
+	Client net.Addr
+	// OriginalDst is the original destination of a transparently proxied connection. It is nil if unknown.
+	OriginalDst net.Addr
+}
+
+// BackendInfo describes a backend eligible for a new connection.
+type BackendInfo struct {
+	Addr        string
+	Weight      int
+	Priority    int
+	Connections int
+}
+
+// Selector chooses a backend for a new connection among eligible backends of the same priority tier.
+// It must return one of the given backends. If it returns nil or an error, the strategy of the app chooses the backend.
+// It is called for every connection attempt, so it should be fast.
+type Selector func(client ClientInfo, backends []BackendInfo) (*BackendInfo, error)
+
+// selectBackend chooses a backend among candidates by the selector of the app. It returns nil if the selector
+// isn't set or doesn't choose a backend.
+// Must be called under the application read lock.
+func (a *application) selectBackend(candidates []*backend, key selectionKey) *backend {
+	if a.selector == nil {
+		return nil
+	}
+	infos := make([]BackendInfo, len(candidates))
+	for i, bnd := range candidates {
+		infos[i] = BackendInfo{
+			Addr:        bnd.addr,
+			Weight:      bnd.weight,
+			Priority:    bnd.priority,
+			Connections: bnd.getConnCount(),
+		}
+	}
+	client := ClientInfo{App: a.name, Client: key.client, OriginalDst: key.origDstAddr}
+	chosen, err := a.selector(client, infos)
+	if err != nil {
+		a.logger.Debug("selector failed, falling back to strategy", fields{"error": err, "app": a.name, "client": key.clientIP})
+		return nil
+	}
+	if chosen == nil {
+		return nil
+	}
+	for _, bnd := range candidates {
+		if bnd.addr == chosen.Addr {
+			return bnd
+		}
+	}
+	a.logger.Debug("selector chose unknown backend, falling back to strategy", fields{"app": a.name, "backend": chosen.Addr})
+	return nil
+}
@@ -0,0 +1,61 @@
+package service
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestSelectorByClientPort(t *testing.T) {
+	even, odd := startBackend(t, echo), startBackend(t, echo)
+	stats := make(chan SessionStats, 1)
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Targets: []string{even, odd},
+		Selector: func(client ClientInfo, backends []BackendInfo) (*BackendInfo, error) {
+			want := even
+			if client.Client.(*net.TCPAddr).Port%2 == 1 {
+				want = odd
+			}
+			for i := range backends {
+				if backends[i].Addr == want {
+					return &backends[i], nil
+				}
+			}
+			return nil, errors.New("backend isn't eligible")
+		},
+		OnDisconnect: func(s SessionStats) { stats <- s },
+	}}})
+	waitBackendsActive(t, p)
+
+	for i := 0; i < 8; i++ {
+		exchange(t, p)
+		s := <-stats
+		want := even
+		if s.Client.(*net.TCPAddr).Port%2 == 1 {
+			want = odd
+		}
+		if s.Backend.String() != want {
+			t.Errorf("client %s went to %s, want %s", s.Client, s.Backend, want)
+		}
+	}
+}
+
+func TestSelectorFallback(t *testing.T) {
+	backend := startBackend(t, echo)
+	for name, selector := range map[string]Selector{
+		"error": func(ClientInfo, []BackendInfo) (*BackendInfo, error) {
+			return nil, errors.New("no choice")
+		},
+		"nil": func(ClientInfo, []BackendInfo) (*BackendInfo, error) {
+			return nil, nil
+		},
+		"unknown": func(ClientInfo, []BackendInfo) (*BackendInfo, error) {
+			return &BackendInfo{Addr: "192.0.2.1:80"}, nil
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{Targets: []string{backend}, Selector: selector}}})
+			exchange(t, p)
+		})
+	}
+}
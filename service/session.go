@@ -0,0 +1,260 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// session is a pair of an incoming connection and its remote connection.
+type session struct {
+	// ctx is cancelled to tear down the session. It is done when the session is closed.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// parent is the context of the frontend. It is done on shutdown.
+	parent    context.Context
+	logger    *proxyLogger
+	client    *Conn
+	remote    *Conn
+	bnd       *backend
+	closeOnce sync.Once
+	// copiers is the number of running copy goroutines.
+	copiers atomic.Int32
+	// reuse is set when the remote connection is returned to the backend pool instead of being closed.
+	// It is written once under closeOnce.
+	reuse bool
+	// settling is set when the client closed its side cleanly and the remote connection may be pooled:
+	// the response of the backend is still copied until the backend is quiet for poolSettleTime.
+	settling atomic.Bool
+	// linger is the destination of the direction which ended cleanly. It is shut down for writing on close
+	// and closed by lingerClose after both copy goroutines stop. It is written once under closeOnce, nil means none.
+	linger *Conn
+	// reason is the reason of the end of the session. It is written once under closeOnce.
+	reason *CopyError
+	// labels are set by the OnConnect hook with ContextLabels before the session starts. They aren't changed afterwards.
+	labels map[string]string
+	// resetOnClose makes forced closes of the connections send RST instead of FIN.
+	resetOnClose bool
+	// bytesIn and bytesOut are the numbers of bytes copied to the remote and to the client connections.
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+	// onDone is called with stats of the session when both copy goroutines stop. It may be nil.
+	onDone func(SessionStats)
+	// onClose is called after the connections are closed. It may be nil.
+	onClose func()
+}
+
+// newSession creates the session of the pair. The session options are set before it is started by watch.
+func newSession(ctx context.Context, logger *proxyLogger, client, remote *Conn, bnd *backend) *session {
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	s := &session{
+		parent: parent,
+		ctx:    ctx,
+		cancel: cancel,
+		logger: logger,
+		client: client,
+		remote: remote,
+		bnd:    bnd,
+	}
+	s.copiers.Store(2)
+	client.session = s
+	remote.session = s
+	client.peer = remote
+	remote.peer = client
+	return s
+}
+
+// watch starts closing the session when its parent ctx is done, the session is cancelled or the client connection
+// reaches maxAge. Zero maxAge means no age limit. The session options must not be changed after it is called.
+func (s *session) watch(maxAge time.Duration) {
+	go func() {
+		defer s.close()
+		if maxAge <= 0 {
+			<-s.ctx.Done()
+			return
+		}
+		timer := time.NewTimer(time.Until(s.client.created.Add(maxAge)))
+		defer timer.Stop()
+		select {
+		case <-s.ctx.Done():
+		case <-timer.C:
+			s.logger.Debugf("connection %s -> %s reached max age", s.client.RemoteAddr().String(), s.client.LocalAddr().String())
+		}
+	}()
+}
+
+// close closes both connections and deletes them from their managers. Such close is forced.
+// It is safe for concurrent use: copy goroutines and admin requests share it, so the pair is torn down only once.
+func (s *session) close() {
+	s.closeOnce.Do(func() {
+		s.reason = &CopyError{Cause: ErrClosedByProxy}
+		if s.parent.Err() != nil {
+			s.reason.Cause = ErrShutdown
+		}
+		s.closeAll(true)
+	})
+}
+
+// abort tears down the session which fails before its copy goroutines are started, so finish is never called.
+// The connections are closed and deleted from their managers like on a forced close, then the session is reported
+// as done.
+func (s *session) abort() {
+	s.close()
+	if s.onDone != nil {
+		s.onDone(s.stats())
+	}
+}
+
+// finish closes the session when copying in one direction is over. It is called by both copy goroutines.
+// The direction which finishes first defines the session result for backend outlier detection:
+// the session failed if its close reason is the backend and the backend either failed or closed without sending
+// any data. Client closes, timeouts and closes by the proxy aren't failures of the backend.
+// If the backend has a connection pool and the client closed its side cleanly, the session isn't closed yet:
+// the response of the backend is copied until the backend is quiet for poolSettleTime, only then the exchange
+// is complete and the remote connection is returned to the pool. A backend which closes its side or fails
+// meanwhile isn't pooled.
+// It returns the reason of the end of the session if this call closed it, otherwise nil: errors of the other
+// direction are caused by the close.
+func (s *session) finish(fromRemote bool, n int64, err error) *CopyError {
+	if fromRemote {
+		s.bytesOut.Add(n)
+	} else {
+		s.bytesIn.Add(n)
+	}
+	var reason *CopyError
+	if fromRemote || err != nil || !s.settle() {
+		s.closeOnce.Do(func() {
+			settled := errors.Is(err, errSettled)
+			if settled {
+				err = nil
+			}
+			s.reason = classifyCopyError(s.parent, s.ctx, err, fromRemote)
+			if s.settling.Load() && err == nil {
+				// the client closed first, then the backend either answered everything or closed its side too
+				s.reason.Cause = ErrClientClosed
+			}
+			reason = s.reason
+			s.reuse = settled && s.ctx.Err() == nil
+			if err == nil {
+				s.linger = s.remote
+				if fromRemote {
+					s.linger = s.client
+				}
+			}
+			s.closeAll(err != nil)
+			s.bnd.recordSession(errors.Is(s.reason, ErrBackendClosed) && (err != nil || n == 0))
+		})
+	}
+	if s.copiers.Add(-1) == 0 {
+		if s.reuse {
+			s.bnd.release(s.remote.Conn)
+		}
+		if s.linger != nil {
+			go lingerClose(s.linger)
+		}
+		if s.onDone != nil {
+			s.onDone(s.stats())
+		}
+	}
+	return reason
+}
+
+// settle starts settling of the session after the client closed its side cleanly if the remote connection
+// may be pooled. The read deadline of the remote connection is shortened to poolSettleTime, so the remote copy
+// goroutine ends with errSettled when the backend is quiet. It returns false if the session isn't settled.
+func (s *session) settle() bool {
+	if s.bnd.pool == nil || s.ctx.Err() != nil {
+		return false
+	}
+	s.settling.Store(true)
+	s.remote.SetReadDeadline(time.Now().Add(poolSettleTime))
+	return true
+}
+
+// closeAll expires deadlines of the connections before closing, so both copy goroutines are unblocked promptly
+// even if a connection type doesn't interrupt blocked calls on Close or the close is delayed.
+// The session ctx is cancelled first, so copy goroutines don't extend the expired deadlines.
+// The close is forced if it isn't caused by a clean end of copying, then connections are reset if resetOnClose is set.
+func (s *session) closeAll(forced bool) {
+	s.cancel()
+	if forced && s.resetOnClose {
+		if err := setResetOnClose(s.client.Conn); err != nil {
+			s.logger.Debug("unable to reset client connection", fields{"error": err})
+		}
+		if !s.reuse {
+			if err := setResetOnClose(s.remote.Conn); err != nil {
+				s.logger.Debug("unable to reset remote connection", fields{"error": err})
+			}
+		}
+	}
+	now := time.Now()
+	if s.logger.debugEnabled() {
+		event := fields{"reason": s.reason.Error()}
+		if len(s.labels) > 0 {
+			event["labels"] = s.labels
+		}
+		s.logger.Debug(fmt.Sprintf("closing connection %s -> %s", s.client.RemoteAddr().String(), s.client.LocalAddr().String()), event)
+	}
+	s.closeConn(s.client, now)
+	s.logger.Debugf("closing connection %s -> %s", s.remote.LocalAddr().String(), s.remote.RemoteAddr().String())
+	if s.reuse {
+		// unblocks the remote copy goroutine, the connection is released when it exits
+		s.remote.SetReadDeadline(now)
+	} else {
+		s.closeConn(s.remote, now)
+	}
+	s.client.manager.delConn(s.client)
+	s.remote.manager.delConn(s.remote)
+	if s.onClose != nil {
+		s.onClose()
+	}
+}
+
+// closeConn expires deadlines of the connection and closes it. The linger connection is only shut down for writing:
+// the peer gets EOF after all data written to it, its close is completed by lingerClose.
+func (s *session) closeConn(conn *Conn, now time.Time) {
+	if conn == s.linger {
+		conn.SetReadDeadline(now)
+		err := closeWrite(conn.Conn)
+		if err == nil {
+			return
+		}
+		s.logger.Debug("unable to half-close connection", fields{"error": err})
+		s.linger = nil
+	}
+	conn.SetDeadline(now)
+	conn.Close()
+}
+
+// closeLinger is the max time a connection shut down for writing waits for the peer to close its side.
+const closeLinger = 2 * time.Second
+
+// lingerClose completes the close of a connection shut down for writing. Closing a socket with unread input
+// sends RST, which may make the peer discard data it hasn't read yet, so the input is discarded until the peer
+// closes its side or closeLinger passes.
+func lingerClose(conn *Conn) {
+	conn.SetReadDeadline(time.Now().Add(closeLinger))
+	io.Copy(io.Discard, conn.Conn)
+	conn.Close()
+}
+
+// stats returns stats of the session. It is called after both copy goroutines stop.
+func (s *session) stats() SessionStats {
+	return SessionStats{
+		App:      s.bnd.appName,
+		Client:   s.client.RemoteAddr(),
+		Backend:  s.remote.RemoteAddr(),
+		Started:  s.client.created,
+		Duration: time.Since(s.client.created),
+		BytesIn:  s.bytesIn.Load(),
+		BytesOut: s.bytesOut.Load(),
+		Reason:   s.reason,
+		Labels:   s.labels,
+	}
+}
@@ -0,0 +1,79 @@
+package service
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBackendCloseDeliversResponse(t *testing.T) {
+	const size = 64 << 10
+	backend := startBackend(t, func(conn net.Conn) {
+		if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+			return
+		}
+		conn.Write(make([]byte, size))
+	})
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{Targets: []string{backend}}}})
+	conn := dialProxy(t, p, 0)
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	conn.Write([]byte("ping"))
+	// the response fits into socket buffers, so the backend closes before the client reads it.
+	// Input arriving after that must not make the proxy reset the unread response.
+	time.Sleep(100 * time.Millisecond)
+	conn.Write([]byte("more"))
+
+	n, err := io.Copy(io.Discard, conn)
+	if err != nil || n != size {
+		t.Errorf("client reads %d bytes, %v, want the whole response of %d bytes and EOF", n, err, size)
+	}
+}
+
+// stoppedManager is a connection manager which doesn't track new connections, like a stopped one.
+type stoppedManager struct {
+	connManager
+}
+
+func (stoppedManager) addConn(*Conn) bool { return false }
+
+func TestSessionAbortAfterAdd(t *testing.T) {
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{Targets: []string{startBackend(t, echo)}}}})
+	fnd := p.fnds[0]
+	a := p.apps[0]
+	a.rmu.RLock()
+	bnd := a.bnds[0]
+	a.rmu.RUnlock()
+
+	client, clientPeer := net.Pipe()
+	remote, remotePeer := net.Pipe()
+	defer clientPeer.Close()
+	defer remotePeer.Close()
+	conn, rConn := newConn(client, stoppedManager{fnd}), newConn(remote, bnd)
+	sess := newSession(context.Background(), fnd.logger, conn, rConn, bnd)
+	done := make(chan SessionStats, 1)
+	sess.onDone = func(s SessionStats) { done <- s }
+
+	// the backend connection is tracked, then tracking of the client connection fails
+	if !rConn.manager.addConn(rConn) || !conn.manager.addConn(conn) {
+		sess.abort()
+	}
+	if n := bnd.getConnCount(); n != 0 {
+		t.Errorf("backend tracks %d connections of the aborted session", n)
+	}
+	if n := fnd.getConnCount(); n != 0 {
+		t.Errorf("frontend tracks %d connections of the aborted session", n)
+	}
+	for name, peer := range map[string]net.Conn{"client": clientPeer, "backend": remotePeer} {
+		peer.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := peer.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("%s connection of the aborted session isn't closed: %v", name, err)
+		}
+	}
+	select {
+	case <-done:
+	default:
+		t.Error("aborted session isn't reported as done")
+	}
+}
@@ -0,0 +1,61 @@
+package service
+
+import (
+	"time"
+)
+
+const (
+	// drainPollInterval is the period of checks of remaining connections during the shutdown drain.
+	drainPollInterval = 100 * time.Millisecond
+	// drainLogInterval is the period of logs of remaining connections during the shutdown drain.
+	drainLogInterval = 5 * time.Second
+)
+
+// drainOnShutdown is a blocking function. When the parent context is done, it stops accepting on all frontends
+// and waits up to drainTimeout for established connections to finish. Then it stops the proxy, which closes
+// the remaining connections.
+func (p Proxy) drainOnShutdown() {
+	select {
+	case <-p.ctx.Done():
+		// stopped without a drain, e.g. by a bind failure
+		return
+	case <-p.parent.Done():
+	}
+	defer p.cancel()
+
+	for _, fnd := range p.fnds {
+		if err := fnd.stopAccepting(); err != nil {
+			p.logger.Debug("unable to stop accepting", fields{"error": err, "frontend": fnd.name()})
+		}
+	}
+	remaining := p.activeConnections()
+	p.logger.Info("draining connections before shutdown", fields{"connections": remaining, "timeout": p.drainTimeout})
+
+	timeout := time.NewTimer(p.drainTimeout)
+	defer timeout.Stop()
+	poll := time.NewTicker(drainPollInterval)
+	defer poll.Stop()
+	progress := time.NewTicker(drainLogInterval)
+	defer progress.Stop()
+	for remaining > 0 {
+		select {
+		case <-timeout.C:
+			p.logger.Warn("drain timed out, closing remaining connections", fields{"connections": remaining})
+			return
+		case <-progress.C:
+			p.logger.Info("draining connections", fields{"connections": remaining})
+		case <-poll.C:
+		}
+		remaining = p.activeConnections()
+	}
+	p.logger.Info("all connections drained", nil)
+}
+
+// activeConnections returns the number of client connections of all frontends including the ones being set up.
+func (p Proxy) activeConnections() int64 {
+	var n int64
+	for _, fnd := range p.fnds {
+		n += fnd.connCount.Load() + fnd.pendingSetups.Load()
+	}
+	return n
+}
@@ -0,0 +1,299 @@
+package service
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// runDrainingProxy runs the proxy of config with its own parent context. Calling the returned function starts
+// the shutdown drain, the returned channel is closed when Run returns.
+func runDrainingProxy(t *testing.T, config ProxyConfig) (Proxy, context.CancelFunc, <-chan struct{}) {
+	t.Helper()
+	parent, shutdown := context.WithCancel(context.Background())
+	t.Cleanup(shutdown)
+	p := newTestProxyContext(t, parent, config)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Run()
+	}()
+	t.Cleanup(func() {
+		p.cancel()
+		<-done
+	})
+	return p, shutdown, done
+}
+
+// waitRun waits up to timeout for the proxy to stop and returns how long it took.
+func waitRun(t *testing.T, done <-chan struct{}, timeout time.Duration) time.Duration {
+	t.Helper()
+	start := time.Now()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatalf("proxy didn't stop in %s", timeout)
+	}
+	return time.Since(start)
+}
+
+func TestDrainTiming(t *testing.T) {
+	const drainTimeout = 300 * time.Millisecond
+	p, shutdown, done := runDrainingProxy(t, ProxyConfig{
+		DrainTimeout: drainTimeout,
+		Apps:         []ConfigApp{{Targets: []string{startBackend(t, echo)}}},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.WaitReady(ctx); err != nil {
+		t.Fatalf("WaitReady(): %v", err)
+	}
+	addr := p.ListenAddrs()[0].String()
+	conn := openExchange(t, p)
+
+	start := time.Now()
+	shutdown()
+	refused := waitFor(t, time.Second, func() bool {
+		c, err := net.DialTimeout("tcp", addr, 100*time.Millisecond)
+		if err != nil {
+			return true
+		}
+		c.Close()
+		return false
+	})
+	if !refused {
+		t.Error("new connections are accepted during the drain")
+	}
+	conn.Write([]byte("pong"))
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Errorf("established connection during the drain: %v", err)
+	}
+
+	waitRun(t, done, 5*time.Second)
+	if elapsed := time.Since(start); elapsed < drainTimeout {
+		t.Errorf("proxy stopped after %s, before the drain timeout %s", elapsed, drainTimeout)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("remaining connection isn't closed after the drain timeout")
+	}
+}
+
+func TestDrainWithoutConnections(t *testing.T) {
+	p, shutdown, done := runDrainingProxy(t, ProxyConfig{
+		DrainTimeout: time.Hour,
+		Apps:         []ConfigApp{{Targets: []string{startBackend(t, echo)}}},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.WaitReady(ctx); err != nil {
+		t.Fatalf("WaitReady(): %v", err)
+	}
+	shutdown()
+	if elapsed := waitRun(t, done, 5*time.Second); elapsed > time.Second {
+		t.Errorf("proxy without connections stopped after %s", elapsed)
+	}
+}
+
+func TestStopDuringDrain(t *testing.T) {
+	p, shutdown, done := runDrainingProxy(t, ProxyConfig{
+		DrainTimeout: time.Hour,
+		Apps:         []ConfigApp{{Targets: []string{startBackend(t, echo)}}},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.WaitReady(ctx); err != nil {
+		t.Fatalf("WaitReady(): %v", err)
+	}
+	conn := openExchange(t, p)
+	shutdown()
+	time.Sleep(2 * drainPollInterval)
+	select {
+	case <-done:
+		t.Fatal("proxy stopped before the drain timeout")
+	default:
+	}
+
+	p.Stop()
+	waitRun(t, done, time.Second)
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("connection isn't closed by Stop")
+	}
+}
+
+func TestDrainStopsBindRetries(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	port := busy.Addr().(*net.TCPAddr).Port
+	backend := startBackend(t, echo)
+	logger := &fakeLogger{}
+	p, shutdown, done := runDrainingProxy(t, ProxyConfig{
+		Logger:       logger,
+		DrainTimeout: time.Hour,
+		Apps: []ConfigApp{
+			{Name: "bound", Targets: []string{backend}},
+			{Name: "unbound", Targets: []string{backend}, Ports: []int{port}},
+		},
+	})
+	if !waitFor(t, 5*time.Second, func() bool { return len(p.ListenAddrs()) == 1 && len(logger.find("Listen()")) > 0 }) {
+		t.Fatal("bind of the busy port didn't fail")
+	}
+	// the open connection keeps the drain going
+	openExchange(t, p)
+
+	shutdown()
+	// the next retry is listenRetryDelay away, the drain stops retrying right away
+	if !waitFor(t, time.Second, func() bool { return len(logger.find("frontend is stopping")) > 0 }) {
+		t.Fatal("bind is retried during the drain")
+	}
+	busy.Close()
+	if addrs := p.ListenAddrs(); len(addrs) != 1 {
+		t.Errorf("proxy listens on %v during the drain", addrs)
+	}
+	p.Stop()
+	waitRun(t, done, time.Second)
+}
+
+func TestShutdownDuringConnects(t *testing.T) {
+	var backendConns atomic.Int64
+	p := newTestProxy(t, ProxyConfig{Apps: []ConfigApp{{Targets: []string{startBackend(t, func(conn net.Conn) {
+		backendConns.Add(1)
+		defer backendConns.Add(-1)
+		echo(conn)
+	})}}}})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Run()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.WaitReady(ctx); err != nil {
+		t.Fatalf("WaitReady(): %v", err)
+	}
+	addr := p.ListenAddrs()[0].String()
+
+	var mu sync.Mutex
+	var clients []net.Conn
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				conn, err := net.DialTimeout("tcp", addr, 100*time.Millisecond)
+				if err != nil {
+					continue
+				}
+				mu.Lock()
+				clients = append(clients, conn)
+				mu.Unlock()
+				conn.Write([]byte("ping"))
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	p.cancel()
+	waitRun(t, done, 5*time.Second)
+	close(stop)
+	wg.Wait()
+
+	// every connection accepted before or during the shutdown is closed by the proxy
+	for _, conn := range clients {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err := io.Copy(io.Discard, conn)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("client connection %s is left open after shutdown", conn.LocalAddr())
+		}
+		conn.Close()
+	}
+	if !waitFor(t, time.Second, func() bool { return backendConns.Load() == 0 }) {
+		t.Errorf("%d backend connections are left open after shutdown", backendConns.Load())
+	}
+	if !waitFor(t, time.Second, func() bool { return p.fnds[0].copiers.Load() == 0 }) {
+		t.Errorf("%d copy goroutines are left after shutdown", p.fnds[0].copiers.Load())
+	}
+}
+
+func TestShutdownReport(t *testing.T) {
+	first, second := startBackend(t, echo), startBackend(t, echo)
+	stats := make(chan SessionStats, 8)
+	p, shutdown, done := runDrainingProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Targets:      []string{first, second},
+		Strategy:     roundRobinName,
+		OnDisconnect: func(s SessionStats) { stats <- s },
+	}}})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.WaitReady(ctx); err != nil {
+		t.Fatalf("WaitReady(): %v", err)
+	}
+	waitBackendsActive(t, p)
+
+	for size := 1; size <= 4; size++ {
+		conn := dialProxy(t, p, 0)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write(make([]byte, size*100))
+		if _, err := io.ReadFull(conn, make([]byte, size*100)); err != nil {
+			t.Fatalf("exchange of %d bytes: %v", size*100, err)
+		}
+		conn.Close()
+	}
+	// left for the shutdown to close
+	openExchange(t, p)
+	shutdown()
+	waitRun(t, done, 5*time.Second)
+
+	want := ShutdownReport{App: "test"}
+	backends := make(map[string]*BackendReport)
+	for i := 0; i < 5; i++ {
+		s := <-stats
+		want.Served++
+		if errors.Is(s.Reason, ErrShutdown) {
+			want.ForceClosed++
+		}
+		want.BytesIn += s.BytesIn
+		want.BytesOut += s.BytesOut
+		addr := s.Backend.String()
+		if backends[addr] == nil {
+			backends[addr] = &BackendReport{Addr: addr}
+		}
+		backends[addr].Served++
+		backends[addr].BytesIn += s.BytesIn
+		backends[addr].BytesOut += s.BytesOut
+	}
+	if want.ForceClosed != 1 || want.BytesIn != 1004 {
+		t.Fatalf("sessions are %+v, want 1 closed by the shutdown and 1004 bytes in", want)
+	}
+	for _, bnd := range backends {
+		want.Backends = append(want.Backends, *bnd)
+	}
+	sort.Slice(want.Backends, func(i, j int) bool {
+		return want.Backends[i].Addr < want.Backends[j].Addr
+	})
+
+	reports := p.ShutdownReport()
+	if len(reports) != 1 {
+		t.Fatalf("%d reports, want 1", len(reports))
+	}
+	if got := reports[0]; !reflect.DeepEqual(got, want) {
+		t.Errorf("report is %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,66 @@
+package service
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSlowStartShareGrows(t *testing.T) {
+	const slowStart = 10 * time.Second
+	warm, fresh := startBackend(t, echo), startBackend(t, echo)
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Targets:   []string{warm, fresh},
+		SlowStart: slowStart,
+	}}})
+	a := p.apps[0]
+	a.rmu.RLock()
+	warmBnd, freshBnd := a.backendByAddr(warm), a.backendByAddr(fresh)
+	a.rmu.RUnlock()
+	// the first health checks set activation times, so they must be over before the times are overridden
+	waitBackendsActive(t, p)
+	warmBnd.activatedAt.Store(time.Now().Add(-time.Hour).UnixNano())
+
+	// share returns the number of 20 held connections which go to the fresh backend activated ago
+	share := func(ago time.Duration) int {
+		freshBnd.activatedAt.Store(time.Now().Add(-ago).UnixNano())
+		conns := make([]net.Conn, 0, 20)
+		for i := 0; i < 20; i++ {
+			conns = append(conns, openExchange(t, p))
+		}
+		n := freshBnd.getConnCount()
+		for _, conn := range conns {
+			conn.Close()
+		}
+		if !waitFor(t, time.Second, func() bool { return warmBnd.getConnCount()+freshBnd.getConnCount() == 0 }) {
+			t.Fatal("connections aren't released")
+		}
+		return n
+	}
+
+	started, halfway, done := share(0), share(slowStart/2), share(slowStart)
+	if !(started < halfway && halfway < done) {
+		t.Errorf("shares of the fresh backend are %d, %d, %d of 20 during slow start, want growing", started, halfway, done)
+	}
+	if done != 10 {
+		t.Errorf("share of the backend after slow start is %d of 20, want 10", done)
+	}
+}
+
+func TestSlowStartFactor(t *testing.T) {
+	bnd := &backend{slowStart: time.Second}
+	for ago, want := range map[time.Duration]float64{
+		0:                      slowStartMinFactor,
+		500 * time.Millisecond: 0.55,
+		time.Second:            1,
+		time.Hour:              1,
+	} {
+		bnd.activatedAt.Store(time.Now().Add(-ago).UnixNano())
+		if f := bnd.slowStartFactor(); f < want-0.01 || f > want+0.01 {
+			t.Errorf("factor %s after activation is %.2f, want %.2f", ago, f, want)
+		}
+	}
+	if f := (&backend{}).slowStartFactor(); f != 1 {
+		t.Errorf("factor without slow start is %.2f", f)
+	}
+}
@@ -0,0 +1,104 @@
+package service
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// sockopt returns the integer socket option of the TCP connection.
+func sockopt(t *testing.T, conn net.Conn, level, opt int) int {
+	t.Helper()
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value int
+	var optErr error
+	if err := raw.Control(func(fd uintptr) {
+		value, optErr = syscall.GetsockoptInt(int(fd), level, opt)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if optErr != nil {
+		t.Fatalf("getsockopt: %v", optErr)
+	}
+	return value
+}
+
+// keepAliveSeconds returns the keep-alive idle time of the connection in seconds or 0 if keep-alive is disabled.
+func keepAliveSeconds(t *testing.T, conn net.Conn) int {
+	t.Helper()
+	if sockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE) == 0 {
+		return 0
+	}
+	return sockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+}
+
+// openSession opens a connection through the proxy and returns its session.
+func openSession(t *testing.T, p Proxy) *session {
+	t.Helper()
+	openExchange(t, p)
+	sessions := p.fnds[0].sessions()
+	if len(sessions) != 1 {
+		t.Fatalf("%d sessions are open, want 1", len(sessions))
+	}
+	return sessions[0]
+}
+
+func TestListenKeepAlive(t *testing.T) {
+	backend := startBackend(t, echo)
+	for period, want := range map[time.Duration]int{42 * time.Second: 42, -1: 0} {
+		p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{Targets: []string{backend}, ListenKeepAlive: period}}})
+		if got := keepAliveSeconds(t, openSession(t, p).client.Conn); got != want {
+			t.Errorf("accepted connection keep-alive is %ds with ListenKeepAlive %s, want %ds", got, period, want)
+		}
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Targets:   []string{startBackend(t, echo)},
+		KeepAlive: 37 * time.Second,
+	}}})
+	sess := openSession(t, p)
+	if got := keepAliveSeconds(t, sess.client.Conn); got != 37 {
+		t.Errorf("client connection keep-alive is %ds, want 37s", got)
+	}
+	if got := keepAliveSeconds(t, sess.remote.Conn); got != 37 {
+		t.Errorf("backend connection keep-alive is %ds, want 37s", got)
+	}
+}
+
+func TestNoDelay(t *testing.T) {
+	backend := startBackend(t, echo)
+	for nagle, want := range map[bool]int{false: 1, true: 0} {
+		p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{Targets: []string{backend}, Nagle: nagle}}})
+		sess := openSession(t, p)
+		if got := sockopt(t, sess.client.Conn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY); got != want {
+			t.Errorf("client connection TCP_NODELAY is %d with Nagle %t", got, nagle)
+		}
+		if got := sockopt(t, sess.remote.Conn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY); got != want {
+			t.Errorf("backend connection TCP_NODELAY is %d with Nagle %t", got, nagle)
+		}
+	}
+}
+
+func TestSmallWritesForwardedPromptly(t *testing.T) {
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{Targets: []string{startBackend(t, echo)}}}})
+	conn := dialProxy(t, p, 0)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// Nagle's algorithm with delayed ACKs would hold back every small write for tens of milliseconds
+	start := time.Now()
+	b := make([]byte, 1)
+	for i := 0; i < 100; i++ {
+		conn.Write([]byte{'x'})
+		if _, err := conn.Read(b); err != nil {
+			t.Fatalf("round trip %d: %v", i, err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("100 one-byte round trips took %s", elapsed)
+	}
+}
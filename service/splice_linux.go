@@ -0,0 +1,91 @@
+//go:build linux
+
+package service
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+const (
+	// spliceChunk is the max number of bytes moved by one splice(2) call, it is the default pipe capacity.
+	spliceChunk = 64 << 10
+	spliceFlags = 0x1 | 0x2 // SPLICE_F_MOVE | SPLICE_F_NONBLOCK
+)
+
+// spliceData copies data from src to dst with splice(2) through a pipe if both connections are *net.TCPConn.
+// Unlike (*net.TCPConn).ReadFrom, it tells failed reads from failed writes: errors are tagged by side, so
+// the session close reason blames the right peer.
+// It returns false if splice can't be used and nothing was copied.
+func spliceData(dst, src *Conn) (bool, int64, error) {
+	dstTCP, ok := dst.Conn.(*net.TCPConn)
+	if !ok {
+		return false, 0, nil
+	}
+	srcTCP, ok := src.Conn.(*net.TCPConn)
+	if !ok {
+		return false, 0, nil
+	}
+	srcRaw, err := srcTCP.SyscallConn()
+	if err != nil {
+		return false, 0, nil
+	}
+	dstRaw, err := dstTCP.SyscallConn()
+	if err != nil {
+		return false, 0, nil
+	}
+	var pipe [2]int
+	if err := syscall.Pipe2(pipe[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		return false, 0, nil
+	}
+	defer syscall.Close(pipe[0])
+	defer syscall.Close(pipe[1])
+
+	var written int64
+	for {
+		var n int64
+		var spliceErr error
+		err := srcRaw.Read(func(fd uintptr) bool {
+			n, spliceErr = syscall.Splice(int(fd), nil, pipe[1], nil, spliceChunk, spliceFlags)
+			return spliceErr != syscall.EAGAIN && spliceErr != syscall.EINTR
+		})
+		if err == nil {
+			err = spliceErr
+		}
+		if err != nil {
+			if written == 0 && (err == syscall.EINVAL || err == syscall.ENOSYS) {
+				return false, 0, nil
+			}
+			return true, written, readError(spliceOpError("read", src, err))
+		}
+		if n == 0 {
+			return true, written, nil
+		}
+		for n > 0 {
+			var m int64
+			err := dstRaw.Write(func(fd uintptr) bool {
+				m, spliceErr = syscall.Splice(pipe[0], nil, int(fd), nil, int(n), spliceFlags)
+				return spliceErr != syscall.EAGAIN && spliceErr != syscall.EINTR
+			})
+			if err == nil {
+				err = spliceErr
+			}
+			if err != nil {
+				return true, written, writeError(spliceOpError("write", dst, err))
+			}
+			written += m
+			n -= m
+		}
+	}
+}
+
+// spliceOpError wraps the errno of splicing from or to conn like errors of net.Conn methods.
+// Errors of waiting for the socket, e.g. an expired deadline, are already wrapped by the raw connection.
+func spliceOpError(op string, conn *Conn, err error) error {
+	errno, ok := err.(syscall.Errno)
+	if !ok {
+		return err
+	}
+	return &net.OpError{Op: op, Net: "tcp", Source: conn.LocalAddr(), Addr: conn.RemoteAddr(), Err: os.NewSyscallError("splice", errno)}
+}
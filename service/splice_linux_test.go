@@ -0,0 +1,101 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"net"
+	"testing"
+)
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(tb testing.TB) (net.Conn, net.Conn) {
+	tb.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer ln.Close()
+	dialed, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	accepted, err := ln.Accept()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		dialed.Close()
+		accepted.Close()
+	})
+	return dialed, accepted
+}
+
+// spliceTransfer writes total bytes of data to the client, splices them from src to dst and returns
+// the number of spliced bytes and the hash of the bytes received by the sink.
+func spliceTransfer(tb testing.TB, data []byte, total int) (int64, []byte) {
+	tb.Helper()
+	client, src := tcpPair(tb)
+	dst, sink := tcpPair(tb)
+	go func() {
+		for sent := 0; sent < total; sent += len(data) {
+			if _, err := client.Write(data); err != nil {
+				break
+			}
+		}
+		client.Close()
+	}()
+	received := make(chan []byte, 1)
+	go func() {
+		h := sha256.New()
+		io.Copy(h, sink)
+		received <- h.Sum(nil)
+	}()
+	ok, written, err := spliceData(newConn(dst, nil), newConn(src, nil))
+	if !ok {
+		tb.Fatal("splice isn't used for TCP connections")
+	}
+	if err != nil {
+		tb.Fatalf("spliceData(): %v", err)
+	}
+	dst.Close()
+	return written, <-received
+}
+
+func TestSpliceLargeTransfer(t *testing.T) {
+	data := make([]byte, 100_003)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	const chunks = 320
+	want := sha256.New()
+	for i := 0; i < chunks; i++ {
+		want.Write(data)
+	}
+
+	written, sum := spliceTransfer(t, data, chunks*len(data))
+	if written != chunks*int64(len(data)) {
+		t.Errorf("spliced %d bytes, want %d", written, chunks*len(data))
+	}
+	if !bytes.Equal(sum, want.Sum(nil)) {
+		t.Error("spliced data is corrupted")
+	}
+}
+
+func TestSpliceNotTCP(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	if ok, _, _ := spliceData(newConn(a, nil), newConn(b, nil)); ok {
+		t.Error("splice is used for in-memory connections")
+	}
+}
+
+func BenchmarkSplice(b *testing.B) {
+	const chunk = 64 * 1024
+	data := make([]byte, chunk)
+	b.SetBytes(chunk)
+	b.ReportAllocs()
+	b.ResetTimer()
+	spliceTransfer(b, data, b.N*chunk)
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package service
+
+// spliceData is not supported on this platform.
+func spliceData(dst, src *Conn) (bool, int64, error) {
+	return false, 0, nil
+}
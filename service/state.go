@@ -0,0 +1,129 @@
+package service
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// statefulStrategy is a strategy with selection state which can be saved and restored across restarts
+// to minimize rebalancing churn.
+type statefulStrategy interface {
+	strategy
+	state() (json.RawMessage, error)
+	restore(state json.RawMessage) error
+}
+
+var _ statefulStrategy = (*roundRobinStrategy)(nil)
+
+// state returns the round robin cursor.
+func (s *roundRobinStrategy) state() (json.RawMessage, error) {
+	return json.Marshal(s.cursor.Load())
+}
+
+func (s *roundRobinStrategy) restore(state json.RawMessage) error {
+	var cursor uint64
+	if err := json.Unmarshal(state, &cursor); err != nil {
+		return errors.Wrap(err, "Unmarshal() round robin cursor")
+	}
+	s.cursor.Store(cursor)
+	return nil
+}
+
+// defaultStateSaveInterval is the period of state saves while the proxy runs if StateSaveInterval isn't set.
+const defaultStateSaveInterval = 30 * time.Second
+
+// saveStatePeriodically is a blocking function. It saves the balancer state every stateSaveInterval until ctx
+// is done, so a crash loses only the selections made since the last save.
+func (p Proxy) saveStatePeriodically() {
+	ticker := time.NewTicker(p.stateSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := p.saveState(p.stateFile); err != nil {
+			p.logger.Error("unable to save balancer state", fields{"error": err, "file": p.stateFile})
+		}
+	}
+}
+
+// balancerState is the saved selection state of stateful strategies by app name.
+type balancerState struct {
+	Apps map[string]appState `json:"apps"`
+}
+
+type appState struct {
+	Strategy string          `json:"strategy"`
+	State    json.RawMessage `json:"state"`
+}
+
+// saveState writes the selection state of apps with stateful strategies to the file.
+// The file is replaced atomically, so a crash during saving doesn't corrupt the previous state.
+func (p Proxy) saveState(path string) error {
+	state := balancerState{Apps: make(map[string]appState)}
+	for _, app := range p.apps {
+		s, ok := app.strategy.(statefulStrategy)
+		if !ok {
+			continue
+		}
+		raw, err := s.state()
+		if err != nil {
+			return errors.Wrapf(err, "state of app %s", app.name)
+		}
+		state.Apps[app.name] = appState{Strategy: s.name(), State: raw}
+	}
+	b, err := json.Marshal(state)
+	if err != nil {
+		return errors.Wrap(err, "Marshal()")
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "CreateTemp()")
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "Write()")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "Close()")
+	}
+	return errors.Wrap(os.Rename(tmp.Name(), path), "Rename()")
+}
+
+// restoreState restores the selection state of apps from the file. A missing file is not an error.
+// The state of an app is skipped if its strategy has changed.
+func (p Proxy) restoreState(path string) error {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "ReadFile()")
+	}
+	var state balancerState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return errors.Wrap(err, "Unmarshal()")
+	}
+	for _, app := range p.apps {
+		s, ok := app.strategy.(statefulStrategy)
+		if !ok {
+			continue
+		}
+		saved, ok := state.Apps[app.name]
+		if !ok || saved.Strategy != s.name() {
+			continue
+		}
+		if err := s.restore(saved.State); err != nil {
+			return errors.Wrapf(err, "state of app %s", app.name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRoundRobinStateSaveRestore(t *testing.T) {
+	first, second := startBackend(t, echo), startBackend(t, echo)
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	stats := make(chan SessionStats, 1)
+	config := func() ProxyConfig {
+		return ProxyConfig{
+			StateFile:         stateFile,
+			StateSaveInterval: 10 * time.Millisecond,
+			Apps: []ConfigApp{{
+				Targets:      []string{first, second},
+				Strategy:     roundRobinName,
+				OnDisconnect: func(s SessionStats) { stats <- s },
+			}},
+		}
+	}
+
+	p := startProxy(t, config())
+	for i, want := range []string{first, second, first} {
+		exchange(t, p)
+		if s := <-stats; s.Backend.String() != want {
+			t.Fatalf("connection %d went to %s, want %s", i, s.Backend, want)
+		}
+	}
+	// the state is saved while the proxy runs, without a shutdown
+	saved := waitFor(t, time.Second, func() bool {
+		b, _ := os.ReadFile(stateFile)
+		return string(b) == `{"apps":{"test":{"strategy":"round_robin","state":3}}}`
+	})
+	if !saved {
+		b, _ := os.ReadFile(stateFile)
+		t.Fatalf("state file is %s", b)
+	}
+
+	restored := startProxy(t, config())
+	if cursor := restored.apps[0].strategy.(*roundRobinStrategy).cursor.Load(); cursor != 3 {
+		t.Errorf("restored cursor is %d, want 3", cursor)
+	}
+	exchange(t, restored)
+	if s := <-stats; s.Backend.String() != second {
+		t.Errorf("first connection after restore went to %s, want %s", s.Backend, second)
+	}
+}
+
+func TestStateSkippedOnStrategyChange(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	if err := os.WriteFile(stateFile, []byte(`{"apps":{"test":{"strategy":"other","state":5}}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	p := newTestProxy(t, ProxyConfig{
+		StateFile: stateFile,
+		Apps:      []ConfigApp{{Targets: []string{startBackend(t, echo)}, Strategy: roundRobinName}},
+	})
+	if cursor := p.apps[0].strategy.(*roundRobinStrategy).cursor.Load(); cursor != 0 {
+		t.Errorf("cursor of another strategy is restored: %d", cursor)
+	}
+}
@@ -0,0 +1,72 @@
+package service
+
+import (
+	"time"
+)
+
+// AppStats is a snapshot of app counters.
+type AppStats struct {
+	Name string
+	// Accepted is the total number of connections accepted by frontends of the app.
+	Accepted int64
+	// Active is the number of connections currently proxied to backends of the app.
+	Active int
+	// BytesIn is the total number of bytes copied from clients to backends of finished copy directions.
+	BytesIn int64
+	// BytesOut is the total number of bytes copied from backends to clients of finished copy directions.
+	BytesOut int64
+	Backends []BackendStats
+}
+
+// BackendStats is a snapshot of backend state.
+type BackendStats struct {
+	Addr        string
+	Active      bool
+	Maintenance bool
+	Connections int
+	// LastError is the last dial or probe error, LastErrorAt is its time. They are empty if there was no error.
+	LastError   string
+	LastErrorAt time.Time
+	// StateChangedAt is the time of the last change of Active. It is zero if Active never changed.
+	StateChangedAt time.Time
+}
+
+// Stats returns a snapshot of the app counters and its current backends.
+// The backend set is read under the app lock, so it is consistent with Active.
+func (a *application) Stats() AppStats {
+	stats := AppStats{
+		Name:     a.name,
+		Accepted: a.accepted.Load(),
+		BytesIn:  a.bytesIn.Load(),
+		BytesOut: a.bytesOut.Load(),
+	}
+	a.rmu.RLock()
+	defer a.rmu.RUnlock()
+	stats.Backends = make([]BackendStats, 0, len(a.bnds))
+	for _, bnd := range a.bnds {
+		count := bnd.getConnCount()
+		stats.Active += count
+		bndStats := BackendStats{
+			Addr:           bnd.addr,
+			Active:         bnd.active.Load(),
+			Maintenance:    bnd.maintenance.Load(),
+			Connections:    count,
+			StateChangedAt: bnd.stateChangedTime(),
+		}
+		if lastErr := bnd.lastError.Load(); lastErr != nil {
+			bndStats.LastError = lastErr.msg
+			bndStats.LastErrorAt = lastErr.at
+		}
+		stats.Backends = append(stats.Backends, bndStats)
+	}
+	return stats
+}
+
+// Stats returns snapshots of all apps without going through the admin API.
+func (p Proxy) Stats() []AppStats {
+	stats := make([]AppStats, 0, len(p.apps))
+	for _, app := range p.apps {
+		stats = append(stats, app.Stats())
+	}
+	return stats
+}
@@ -0,0 +1,82 @@
+package service
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStatsCoherent(t *testing.T) {
+	const clients, rounds = 4, 25
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Targets: []string{startBackend(t, echo), startBackend(t, echo)},
+	}}})
+
+	stop := make(chan struct{})
+	sampled := make(chan int)
+	go func() {
+		var prev AppStats
+		n := 0
+		defer func() { sampled <- n }()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			s := p.Stats()[0]
+			sum := 0
+			for _, bnd := range s.Backends {
+				sum += bnd.Connections
+			}
+			if s.Active != sum {
+				t.Errorf("active connections are %d, backends have %d", s.Active, sum)
+			}
+			if s.Accepted < prev.Accepted || s.BytesIn < prev.BytesIn || s.BytesOut < prev.BytesOut {
+				t.Errorf("totals decrease from %+v to %+v", prev, s)
+			}
+			prev = s
+			n++
+			time.Sleep(100 * time.Microsecond)
+		}
+	}()
+	addr := p.ListenAddrs()[0].String()
+	var wg sync.WaitGroup
+	for c := 0; c < clients; c++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				conn, err := net.DialTimeout("tcp", addr, time.Second)
+				if err != nil {
+					t.Errorf("dial proxy: %v", err)
+					return
+				}
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				conn.Write([]byte("ping"))
+				if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+					t.Errorf("exchange: %v", err)
+				}
+				conn.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	if n := <-sampled; n == 0 {
+		t.Error("no stats are sampled during the traffic")
+	}
+
+	want := AppStats{Accepted: clients * rounds, BytesIn: 4 * clients * rounds, BytesOut: 4 * clients * rounds}
+	if !waitFor(t, time.Second, func() bool {
+		s := p.Stats()[0]
+		return s.Active == 0 && s.BytesIn == want.BytesIn && s.BytesOut == want.BytesOut
+	}) {
+		t.Fatalf("stats after the traffic are %+v, want %+v", p.Stats()[0], want)
+	}
+	if s := p.Stats()[0]; s.Name != "test" || s.Accepted != want.Accepted || len(s.Backends) != 2 {
+		t.Errorf("stats after the traffic are %+v, want %d accepted connections of 2 backends", s, want.Accepted)
+	}
+}
@@ -0,0 +1,60 @@
+package service
+
+import (
+	"time"
+)
+
+// StatusKind is a kind of coarse lifecycle event of the proxy.
+type StatusKind string
+
+const (
+	// StatusStarting is sent when Run starts frontends and backends.
+	StatusStarting StatusKind = "starting"
+	// StatusReady is sent when all frontends listen.
+	StatusReady StatusKind = "ready"
+	// StatusBackendUp is sent when a backend becomes active.
+	StatusBackendUp StatusKind = "backend-up"
+	// StatusBackendDown is sent when a backend becomes inactive.
+	StatusBackendDown StatusKind = "backend-down"
+	// StatusDraining is sent when a backend starts draining.
+	StatusDraining StatusKind = "draining"
+	// StatusAllBackendsDown is sent when the last active backend of the app becomes inactive.
+	StatusAllBackendsDown StatusKind = "all-backends-down"
+	// StatusBackendsRecovered is sent when a backend of the app becomes active after all were down.
+	StatusBackendsRecovered StatusKind = "backends-recovered"
+	// StatusStopped is sent when Run finishes.
+	StatusStopped StatusKind = "stopped"
+)
+
+// statusBufferSize is the capacity of the status channel. Updates are dropped if the channel is full.
+const statusBufferSize = 64
+
+// Status is a coarse lifecycle event. App and Backend are set for backend events.
+type Status struct {
+	Kind    StatusKind
+	App     string
+	Backend string
+	Time    time.Time
+}
+
+// statusNotifier sends status updates without blocking. A nil notifier drops all updates.
+type statusNotifier struct {
+	ch chan Status
+}
+
+func newStatusNotifier(enabled bool) *statusNotifier {
+	if !enabled {
+		return nil
+	}
+	return &statusNotifier{ch: make(chan Status, statusBufferSize)}
+}
+
+func (n *statusNotifier) send(kind StatusKind, app, backend string) {
+	if n == nil {
+		return
+	}
+	select {
+	case n.ch <- Status{Kind: kind, App: app, Backend: backend, Time: time.Now()}:
+	default:
+	}
+}
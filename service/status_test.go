@@ -0,0 +1,89 @@
+package service
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// nextStatus returns the next status update or fails the test if there is none in a second.
+func nextStatus(t *testing.T, updates <-chan Status) Status {
+	t.Helper()
+	select {
+	case s := <-updates:
+		return s
+	case <-time.After(time.Second):
+		t.Fatal("no status update")
+		return Status{}
+	}
+}
+
+func TestStatusSequence(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	failing, stable := ln.Addr().String(), startBackend(t, echo)
+	config := ProxyConfig{
+		StatusUpdates: true,
+		Apps:          []ConfigApp{{Targets: []string{failing, stable}}},
+	}
+	p := newTestProxy(t, config)
+	updates := p.Status()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Run()
+	}()
+
+	if s := nextStatus(t, updates); s.Kind != StatusStarting {
+		t.Fatalf("first update is %s, want %s", s.Kind, StatusStarting)
+	}
+	// readiness and backend checks race
+	started := make(map[Status]bool)
+	for i := 0; i < 3; i++ {
+		s := nextStatus(t, updates)
+		s.Time = time.Time{}
+		started[s] = true
+	}
+	for _, want := range []Status{
+		{Kind: StatusReady},
+		{Kind: StatusBackendUp, App: "test", Backend: failing},
+		{Kind: StatusBackendUp, App: "test", Backend: stable},
+	} {
+		if !started[want] {
+			t.Errorf("no %+v update after start, got %+v", want, started)
+		}
+	}
+
+	ln.Close()
+	p.apps[0].bnds[0].healthcheck()
+	if s := nextStatus(t, updates); s.Kind != StatusBackendDown || s.Backend != failing {
+		t.Errorf("update after a failed probe is %+v, want %s of %s", s, StatusBackendDown, failing)
+	}
+	config.Apps[0].Targets = []string{stable}
+	if err := p.Reload(config); err != nil {
+		t.Fatalf("Reload(): %v", err)
+	}
+	if s := nextStatus(t, updates); s.Kind != StatusDraining || s.Backend != failing {
+		t.Errorf("update after removal is %+v, want %s of %s", s, StatusDraining, failing)
+	}
+	p.cancel()
+	<-done
+	if s := nextStatus(t, updates); s.Kind != StatusStopped {
+		t.Errorf("last update is %s, want %s", s.Kind, StatusStopped)
+	}
+	select {
+	case s := <-updates:
+		t.Errorf("unexpected update %+v after stop", s)
+	default:
+	}
+}
+
+func TestStatusDisabled(t *testing.T) {
+	p := newTestProxy(t, ProxyConfig{Apps: []ConfigApp{{Targets: []string{"127.0.0.1:1"}}}})
+	if p.Status() != nil {
+		t.Error("status channel exists without StatusUpdates")
+	}
+}
@@ -0,0 +1,157 @@
+package service
+
+import (
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// strategy chooses a backend for a new connection among eligible candidates of the same priority tier.
+type strategy interface {
+	name() string
+	choose(candidates []*backend, key selectionKey) *backend
+}
+
+// ignoresWeights reports whether the strategy chooses backends regardless of their weights.
+func ignoresWeights(s strategy) bool {
+	_, ok := s.(leastConnStrategy)
+	return ok
+}
+
+// newStrategy returns the strategy by its name. Empty name means the default least_conn strategy.
+// hashReplicas is the number of points per unit of backend weight on the ring of hashing strategies.
+func newStrategy(name string, hashReplicas int) (strategy, error) {
+	switch name {
+	case "", leastConnStrategy{}.name():
+		return leastConnStrategy{}, nil
+	case roundRobinName:
+		return &roundRobinStrategy{}, nil
+	case weightedLeastConnStrategy{}.name():
+		return weightedLeastConnStrategy{}, nil
+	case dstHashName:
+		return newHashStrategy(name, func(k selectionKey) string { return k.origDst }, hashReplicas), nil
+	case srcHashName:
+		return newHashStrategy(name, func(k selectionKey) string { return k.clientIP }, hashReplicas), nil
+	default:
+		return nil, errors.Errorf("unknown balancing strategy %q", name)
+	}
+}
+
+// leastConnStrategy chooses the backend with MIN number of connections. It ignores backend weights.
+// Backends in the slow start window look more loaded than they are, so they get a ramping share of new connections.
+type leastConnStrategy struct{}
+
+func (leastConnStrategy) name() string {
+	return "least_conn"
+}
+
+func (leastConnStrategy) choose(candidates []*backend, _ selectionKey) *backend {
+	var next *backend
+	var minScore float64
+	for _, bnd := range candidates {
+		score := float64(bnd.getConnCount()+1) / bnd.slowStartFactor()
+		if next == nil || score < minScore {
+			next = bnd
+			minScore = score
+		}
+	}
+	return next
+}
+
+// weightedLeastConnStrategy chooses the backend with MIN number of connections per unit of weight,
+// so backends with bigger weights get proportionally more connections before they are deprioritized.
+type weightedLeastConnStrategy struct{}
+
+func (weightedLeastConnStrategy) name() string {
+	return "weighted_least_conn"
+}
+
+func (weightedLeastConnStrategy) choose(candidates []*backend, _ selectionKey) *backend {
+	var next *backend
+	var minScore float64
+	for _, bnd := range candidates {
+		score := float64(bnd.getConnCount()+1) / (float64(bnd.weight) * bnd.slowStartFactor())
+		if next == nil || score < minScore {
+			next = bnd
+			minScore = score
+		}
+	}
+	return next
+}
+
+const roundRobinName = "round_robin"
+
+// roundRobinStrategy chooses candidates in turn, proportionally to their weights. The cursor is shared by all priority tiers.
+type roundRobinStrategy struct {
+	cursor atomic.Uint64
+}
+
+func (*roundRobinStrategy) name() string {
+	return roundRobinName
+}
+
+// choose chooses every candidate as many times in a row as its weight.
+func (s *roundRobinStrategy) choose(candidates []*backend, _ selectionKey) *backend {
+	total := 0
+	for _, bnd := range candidates {
+		total += bnd.weight
+	}
+	i := int((s.cursor.Add(1) - 1) % uint64(total))
+	for _, bnd := range candidates {
+		if i < bnd.weight {
+			return bnd
+		}
+		i -= bnd.weight
+	}
+	return candidates[len(candidates)-1]
+}
+
+const (
+	dstHashName = "dst_hash"
+	srcHashName = "src_hash"
+)
+
+// hashStrategy maps a key of the connection to a backend with consistent hashing.
+// Connections with an empty key are distributed round-robin.
+type hashStrategy struct {
+	strategyName string
+	key          func(selectionKey) string
+	rings        ringCache
+	fallback     roundRobinStrategy
+}
+
+// newHashStrategy returns a consistent hashing strategy of the key of connections. Zero replicas means defaultHashReplicas.
+func newHashStrategy(name string, key func(selectionKey) string, replicas int) *hashStrategy {
+	if replicas <= 0 {
+		replicas = defaultHashReplicas
+	}
+	return &hashStrategy{
+		strategyName: name,
+		key:          key,
+		rings:        ringCache{replicas: replicas},
+	}
+}
+
+func (s *hashStrategy) name() string {
+	return s.strategyName
+}
+
+func (s *hashStrategy) choose(candidates []*backend, key selectionKey) *backend {
+	k := s.key(key)
+	if k == "" {
+		return s.fallback.choose(candidates, key)
+	}
+	return s.rings.get(candidates).get(k)
+}
+
+// sameStrategy reports whether the strategies are of the same kind with the same settings.
+func sameStrategy(a, b strategy) bool {
+	if a.name() != b.name() {
+		return false
+	}
+	ha, ok := a.(*hashStrategy)
+	if !ok {
+		return true
+	}
+	return ha.rings.replicas == b.(*hashStrategy).rings.replicas
+}
@@ -0,0 +1,156 @@
+package service
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestWeightedLeastConnUnevenWeights(t *testing.T) {
+	light, heavy := startBackend(t, echo), startBackend(t, echo)
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Backends: []ConfigBackend{{Addr: light, Weight: 1}, {Addr: heavy, Weight: 3}},
+		Strategy: "weighted_least_conn",
+	}}})
+	waitBackendsActive(t, p)
+	a := p.apps[0]
+	a.rmu.RLock()
+	lightBnd, heavyBnd := a.backendByAddr(light), a.backendByAddr(heavy)
+	a.rmu.RUnlock()
+
+	// held connections are spread by weight at every step
+	for i := 1; i <= 12; i++ {
+		openExchange(t, p)
+		if i%4 == 0 {
+			if l, h := lightBnd.getConnCount(), heavyBnd.getConnCount(); l != i/4 || h != 3*i/4 {
+				t.Errorf("%d connections are spread %d:%d, want %d:%d", i, l, h, i/4, 3*i/4)
+			}
+		}
+	}
+}
+
+func TestWeightedLeastConnScore(t *testing.T) {
+	light := &backend{weight: 1}
+	heavy := &backend{weight: 4}
+	light.connCount.Store(1)
+	heavy.connCount.Store(4)
+	// scores are 2/1 and 5/4
+	if got := (weightedLeastConnStrategy{}).choose([]*backend{light, heavy}, selectionKey{}); got != heavy {
+		t.Error("backend with fewer connections per unit of weight isn't chosen")
+	}
+	heavy.connCount.Store(8)
+	// scores are 2/1 and 9/4
+	if got := (weightedLeastConnStrategy{}).choose([]*backend{light, heavy}, selectionKey{}); got != light {
+		t.Error("backend with more connections per unit of weight is chosen")
+	}
+}
+
+// testBackends returns n backends with distinct addresses and weight 1 for unit tests of strategies.
+func testBackends(n int) []*backend {
+	bnds := make([]*backend, 0, n)
+	for i := 0; i < n; i++ {
+		bnds = append(bnds, &backend{addr: "10.0.0." + strconv.Itoa(i+1) + ":80", weight: 1})
+	}
+	return bnds
+}
+
+func TestDstHashStable(t *testing.T) {
+	s, err := newStrategy(dstHashName, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bnds := testBackends(4)
+	reversed := []*backend{bnds[3], bnds[2], bnds[1], bnds[0]}
+	used := make(map[*backend]bool)
+	for i := 0; i < 50; i++ {
+		key := selectionKey{clientIP: "192.0.2." + strconv.Itoa(i), origDst: "198.51.100." + strconv.Itoa(i) + ":443"}
+		chosen := s.choose(bnds, key)
+		used[chosen] = true
+		// other clients of the destination and another order of candidates don't change the choice
+		key.clientIP = "192.0.2.200"
+		if again := s.choose(reversed, key); again != chosen {
+			t.Errorf("destination %s maps to %s, then to %s", key.origDst, chosen.addr, again.addr)
+		}
+	}
+	if len(used) != len(bnds) {
+		t.Errorf("50 destinations map to %d of %d backends", len(used), len(bnds))
+	}
+}
+
+func TestDstHashFallback(t *testing.T) {
+	s, err := newStrategy(dstHashName, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bnds := testBackends(2)
+	// connections without the original destination are distributed round-robin
+	for i := 0; i < 4; i++ {
+		if got := s.choose(bnds, selectionKey{clientIP: "192.0.2.1"}); got != bnds[i%2] {
+			t.Errorf("connection %d without destination goes to %s, want %s", i, got.addr, bnds[i%2].addr)
+		}
+	}
+}
+
+func TestPriorityFailover(t *testing.T) {
+	serve := func(ln net.Listener) {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				echo(conn)
+				conn.Close()
+			}()
+		}
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serve(ln)
+	primary, secondary := ln.Addr().String(), startBackend(t, echo)
+	stats := make(chan SessionStats, 1)
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Backends:            []ConfigBackend{{Addr: secondary, Priority: 1}, {Addr: primary}},
+		HealthcheckInterval: 50 * time.Millisecond,
+		OnDisconnect:        func(s SessionStats) { stats <- s },
+	}}})
+	waitBackendsActive(t, p)
+	var primaryBnd *backend
+	p.apps[0].rmu.RLock()
+	for _, bnd := range p.apps[0].bnds {
+		if bnd.addr == primary {
+			primaryBnd = bnd
+		}
+	}
+	p.apps[0].rmu.RUnlock()
+	expect := func(stage, want string) {
+		t.Helper()
+		for i := 0; i < 3; i++ {
+			exchange(t, p)
+			if s := <-stats; s.Backend.String() != want {
+				t.Errorf("connection %d %s went to %s, want %s", i, stage, s.Backend, want)
+			}
+		}
+	}
+
+	expect("with both tiers up", primary)
+
+	ln.Close()
+	if !waitFor(t, 5*time.Second, func() bool { return !primaryBnd.eligible() }) {
+		t.Fatal("primary backend is active after its listener is closed")
+	}
+	expect("with the primary down", secondary)
+
+	if ln, err = net.Listen("tcp", primary); err != nil {
+		t.Skipf("primary address can't be reused: %v", err)
+	}
+	defer ln.Close()
+	go serve(ln)
+	if !waitFor(t, 5*time.Second, primaryBnd.eligible) {
+		t.Fatal("primary backend isn't active after it recovered")
+	}
+	expect("after the primary recovered", primary)
+}
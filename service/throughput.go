@@ -0,0 +1,68 @@
+package service
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultMinThroughputWindow is the measurement window of the minimum throughput watchdog.
+const defaultMinThroughputWindow = 30 * time.Second
+
+var (
+	errSlowTransfer = errors.New("transfer is too slow")
+)
+
+// throughputReader is a watchdog of trickling connections. It counts bytes read from src and fails the read
+// with errSlowTransfer once a window passes in which some data was read, but less than minRate bytes per second.
+// Windows without data are idle connections, they are left alone.
+type throughputReader struct {
+	r       io.Reader
+	src     *Conn
+	minRate int64
+	window  time.Duration
+	read    atomic.Int64
+	slow    atomic.Bool
+}
+
+func newThroughputReader(r io.Reader, src *Conn, minRate int64, window time.Duration) *throughputReader {
+	if window <= 0 {
+		window = defaultMinThroughputWindow
+	}
+	return &throughputReader{r: r, src: src, minRate: minRate, window: window}
+}
+
+func (tr *throughputReader) Read(p []byte) (int, error) {
+	n, err := tr.r.Read(p)
+	tr.read.Add(int64(n))
+	if err != nil && tr.slow.Load() {
+		return n, errors.Wrapf(errSlowTransfer, "less than %d bytes/s for %s", tr.minRate, tr.window)
+	}
+	return n, err
+}
+
+// watch is a blocking function. It checks the throughput every window and expires the read deadline of src
+// if it is too low, which unblocks the read. It exits when ctx is done or the transfer is too slow.
+func (tr *throughputReader) watch(ctx context.Context) {
+	ticker := time.NewTicker(tr.window)
+	defer ticker.Stop()
+	var last int64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		read := tr.read.Load()
+		n := read - last
+		last = read
+		if n > 0 && float64(n)/tr.window.Seconds() < float64(tr.minRate) {
+			tr.slow.Store(true)
+			tr.src.SetReadDeadline(time.Now())
+			return
+		}
+	}
+}
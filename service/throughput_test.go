@@ -0,0 +1,54 @@
+package service
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMinThroughput(t *testing.T) {
+	const window = 200 * time.Millisecond
+	stats := make(chan SessionStats, 2)
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Targets:             []string{startBackend(t, echo)},
+		MinThroughput:       1000,
+		MinThroughputWindow: window,
+		OnDisconnect:        func(s SessionStats) { stats <- s },
+	}}})
+
+	// send writes a chunk of the size every 10ms for a second and reads the echo
+	send := func(conn net.Conn, size int) error {
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		chunk := make([]byte, size)
+		for i := 0; i < 100; i++ {
+			if _, err := conn.Write(chunk); err != nil {
+				return err
+			}
+			if _, err := io.ReadFull(conn, chunk); err != nil {
+				return err
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return nil
+	}
+	trickle, fast := dialProxy(t, p, 0), dialProxy(t, p, 0)
+	trickled := make(chan error, 1)
+	go func() {
+		trickled <- send(trickle, 1)
+	}()
+	if err := send(fast, 1024); err != nil {
+		t.Errorf("fast transfer: %v", err)
+	}
+	if err := <-trickled; err == nil {
+		t.Error("trickle of 100 bytes/s isn't closed")
+	}
+	s := <-stats
+	if !errors.Is(s.Reason, ErrClosedByProxy) || !errors.Is(s.Reason, errSlowTransfer) {
+		t.Errorf("trickle is closed with %v, want %v", s.Reason, errSlowTransfer)
+	}
+	if s.Duration > 5*window {
+		t.Errorf("trickle is closed after %s with the window of %s", s.Duration, window)
+	}
+}
@@ -0,0 +1,33 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+)
+
+// tlsDialer originates TLS to backends over connections of the wrapped dialer. The handshake isn't done here:
+// backend connections are handshaked by setupConn within ConnectTimeout, health checks do it within their timeout.
+type tlsDialer struct {
+	dialer Dialer
+	config *tls.Config
+}
+
+// newTLSDialer returns a dialer of TLS connections with the config. The config is cloned, ServerName defaults
+// to the host of the backend address, so the certificate of the backend is verified against it.
+// Certificates of the config (if any) are presented to backends which request a client certificate.
+func newTLSDialer(dialer Dialer, config *tls.Config, host string) *tlsDialer {
+	config = config.Clone()
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	return &tlsDialer{dialer: dialer, config: config}
+}
+
+func (d *tlsDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return tls.Client(conn, d.config), nil
+}
@@ -0,0 +1,170 @@
+package service
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// testCert returns a self-signed certificate of 127.0.0.1 usable by servers and clients.
+func testCert(t *testing.T, name string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// certPool returns a pool of the certificate.
+func certPool(cert tls.Certificate) *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+	return pool
+}
+
+// startTLSBackend starts a TLS server with the config which serves every connection with handle after the handshake.
+func startTLSBackend(t *testing.T, config *tls.Config, handle func(conn *tls.Conn)) string {
+	t.Helper()
+	return startBackend(t, func(conn net.Conn) {
+		tlsConn := tls.Server(conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			return
+		}
+		handle(tlsConn)
+	})
+}
+
+func TestStalledHandshakeRetried(t *testing.T) {
+	const connectTimeout = 200 * time.Millisecond
+	serverCert := testCert(t, "backend")
+	stalled := startBackend(t, func(conn net.Conn) {
+		// accepts, but never answers the handshake
+		io.Copy(io.Discard, conn)
+	})
+	healthy := startTLSBackend(t, &tls.Config{Certificates: []tls.Certificate{serverCert}}, func(conn *tls.Conn) { echo(conn) })
+	stats := make(chan SessionStats, 1)
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Targets:        []string{stalled, healthy},
+		Strategy:       roundRobinName,
+		TLS:            &tls.Config{RootCAs: certPool(serverCert)},
+		ConnectTimeout: connectTimeout,
+		DialRetries:    1,
+		OnDisconnect:   func(s SessionStats) { stats <- s },
+	}}})
+	a := p.apps[0]
+	a.rmu.RLock()
+	stalledBnd := a.backendByAddr(stalled)
+	a.rmu.RUnlock()
+	// the stalled backend passes selection until a health check notices it
+	stalledBnd.active.Store(true)
+
+	start := time.Now()
+	exchange(t, p)
+	elapsed := time.Since(start)
+	if s := <-stats; s.Backend.String() != healthy {
+		t.Errorf("connection went to %s, want %s", s.Backend, healthy)
+	}
+	if elapsed < connectTimeout || elapsed > 3*connectTimeout {
+		t.Errorf("retry after the stalled handshake took %s, want about %s", elapsed, connectTimeout)
+	}
+}
+
+func TestBackendMutualTLS(t *testing.T) {
+	serverCert, clientCert := testCert(t, "backend"), testCert(t, "proxy")
+	peers := make(chan string, 8)
+	backend := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    certPool(clientCert),
+	}, func(conn *tls.Conn) {
+		peers <- conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+		echo(conn)
+	})
+
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Backends: []ConfigBackend{{
+			Addr: backend,
+			TLS:  &tls.Config{RootCAs: certPool(serverCert), Certificates: []tls.Certificate{clientCert}},
+		}},
+	}}})
+	waitBackendsActive(t, p)
+	exchange(t, p)
+	if peer := <-peers; peer != "proxy" {
+		t.Errorf("backend gets the client certificate of %q, want proxy", peer)
+	}
+
+	anonymous := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Targets: []string{backend},
+		TLS:     &tls.Config{RootCAs: certPool(serverCert)},
+	}}})
+	conn := dialProxy(t, anonymous, 0)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("ping"))
+	if n, _ := io.ReadFull(conn, make([]byte, 4)); n != 0 {
+		t.Error("backend requiring a client certificate is reached without it")
+	}
+}
+
+func TestBackendALPN(t *testing.T) {
+	serverCert := testCert(t, "backend")
+	protocols := make(chan string, 8)
+	backend := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}, func(conn *tls.Conn) {
+		protocols <- conn.ConnectionState().NegotiatedProtocol
+		echo(conn)
+	})
+	logger := &fakeLogger{}
+	stats := make(chan SessionStats, 1)
+	p := startProxy(t, ProxyConfig{
+		Logger: logger,
+		Apps: []ConfigApp{{
+			Targets:      []string{backend},
+			TLS:          &tls.Config{RootCAs: certPool(serverCert), NextProtos: []string{"spdy/3", "http/1.1"}},
+			OnDisconnect: func(s SessionStats) { stats <- s },
+		}},
+	})
+	exchange(t, p)
+	<-stats
+
+	if protocol := <-protocols; protocol != "http/1.1" {
+		t.Errorf("backend negotiates %q, want the common protocol http/1.1", protocol)
+	}
+	events := logger.find("backend TLS handshake completed")
+	if len(events) != 1 {
+		t.Fatalf("%d handshake events of backend connections, want 1", len(events))
+	}
+	if alpn := events[0].fields["alpn"]; alpn != "http/1.1" {
+		t.Errorf("logged protocol is %v, want http/1.1", alpn)
+	}
+}
@@ -0,0 +1,64 @@
+package service
+
+import (
+	"context"
+	"net"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// staleSocketTimeout bounds the check whether a socket file is used by a running process.
+const staleSocketTimeout = time.Second
+
+// newUnixFrontend creates the local-only frontend of the Unix domain socket at the path.
+// Connections of Unix sockets have no client IP, so access lists don't apply to them and they share one
+// MaxConnsPerIP counter.
+func newUnixFrontend(ctx context.Context, logger *proxyLogger, path string, app *application, bufPool bufferPool, opts frontendOptions) (*frontend, error) {
+	if path == "" {
+		return nil, errors.New("empty Unix socket path")
+	}
+	f, err := buildFrontend(ctx, logger, path, app, bufPool, opts)
+	if err != nil {
+		return nil, err
+	}
+	f.unixAddr = &net.UnixAddr{Name: path, Net: "unix"}
+	return f, nil
+}
+
+// listenUnix creates the listener of the Unix socket and starts accepting connections on it.
+// A stale socket file left by a crashed process is removed first. The file is unlinked when the listener is closed.
+// It must be called under lmu.
+func (f *frontend) listenUnix() (net.Listener, error) {
+	if err := removeStaleSocket(f.unixAddr.Name); err != nil {
+		return nil, err
+	}
+	listener, err := net.ListenUnix("unix", f.unixAddr)
+	if err != nil {
+		return nil, err
+	}
+	listener.SetUnlinkOnClose(true)
+	go f.listenForNewConn(listener)
+	return listener, nil
+}
+
+// removeStaleSocket removes the socket file at the path if nobody accepts connections on it.
+// Other files are kept, so listening on them fails.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "Lstat()")
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+	if conn, err := net.DialTimeout("unix", path, staleSocketTimeout); err == nil {
+		conn.Close()
+		return errors.Errorf("socket %s is in use", path)
+	}
+	return errors.Wrap(os.Remove(path), "Remove() stale socket")
+}
@@ -0,0 +1,51 @@
+package service
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUnixSocketFrontend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	// a stale socket file of a crashed process
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Skipf("Unix sockets: %v", err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	backend := startBackend(t, echo)
+	stats := make(chan SessionStats, 1)
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		Targets:      []string{backend},
+		ListenUnix:   []string{path},
+		OnDisconnect: func(s SessionStats) { stats <- s },
+	}}})
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		t.Fatalf("dial Unix socket: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("ping"))
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Fatalf("exchange through the Unix socket: %v", err)
+	}
+	conn.Close()
+	if s := <-stats; s.Backend.String() != backend || s.BytesIn != 4 || s.BytesOut != 4 {
+		t.Errorf("Unix socket client copied %d/%d bytes to %s, want 4/4 to %s", s.BytesIn, s.BytesOut, s.Backend, backend)
+	}
+
+	p.cancel()
+	if !waitFor(t, 5*time.Second, func() bool {
+		_, err := os.Lstat(path)
+		return os.IsNotExist(err)
+	}) {
+		t.Error("socket file isn't removed on shutdown")
+	}
+}
@@ -0,0 +1,36 @@
+package service
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestStuckWriteWatchdog(t *testing.T) {
+	stats := make(chan SessionStats, 1)
+	p := startProxy(t, ProxyConfig{Apps: []ConfigApp{{
+		// the backend floods the client, which never reads
+		Targets: []string{startBackend(t, func(conn net.Conn) {
+			data := make([]byte, 64*1024)
+			for {
+				if _, err := conn.Write(data); err != nil {
+					return
+				}
+			}
+		})},
+		WriteTimeout: 200 * time.Millisecond,
+		OnDisconnect: func(s SessionStats) { stats <- s },
+	}}})
+	dialProxy(t, p, 0)
+
+	select {
+	case s := <-stats:
+		if !errors.Is(s.Reason, ErrTimeout) || !errors.Is(s.Reason, errStuckWrite) {
+			t.Errorf("stuck pair is closed with %v", s.Reason)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stuck write isn't detected")
+	}
+}
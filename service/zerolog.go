@@ -0,0 +1,40 @@
+package service
+
+import (
+	"github.com/rs/zerolog"
+)
+
+// zerologLogger is the Logger which writes events with a zerolog logger.
+type zerologLogger struct {
+	logger *zerolog.Logger
+}
+
+var (
+	_ Logger       = zerologLogger{}
+	_ DebugEnabler = zerologLogger{}
+)
+
+// NewZerologLogger returns the Logger which writes events with the zerolog logger. Its level filters events.
+func NewZerologLogger(logger *zerolog.Logger) Logger {
+	return zerologLogger{logger: logger}
+}
+
+func (l zerologLogger) Debug(msg string, fields map[string]any) {
+	l.logger.Debug().Fields(fields).Msg(msg)
+}
+
+func (l zerologLogger) Info(msg string, fields map[string]any) {
+	l.logger.Info().Fields(fields).Msg(msg)
+}
+
+func (l zerologLogger) Warn(msg string, fields map[string]any) {
+	l.logger.Warn().Fields(fields).Msg(msg)
+}
+
+func (l zerologLogger) Error(msg string, fields map[string]any) {
+	l.logger.Error().Fields(fields).Msg(msg)
+}
+
+func (l zerologLogger) DebugEnabled() bool {
+	return l.logger.GetLevel() <= zerolog.DebugLevel && zerolog.GlobalLevel() <= zerolog.DebugLevel
+}